@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/https"
+	"saddy/pkg/proxy"
+)
+
+const listenerShutdownTimeout = 5 * time.Second
+
+// proxyListeners runs the listeners of the reverse proxy and moves them when
+// a configuration reload changes their addresses.
+type proxyListeners struct {
+	config  *config.Config // Live configuration, read by the passthrough listener
+	proxy   *proxy.ReverseProxy
+	tls     *https.AutoTLS // nil without auto_https
+	errChan chan error     // Receives errors of the main listener
+
+	mu      sync.Mutex
+	servers []*http.Server
+}
+
+// start binds the listeners for the addresses in cfg and serves them in the
+// background. Only a failure to bind the main listener is returned, the
+// others are logged.
+func (l *proxyListeners) start(cfg *config.Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tls != nil {
+		return l.startHTTPS(cfg)
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting HTTP reverse proxy server on %s", addr)
+	l.serve("HTTP server", l.httpServer(addr), listener, true)
+	return nil
+}
+
+func (l *proxyListeners) startHTTPS(cfg *config.Config) error {
+	// Connections to passthrough rules are forwarded before TLS termination
+	httpsAddr := fmt.Sprintf("%s:443", cfg.Server.Host)
+	listener, err := net.Listen("tcp", httpsAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting HTTPS reverse proxy server on %s", httpsAddr)
+
+	httpsServer := &http.Server{
+		Addr:              httpsAddr,
+		Handler:           l.proxy.GetEngine(),
+		TLSConfig:         l.tls.GetTLSConfig(),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		ConnState:         l.tls.TrackHandshake,
+	}
+	l.serve("HTTPS server", httpsServer, proxy.NewPassthroughListener(listener, l.config), true)
+
+	// Start HTTP challenge server for Let's Encrypt, on port 80 by default
+	challengeAddr := cfg.Server.TLS.ChallengeAddress
+	if challengeAddr == "" {
+		challengeAddr = fmt.Sprintf("%s:80", cfg.Server.Host)
+	}
+	if challengeAddr != config.ChallengeOnMainListener {
+		if listener, err := net.Listen("tcp", challengeAddr); err != nil {
+			log.Printf("HTTP challenge server error: %v", err)
+		} else {
+			log.Printf("Starting HTTP challenge server on %s", challengeAddr)
+			l.serve("HTTP challenge server", l.tls.HTTPChallengeServer(challengeAddr), listener, false)
+		}
+	}
+
+	// Also start HTTP server on configured port (unless the challenge server has it)
+	httpAddr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+	if httpAddr != challengeAddr && cfg.Server.Port != 443 {
+		if listener, err := net.Listen("tcp", httpAddr); err != nil {
+			log.Printf("HTTP server error: %v", err)
+		} else {
+			log.Printf("Starting HTTP server on %s (for non-HTTPS access)", httpAddr)
+			l.serve("HTTP server", l.httpServer(httpAddr), listener, false)
+		}
+	}
+	return nil
+}
+
+func (l *proxyListeners) httpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           l.proxy.GetEngine(),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+}
+
+// serve runs server on listener in the background. Errors of the main
+// listener stop Saddy, those of the others are logged.
+func (l *proxyListeners) serve(name string, server *http.Server, listener net.Listener, critical bool) {
+	l.servers = append(l.servers, server)
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		switch {
+		case errors.Is(err, http.ErrServerClosed):
+		case critical:
+			l.errChan <- err
+		default:
+			log.Printf("%s error: %v", name, err)
+		}
+	}()
+}
+
+// stop gracefully shuts down the listeners.
+func (l *proxyListeners) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), listenerShutdownTimeout)
+	defer cancel()
+	for _, server := range l.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down %s: %v", server.Addr, err)
+		}
+	}
+	l.servers = nil
+}
+
+// bound reports whether the listeners are bound; they aren't while moving.
+func (l *proxyListeners) bound() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.servers) > 0
+}
+
+// move rebinds the listeners from the addresses of current to those of
+// next. If next can't be bound, the listeners go back to current.
+func (l *proxyListeners) move(current, next *config.Config) error {
+	log.Printf("Moving reverse proxy listeners")
+	l.stop()
+	err := l.start(next)
+	if err == nil {
+		return nil
+	}
+
+	// Without a listener Saddy can't serve anything
+	if restoreErr := l.start(current); restoreErr != nil {
+		select {
+		case l.errChan <- fmt.Errorf("failed to restore listeners: %v", restoreErr):
+		default:
+		}
+	}
+	return err
+}
@@ -2,21 +2,30 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"saddy/pkg/api"
 	"saddy/pkg/cache"
 	"saddy/pkg/config"
+	"saddy/pkg/events"
 	"saddy/pkg/https"
+	"saddy/pkg/logs"
+	"saddy/pkg/notify"
 	"saddy/pkg/proxy"
+	"saddy/pkg/reload"
+	"saddy/pkg/warmer"
 	"saddy/pkg/web"
 )
 
@@ -27,6 +36,9 @@ const (
 func main() {
 	var configFile = flag.String("config", "config.yaml", "Configuration file path")
 	var help = flag.Bool("help", false, "Show help message")
+	var hashPassword = flag.Bool("hash-password", false, "Read a password from stdin and print its hash for web_ui.password")
+	var hashAlgorithm = flag.String("hash-algorithm", config.PasswordBcrypt, "Algorithm for -hash-password: bcrypt or argon2id")
+	var watch = flag.Bool("watch", false, "Reload the configuration file when it changes")
 	flag.Parse()
 
 	if *help {
@@ -34,6 +46,11 @@ func main() {
 		return
 	}
 
+	if *hashPassword {
+		printPasswordHash(*hashAlgorithm)
+		return
+	}
+
 	// Load configuration
 	cfg, err := config.LoadConfig(*configFile)
 	if err != nil {
@@ -41,29 +58,76 @@ func main() {
 	}
 
 	log.Printf("Starting Saddy with configuration from %s", *configFile)
+	if err := cfg.WebUI.Validate(); err != nil {
+		log.Printf("Warning: Invalid web_ui users: %v", err)
+	}
+	for _, user := range cfg.WebUI.Accounts() {
+		if !config.IsPasswordHash(user.Password) {
+			log.Printf("Warning: The password of %s is stored in plaintext, replace it with the output of saddy -hash-password", user.Username)
+		}
+	}
+	for _, rule := range cfg.Proxy.Rules {
+		if err := rule.SSL.HSTS.Validate(); err != nil {
+			log.Printf("Warning: Not sending HSTS preload for %s: %v", rule.Domain, err)
+		}
+		if err := rule.UpstreamTLS.Validate(); err != nil {
+			log.Printf("Warning: Requests for %s will fail: %v", rule.Domain, err)
+		}
+	}
 
 	// Initialize components
+	logTail := logs.NewTail()
+	log.SetOutput(io.MultiWriter(os.Stderr, logTail))
 	cacheInstance := initializeCache(cfg)
-	tlsInstance := initializeTLS(cfg)
+	eventBus := events.NewBus()
+	tlsInstance := initializeTLS(cfg, eventBus)
 
 	// Initialize servers
 	reverseProxy := proxy.NewReverseProxy(cfg, cacheInstance)
+	reverseProxy.SetEvents(eventBus)
+	reverseProxy.SetLogs(logTail)
+	if tlsInstance != nil {
+		// The proxy's listeners answer HTTP-01 challenges for managed domains too
+		reverseProxy.UseChallengeHandler(tlsInstance.HTTPChallengeHandler)
+	}
+	cacheWarmer := warmer.New(reverseProxy.GetEngine(), cfg.Cache.Warm)
+	listeners := &proxyListeners{config: cfg, proxy: reverseProxy, tls: tlsInstance, errChan: make(chan error, 2)}
+	reloader := reload.New(cfg, reverseProxy, tlsInstance, cacheInstance, cacheWarmer)
+	reloader.SetListeners(listeners.move)
+	reloader.SetEvents(eventBus)
 	adminAPI := api.NewAdminAPI(cfg, cacheInstance, tlsInstance)
+	adminAPI.SetWarmer(cacheWarmer)
+	adminAPI.SetCacheStats(reverseProxy.CacheStats())
+	adminAPI.SetEvents(eventBus)
+	adminAPI.SetLogs(logTail)
+	adminAPI.SetTraffic(reverseProxy.Traffic())
+	adminAPI.SetProxy(reverseProxy)
+	adminAPI.SetReloader(reloader)
+	history := initializeHistory(cfg, *configFile)
+	adminAPI.SetHistory(history)
+	adminAPI.SetListenerCheck(listeners.bound)
 	adminServer := web.NewAdminServer(adminAPI)
+	go adminAPI.RecordLoad()
+
+	// SIGHUP, and with -watch changes to the file, re-read the configuration
+	configFileReloader := &configReloader{
+		path:     *configFile,
+		config:   cfg,
+		reloader: reloader,
+		adminAPI: adminAPI,
+		history:  history,
+		events:   eventBus,
+		watch:    *watch,
+	}
 
 	// Start servers and wait for shutdown
-	runServers(cfg, reverseProxy, adminServer, tlsInstance, cacheInstance)
+	runServers(cfg, reverseProxy, listeners, adminServer, tlsInstance, cacheInstance, cacheWarmer, eventBus, configFileReloader)
 }
 
-func initializeCache(cfg *config.Config) cache.Storage {
-	cacheInstance, err := cache.NewCacheStorage(cache.FactoryConfig{
-		StorageType:     cfg.Cache.StorageType,
-		CacheDir:        cfg.Cache.CacheDir,
-		MaxSize:         cfg.Cache.MaxSize,
-		DefaultTTL:      cfg.Cache.DefaultTTL,
-		CleanupInterval: cfg.Cache.CleanupInterval,
-		Persistent:      cfg.Cache.Persistent,
-	})
+// initializeCache creates the configured cache storage, which a reload can
+// replace.
+func initializeCache(cfg *config.Config) *cache.Reloadable {
+	storage, err := reload.NewCache(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize cache: %v", err)
 	}
@@ -77,27 +141,118 @@ func initializeCache(cfg *config.Config) cache.Storage {
 			cfg.Cache.StorageType, cfg.Cache.DefaultTTL)
 	}
 
-	return cacheInstance
+	return cache.NewReloadable(storage)
+}
+
+// initializeHistory records the configuration Saddy starts with, so the
+// first change through the admin API can be rolled back.
+func initializeHistory(cfg *config.Config, configFile string) *config.History {
+	history := config.NewHistory(cfg.History)
+	if _, err := history.Record(cfg, "saddy", "Loaded from "+configFile); err != nil {
+		log.Printf("Warning: Failed to record configuration version: %v", err)
+	}
+	return history
 }
 
-func initializeTLS(cfg *config.Config) *https.AutoTLS {
+func initializeTLS(cfg *config.Config, eventBus *events.Bus) *https.AutoTLS {
 	if !cfg.Server.AutoHTTPS {
 		return nil
 	}
 
 	tlsConfig := &https.TLSConfig{
-		Email:    cfg.Server.TLS.Email,
-		CacheDir: cfg.Server.TLS.CacheDir,
-		Staging:  false, // Set to true for development
+		Email:                 cfg.Server.TLS.Email,
+		CacheDir:              cfg.Server.TLS.CacheDir,
+		Staging:               cfg.Server.TLS.Staging,
+		DirectoryURL:          cfg.Server.TLS.DirectoryURL,
+		CARootFile:            cfg.Server.TLS.CARoot,
+		EABKeyID:              cfg.Server.TLS.EABKeyID,
+		EABHMACKey:            cfg.Server.TLS.EABHMACKey,
+		PreferredChain:        cfg.Server.TLS.PreferredChain,
+		Issuer:                cfg.Server.TLS.Issuer,
+		Challenge:             cfg.Server.TLS.Challenge,
+		DNSPropagationTimeout: time.Duration(cfg.Server.TLS.DNS.PropagationTimeout) * time.Second,
+		Policy:                https.TLSPolicy(cfg.Server.TLS.Policy),
+		Notifier:              notify.New(cfg.Server.TLS.Notify),
+		ExpiryWarningDays:     cfg.Server.TLS.Notify.ExpiryDays,
+		RenewBefore:           time.Duration(cfg.Server.TLS.RenewalDays) * 24 * time.Hour,
+		RenewalInterval:       time.Duration(cfg.Server.TLS.RenewalInterval) * time.Second,
+		RenewalJitter:         time.Duration(cfg.Server.TLS.RenewalJitter) * time.Second,
+		SessionTicketRotation: time.Duration(cfg.Server.TLS.SessionTicketRotation) * time.Second,
+		Events:                eventBus,
+	}
+	if dns := cfg.Server.TLS.DNS; dns.Provider != "" {
+		provider, err := https.NewDNSProvider(https.DNSConfig{
+			Provider:        dns.Provider,
+			APIToken:        dns.APIToken,
+			Zone:            dns.Zone,
+			HostedZoneID:    dns.HostedZoneID,
+			AccessKeyID:     dns.AccessKeyID,
+			SecretAccessKey: dns.SecretAccessKey,
+			WebhookURL:      dns.WebhookURL,
+			TTL:             dns.TTL,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize DNS provider: %v", err)
+		}
+		tlsConfig.DNSProvider = provider
+		log.Printf("DNS-01 challenges enabled with provider: %s", dns.Provider)
+	}
+	if onDemand := cfg.Server.TLS.OnDemand; onDemand.Enabled {
+		if onDemand.Ask == "" {
+			log.Fatalf("On-demand TLS requires an ask URL")
+		}
+		tlsConfig.OnDemandAsk = onDemand.Ask
+		log.Printf("On-demand TLS enabled, asking %s", onDemand.Ask)
+	}
+	storage := cfg.Server.TLS.Storage
+	encrypted := storage.EncryptionPassphrase != "" || storage.EncryptionKeyFile != ""
+	if (storage.Type != "" && storage.Type != "file") || encrypted {
+		dir := cfg.Server.TLS.CacheDir
+		if dir == "" {
+			dir = "./certs"
+		}
+		certStorage, err := https.NewCertStorage(https.StorageConfig{
+			Type:            storage.Type,
+			Dir:             dir,
+			Prefix:          storage.Prefix,
+			RedisURL:        storage.Redis,
+			Driver:          storage.Driver,
+			DSN:             storage.DSN,
+			Table:           storage.Table,
+			Bucket:          storage.Bucket,
+			Region:          storage.Region,
+			Endpoint:        storage.Endpoint,
+			AccessKeyID:     storage.AccessKeyID,
+			SecretAccessKey: storage.SecretAccessKey,
+
+			EncryptionPassphrase: storage.EncryptionPassphrase,
+			EncryptionKeyFile:    storage.EncryptionKeyFile,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize certificate storage: %v", err)
+		}
+		tlsConfig.Storage = certStorage
+		if encrypted {
+			log.Printf("Private keys in the certificate storage are encrypted")
+		}
+		if storage.Type != "" && storage.Type != "file" {
+			log.Printf("Certificates stored in %s storage", storage.Type)
+		}
 	}
 	tlsInstance := https.NewAutoTLS(tlsConfig)
 	log.Printf("Auto HTTPS enabled with email: %s", cfg.Server.TLS.Email)
 
-	// Register domains from proxy rules with SSL enabled
+	// Register domains from proxy rules with SSL enabled; passthrough
+	// backends hold their own certificates
 	for _, rule := range cfg.Proxy.Rules {
-		if rule.SSL.Enabled {
+		if rule.SSL.Enabled && !rule.Passthrough {
 			log.Printf("Registering domain for HTTPS: %s", rule.Domain)
-			if err := tlsInstance.AddDomain(rule.Domain); err != nil {
+			if err := tlsInstance.AddDomainWithOptions(rule.Domain, https.DomainOptions{
+				Issuer:    rule.SSL.Issuer,
+				Challenge: rule.SSL.Challenge,
+				Policy:    (*https.TLSPolicy)(rule.SSL.Policy),
+				Aliases:   rule.CertAliases(),
+			}); err != nil {
 				log.Printf("Warning: Failed to register domain %s: %v", rule.Domain, err)
 			}
 		}
@@ -106,113 +261,156 @@ func initializeTLS(cfg *config.Config) *https.AutoTLS {
 	return tlsInstance
 }
 
-func runServers(cfg *config.Config, reverseProxy *proxy.ReverseProxy, adminServer *web.AdminServer, tlsInstance *https.AutoTLS, cacheInstance cache.Storage) {
+func runServers(cfg *config.Config, reverseProxy *proxy.ReverseProxy, listeners *proxyListeners, adminServer *web.AdminServer, tlsInstance *https.AutoTLS, cacheInstance cache.Storage, cacheWarmer *warmer.Warmer, eventBus *events.Bus, configFileReloader *configReloader) {
 	// Create context for graceful shutdown
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start servers in goroutines
-	errChan := make(chan error, 2)
+	// Servers report fatal errors here
+	errChan := listeners.errChan
 
 	// Start reverse proxy server
-	go startReverseProxy(cfg, reverseProxy, tlsInstance, errChan)
+	if err := listeners.start(cfg); err != nil {
+		errChan <- err
+	}
 
 	// Start admin server
-	go startAdminServer(cfg, adminServer, errChan)
+	go startAdminServer(cfg, adminServer, tlsInstance, errChan)
 
 	// Start TLS renewal checker
 	if tlsInstance != nil {
 		go tlsInstance.CheckRenewals()
+		go tlsInstance.RefreshOCSP()
+		go tlsInstance.RotateSessionTicketKeys()
 	}
 
-	// Wait for interrupt signal or error
-	waitForShutdownSignal(errChan, cancel)
-
-	// Graceful shutdown
-	shutdownServers(reverseProxy, cacheInstance)
-}
-
-func startReverseProxy(cfg *config.Config, reverseProxy *proxy.ReverseProxy, tlsInstance *https.AutoTLS, errChan chan error) {
-	if cfg.Server.AutoHTTPS && tlsInstance != nil {
-		startHTTPSReverseProxy(cfg, reverseProxy, tlsInstance, errChan)
-	} else {
-		startHTTPReverseProxy(cfg, reverseProxy, errChan)
-	}
-}
+	// Start scheduled cache warming
+	go cacheWarmer.Run(ctx)
 
-func startHTTPSReverseProxy(cfg *config.Config, reverseProxy *proxy.ReverseProxy, tlsInstance *https.AutoTLS, errChan chan error) {
-	// Start HTTPS server on port 443
-	httpsAddr := fmt.Sprintf("%s:443", cfg.Server.Host)
-	log.Printf("Starting HTTPS reverse proxy server on %s", httpsAddr)
+	// Start backend health checks
+	go reverseProxy.ProbeBackends(ctx)
 
-	httpsServer := &http.Server{
-		Addr:              httpsAddr,
-		Handler:           reverseProxy.GetEngine(),
-		TLSConfig:         tlsInstance.GetTLSConfig(),
-		ReadHeaderTimeout: defaultReadHeaderTimeout,
-	}
+	// Send events to the configured webhooks
+	go notify.NewWebhooks(cfg).Run(ctx, eventBus)
+	go notify.MonitorCacheUsage(ctx, cacheInstance, cfg, eventBus)
 
-	// Start HTTP challenge server for Let's Encrypt on port 80
-	go func() {
-		challengeAddr := fmt.Sprintf("%s:80", cfg.Server.Host)
-		log.Printf("Starting HTTP challenge server on %s", challengeAddr)
-		if err := tlsInstance.StartHTTPChallenge(challengeAddr); err != nil {
-			log.Printf("HTTP challenge server error: %v", err)
+	// Reload the configuration file when it changes
+	if configFileReloader.watch {
+		if err := configFileReloader.watchFile(ctx); err != nil {
+			log.Printf("Warning: Not watching %s for changes: %v", configFileReloader.path, err)
 		}
-	}()
-
-	// Also start HTTP redirect server on configured port (if different from 80)
-	if cfg.Server.Port != 80 && cfg.Server.Port != 443 {
-		go func() {
-			httpAddr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-			log.Printf("Starting HTTP server on %s (for non-HTTPS access)", httpAddr)
-			if err := reverseProxy.Start(); err != nil {
-				log.Printf("HTTP server error: %v", err)
-			}
-		}()
 	}
 
-	errChan <- httpsServer.ListenAndServeTLS("", "")
-}
+	// Wait for interrupt signal or error, reloading on SIGHUP
+	waitForShutdownSignal(errChan, cancel, configFileReloader)
 
-func startHTTPReverseProxy(cfg *config.Config, reverseProxy *proxy.ReverseProxy, errChan chan error) {
-	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	log.Printf("Starting HTTP reverse proxy server on %s", addr)
-	errChan <- reverseProxy.Start()
+	// Graceful shutdown
+	shutdownServers(listeners, cacheInstance)
 }
 
-func startAdminServer(cfg *config.Config, adminServer *web.AdminServer, errChan chan error) {
-	adminAddr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.AdminPort)
+func startAdminServer(cfg *config.Config, adminServer *web.AdminServer, tlsInstance *https.AutoTLS, errChan chan error) {
+	adminAddr := cfg.Server.Admin.Listen
+	if adminAddr == "" {
+		adminAddr = fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.AdminPort)
+	}
+	tlsConfig, err := adminTLSConfig(cfg, tlsInstance)
+	if err != nil {
+		errChan <- fmt.Errorf("admin server TLS: %v", err)
+		return
+	}
 	log.Printf("Starting admin server on %s", adminAddr)
+	if host, _, err := net.SplitHostPort(adminAddr); err == nil && len(cfg.Server.Admin.AllowedIPs) == 0 {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			log.Printf("Warning: The admin interface is reachable on every interface, restrict it with server.admin.listen or server.admin.allowed_ips")
+		}
+	}
 
 	if cfg.WebUI.Enabled {
-		log.Printf("Web UI available at http://%s:%d", cfg.Server.Host, cfg.Server.AdminPort)
+		scheme := "http"
+		if tlsConfig != nil {
+			scheme = "https"
+		}
+		log.Printf("Web UI available at %s://%s", scheme, adminAddr)
 	}
 
-	errChan <- adminServer.Start(adminAddr)
+	errChan <- adminServer.Start(adminAddr, tlsConfig)
 }
 
-func waitForShutdownSignal(errChan chan error, cancel context.CancelFunc) {
+// adminTLSConfig returns the TLS configuration of the admin interface, or
+// nil for plain HTTP.
+func adminTLSConfig(cfg *config.Config, tlsInstance *https.AutoTLS) (*tls.Config, error) {
+	admin := cfg.Server.Admin
+	switch admin.TLS {
+	case "":
+		return nil, nil
+	case config.AdminTLSACME:
+		if tlsInstance == nil {
+			return nil, fmt.Errorf("ACME certificates require auto_https")
+		}
+		if admin.Domain == "" {
+			return nil, fmt.Errorf("ACME certificates require admin.domain")
+		}
+		if err := tlsInstance.AddDomain(admin.Domain); err != nil {
+			return nil, err
+		}
+		return tlsInstance.GetTLSConfig(), nil
+	case config.AdminTLSSelfSigned:
+		domain := admin.Domain
+		if domain == "" {
+			domain = "localhost"
+		}
+		dir := cfg.Server.TLS.CacheDir
+		if dir == "" {
+			dir = "./certs"
+		}
+		cert, err := https.LoadOrCreateSelfSigned(dir, domain)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}, nil
+	case config.AdminTLSFiles:
+		cert, err := tls.LoadX509KeyPair(admin.CertFile, admin.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	default:
+		return nil, fmt.Errorf("unknown admin.tls %q, expected acme, self_signed or files", admin.TLS)
+	}
+}
+
+func waitForShutdownSignal(errChan chan error, cancel context.CancelFunc, configFileReloader *configReloader) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	select {
-	case err := <-errChan:
-		log.Printf("Server error: %v", err)
-		cancel()
-	case sig := <-sigChan:
-		log.Printf("Received signal: %v", sig)
-		cancel()
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errChan:
+			log.Printf("Server error: %v", err)
+			cancel()
+			return
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				log.Printf("Received SIGHUP, reloading %s", configFileReloader.path)
+				if changed, err := configFileReloader.reload(); err != nil {
+					log.Printf("Error: Failed to reload configuration, keeping the running one: %v", err)
+				} else if !changed {
+					log.Printf("Configuration unchanged")
+				}
+				continue
+			}
+			log.Printf("Received signal: %v", sig)
+			cancel()
+			return
+		}
 	}
 }
 
-func shutdownServers(reverseProxy *proxy.ReverseProxy, cacheInstance cache.Storage) {
+func shutdownServers(listeners *proxyListeners, cacheInstance cache.Storage) {
 	log.Println("Shutting down servers...")
 
 	// Shutdown reverse proxy
-	if err := reverseProxy.Stop(); err != nil {
-		log.Printf("Error shutting down reverse proxy: %v", err)
-	}
+	listeners.stop()
 
 	// Shutdown cache
 	if cacheInstance != nil {
@@ -222,6 +420,20 @@ func shutdownServers(reverseProxy *proxy.ReverseProxy, cacheInstance cache.Stora
 	log.Println("Saddy stopped gracefully")
 }
 
+// printPasswordHash hashes the first line of stdin.
+func printPasswordHash(algorithm string) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	hash, err := config.HashPassword(strings.TrimRight(password, "\r\n"), algorithm)
+	if err != nil {
+		log.Fatalf("Failed to hash password: %v", err)
+	}
+	fmt.Println(hash)
+}
+
 func showHelp() {
 	fmt.Println(`Saddy - A lightweight reverse proxy with auto HTTPS and CDN caching
 
@@ -233,6 +445,12 @@ Options:
         Configuration file path (default "configs/config.yaml")
   -help
         Show this help message
+  -hash-password
+        Read a password from stdin and print its hash for web_ui.password
+  -hash-algorithm string
+        Algorithm for -hash-password: bcrypt or argon2id (default "bcrypt")
+  -watch
+        Reload the configuration file when it changes
 
 Configuration:
   The configuration file should be in YAML format. See configs/config.yaml for an example.
@@ -243,7 +461,7 @@ Features:
   - CDN-like caching with configurable TTL
   - Web-based configuration interface
   - RESTful API for configuration management
-  - Graceful shutdown and hot reloading
+  - Graceful shutdown and hot reloading (send SIGHUP or use -watch to re-read the configuration)
 
 Web Interface:
   Access the web interface at http://localhost:8081 (default admin port)
@@ -255,5 +473,6 @@ API:
 
 Examples:
   saddy                                    # Start with default config
-  saddy -config /path/to/config.yaml      # Start with custom config`)
+  saddy -config /path/to/config.yaml      # Start with custom config
+  saddy -watch                             # Apply edits to the config file automatically`)
 }
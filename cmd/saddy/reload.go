@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+
+	"saddy/pkg/api"
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+	"saddy/pkg/reload"
+)
+
+// configReloader re-reads the configuration file and applies it to the
+// running servers, on SIGHUP and, with -watch, when the file changes.
+// Rules, cache settings and certificate domains change in place and
+// listeners are moved gracefully, so requests in flight are not dropped.
+type configReloader struct {
+	path     string
+	config   *config.Config // Live configuration
+	reloader *reload.Reloader
+	adminAPI *api.AdminAPI
+	history  *config.History
+	events   *events.Bus
+	watch    bool // Reload when the file changes on disk
+
+	mu sync.Mutex // Serializes reloads
+}
+
+// reload applies the configuration file and reports whether it differed
+// from the running configuration. If it can't be read or is invalid, the
+// running configuration is kept and the error returned.
+func (r *configReloader) reload() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.LoadConfig(r.path)
+	if err != nil {
+		return false, r.failed(err)
+	}
+	// e.g. the file was just saved through the admin API
+	if len(r.reloader.Preview(next).Changed) == 0 {
+		return false, nil
+	}
+	credentialsChanged := !slices.Equal(next.WebUI.Accounts(), r.config.Snapshot().WebUI.Accounts())
+
+	if _, err := r.reloader.Apply(next); err != nil {
+		return false, r.failed(err)
+	}
+
+	// Log out sessions opened with the old credentials
+	if credentialsChanged {
+		r.adminAPI.InvalidateSessions()
+	}
+	if _, err := r.history.Record(r.config, "saddy", "Reloaded from "+r.path); err != nil {
+		log.Printf("Warning: Failed to record configuration version: %v", err)
+	}
+	return true, nil
+}
+
+func (r *configReloader) failed(err error) error {
+	r.events.Publish(events.Event{Type: events.Error, Message: "Failed to reload " + r.path + ": " + err.Error()})
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatchDebounce is how long the configuration file has to stay
+// untouched before it is reloaded, so that an editor or deployment tool
+// writing it in several steps triggers one reload of the finished file.
+const configWatchDebounce = time.Second
+
+// watchFile reloads the configuration when the file, or one of the files it
+// includes, changes, until ctx is done. Directories are watched rather than
+// files, so files replaced by a rename, as editors and Kubernetes ConfigMaps
+// do, and included files dropped in or removed are followed.
+func (r *configReloader) watchFile(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		watcher.Close() //nolint:errcheck
+		return err
+	}
+	// The include pattern in effect at startup
+	include := r.config.Snapshot().IncludePattern()
+	if include != "" && filepath.Dir(include) != filepath.Dir(r.path) {
+		if err := watcher.Add(filepath.Dir(include)); err != nil {
+			log.Printf("Warning: Not watching %s for changes: %v", filepath.Dir(include), err)
+		}
+	}
+	log.Printf("Watching %s for changes", r.path)
+
+	go func() {
+		defer watcher.Close() //nolint:errcheck
+
+		name := filepath.Clean(r.path)
+		last := configHash(name, include)
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				included, _ := filepath.Match(include, event.Name)
+				// ConfigMaps swap a symlink next to the file
+				if filepath.Clean(event.Name) == name || included || filepath.Base(event.Name) == "..data" {
+					debounce = time.After(configWatchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Warning: Watching %s: %v", r.path, err)
+			case <-debounce:
+				debounce = nil
+				hash := configHash(name, include)
+				if hash == nil || bytes.Equal(hash, last) {
+					continue
+				}
+				last = hash
+				log.Printf("%s changed, reloading", r.path)
+				if changed, err := r.reload(); err != nil {
+					log.Printf("Error: Failed to reload configuration, keeping the running one: %v", err)
+				} else if !changed {
+					log.Printf("Configuration unchanged")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// configHash returns the SHA-256 of the names and content of the
+// configuration file and the files matching include, or nil if the
+// configuration file can't be read, e.g. while it is being replaced.
+func configHash(name, include string) []byte {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	hash := sha256.New()
+	hash.Write(data)
+	if include != "" {
+		files, _ := filepath.Glob(include)
+		for _, file := range files {
+			if data, err := os.ReadFile(file); err == nil {
+				fmt.Fprintf(hash, "\x00%s\x00%d\x00", file, len(data))
+				hash.Write(data)
+			}
+		}
+	}
+	return hash.Sum(nil)
+}
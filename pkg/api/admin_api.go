@@ -2,194 +2,503 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"saddy/pkg/cache"
 	"saddy/pkg/config"
+	"saddy/pkg/events"
 	"saddy/pkg/https"
+	"saddy/pkg/logs"
+	"saddy/pkg/metrics"
+	"saddy/pkg/proxy"
+	"saddy/pkg/reload"
+	"saddy/pkg/warmer"
 
 	"github.com/gin-gonic/gin"
 )
 
 // AdminAPI provides administrative API endpoints for configuration and monitoring.
 type AdminAPI struct {
-	config *config.Config
-	cache  cache.Storage
-	tls    *https.AutoTLS
+	config   *config.Config
+	cache    cache.Storage
+	tls      *https.AutoTLS
+	warmer   *warmer.Warmer
+	stats    *cache.StatsRecorder
+	traffic  *metrics.Recorder
+	proxy    *proxy.ReverseProxy
+	reloader *reload.Reloader
+	history  *config.History
+
+	tokensMu   sync.Mutex
+	tokensUsed map[string]time.Time // Last use of API tokens by ID
+
+	sessionKey []byte // Signs session cookies
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+
+	totpMu      sync.Mutex
+	totpPending map[string]string // Unconfirmed TOTP secrets by username
+	totpUsed    map[string]int64  // Last accepted TOTP period by username
+
+	logins   *loginLimiter
+	requests *rateLimiter // Requests per client IP, for server.admin.rate_limit
+	writes   *rateLimiter // Requests that change state per client IP
+	events   *events.Bus
+	logs     *logs.Tail
+
+	listenersBound func() bool // Reports whether the proxy listeners are bound, nil if unknown
+
+	loadMu sync.Mutex
+	load   []loadSample // Recent load, oldest first
 }
 
 // NewAdminAPI creates a new AdminAPI instance with the given configuration and services.
 func NewAdminAPI(cfg *config.Config, cacheStorage cache.Storage, tls *https.AutoTLS) *AdminAPI {
+	sessionKey := make([]byte, 32)
+	_, _ = rand.Read(sessionKey) //nolint:errcheck
+
 	return &AdminAPI{
-		config: cfg,
-		cache:  cacheStorage,
-		tls:    tls,
+		config:     cfg,
+		cache:      cacheStorage,
+		tls:        tls,
+		tokensUsed: make(map[string]time.Time),
+		sessionKey: sessionKey,
+		sessions:   make(map[string]*session),
+
+		totpPending: make(map[string]string),
+		totpUsed:    make(map[string]int64),
+
+		logins:   newLoginLimiter(),
+		requests: newRateLimiter(),
+		writes:   newRateLimiter(),
 	}
 }
 
+// SetWarmer enables the cache warming endpoints.
+func (a *AdminAPI) SetWarmer(w *warmer.Warmer) {
+	a.warmer = w
+}
+
+// SetCacheStats enables the per-domain cache statistics endpoints.
+func (a *AdminAPI) SetCacheStats(stats *cache.StatsRecorder) {
+	a.stats = stats
+}
+
+// SetReloader applies configuration updates to the running subsystems
+// through r instead of only replacing the configuration.
+func (a *AdminAPI) SetReloader(r *reload.Reloader) {
+	a.reloader = r
+}
+
 // SetupRoutes configures all API routes under the given router group.
 func (a *AdminAPI) SetupRoutes(router *gin.RouterGroup) {
 	// Check if web UI is enabled and has valid credentials
-	if !a.config.WebUI.Enabled || a.config.WebUI.Username == "" || a.config.WebUI.Password == "" {
+	if !a.config.WebUI.Enabled || len(a.config.WebUI.Accounts()) == 0 {
 		// If no valid auth, skip authentication
 		return
 	}
 
-	// Authentication middleware
-	auth := gin.BasicAuth(gin.Accounts{
-		a.config.WebUI.Username: a.config.WebUI.Password,
-	})
+	// Bodies beyond the largest accepted document are refused with 413
+	router.Use(limitBody)
+	// Clients over server.admin.rate_limit get 429
+	router.Use(a.rateLimit)
+
+	// Authentication middleware: Basic Auth or an API token
+	auth := a.authenticate()
 
 	// Configuration endpoints
 	configGroup := router.Group("/config")
 	configGroup.Use(auth)
 	{
-		configGroup.GET("/", a.getConfig)
-		configGroup.PUT("/", a.updateConfig)
-		configGroup.GET("/proxy", a.getProxyRules)
-		configGroup.POST("/proxy", a.addProxyRule)
-		configGroup.PUT("/proxy/:domain", a.updateProxyRule)
-		configGroup.DELETE("/proxy/:domain", a.deleteProxyRule)
+		configGroup.GET("/", requireScope(ScopeAdmin), a.getConfig)
+		configGroup.PUT("/", requireScope(ScopeAdmin), a.updateConfig)
+		configGroup.POST("/validate", requireScope(ScopeAdmin), a.validateConfig)
+		configGroup.POST("/diff", requireScope(ScopeAdmin), a.diffConfig)
+		configGroup.GET("/history", requireScope(ScopeAdmin), a.listConfigVersions)
+		configGroup.GET("/history/:version", requireScope(ScopeAdmin), a.getConfigVersion)
+		configGroup.POST("/rollback/:version", requireScope(ScopeAdmin), a.rollbackConfig)
+		configGroup.GET("/export", requireScope(ScopeAdmin), a.exportConfig)
+		configGroup.POST("/import", requireScope(ScopeAdmin), a.importConfig)
+		configGroup.GET("/proxy", requireScope(ScopeRules), a.getProxyRules)
+		configGroup.POST("/proxy", requireScope(ScopeRules), a.addProxyRule)
+		configGroup.PUT("/proxy/:domain", requireScope(ScopeRules), a.updateProxyRule)
+		configGroup.DELETE("/proxy/:domain", requireScope(ScopeRules), a.deleteProxyRule)
 	}
 
 	// Cache endpoints
 	cacheGroup := router.Group("/cache")
-	cacheGroup.Use(auth)
+	cacheGroup.Use(auth, requireScope(ScopeCache))
 	{
 		cacheGroup.GET("/stats", a.getCacheStats)
+		cacheGroup.GET("/stats/domains", a.getDomainCacheStats)
+		cacheGroup.DELETE("/stats/domains", a.resetDomainCacheStats)
+		cacheGroup.GET("/keys", a.listCacheKeys)
+		cacheGroup.GET("/entry", a.inspectCacheEntry)
+		cacheGroup.PATCH("/entry", a.updateCacheEntry)
 		cacheGroup.DELETE("/", a.clearCache)
+		cacheGroup.POST("/purge", a.purgeCache)
+		cacheGroup.GET("/warm", a.getWarmStatus)
+		cacheGroup.POST("/warm", a.warmCache)
 		cacheGroup.DELETE("/:key", a.deleteCacheKey)
 	}
 
 	// TLS/SSL endpoints
 	tlsGroup := router.Group("/tls")
-	tlsGroup.Use(auth)
+	tlsGroup.Use(auth, requireScope(ScopeTLS))
 	{
 		tlsGroup.GET("/domains", a.getTLSDomains)
+		tlsGroup.GET("/status", a.getTLSStatus)
+		tlsGroup.GET("/stats", a.getTLSStats)
+		tlsGroup.DELETE("/stats", a.resetTLSStats)
+		tlsGroup.POST("/renew-all", a.renewAllTLS)
+		tlsGroup.POST("/check-all", a.checkAllTLS)
 		tlsGroup.GET("/domains/:domain", a.getTLSCertInfo)
 		tlsGroup.GET("/domains/:domain/check", a.checkDomainStatus)
 		tlsGroup.POST("/domains/:domain/renew", a.renewTLSDomain)
+		tlsGroup.POST("/domains/:domain/revoke", a.revokeTLSDomain)
 		tlsGroup.POST("/domains/:domain", a.addTLSDomain)
 		tlsGroup.DELETE("/domains/:domain", a.removeTLSDomain)
 	}
 
 	// System endpoints
 	systemGroup := router.Group("/system")
-	systemGroup.Use(auth)
+	systemGroup.Use(auth, requireScope(ScopeRead))
 	{
 		systemGroup.GET("/status", a.getSystemStatus)
-		systemGroup.GET("/health", a.getHealth)
+		systemGroup.GET("/health", a.Liveness)
+		systemGroup.GET("/metrics", a.Metrics)
+		systemGroup.GET("/runtime", a.getRuntimeStats)
+	}
+
+	// Profiling endpoints
+	debugGroup := router.Group("/debug")
+	debugGroup.Use(auth, requireScope(ScopeAdmin), a.requireProfiling)
+	{
+		debugGroup.GET("/pprof/*profile", a.serveProfile)
+		debugGroup.POST("/pprof/*profile", a.serveProfile)
+	}
+
+	// Upstream and rule test endpoints
+	proxyGroup := router.Group("/proxy")
+	proxyGroup.Use(auth, requireScope(ScopeRules))
+	{
+		proxyGroup.GET("/upstreams", a.getUpstreams)
+		proxyGroup.GET("/upstreams/:domain", a.getUpstream)
+		proxyGroup.POST("/:domain/test", a.testProxyRule)
+	}
+
+	// Live traffic endpoints
+	trafficGroup := router.Group("/traffic")
+	trafficGroup.Use(auth, requireScope(ScopeRead))
+	{
+		trafficGroup.GET("", a.getTraffic)
+		trafficGroup.GET("/series", a.getTrafficSeries)
+		trafficGroup.DELETE("", requireScope(ScopeAdmin), a.resetTraffic)
+	}
+
+	// Runtime event endpoints
+	eventGroup := router.Group("/events")
+	eventGroup.Use(auth, requireScope(ScopeRead))
+	{
+		eventGroup.GET("", a.streamEvents)
+		eventGroup.GET("/recent", a.getRecentEvents)
+	}
+
+	// Live log endpoints
+	logGroup := router.Group("/logs")
+	logGroup.Use(auth, requireScope(ScopeRead))
+	{
+		logGroup.GET("/tail", a.tailLogs)
+	}
+
+	// API token endpoints
+	tokenGroup := router.Group("/tokens")
+	tokenGroup.Use(auth, requireScope(ScopeAdmin))
+	{
+		tokenGroup.GET("", a.listAPITokens)
+		tokenGroup.POST("", a.createAPIToken)
+		tokenGroup.DELETE("/:id", a.revokeAPIToken)
+		tokenGroup.POST("/:id/rotate", a.rotateAPIToken)
 	}
 
 	// Auth endpoints (without BasicAuth middleware to avoid browser popup)
 	authGroup := router.Group("/auth")
 	{
-		authGroup.POST("/login", a.login)
+		authGroup.POST("/login", a.Login)
+		authGroup.POST("/logout", a.Logout)
+		authGroup.GET("/sessions", auth, requireScope(ScopeAdmin), a.listSessions)
+		authGroup.DELETE("/sessions", auth, requireScope(ScopeAdmin), a.invalidateSessions)
+		authGroup.POST("/password", auth, a.changePassword)
+		authGroup.GET("/totp", auth, a.getTOTPStatus)
+		authGroup.POST("/totp/enroll", auth, a.enrollTOTP)
+		authGroup.POST("/totp/confirm", auth, a.confirmTOTP)
+		authGroup.DELETE("/totp", auth, a.disableTOTP)
+		authGroup.GET("/lockouts", auth, requireScope(ScopeAdmin), a.getLockouts)
+		authGroup.DELETE("/lockouts", auth, requireScope(ScopeAdmin), a.clearLockouts)
 	}
 }
 
 func (a *AdminAPI) getConfig(c *gin.Context) {
-	c.JSON(http.StatusOK, a.config)
+	c.JSON(http.StatusOK, a.config.Redacted())
 }
 
 func (a *AdminAPI) updateConfig(c *gin.Context) {
 	var newConfig config.Config
 	if err := c.ShouldBindJSON(&newConfig); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBodyError(c, err)
 		return
 	}
 
-	// Update current config
-	*a.config = newConfig
-
-	// Save to file
-	if err := a.config.SaveConfig("config.yaml"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, ok := a.applyConfig(c, &newConfig)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Configuration updated successfully"})
+	a.recordVersion(c, "Configuration updated")
+	a.publish(events.ConfigUpdated, "", "Configuration updated")
+	c.JSON(http.StatusOK, gin.H{"message": "Configuration updated successfully", "reload": result})
+}
+
+// applyConfig makes next the running configuration and saves it. API tokens
+// are kept, as they are only managed through /tokens, redacted secrets keep
+// their running values, and sessions are logged out if the credentials
+// changed. On failure it answers the request and returns false.
+//
+// tokensMu is held until the configuration is saved, so that tokens created
+// meanwhile aren't lost.
+func (a *AdminAPI) applyConfig(c *gin.Context, next *config.Config) (*reload.Result, bool) {
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+	current := a.config.Snapshot()
+	next.RestoreSecrets(current)
+	if err := next.WebUI.Validate(); err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	credentialsChanged := !slices.Equal(next.WebUI.Accounts(), current.WebUI.Accounts())
+	next.WebUI.APITokens = current.WebUI.APITokens
+
+	// Apply the configuration to the running proxy, cache and certificates
+	var result *reload.Result
+	var err error
+	if a.reloader != nil {
+		result, err = a.reloader.Apply(next)
+	} else if err = next.Validate(); err == nil {
+		a.config.Replace(next)
+	}
+	var invalid config.ValidationErrors
+	switch {
+	case errors.As(err, &invalid):
+		respondError(c, http.StatusUnprocessableEntity, "", err.Error(), invalid)
+		return nil, false
+	case err != nil:
+		a.publish(events.Error, "", "Failed to apply configuration: "+err.Error())
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+
+	// Log out sessions opened with the old credentials
+	if credentialsChanged {
+		a.InvalidateSessions()
+	}
+
+	// Save to file
+	if err := a.config.Save(); err != nil {
+		a.publish(events.Error, "", "Failed to save configuration: "+err.Error())
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return result, true
 }
 
+// Pagination limits for the proxy rule listing
+const (
+	defaultRulesPerPage = 50
+	maxRulesPerPage     = 500
+)
+
+// getProxyRules lists the proxy rules in configuration order. search
+// matches part of the domain or target, ssl, cache and passthrough filter
+// on those settings and sort orders by domain or target, descending with a
+// leading "-". Rules are paged when page or per_page is given.
 func (a *AdminAPI) getProxyRules(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"rules": a.config.Proxy.Rules})
+	rules := slices.Clone(a.config.Snapshot().Proxy.Rules)
+
+	filters := []struct {
+		name    string
+		enabled func(config.ProxyRule) bool
+	}{
+		{"ssl", func(r config.ProxyRule) bool { return r.SSL.Enabled }},
+		{"cache", func(r config.ProxyRule) bool { return r.Cache.Enabled }},
+		{"passthrough", func(r config.ProxyRule) bool { return r.Passthrough }},
+	}
+	for _, filter := range filters {
+		name, enabled := filter.name, filter.enabled
+		value, set := c.GetQuery(name)
+		if !set {
+			continue
+		}
+		want, err := strconv.ParseBool(value)
+		if err != nil {
+			RespondError(c, http.StatusBadRequest, "Invalid "+name+": "+value)
+			return
+		}
+		rules = slices.DeleteFunc(rules, func(r config.ProxyRule) bool { return enabled(r) != want })
+	}
+	if search := strings.ToLower(c.Query("search")); search != "" {
+		rules = slices.DeleteFunc(rules, func(r config.ProxyRule) bool {
+			return !strings.Contains(strings.ToLower(r.Domain), search) && !strings.Contains(strings.ToLower(r.Target), search)
+		})
+	}
+
+	if order := c.Query("sort"); order != "" {
+		field := strings.TrimPrefix(order, "-")
+		var key func(config.ProxyRule) string
+		switch field {
+		case "domain":
+			key = func(r config.ProxyRule) string { return r.Domain }
+		case "target":
+			key = func(r config.ProxyRule) string { return r.Target }
+		default:
+			RespondError(c, http.StatusBadRequest, "Invalid sort: "+order+", expected domain or target")
+			return
+		}
+		slices.SortStableFunc(rules, func(x, y config.ProxyRule) int {
+			if field != order {
+				x, y = y, x
+			}
+			return strings.Compare(key(x), key(y))
+		})
+	}
+
+	_, paged := c.GetQuery("page")
+	if _, set := c.GetQuery("per_page"); !paged && !set {
+		c.JSON(http.StatusOK, gin.H{"rules": rules, "total": len(rules)})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		RespondError(c, http.StatusBadRequest, "Invalid page: "+c.Query("page"))
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultRulesPerPage)))
+	if err != nil || perPage < 1 || perPage > maxRulesPerPage {
+		RespondError(c, http.StatusBadRequest, "Invalid per_page: "+c.Query("per_page"))
+		return
+	}
+	start := min((page-1)*perPage, len(rules))
+	end := min(start+perPage, len(rules))
+
+	c.JSON(http.StatusOK, gin.H{
+		"rules":    rules[start:end],
+		"page":     page,
+		"per_page": perPage,
+		"total":    len(rules),
+	})
 }
 
 func (a *AdminAPI) addProxyRule(c *gin.Context) {
 	var rule config.ProxyRule
 	if err := c.ShouldBindJSON(&rule); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBodyError(c, err)
 		return
 	}
-
-	a.config.AddProxyRule(rule)
-
-	// Save to file
-	if err := a.config.SaveConfig("config.yaml"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := checkHSTSPreload(&rule); err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := rule.UpstreamTLS.Validate(); err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Add TLS domain if SSL is enabled
-	if rule.SSL.Enabled && a.tls != nil {
-		if err := a.tls.AddDomain(rule.Domain); err != nil {
-			// Log error but don't fail the operation
-			c.Header("X-TLS-Warning", "Failed to obtain TLS certificate: "+err.Error())
-		}
+	next := a.config.Snapshot()
+	next.AddProxyRule(rule)
+	result, ok := a.applyConfig(c, next)
+	if !ok {
+		return
 	}
+	setTLSWarning(c, result)
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Proxy rule added successfully"})
+	a.recordVersion(c, "Proxy rule added for "+rule.Domain)
+	a.publish(events.ConfigUpdated, rule.Domain, "Proxy rule added for "+rule.Domain)
+	c.JSON(http.StatusCreated, gin.H{"message": "Proxy rule added successfully", "reload": result})
 }
 
 func (a *AdminAPI) updateProxyRule(c *gin.Context) {
 	domain := c.Param("domain")
 	var rule config.ProxyRule
 	if err := c.ShouldBindJSON(&rule); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBodyError(c, err)
 		return
 	}
 
 	// Ensure domain matches
 	rule.Domain = domain
+	if err := checkHSTSPreload(&rule); err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := rule.UpstreamTLS.Validate(); err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	a.config.AddProxyRule(rule)
-
-	// Save to file
-	if err := a.config.SaveConfig("config.yaml"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	next := a.config.Snapshot()
+	next.AddProxyRule(rule)
+	result, ok := a.applyConfig(c, next)
+	if !ok {
 		return
 	}
+	setTLSWarning(c, result)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Proxy rule updated successfully"})
+	a.recordVersion(c, "Proxy rule updated for "+domain)
+	a.publish(events.ConfigUpdated, domain, "Proxy rule updated for "+domain)
+	c.JSON(http.StatusOK, gin.H{"message": "Proxy rule updated successfully", "reload": result})
 }
 
 func (a *AdminAPI) deleteProxyRule(c *gin.Context) {
 	domain := c.Param("domain")
 
-	if !a.config.RemoveProxyRule(domain) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Proxy rule not found"})
+	next := a.config.Snapshot()
+	if !next.RemoveProxyRule(domain) {
+		RespondError(c, http.StatusNotFound, "Proxy rule not found")
 		return
 	}
-
-	// Save to file
-	if err := a.config.SaveConfig("config.yaml"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, ok := a.applyConfig(c, next)
+	if !ok {
 		return
 	}
 
-	// Remove TLS domain
-	if a.tls != nil {
-		a.tls.RemoveDomain(domain)
-	}
+	a.recordVersion(c, "Proxy rule deleted for "+domain)
+	a.publish(events.ConfigUpdated, domain, "Proxy rule deleted for "+domain)
+	c.JSON(http.StatusOK, gin.H{"message": "Proxy rule deleted successfully", "reload": result})
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Proxy rule deleted successfully"})
+// setTLSWarning passes the domains that failed to register on in the
+// X-TLS-Warning header. The rule change itself was applied.
+func setTLSWarning(c *gin.Context, result *reload.Result) {
+	if result != nil && len(result.Warnings) > 0 {
+		c.Header("X-TLS-Warning", strings.Join(result.Warnings, "; "))
+	}
 }
 
 func (a *AdminAPI) getCacheStats(c *gin.Context) {
 	if a.cache == nil {
-		c.JSON(http.StatusOK, gin.H{"error": "Cache not available"})
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
 		return
 	}
 
@@ -197,19 +506,386 @@ func (a *AdminAPI) getCacheStats(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
+func (a *AdminAPI) getDomainCacheStats(c *gin.Context) {
+	if a.stats == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache statistics not available")
+		return
+	}
+
+	domains := a.stats.Snapshot()
+	if domain := c.Query("domain"); domain != "" {
+		stats, exists := domains[domain]
+		if !exists {
+			RespondError(c, http.StatusNotFound, "No statistics for domain: "+domain)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"domain": domain, "stats": stats})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+func (a *AdminAPI) resetDomainCacheStats(c *gin.Context) {
+	if a.stats == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache statistics not available")
+		return
+	}
+
+	a.stats.Reset()
+	c.JSON(http.StatusOK, gin.H{"message": "Cache statistics reset successfully"})
+}
+
+// Pagination limits for the cache key listing
+const (
+	defaultKeysPerPage = 50
+	maxKeysPerPage     = 500
+)
+
+func (a *AdminAPI) listCacheKeys(c *gin.Context) {
+	if a.cache == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		RespondError(c, http.StatusBadRequest, "Invalid page: "+c.Query("page"))
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultKeysPerPage)))
+	if err != nil || perPage < 1 || perPage > maxKeysPerPage {
+		RespondError(c, http.StatusBadRequest, "Invalid per_page: "+c.Query("per_page"))
+		return
+	}
+
+	// Keys have the form "domain:METHOD:path?query"; prefix filters on the path
+	domain := c.Query("domain")
+	if domain == "" {
+		domain = "*"
+	}
+	entries := a.cache.Entries(domain + ":*:" + c.Query("prefix") + "*")
+
+	start := (page - 1) * perPage
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + perPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	now := time.Now()
+	keys := make([]gin.H, 0, end-start)
+	for _, entry := range entries[start:end] {
+		keys = append(keys, cacheEntryInfo(entry, now))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys":     keys,
+		"page":     page,
+		"per_page": perPage,
+		"total":    len(entries),
+	})
+}
+
+// defaultInspectBodySize is how much of the body inspectCacheEntry returns by default.
+const defaultInspectBodySize = 4096
+
+func (a *AdminAPI) inspectCacheEntry(c *gin.Context) {
+	if a.cache == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
+		return
+	}
+
+	key := c.Query("key")
+	if key == "" {
+		RespondError(c, http.StatusBadRequest, "key is required")
+		return
+	}
+	maxBody, err := strconv.Atoi(c.DefaultQuery("max_body", strconv.Itoa(defaultInspectBodySize)))
+	if err != nil || maxBody < 0 {
+		RespondError(c, http.StatusBadRequest, "Invalid max_body: "+c.Query("max_body"))
+		return
+	}
+
+	// GetStale also returns fresh entries and does not count as a hit
+	entry := a.cache.GetStale(key)
+	if entry == nil {
+		RespondError(c, http.StatusNotFound, "Cache key not found: "+key)
+		return
+	}
+
+	info := cacheEntryInfo(entry, time.Now())
+	info["headers"] = entry.Headers
+	info["stale_until"] = entry.StaleUntil
+
+	if c.DefaultQuery("body", "true") != "false" {
+		addBody(info, entry.Value, maxBody)
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// addBody adds up to maxBody bytes of body to info, as text if it is UTF-8
+// and base64 otherwise. maxBody 0 adds the whole body.
+func addBody(info gin.H, body []byte, maxBody int) {
+	truncated := maxBody > 0 && len(body) > maxBody
+	if truncated {
+		body = body[:maxBody]
+	}
+	if utf8.Valid(body) {
+		info["body"] = string(body)
+		info["body_encoding"] = "text"
+	} else {
+		info["body"] = base64.StdEncoding.EncodeToString(body)
+		info["body_encoding"] = "base64"
+	}
+	info["body_truncated"] = truncated
+}
+
+// cacheEntryUpdate is the body of updateCacheEntry.
+type cacheEntryUpdate struct {
+	Key    string `json:"key" binding:"required"`
+	TTL    *int   `json:"ttl"`    // Expire this many seconds from now
+	Extend int    `json:"extend"` // Add seconds to the current expiration
+	Pin    bool   `json:"pin"`    // Never expire
+	Expire bool   `json:"expire"` // Expire immediately
+}
+
+func (a *AdminAPI) updateCacheEntry(c *gin.Context) {
+	if a.cache == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
+		return
+	}
+
+	var request cacheEntryUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+
+	entry := a.cache.GetStale(request.Key)
+	if entry == nil {
+		RespondError(c, http.StatusNotFound, "Cache key not found: "+request.Key)
+		return
+	}
+
+	now := time.Now()
+	var expiresAt time.Time
+	switch {
+	case request.Pin:
+		// The zero time never expires
+	case request.Expire:
+		expiresAt = now
+	case request.TTL != nil:
+		if *request.TTL <= 0 {
+			RespondError(c, http.StatusBadRequest, "ttl must be positive")
+			return
+		}
+		expiresAt = now.Add(time.Duration(*request.TTL) * time.Second)
+	case request.Extend != 0:
+		if entry.ExpiresAt.IsZero() {
+			RespondError(c, http.StatusBadRequest, "Cache entry never expires")
+			return
+		}
+		// Extending an expired entry counts from now
+		base := entry.ExpiresAt
+		if base.Before(now) {
+			base = now
+		}
+		expiresAt = base.Add(time.Duration(request.Extend) * time.Second)
+	default:
+		RespondError(c, http.StatusBadRequest, "One of ttl, extend, pin or expire is required")
+		return
+	}
+
+	if !a.cache.SetExpiry(request.Key, expiresAt) {
+		RespondError(c, http.StatusNotFound, "Cache key not found: "+request.Key)
+		return
+	}
+
+	entry.ExpiresAt = expiresAt
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cache entry updated successfully",
+		"entry":   cacheEntryInfo(entry, now),
+	})
+}
+
+// cacheEntryInfo summarizes a cache entry's metadata. A ttl_remaining of -1
+// means the entry never expires.
+func cacheEntryInfo(entry *cache.CacheItem, now time.Time) gin.H {
+	ttlRemaining := int64(-1)
+	if !entry.ExpiresAt.IsZero() {
+		ttlRemaining = int64(entry.ExpiresAt.Sub(now).Seconds())
+		if ttlRemaining < 0 {
+			ttlRemaining = 0
+		}
+	}
+
+	return gin.H{
+		"key":           entry.Key,
+		"status_code":   entry.StatusCode,
+		"size":          entry.Size,
+		"hits":          entry.Hits,
+		"tags":          entry.Tags,
+		"created_at":    entry.CreatedAt,
+		"expires_at":    entry.ExpiresAt,
+		"ttl_remaining": ttlRemaining,
+		"stale":         entry.IsExpired(now),
+	}
+}
+
+// clearCache deletes every cache entry or, with domain or path, only the
+// entries of that domain whose path matches, e.g. domain=example.com and
+// path=/static/*. soft=true marks them stale instead of deleting them.
 func (a *AdminAPI) clearCache(c *gin.Context) {
 	if a.cache == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cache not available"})
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
+		return
+	}
+
+	domain, path := c.Query("domain"), c.Query("path")
+	if domain == "" && path == "" {
+		a.cache.Clear()
+		c.JSON(http.StatusOK, gin.H{"message": "Cache cleared successfully"})
+		return
+	}
+
+	soft, err := strconv.ParseBool(c.DefaultQuery("soft", "false"))
+	if err != nil {
+		RespondError(c, http.StatusBadRequest, "Invalid soft: "+c.Query("soft"))
+		return
+	}
+	mode := cache.PurgeHard
+	if soft {
+		mode = cache.PurgeSoft
+	}
+
+	// Keys have the form "domain:METHOD:path?query"
+	if domain == "" {
+		domain = "*"
+	}
+	pattern := domain + ":*"
+	if path != "" {
+		if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "*") {
+			path = "/" + path
+		}
+		pattern = domain + ":*:" + path
+	}
+
+	removed := a.cache.Purge(pattern, mode)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cache purged successfully",
+		"pattern": pattern,
+		"soft":    soft,
+		"removed": removed,
+	})
+}
+
+// purgeRequest is the body of purgeCache.
+type purgeRequest struct {
+	URL    string   `json:"url"`    // URL pattern such as example.com/static/*
+	Prefix string   `json:"prefix"` // URL prefix such as example.com/static/
+	Key    string   `json:"key"`    // Raw cache key pattern
+	Tags   []string `json:"tags"`   // Surrogate keys assigned by the backend
+	Soft   bool     `json:"soft"`   // Mark entries stale instead of deleting them
+}
+
+func (a *AdminAPI) purgeCache(c *gin.Context) {
+	if a.cache == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
+		return
+	}
+
+	var request purgeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+
+	mode := cache.PurgeHard
+	if request.Soft {
+		mode = cache.PurgeSoft
+	}
+
+	if len(request.Tags) > 0 {
+		removed := 0
+		for _, tag := range request.Tags {
+			removed += a.cache.PurgeTag(tag, mode)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Cache purged successfully",
+			"tags":    request.Tags,
+			"soft":    request.Soft,
+			"removed": removed,
+		})
+		return
+	}
+
+	var pattern string
+	switch {
+	case request.URL != "":
+		pattern = cache.URLKeyPattern(request.URL)
+	case request.Prefix != "":
+		pattern = cache.URLKeyPattern(request.Prefix + "*")
+	case request.Key != "":
+		pattern = request.Key
+	default:
+		RespondError(c, http.StatusBadRequest, "One of url, prefix, key or tags is required")
+		return
+	}
+
+	removed := a.cache.Purge(pattern, mode)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cache purged successfully",
+		"pattern": pattern,
+		"soft":    request.Soft,
+		"removed": removed,
+	})
+}
+
+func (a *AdminAPI) warmCache(c *gin.Context) {
+	if a.warmer == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache warming not available")
+		return
+	}
+
+	var job warmer.Job
+	if err := c.ShouldBindJSON(&job); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+	if len(job.URLs) == 0 && len(job.Sitemaps) == 0 {
+		RespondError(c, http.StatusBadRequest, "At least one of urls or sitemaps is required")
+		return
+	}
+
+	if err := a.warmer.Start(job); err != nil {
+		RespondError(c, http.StatusConflict, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Cache warming started"})
+}
+
+func (a *AdminAPI) getWarmStatus(c *gin.Context) {
+	if a.warmer == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Cache warming not available")
 		return
 	}
 
-	a.cache.Clear()
-	c.JSON(http.StatusOK, gin.H{"message": "Cache cleared successfully"})
+	status := a.warmer.Status()
+	if status == nil {
+		c.JSON(http.StatusOK, gin.H{"running": false})
+		return
+	}
+	c.JSON(http.StatusOK, status)
 }
 
 func (a *AdminAPI) deleteCacheKey(c *gin.Context) {
 	if a.cache == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cache not available"})
+		RespondError(c, http.StatusServiceUnavailable, "Cache not available")
 		return
 	}
 
@@ -228,16 +904,68 @@ func (a *AdminAPI) getTLSDomains(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"domains": domains})
 }
 
+// getTLSStatus returns the certificate details of every managed domain, with
+// an error in place of the details for domains that have no certificate yet.
+func (a *AdminAPI) getTLSStatus(c *gin.Context) {
+	certificates := []interface{}{}
+	if a.tls != nil {
+		domains := a.tls.ListDomains()
+		sort.Strings(domains)
+		for _, domain := range domains {
+			info, err := a.tls.GetCertInfo(domain)
+			if err != nil {
+				certificates = append(certificates, gin.H{"domain": domain, "error": err.Error()})
+				continue
+			}
+			certificates = append(certificates, info)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certificates": certificates})
+}
+
+// getTLSStats returns the TLS handshake statistics of the HTTPS server, or of
+// a single domain with the domain query parameter.
+func (a *AdminAPI) getTLSStats(c *gin.Context) {
+	if a.tls == nil {
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
+		return
+	}
+
+	stats := a.tls.HandshakeStats()
+	if domain := c.Query("domain"); domain != "" {
+		counters, exists := stats.Domains[domain]
+		if !exists {
+			RespondError(c, http.StatusNotFound, "No statistics for domain: "+domain)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"domain": domain, "stats": counters})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+func (a *AdminAPI) resetTLSStats(c *gin.Context) {
+	if a.tls == nil {
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
+		return
+	}
+
+	a.tls.ResetHandshakeStats()
+	c.JSON(http.StatusOK, gin.H{"message": "TLS statistics reset successfully"})
+}
+
 func (a *AdminAPI) getTLSCertInfo(c *gin.Context) {
 	if a.tls == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "TLS not available"})
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
 		return
 	}
 
 	domain := c.Param("domain")
 	info, err := a.tls.GetCertInfo(domain)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		RespondError(c, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -246,28 +974,112 @@ func (a *AdminAPI) getTLSCertInfo(c *gin.Context) {
 
 func (a *AdminAPI) renewTLSDomain(c *gin.Context) {
 	if a.tls == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "TLS not available"})
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
 		return
 	}
 
 	domain := c.Param("domain")
 	if err := a.tls.ForceRenewal(domain); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if errors.Is(err, https.ErrBackingOff) {
+			status = http.StatusTooManyRequests
+		}
+		RespondError(c, status, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Certificate renewed successfully"})
 }
 
+// renewAllTLS runs the renewal check for every domain now, renewing the due
+// certificates, or all of them with ?force=true, and reports per domain.
+func (a *AdminAPI) renewAllTLS(c *gin.Context) {
+	if a.tls == nil {
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
+		return
+	}
+
+	results := a.tls.RenewAll(c.Query("force") == "true")
+	counts := map[string]int{https.RenewalRenewed: 0, https.RenewalFailed: 0, https.RenewalSkipped: 0}
+	for _, result := range results {
+		counts[result.Action]++
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"renewed": counts[https.RenewalRenewed],
+		"failed":  counts[https.RenewalFailed],
+		"skipped": counts[https.RenewalSkipped],
+	})
+}
+
+// maxConcurrentChecks bounds the domains checkAllTLS checks at once.
+const maxConcurrentChecks = 8
+
+// checkAllTLS runs the domain check of checkDomainStatus for every TLS
+// domain.
+func (a *AdminAPI) checkAllTLS(c *gin.Context) {
+	if a.tls == nil {
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
+		return
+	}
+
+	domains := a.tls.ListDomains()
+	sort.Strings(domains)
+	statuses := make([]gin.H, len(domains))
+	sem := make(chan struct{}, maxConcurrentChecks)
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			statuses[i] = a.domainStatus(domain)
+		}()
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"domains": statuses, "count": len(statuses)})
+}
+
+// revokeTLSDomain revokes the certificate of a domain, e.g. after a key
+// compromise or a domain transfer, and replaces it unless remove=true.
+func (a *AdminAPI) revokeTLSDomain(c *gin.Context) {
+	if a.tls == nil {
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
+		return
+	}
+
+	domain := c.Param("domain")
+	remove := c.Query("remove") == "true"
+	if err := a.tls.RevokeCertificate(domain, c.Query("reason"), remove); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, https.ErrInvalidRevocationReason) {
+			status = http.StatusBadRequest
+		}
+		RespondError(c, status, err.Error())
+		return
+	}
+
+	if remove {
+		c.JSON(http.StatusOK, gin.H{"message": "Certificate revoked and domain removed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate revoked and replaced"})
+}
+
 func (a *AdminAPI) addTLSDomain(c *gin.Context) {
 	if a.tls == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "TLS not available"})
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
 		return
 	}
 
 	domain := c.Param("domain")
-	if err := a.tls.AddDomain(domain); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := a.tls.AddDomainWithOptions(domain, https.DomainOptions{
+		Issuer:    c.Query("issuer"),
+		Challenge: c.Query("challenge"),
+	}); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -276,27 +1088,44 @@ func (a *AdminAPI) addTLSDomain(c *gin.Context) {
 
 func (a *AdminAPI) removeTLSDomain(c *gin.Context) {
 	if a.tls == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "TLS not available"})
+		RespondError(c, http.StatusServiceUnavailable, "TLS not available")
 		return
 	}
 
 	domain := c.Param("domain")
+	if c.Query("keep_certificate") == "true" {
+		a.tls.DeactivateDomain(domain)
+		c.JSON(http.StatusOK, gin.H{"message": "TLS domain deactivated successfully"})
+		return
+	}
 	a.tls.RemoveDomain(domain)
 	c.JSON(http.StatusOK, gin.H{"message": "TLS domain removed successfully"})
 }
 
 func (a *AdminAPI) getSystemStatus(c *gin.Context) {
+	cfg := a.config.Snapshot()
 	status := gin.H{
 		"server": gin.H{
-			"host":       a.config.Server.Host,
-			"port":       a.config.Server.Port,
-			"admin_port": a.config.Server.AdminPort,
-			"auto_https": a.config.Server.AutoHTTPS,
+			"host":       cfg.Server.Host,
+			"port":       cfg.Server.Port,
+			"admin_port": cfg.Server.AdminPort,
+			"auto_https": cfg.Server.AutoHTTPS,
 		},
-		"proxy_rules_count": len(a.config.Proxy.Rules),
+		"proxy_rules_count": len(cfg.Proxy.Rules),
 		"cache_enabled":     a.cache != nil,
 		"tls_enabled":       a.tls != nil,
-		"web_ui_enabled":    a.config.WebUI.Enabled,
+		"web_ui_enabled":    cfg.WebUI.Enabled,
+		"started_at":        processStart.UTC(),
+		"uptime_seconds":    int64(time.Since(processStart).Seconds()),
+		"load_history": gin.H{
+			"interval": int(loadSampleInterval / time.Second),
+			"samples":  a.loadHistory(),
+		},
+	}
+
+	// Add the requests since startup if traffic is recorded
+	if a.traffic != nil {
+		status["request_totals"] = requestTotals(a.traffic)
 	}
 
 	// Add cache stats if available
@@ -312,16 +1141,13 @@ func (a *AdminAPI) getSystemStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
-func (a *AdminAPI) getHealth(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "healthy",
-		"timestamp": time.Now().Unix(),
-	})
-}
-
 func (a *AdminAPI) checkDomainStatus(c *gin.Context) {
-	domain := c.Param("domain")
+	c.JSON(http.StatusOK, a.domainStatus(c.Param("domain")))
+}
 
+// domainStatus checks DNS, HTTP and HTTPS reachability, the proxy rule and
+// the certificate of a domain.
+func (a *AdminAPI) domainStatus(domain string) gin.H {
 	status := gin.H{
 		"domain": domain,
 		"checks": gin.H{},
@@ -364,7 +1190,7 @@ func (a *AdminAPI) checkDomainStatus(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, status)
+	return status
 }
 
 func checkDNS(domain string) gin.H {
@@ -402,6 +1228,32 @@ func checkHTTP(domain string) gin.H {
 	}
 }
 
+// checkHSTSPreload refuses HSTS preloading for a domain that doesn't already
+// serve HTTPS with a trusted certificate: once preloaded, browsers won't
+// reach it over HTTP anymore.
+func checkHSTSPreload(rule *config.ProxyRule) error {
+	hsts := rule.SSL.HSTS
+	if !hsts.Preload {
+		return nil
+	}
+	if err := hsts.Validate(); err != nil {
+		return err
+	}
+	if !rule.SSL.Enabled || strings.Contains(rule.Domain, "*") {
+		return fmt.Errorf("HSTS preload requires SSL on a single domain")
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get("https://" + rule.Domain)
+	if err != nil {
+		return fmt.Errorf("HSTS preload requires %s to serve HTTPS: %v", rule.Domain, err)
+	}
+	_ = resp.Body.Close() //nolint:errcheck
+	return nil
+}
+
 func checkHTTPS(domain string) gin.H {
 	client := &http.Client{
 		Timeout: 5 * time.Second,
@@ -423,23 +1275,48 @@ func checkHTTPS(domain string) gin.H {
 	}
 }
 
-// login handles user authentication without triggering browser's HTTP Basic Auth popup.
-func (a *AdminAPI) login(c *gin.Context) {
-	var credentials struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}
+// loginRequest is the body of Login.
+type loginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Remember bool   `json:"remember"`
+	Code     string `json:"code"` // TOTP code, for users with two-factor authentication
+}
+
+// Login checks the admin credentials and starts a Web UI session.
+func (a *AdminAPI) Login(c *gin.Context) {
+	var credentials loginRequest
 
 	if err := c.ShouldBindJSON(&credentials); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		RespondError(c, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if a.checkLockout(c) {
 		return
 	}
 
 	// Check credentials
-	if credentials.Username == a.config.WebUI.Username && credentials.Password == a.config.WebUI.Password {
-		c.JSON(http.StatusOK, gin.H{"success": true})
+	if user := a.checkPassword(credentials.Username, credentials.Password); user != nil {
+		if user.TOTPSecret != "" {
+			if credentials.Code == "" {
+				respondError(c, http.StatusUnauthorized, CodeTOTPRequired, "Two-factor code required", nil)
+				return
+			}
+			if !a.checkTOTP(user.Username, user.TOTPSecret, credentials.Code) {
+				a.loginFailed(c)
+				respondError(c, http.StatusUnauthorized, CodeTOTPRequired, "Invalid two-factor code", nil)
+				return
+			}
+		}
+		if err := a.startSession(c, user, credentials.Remember); err != nil {
+			RespondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.logins.succeeded(c.RemoteIP())
+		c.JSON(http.StatusOK, gin.H{"success": true, "role": user.Role})
 	} else {
+		a.loginFailed(c)
 		// Return 401 without WWW-Authenticate header to prevent browser popup
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		RespondError(c, http.StatusUnauthorized, "Invalid username or password")
 	}
 }
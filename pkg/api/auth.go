@@ -0,0 +1,406 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes of API tokens. Each endpoint group requires its scope for changes;
+// reading only requires ScopeRead, except for ScopeAdmin endpoints. Users get
+// the scopes of their role.
+const (
+	ScopeRead  = "read"  // GET requests to every endpoint
+	ScopeRules = "rules" // Proxy rules
+	ScopeCache = "cache" // Cache entries, purges and warming
+	ScopeTLS   = "tls"   // TLS domains and certificates
+	ScopeAdmin = "admin" // Everything, including the configuration and API tokens
+)
+
+var allScopes = []string{ScopeRead, ScopeRules, ScopeCache, ScopeTLS, ScopeAdmin}
+
+// roleScopes returns the scopes granted to users with role.
+func roleScopes(role string) []string {
+	switch role {
+	case config.RoleAdmin:
+		return allScopes
+	case config.RoleOperator:
+		return []string{ScopeRead, ScopeRules, ScopeCache, ScopeTLS}
+	case config.RoleViewer:
+		return []string{ScopeRead}
+	default:
+		return nil
+	}
+}
+
+const (
+	// apiTokenPrefix marks Saddy API tokens, e.g. for secret scanners.
+	apiTokenPrefix = "sdy_"
+	authScopesKey  = "saddy.scopes"
+	authTokenKey   = "saddy.token" // Name of the API token used
+	basicAuthRealm = `Basic realm="Authorization Required"`
+)
+
+// authenticate accepts a user's HTTP Basic credentials or Web UI session,
+// which grant the scopes of the user's role, or a bearer API token, which
+// grants its own scopes.
+func (a *AdminAPI) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if _, err := c.Cookie(SessionCookie); header == "" && err == nil {
+			s := a.sessionFromCookie(c.Request)
+			if s == nil {
+				// No WWW-Authenticate, the Web UI redirects to its login page
+				RespondError(c, http.StatusUnauthorized, "Session expired")
+				return
+			}
+			if !checkCSRF(c, s) {
+				RespondError(c, http.StatusForbidden, "Invalid or missing CSRF token")
+				return
+			}
+			if token, err := c.Cookie(CSRFCookie); err != nil || token != s.CSRFToken {
+				// Give the Web UI its token back, e.g. after the cookie was cleared
+				a.setCSRFCookie(c, s.CSRFToken, 0)
+			}
+			c.Set(authScopesKey, roleScopes(s.Role))
+			c.Set(authUserKey, s.Username)
+			return
+		}
+
+		if a.checkLockout(c) {
+			return
+		}
+
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			stored, ok := a.lookupToken(strings.TrimSpace(token))
+			if !ok {
+				a.loginFailed(c)
+				c.Header("WWW-Authenticate", "Bearer")
+				RespondError(c, http.StatusUnauthorized, "Invalid or expired API token")
+				return
+			}
+			c.Set(authScopesKey, stored.Scopes)
+			c.Set(authTokenKey, stored.Name)
+			return
+		}
+
+		username, password, ok := c.Request.BasicAuth()
+		user := a.checkPassword(username, password)
+		if !ok || user == nil {
+			if ok {
+				a.loginFailed(c)
+			}
+			c.Header("WWW-Authenticate", basicAuthRealm)
+			RespondError(c, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if user.TOTPSecret != "" {
+			// Basic Auth can't carry the second factor
+			RespondError(c, http.StatusUnauthorized, "Two-factor authentication is enabled for "+user.Username+", log in to the Web UI or use an API token")
+			return
+		}
+		c.Set(authScopesKey, roleScopes(user.Role))
+		c.Set(authUserKey, user.Username)
+	}
+}
+
+// checkPassword returns the user with username and password, or nil.
+func (a *AdminAPI) checkPassword(username, password string) *config.AdminUser {
+	user := a.findUser(username)
+	if user == nil || !user.CheckPassword(password) {
+		return nil
+	}
+	return user
+}
+
+// findUser returns the user named username, or nil.
+func (a *AdminAPI) findUser(username string) *config.AdminUser {
+	for _, user := range a.config.Snapshot().WebUI.Accounts() {
+		if subtle.ConstantTimeCompare([]byte(username), []byte(user.Username)) == 1 {
+			return &user
+		}
+	}
+	return nil
+}
+
+// requireScope rejects requests whose credentials lack scope. Reading only
+// needs ScopeRead unless scope is ScopeAdmin, which covers everything.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes := c.GetStringSlice(authScopesKey)
+		reading := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+		readable := reading && scope != ScopeAdmin && slices.Contains(scopes, ScopeRead)
+		if slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin) || readable {
+			return
+		}
+		RespondError(c, http.StatusForbidden, "Permission denied: requires the "+scope+" scope")
+	}
+}
+
+// lookupToken returns the stored API token of token if it is valid.
+func (a *AdminAPI) lookupToken(token string) (config.APIToken, bool) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return config.APIToken{}, false
+	}
+	hash := hashToken(token)
+
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+	for _, stored := range a.config.Snapshot().WebUI.APITokens {
+		if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if !stored.ExpiresAt.IsZero() && time.Now().After(stored.ExpiresAt) {
+			return config.APIToken{}, false
+		}
+		a.tokensUsed[stored.ID] = time.Now()
+		return stored, true
+	}
+	return config.APIToken{}, false
+}
+
+// actor names who made the request: the user, or the API token.
+func actor(c *gin.Context) string {
+	if user := c.GetString(authUserKey); user != "" {
+		return user
+	}
+	if token := c.GetString(authTokenKey); token != "" {
+		return "token:" + token
+	}
+	return ""
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenRequest is the body of createAPIToken.
+type apiTokenRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes" binding:"required"`
+	ExpiresIn int      `json:"expires_in"` // Seconds, 0 for a token that doesn't expire
+}
+
+// apiTokenInfo describes a token without its secret.
+type apiTokenInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"` // Since the last restart
+}
+
+func (a *AdminAPI) listAPITokens(c *gin.Context) {
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+
+	stored := a.config.Snapshot().WebUI.APITokens
+	tokens := make([]apiTokenInfo, 0, len(stored))
+	for _, token := range stored {
+		info := apiTokenInfo{ID: token.ID, Name: token.Name, Scopes: token.Scopes, CreatedAt: token.CreatedAt}
+		if !token.ExpiresAt.IsZero() {
+			expires := token.ExpiresAt
+			info.ExpiresAt = &expires
+		}
+		if used, ok := a.tokensUsed[token.ID]; ok {
+			info.LastUsedAt = &used
+		}
+		tokens = append(tokens, info)
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// createAPIToken issues a token. The secret is only returned here; the
+// configuration keeps its hash.
+func (a *AdminAPI) createAPIToken(c *gin.Context) {
+	var request apiTokenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			respondError(c, http.StatusBadRequest, "", "Unknown scope: "+scope, gin.H{"scopes": allScopes})
+			return
+		}
+	}
+	if request.ExpiresIn < 0 {
+		RespondError(c, http.StatusBadRequest, "expires_in must not be negative")
+		return
+	}
+
+	token, err := newAPIToken()
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stored := config.APIToken{
+		ID:        hex.EncodeToString(id),
+		Name:      request.Name,
+		Hash:      hashToken(token),
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if request.ExpiresIn > 0 {
+		stored.ExpiresAt = stored.CreatedAt.Add(time.Duration(request.ExpiresIn) * time.Second)
+	}
+
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+	tokens := a.config.Snapshot().WebUI.APITokens
+	a.setAPITokens(append(slices.Clone(tokens), stored))
+	if err := a.config.Save(); err != nil {
+		a.setAPITokens(tokens)
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, issuedToken(stored, token))
+}
+
+// setAPITokens replaces the stored API tokens. Callers hold tokensMu.
+func (a *AdminAPI) setAPITokens(tokens []config.APIToken) {
+	a.config.Update(func(cfg *config.Config) {
+		cfg.WebUI.APITokens = tokens
+	})
+}
+
+// newAPIToken returns a new random token secret.
+func newAPIToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// issuedToken is the response to a created or rotated token, the only one
+// that includes its secret.
+func issuedToken(stored config.APIToken, token string) gin.H {
+	response := gin.H{
+		"id":      stored.ID,
+		"name":    stored.Name,
+		"scopes":  stored.Scopes,
+		"token":   token,
+		"message": "Store the token now, it can't be shown again",
+	}
+	if !stored.ExpiresAt.IsZero() {
+		response["expires_at"] = stored.ExpiresAt
+	}
+	return response
+}
+
+// tokenRotation is the body of rotateAPIToken.
+type tokenRotation struct {
+	ExpiresIn int `json:"expires_in"` // Seconds until the new secret expires; by default the token's lifetime again, if it had one
+}
+
+// rotateAPIToken replaces the secret of a token, keeping its ID, name and
+// scopes. The old secret stops working immediately.
+func (a *AdminAPI) rotateAPIToken(c *gin.Context) {
+	var request tokenRotation
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		respondBodyError(c, err)
+		return
+	}
+	if request.ExpiresIn < 0 {
+		RespondError(c, http.StatusBadRequest, "expires_in must not be negative")
+		return
+	}
+	token, err := newAPIToken()
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id := c.Param("id")
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+	tokens := a.config.Snapshot().WebUI.APITokens
+	i := slices.IndexFunc(tokens, func(token config.APIToken) bool { return token.ID == id })
+	if i < 0 {
+		RespondError(c, http.StatusNotFound, "API token not found: "+id)
+		return
+	}
+
+	stored := tokens[i]
+	lifetime := time.Duration(request.ExpiresIn) * time.Second
+	if lifetime == 0 && !stored.ExpiresAt.IsZero() {
+		lifetime = stored.ExpiresAt.Sub(stored.CreatedAt)
+	}
+	stored.Hash = hashToken(token)
+	stored.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	stored.ExpiresAt = time.Time{}
+	if lifetime > 0 {
+		stored.ExpiresAt = stored.CreatedAt.Add(lifetime)
+	}
+
+	rotated := slices.Clone(tokens)
+	rotated[i] = stored
+	a.setAPITokens(rotated)
+	if err := a.config.Save(); err != nil {
+		a.setAPITokens(tokens)
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	delete(a.tokensUsed, id)
+	c.JSON(http.StatusOK, issuedToken(stored, token))
+}
+
+func (a *AdminAPI) revokeAPIToken(c *gin.Context) {
+	id := c.Param("id")
+
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+	tokens := a.config.Snapshot().WebUI.APITokens
+	i := slices.IndexFunc(tokens, func(token config.APIToken) bool { return token.ID == id })
+	if i < 0 {
+		RespondError(c, http.StatusNotFound, "API token not found: "+id)
+		return
+	}
+
+	a.setAPITokens(slices.Delete(slices.Clone(tokens), i, i+1))
+	if err := a.config.Save(); err != nil {
+		a.setAPITokens(tokens)
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	delete(a.tokensUsed, id)
+	c.JSON(http.StatusOK, gin.H{"message": "API token revoked successfully"})
+}
+
+// CheckAllowedIP refuses connections from addresses outside
+// server.admin.allowed_ips. It goes by the connection's address, not by
+// forwarding headers a client could forge. Connections over a unix socket
+// carry no address and are left to the socket's permissions.
+func (a *AdminAPI) CheckAllowedIP(c *gin.Context) {
+	allowed := a.config.Snapshot().Server.Admin.AllowedIPs
+	if len(allowed) == 0 {
+		return
+	}
+	ip := c.RemoteIP()
+	if ip == "" || proxy.IPAllowed(ip, allowed) {
+		return
+	}
+	RespondError(c, http.StatusForbidden, "Access denied for "+ip)
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+	"saddy/pkg/https"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// backupFormat is the version of the backup bundle layout. Imports of newer
+// bundles are refused.
+const backupFormat = 1
+
+// configBackup is the bundle exported for migrations and disaster recovery.
+// Certificates are described but not included: their keys stay in the
+// certificate storage, and a host without them issues new ones. Secrets are
+// redacted; imported on the same server they keep their running values.
+type configBackup struct {
+	Format       int               `json:"format"`
+	Created      time.Time         `json:"created"`
+	Host         string            `json:"host,omitempty"` // Host name of the exporting server
+	Config       *config.Config    `json:"config"`
+	Certificates []*https.CertInfo `json:"certificates"`
+}
+
+// exportConfig answers a backup bundle of the running configuration, redacted,
+// and the certificates it manages, as JSON or, with format=yaml, YAML.
+func (a *AdminAPI) exportConfig(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "yaml" {
+		RespondError(c, http.StatusBadRequest, "Invalid format: "+format+", expected json or yaml")
+		return
+	}
+
+	backup := configBackup{Format: backupFormat, Created: time.Now().UTC(), Certificates: []*https.CertInfo{}}
+	backup.Host, _ = os.Hostname()
+	if a.tls != nil {
+		domains := a.tls.ListDomains()
+		sort.Strings(domains)
+		for _, domain := range domains {
+			// Domains without a certificate yet have nothing to describe
+			if info, err := a.tls.GetCertInfo(domain); err == nil {
+				backup.Certificates = append(backup.Certificates, info)
+			}
+		}
+	}
+
+	a.tokensMu.Lock()
+	backup.Config = a.config.Redacted()
+	data, err := json.MarshalIndent(backup, "", "  ")
+	a.tokensMu.Unlock()
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	contentType := "application/json"
+	if format == "yaml" {
+		if data, err = jsonToYAML(data); err != nil {
+			RespondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		contentType = "application/yaml"
+	}
+	filename := fmt.Sprintf("saddy-backup-%s.%s", backup.Created.Format("20060102-150405"), format)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// jsonToYAML converts a JSON document to block style YAML, keeping the
+// order of its keys.
+func jsonToYAML(data []byte) ([]byte, error) {
+	// JSON is YAML in flow style
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	var plainStyle func(node *yaml.Node)
+	plainStyle = func(node *yaml.Node) {
+		node.Style = 0
+		for _, child := range node.Content {
+			plainStyle(child)
+		}
+	}
+	plainStyle(&document)
+	return yaml.Marshal(&document)
+}
+
+// importConfig applies the configuration of a backup bundle, JSON or YAML,
+// like an update. API tokens are kept. The response lists the domains that
+// had a certificate on the exporting server but have none here; they are
+// issued again like newly added domains.
+func (a *AdminAPI) importConfig(c *gin.Context) {
+	data, format, err := readConfigDocument(c)
+	if err != nil {
+		respondBodyError(c, err)
+		return
+	}
+
+	backup, configData, err := decodeBackup(data, format)
+	if err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	next, errs := config.CheckConfig(configData, format)
+	if len(errs) > 0 {
+		// Fields are named within the bundle
+		for i := range errs {
+			errs[i].Field = strings.TrimSuffix("config."+errs[i].Field, ".")
+		}
+		respondError(c, http.StatusUnprocessableEntity, "", errs.Error(), errs)
+		return
+	}
+
+	result, ok := a.applyConfig(c, next)
+	if !ok {
+		return
+	}
+
+	pending := []string{}
+	if a.tls != nil {
+		for _, cert := range backup.Certificates {
+			if _, err := a.tls.GetCertInfo(cert.Domain); err != nil {
+				pending = append(pending, cert.Domain)
+			}
+		}
+	}
+
+	message := "Configuration imported from backup"
+	if backup.Host != "" {
+		message += " of " + backup.Host
+	}
+	if !backup.Created.IsZero() {
+		message += " created " + backup.Created.Format(time.RFC3339)
+	}
+	a.recordVersion(c, message)
+	a.publish(events.ConfigUpdated, "", message)
+	c.JSON(http.StatusOK, gin.H{"message": message, "reload": result, "certificates_pending": pending})
+}
+
+// backupHeader is the part of a backup bundle read on import besides the
+// configuration, which is checked on its own.
+type backupHeader struct {
+	Format       int       `json:"format" yaml:"format"`
+	Created      time.Time `json:"created" yaml:"created"`
+	Host         string    `json:"host" yaml:"host"`
+	Certificates []struct {
+		Domain string `json:"domain" yaml:"domain"`
+	} `json:"certificates" yaml:"certificates"`
+}
+
+// decodeBackup reads a backup bundle and returns its header and the
+// configuration document it holds, in the same format.
+func decodeBackup(data []byte, format string) (*backupHeader, []byte, error) {
+	var header backupHeader
+	var configData []byte
+	switch format {
+	case "yaml":
+		var document struct {
+			backupHeader `yaml:",inline"`
+			Config       yaml.Node `yaml:"config"`
+		}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+		header = document.backupHeader
+		if document.Config.Kind != 0 {
+			var err error
+			if configData, err = yaml.Marshal(&document.Config); err != nil {
+				return nil, nil, fmt.Errorf("invalid backup: %v", err)
+			}
+		}
+	default:
+		var document struct {
+			backupHeader
+			Config json.RawMessage `json:"config"`
+		}
+		if err := json.Unmarshal(data, &document); err != nil {
+			return nil, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+		header = document.backupHeader
+		configData = document.Config
+	}
+
+	if header.Format == 0 || len(configData) == 0 || string(configData) == "null" {
+		return nil, nil, fmt.Errorf("not a Saddy backup: format and config are required")
+	}
+	if header.Format > backupFormat {
+		return nil, nil, fmt.Errorf("unsupported backup format %d, expected %d or older", header.Format, backupFormat)
+	}
+	return &header, configData, nil
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// diffConfig compares a proposed configuration, JSON or YAML, with the
+// running one without applying it. It answers the changed settings, a
+// unified diff of the YAML documents, the problems validation finds and,
+// when updates are applied live, what applying it would do. format=text
+// answers only the unified diff. Secrets are compared redacted, so changing
+// one isn't shown.
+func (a *AdminAPI) diffConfig(c *gin.Context) {
+	data, format, err := readConfigDocument(c)
+	if err != nil {
+		respondBodyError(c, err)
+		return
+	}
+
+	next, errs := config.CheckConfig(data, format)
+	if next == nil {
+		respondError(c, http.StatusUnprocessableEntity, "", errs.Error(), errs)
+		return
+	}
+
+	// Updates keep the API tokens and redacted secrets, so they are no change
+	a.tokensMu.Lock()
+	running := a.config.Snapshot()
+	next.WebUI.APITokens = running.WebUI.APITokens
+	a.tokensMu.Unlock()
+	next.RestoreSecrets(running)
+	current, proposed := running.Redacted(), next.Redacted()
+
+	changes, err := config.Diff(current, proposed)
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	text, err := config.UnifiedDiff(current, proposed, "running", "proposed")
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if c.Query("format") == "text" {
+		c.String(http.StatusOK, text)
+		return
+	}
+
+	if changes == nil {
+		changes = []config.Change{}
+	}
+	if errs == nil {
+		errs = config.ValidationErrors{}
+	}
+	response := gin.H{
+		"changes": changes,
+		"diff":    text,
+		"valid":   len(errs) == 0,
+		"errors":  errs,
+	}
+	if a.reloader != nil {
+		response["reload"] = a.reloader.Preview(next)
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CSRFCookie holds the CSRF token of the session for the Web UI's
+	// scripts, which send it back in CSRFHeader. Other sites can't read it.
+	CSRFCookie = "saddy_csrf"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// setCSRFCookie sets the CSRF cookie. Unlike the session cookie, scripts
+// can read it.
+func (a *AdminAPI) setCSRFCookie(c *gin.Context, token string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// checkCSRF verifies that a request authenticated by the session cookie
+// comes from the Web UI: changes must carry the session's CSRF token and,
+// if the browser names one, an Origin on the admin interface's host.
+func checkCSRF(c *gin.Context, s *session) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	if origin := c.GetHeader("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != c.Request.Host {
+			return false
+		}
+	}
+	token := c.GetHeader(CSRFHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
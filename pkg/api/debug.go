@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// processStart is when the process started, for the uptime.
+var processStart = time.Now()
+
+// getRuntimeStats answers the goroutine, memory and garbage collector
+// figures of the process.
+func (a *AdminAPI) getRuntimeStats(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastGC interface{}
+	if mem.LastGC > 0 {
+		lastGC = time.Unix(0, int64(mem.LastGC)).UTC()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"go_version":     runtime.Version(),
+		"uptime_seconds": int64(time.Since(processStart).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+		"cpus":           runtime.NumCPU(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"memory": gin.H{
+			"alloc":         mem.Alloc,
+			"total_alloc":   mem.TotalAlloc,
+			"sys":           mem.Sys,
+			"heap_alloc":    mem.HeapAlloc,
+			"heap_inuse":    mem.HeapInuse,
+			"heap_idle":     mem.HeapIdle,
+			"heap_released": mem.HeapReleased,
+			"heap_objects":  mem.HeapObjects,
+			"stack_inuse":   mem.StackInuse,
+			"mallocs":       mem.Mallocs,
+			"frees":         mem.Frees,
+		},
+		"gc": gin.H{
+			"count":          mem.NumGC,
+			"next_heap_size": mem.NextGC,
+			"last":           lastGC,
+			"pause_total_ms": float64(mem.PauseTotalNs) / float64(time.Millisecond),
+			"cpu_fraction":   mem.GCCPUFraction,
+		},
+	})
+}
+
+// requireProfiling refuses the profiling endpoints unless
+// server.admin.profiling is on. It is checked per request, so a reload
+// turns profiling on and off.
+func (a *AdminAPI) requireProfiling(c *gin.Context) {
+	if !a.config.Snapshot().Server.Admin.Profiling {
+		RespondError(c, http.StatusNotFound, "Profiling is not enabled, set server.admin.profiling")
+		return
+	}
+	c.Next()
+}
+
+// serveProfile serves the pprof index and profiles, like net/http/pprof
+// below /debug/pprof/ of the default mux.
+func (a *AdminAPI) serveProfile(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("profile"), "/")
+	switch name {
+	case "":
+		// The index links to the profiles relative to its own path
+		if !strings.HasSuffix(c.Request.URL.Path, "/") {
+			c.Redirect(http.StatusMovedPermanently, c.Request.URL.Path+"/")
+			return
+		}
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
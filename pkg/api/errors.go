@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Codes of error responses. Every status has a default code; a few errors
+// carry a more specific one clients can act on.
+const (
+	CodeInvalidRequest   = "invalid_request"    // 400
+	CodeUnauthorized     = "unauthorized"       // 401
+	CodeTOTPRequired     = "totp_required"      // 401, the login needs a two-factor code
+	CodeForbidden        = "forbidden"          // 403
+	CodeNotFound         = "not_found"          // 404
+	CodeMethodNotAllowed = "method_not_allowed" // 405
+	CodeConflict         = "conflict"           // 409
+	CodeTooLarge         = "request_too_large"  // 413
+	CodeValidationFailed = "validation_failed"  // 422, details lists the problems
+	CodeTooManyRequests  = "too_many_requests"  // 429
+	CodeInternal         = "internal_error"     // 500
+	CodeUnavailable      = "unavailable"        // 503, the subsystem isn't running
+)
+
+// errorCodes are the default codes by status.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusTooManyRequests:       CodeTooManyRequests,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// apiError is the envelope of every error response of the API:
+// {"error": {"code": ..., "message": ..., "details": ...}}.
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// RespondError aborts the request with status and an error envelope of
+// message and the default code of status.
+func RespondError(c *gin.Context, status int, message string) {
+	respondError(c, status, "", message, nil)
+}
+
+// respondError aborts the request with status and an error envelope. An
+// empty code is the default code of status.
+func respondError(c *gin.Context, status int, code, message string, details interface{}) {
+	if code == "" {
+		code = errorCodes[status]
+	}
+	if code == "" {
+		code = CodeInternal
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": apiError{Code: code, Message: message, Details: details}})
+}
+
+// respondBodyError answers an unreadable request body: 413 if it is too
+// large, 400 otherwise.
+func respondBodyError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		RespondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	RespondError(c, http.StatusBadRequest, err.Error())
+}
+
+// limitBody bounds request bodies to maxConfigSize, the largest document
+// the API accepts.
+func limitBody(c *gin.Context) {
+	if c.Request.Body != nil {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxConfigSize)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"saddy/pkg/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventsHeartbeat is how often an idle event stream sends a comment, so that
+// proxies and browsers keep the connection open.
+const eventsHeartbeat = 15 * time.Second
+
+// SetEvents enables the event stream and publishes configuration changes to
+// bus.
+func (a *AdminAPI) SetEvents(bus *events.Bus) {
+	a.events = bus
+}
+
+// publish sends an event of eventType to the event stream.
+func (a *AdminAPI) publish(eventType, domain, message string) {
+	a.events.Publish(events.Event{Type: eventType, Domain: domain, Message: message})
+}
+
+// streamEvents sends runtime events as server-sent events. Clients that
+// reconnect with Last-Event-ID get the events they missed; ?types= limits
+// the stream to a comma-separated list of event types.
+func (a *AdminAPI) streamEvents(c *gin.Context) {
+	if a.events == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Event stream not available")
+		return
+	}
+
+	var types []string
+	if list := c.Query("types"); list != "" {
+		types = strings.Split(list, ",")
+	}
+	lastID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64) //nolint:errcheck
+
+	ch, missed, cancel := a.events.Subscribe(lastID)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(event events.Event) {
+		if types != nil && !slices.Contains(types, event.Type) {
+			return
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	}
+	for _, event := range missed {
+		send(event)
+	}
+	// Tell the client to reconnect after 3s, and get the headers out
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event := <-ch:
+			send(event)
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// getRecentEvents returns the latest events, e.g. for tooling that polls
+// instead of streaming.
+func (a *AdminAPI) getRecentEvents(c *gin.Context) {
+	if a.events == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Event stream not available")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		RespondError(c, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	recent := a.events.Recent(limit)
+	c.JSON(http.StatusOK, gin.H{"events": recent, "count": len(recent)})
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessCheck is the outcome of one condition of readiness.
+type readinessCheck struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Message string `json:"message,omitempty"`
+}
+
+// SetListenerCheck sets the function reporting whether the reverse proxy's
+// listeners are bound, for readiness.
+func (a *AdminAPI) SetListenerCheck(bound func() bool) {
+	a.listenersBound = bound
+}
+
+// Liveness answers 200 as long as the process serves requests.
+func (a *AdminAPI) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "healthy",
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// Readiness answers 200 when Saddy can serve the proxied sites and 503
+// otherwise, listing the checks either way.
+func (a *AdminAPI) Readiness(c *gin.Context) {
+	checks := a.readinessChecks()
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if !check.Ready {
+			status, code = "not_ready", http.StatusServiceUnavailable
+			break
+		}
+	}
+	c.JSON(code, gin.H{
+		"status":    status,
+		"timestamp": time.Now().Unix(),
+		"checks":    checks,
+	})
+}
+
+func (a *AdminAPI) readinessChecks() []readinessCheck {
+	config := readinessCheck{Name: "config", Ready: true, Message: fmt.Sprintf("%d proxy rules", len(a.config.Snapshot().Proxy.Rules))}
+	if path := a.config.Path(); path != "" {
+		config.Message += " from " + path
+	}
+
+	listeners := readinessCheck{Name: "listeners", Ready: a.listenersBound == nil || a.listenersBound()}
+	if !listeners.Ready {
+		listeners.Message = "the reverse proxy is not listening"
+	}
+
+	cache := readinessCheck{Name: "cache", Ready: a.cache != nil}
+	if !cache.Ready {
+		cache.Message = "the cache is not initialized"
+	}
+
+	return []readinessCheck{config, listeners, cache, a.certificateCheck()}
+}
+
+// certificateCheck reports the domains of SSL-enabled rules without a
+// valid certificate. Without automatic HTTPS there is nothing to check.
+func (a *AdminAPI) certificateCheck() readinessCheck {
+	check := readinessCheck{Name: "certificates", Ready: true}
+	if a.tls == nil {
+		check.Message = "automatic HTTPS is disabled"
+		return check
+	}
+
+	var missing []string
+	for _, rule := range a.config.Snapshot().Proxy.Rules {
+		if !rule.SSL.Enabled || rule.Passthrough {
+			continue
+		}
+		if info, err := a.tls.GetCertInfo(rule.Domain); err != nil || info.IsExpired {
+			missing = append(missing, rule.Domain)
+		}
+	}
+	if len(missing) > 0 {
+		check.Ready = false
+		check.Message = "no valid certificate for " + strings.Join(missing, ", ")
+	}
+	return check
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetHistory records every configuration change in h and enables the
+// history and rollback endpoints.
+func (a *AdminAPI) SetHistory(h *config.History) {
+	a.history = h
+}
+
+// recordVersion records the running configuration as changed by the
+// request. Failures are logged, the change itself has been saved.
+func (a *AdminAPI) recordVersion(c *gin.Context, message string) {
+	if a.history == nil {
+		return
+	}
+	if _, err := a.history.Record(a.config, actor(c), message); err != nil {
+		log.Printf("Warning: Failed to record configuration version: %v", err)
+	}
+}
+
+func (a *AdminAPI) listConfigVersions(c *gin.Context) {
+	if a.history == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Configuration history not available")
+		return
+	}
+	versions, err := a.history.List()
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if versions == nil {
+		versions = []config.Version{}
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+func (a *AdminAPI) getConfigVersion(c *gin.Context) {
+	version, cfg, ok := a.loadVersion(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"version": version, "config": cfg.Redacted()})
+}
+
+// rollbackConfig applies a recorded version like an update, and records
+// the result as a new version.
+func (a *AdminAPI) rollbackConfig(c *gin.Context) {
+	version, cfg, ok := a.loadVersion(c)
+	if !ok {
+		return
+	}
+
+	result, ok := a.applyConfig(c, cfg)
+	if !ok {
+		return
+	}
+
+	message := fmt.Sprintf("Rolled back to version %d", version.Version)
+	a.recordVersion(c, message)
+	a.publish(events.ConfigUpdated, "", message)
+	c.JSON(http.StatusOK, gin.H{"message": message, "reload": result})
+}
+
+// loadVersion loads the version named by the request. On failure it
+// answers the request and returns false.
+func (a *AdminAPI) loadVersion(c *gin.Context) (*config.Version, *config.Config, bool) {
+	if a.history == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Configuration history not available")
+		return nil, nil, false
+	}
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		RespondError(c, http.StatusBadRequest, "Invalid version: "+c.Param("version"))
+		return nil, nil, false
+	}
+
+	version, cfg, err := a.history.Load(number)
+	switch {
+	case errors.Is(err, config.ErrVersionNotFound):
+		RespondError(c, http.StatusNotFound, "Configuration version not found")
+		return nil, nil, false
+	case err != nil:
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	return version, cfg, true
+}
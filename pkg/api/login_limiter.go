@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLoginMaxAttempts = 5
+	defaultLoginLockout     = 15 * time.Minute
+)
+
+// loginLimiter locks out client IPs after repeated failed logins, counting
+// failures of the login form, Basic Auth, API tokens and TOTP codes.
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{clients: make(map[string]*loginAttempts)}
+}
+
+// loginPolicy returns the failures allowed per IP within the lockout
+// duration, and the lockout duration.
+func (a *AdminAPI) loginPolicy() (int, time.Duration) {
+	webUI := a.config.Snapshot().WebUI
+	maxAttempts := webUI.LoginMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultLoginMaxAttempts
+	}
+	lockout := defaultLoginLockout
+	if webUI.LoginLockout > 0 {
+		lockout = time.Duration(webUI.LoginLockout) * time.Second
+	}
+	return maxAttempts, lockout
+}
+
+// lockedOut returns how long ip remains locked out.
+func (l *loginLimiter) lockedOut(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if attempts, ok := l.clients[ip]; ok {
+		if wait := time.Until(attempts.lockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// failed records a failed login from ip and reports whether it is now
+// locked out.
+func (l *loginLimiter) failed(ip string, maxAttempts int, lockout time.Duration) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, attempts := range l.clients {
+		if now.Sub(attempts.firstFailed) > lockout && now.After(attempts.lockedUntil) {
+			delete(l.clients, client)
+		}
+	}
+
+	attempts, ok := l.clients[ip]
+	if !ok {
+		attempts = &loginAttempts{firstFailed: now}
+		l.clients[ip] = attempts
+	}
+	attempts.failures++
+	if attempts.failures >= maxAttempts {
+		attempts.lockedUntil = now.Add(lockout)
+		attempts.failures = 0
+		attempts.firstFailed = now
+		return true
+	}
+	return false
+}
+
+// succeeded forgets the failures of ip.
+func (l *loginLimiter) succeeded(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+}
+
+// checkLockout aborts with 429 if the client is locked out. Clients are
+// told apart by the connection's address, since X-Forwarded-For changed on
+// every attempt would otherwise allow unlimited guesses.
+func (a *AdminAPI) checkLockout(c *gin.Context) bool {
+	wait := a.logins.lockedOut(c.RemoteIP())
+	if wait == 0 {
+		return false
+	}
+	seconds := int(wait.Round(time.Second) / time.Second)
+	c.Header("Retry-After", fmt.Sprint(seconds))
+	respondError(c, http.StatusTooManyRequests, "", fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), gin.H{"retry_after": seconds})
+	return true
+}
+
+// loginFailed records a failed login of the client.
+func (a *AdminAPI) loginFailed(c *gin.Context) {
+	maxAttempts, lockout := a.loginPolicy()
+	if a.logins.failed(c.RemoteIP(), maxAttempts, lockout) {
+		log.Printf("Warning: Locked out %s from the admin interface for %s after %d failed logins", c.RemoteIP(), lockout, maxAttempts)
+	}
+}
+
+func (a *AdminAPI) getLockouts(c *gin.Context) {
+	now := time.Now()
+
+	a.logins.mu.Lock()
+	lockouts := make([]gin.H, 0)
+	for ip, attempts := range a.logins.clients {
+		if now.Before(attempts.lockedUntil) {
+			lockouts = append(lockouts, gin.H{"ip": ip, "locked_until": attempts.lockedUntil})
+		}
+	}
+	a.logins.mu.Unlock()
+
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i]["ip"].(string) < lockouts[j]["ip"].(string) })
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts, "count": len(lockouts)})
+}
+
+// clearLockouts lifts the lockout of ?ip=, or of every client.
+func (a *AdminAPI) clearLockouts(c *gin.Context) {
+	a.logins.mu.Lock()
+	defer a.logins.mu.Unlock()
+	if ip := c.Query("ip"); ip != "" {
+		delete(a.logins.clients, ip)
+	} else {
+		a.logins.clients = make(map[string]*loginAttempts)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lockouts cleared successfully"})
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"saddy/pkg/logs"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// defaultTailLines is how many kept lines tailLogs sends before new ones,
+// like tail -f.
+const defaultTailLines = 10
+
+// SetLogs enables the live log tail.
+func (a *AdminAPI) SetLogs(tail *logs.Tail) {
+	a.logs = tail
+}
+
+// tailLogs streams log lines over a WebSocket as JSON messages: the last
+// ?lines= kept lines, then new ones as they are logged. ?level= drops lines
+// below that level and ?domain= keeps the access lines of one domain.
+func (a *AdminAPI) tailLogs(c *gin.Context) {
+	if a.logs == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Log tail not available")
+		return
+	}
+	if !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		RespondError(c, http.StatusBadRequest, "Expected a WebSocket upgrade request")
+		return
+	}
+
+	minSeverity := 0
+	if level := c.Query("level"); level != "" {
+		if minSeverity = logs.Severity(level); minSeverity < 0 {
+			RespondError(c, http.StatusBadRequest, "Invalid level: must be one of "+strings.Join(logs.Levels, ", "))
+			return
+		}
+	}
+	lines := defaultTailLines
+	if value := c.Query("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > logs.HistorySize {
+			RespondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid lines: must be between 0 and %d", logs.HistorySize))
+			return
+		}
+		lines = n
+	}
+	domain := c.Query("domain")
+	matches := func(line logs.Line) bool {
+		return logs.Severity(line.Level) >= minSeverity && (domain == "" || line.Domain == domain)
+	}
+
+	server := websocket.Server{Handshake: sameOrigin, Handler: func(ws *websocket.Conn) {
+		ch, recent, cancel := a.logs.Subscribe(logs.HistorySize)
+		defer cancel()
+
+		// Recent lines that match, up to lines of them
+		var backlog []logs.Line
+		for _, line := range recent {
+			if matches(line) {
+				backlog = append(backlog, line)
+			}
+		}
+		for _, line := range backlog[max(len(backlog)-lines, 0):] {
+			if websocket.JSON.Send(ws, line) != nil {
+				return
+			}
+		}
+
+		// The client doesn't send anything; reading notices when it leaves
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case line := <-ch:
+				if matches(line) && websocket.JSON.Send(ws, line) != nil {
+					return
+				}
+			}
+		}
+	}}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// sameOrigin refuses WebSocket handshakes from pages of other sites, which
+// browsers would make with the user's credentials. Clients other than
+// browsers send no Origin.
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross-origin WebSocket request from %s", origin)
+	}
+	config.Origin = u
+	return nil
+}
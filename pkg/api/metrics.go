@@ -0,0 +1,175 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"saddy/pkg/metrics"
+	"saddy/pkg/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// prometheusContentType is the content type of the Prometheus text format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PublicMetricsPath returns the path that serves the metrics without
+// authentication, or "" if there is none.
+func (a *AdminAPI) PublicMetricsPath() string {
+	return a.config.Snapshot().Server.Admin.MetricsPath
+}
+
+// Metrics answers the proxy, cache and TLS metrics in the Prometheus text
+// format. Subsystems that aren't running are left out.
+func (a *AdminAPI) Metrics(c *gin.Context) {
+	var e metrics.Exposition
+	if a.traffic != nil {
+		writeTrafficMetrics(&e, a.traffic.Totals())
+	}
+	if a.stats != nil {
+		a.writeCacheMetrics(&e)
+	}
+	if a.cache != nil {
+		writeCacheStorageMetrics(&e, a.cache.Stats())
+	}
+	if a.proxy != nil {
+		writeUpstreamMetrics(&e, a.proxy.Upstreams())
+	}
+	if a.tls != nil {
+		a.writeTLSMetrics(&e)
+	}
+	c.Data(http.StatusOK, prometheusContentType, []byte(e.String()))
+}
+
+func writeTrafficMetrics(e *metrics.Exposition, totals map[string]metrics.Totals) {
+	domains := sortedKeys(totals)
+
+	e.Family("saddy_http_requests_total", metrics.Counter, "Proxied requests by domain and status class.")
+	classes := [...]string{"other", "1xx", "2xx", "3xx", "4xx", "5xx"}
+	for _, domain := range domains {
+		for class, count := range totals[domain].Status {
+			if count > 0 {
+				e.Sample("saddy_http_requests_total", float64(count), "domain", domain, "code", classes[class])
+			}
+		}
+	}
+
+	e.Family("saddy_http_response_bytes_total", metrics.Counter, "Bytes of proxied responses by domain.")
+	for _, domain := range domains {
+		e.Sample("saddy_http_response_bytes_total", float64(totals[domain].Bytes), "domain", domain)
+	}
+
+	e.Family("saddy_http_request_duration_seconds", metrics.Histogram, "Time to answer proxied requests by domain.")
+	bounds := metrics.LatencyBounds()
+	for _, domain := range domains {
+		t := totals[domain]
+		var cumulative int64
+		for i, count := range t.Latency {
+			cumulative += count
+			le := "+Inf"
+			if i < len(bounds) {
+				le = strconv.FormatFloat(bounds[i]/1000, 'g', -1, 64)
+			}
+			e.Sample("saddy_http_request_duration_seconds_bucket", float64(cumulative), "domain", domain, "le", le)
+		}
+		e.Sample("saddy_http_request_duration_seconds_sum", t.LatencySeconds, "domain", domain)
+		e.Sample("saddy_http_request_duration_seconds_count", float64(t.Requests), "domain", domain)
+	}
+}
+
+func (a *AdminAPI) writeCacheMetrics(e *metrics.Exposition) {
+	stats := a.stats.Snapshot()
+	domains := sortedKeys(stats)
+
+	e.Family("saddy_cache_requests_total", metrics.Counter, "Cacheable requests by domain and cache outcome.")
+	for _, domain := range domains {
+		s := stats[domain]
+		e.Sample("saddy_cache_requests_total", float64(s.Hits), "domain", domain, "outcome", "hit")
+		e.Sample("saddy_cache_requests_total", float64(s.Stale), "domain", domain, "outcome", "stale")
+		e.Sample("saddy_cache_requests_total", float64(s.Misses), "domain", domain, "outcome", "miss")
+		e.Sample("saddy_cache_requests_total", float64(s.Bypasses), "domain", domain, "outcome", "bypass")
+	}
+
+	e.Family("saddy_cache_served_bytes_total", metrics.Counter, "Bytes served from the cache by domain.")
+	for _, domain := range domains {
+		e.Sample("saddy_cache_served_bytes_total", float64(stats[domain].BytesCached), "domain", domain)
+	}
+}
+
+func writeCacheStorageMetrics(e *metrics.Exposition, stats map[string]interface{}) {
+	gauges := []struct{ key, name, help string }{
+		{"items_count", "saddy_cache_entries", "Entries in the cache."},
+		{"current_size", "saddy_cache_size_bytes", "Size of the cached entries."},
+		{"max_size", "saddy_cache_max_size_bytes", "Maximum size of the cache."},
+	}
+	for _, gauge := range gauges {
+		if value, ok := number(stats[gauge.key]); ok {
+			e.Family(gauge.name, metrics.Gauge, gauge.help)
+			e.Sample(gauge.name, value)
+		}
+	}
+}
+
+func writeUpstreamMetrics(e *metrics.Exposition, upstreams []proxy.UpstreamStatus) {
+	e.Family("saddy_upstream_healthy", metrics.Gauge, "Whether the target of a proxy rule answered its last request or probe.")
+	for _, upstream := range upstreams {
+		e.Sample("saddy_upstream_healthy", boolValue(upstream.Healthy), "domain", upstream.Domain, "target", upstream.Target)
+	}
+	e.Family("saddy_upstream_ejected", metrics.Gauge, "Whether the target of a proxy rule is ejected after repeated failures.")
+	for _, upstream := range upstreams {
+		e.Sample("saddy_upstream_ejected", boolValue(upstream.Ejected), "domain", upstream.Domain, "target", upstream.Target)
+	}
+	e.Family("saddy_upstream_in_flight_requests", metrics.Gauge, "Requests being sent to the target of a proxy rule.")
+	for _, upstream := range upstreams {
+		e.Sample("saddy_upstream_in_flight_requests", float64(upstream.InFlight), "domain", upstream.Domain, "target", upstream.Target)
+	}
+}
+
+func (a *AdminAPI) writeTLSMetrics(e *metrics.Exposition) {
+	stats := a.tls.HandshakeStats()
+	e.Family("saddy_tls_handshakes_total", metrics.Counter, "TLS handshakes by domain and result.")
+	for _, domain := range sortedKeys(stats.Domains) {
+		counters := stats.Domains[domain]
+		e.Sample("saddy_tls_handshakes_total", float64(counters.Successes), "domain", domain, "result", "success")
+		e.Sample("saddy_tls_handshakes_total", float64(counters.Failures), "domain", domain, "result", "failure")
+	}
+	e.Family("saddy_tls_handshakes_unknown_sni_total", metrics.Counter, "Failed TLS handshakes without a server name or for names that aren't managed.")
+	e.Sample("saddy_tls_handshakes_unknown_sni_total", float64(stats.UnknownSNI))
+
+	expiries := a.tls.CertificateExpiries()
+	e.Family("saddy_tls_certificate_expiry_timestamp_seconds", metrics.Gauge, "When the certificate served for a domain expires, in Unix time.")
+	for _, domain := range sortedKeys(expiries) {
+		e.Sample("saddy_tls_certificate_expiry_timestamp_seconds", float64(expiries[domain].Unix()), "domain", domain)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// number converts the numbers of cache statistics to float64.
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/proxy"
+	"saddy/pkg/warmer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIVersion is the version of the admin API in its OpenAPI document.
+const openAPIVersion = "1.0.0"
+
+// routeDoc describes an endpoint in the OpenAPI document. Endpoints without
+// one are still listed, so the document always covers every route.
+type routeDoc struct {
+	Summary string
+	Scope   string // Scope needed for changes; reading needs ScopeRead
+	Public  bool   // No authentication
+	Query   []queryParam
+	Body    any // Value of the JSON request body's type
+}
+
+type queryParam struct {
+	Name        string
+	Description string
+}
+
+// routeDocs documents the routes set up by SetupRoutes, keyed by method
+// and path relative to the API's base path.
+var routeDocs = map[string]routeDoc{
+	"GET /config/":                   {Summary: "Get the full configuration", Scope: ScopeAdmin},
+	"PUT /config/":                   {Summary: "Replace the configuration and apply it to the running server", Scope: ScopeAdmin, Body: config.Config{}},
+	"POST /config/validate":          {Summary: "Check a configuration, JSON or YAML, without applying it", Scope: ScopeAdmin, Body: config.Config{}},
+	"POST /config/diff":              {Summary: "Compare a configuration, JSON or YAML, with the running one", Scope: ScopeAdmin, Query: []queryParam{{"format", "text for only the unified diff"}}, Body: config.Config{}},
+	"GET /config/history":            {Summary: "List the recorded configuration versions, newest first", Scope: ScopeAdmin},
+	"GET /config/history/:version":   {Summary: "Get a recorded configuration version", Scope: ScopeAdmin},
+	"POST /config/rollback/:version": {Summary: "Apply a recorded configuration version", Scope: ScopeAdmin},
+	"GET /config/export":             {Summary: "Export a backup of the configuration and certificate metadata", Scope: ScopeAdmin, Query: []queryParam{{"format", "json (default) or yaml"}}},
+	"POST /config/import":            {Summary: "Apply the configuration of a backup, JSON or YAML", Scope: ScopeAdmin},
+	"GET /config/proxy": {Summary: "List proxy rules", Scope: ScopeRules, Query: []queryParam{
+		{"search", "Only rules whose domain or target contains this"}, {"ssl", "true or false"}, {"cache", "true or false"},
+		{"passthrough", "true or false"}, {"sort", "domain or target, descending with a leading -"},
+		{"page", "Page number, from 1; all rules unless page or per_page is given"}, {"per_page", "Rules per page"}}},
+	"POST /config/proxy":           {Summary: "Add a proxy rule", Scope: ScopeRules, Body: config.ProxyRule{}},
+	"PUT /config/proxy/:domain":    {Summary: "Update a proxy rule", Scope: ScopeRules, Body: config.ProxyRule{}},
+	"DELETE /config/proxy/:domain": {Summary: "Delete a proxy rule", Scope: ScopeRules},
+
+	"GET /cache/stats":            {Summary: "Get cache statistics", Scope: ScopeCache},
+	"GET /cache/stats/domains":    {Summary: "Get cache statistics per domain", Scope: ScopeCache, Query: []queryParam{{"domain", "Only this domain"}}},
+	"DELETE /cache/stats/domains": {Summary: "Reset cache statistics per domain", Scope: ScopeCache, Query: []queryParam{{"domain", "Only this domain"}}},
+	"GET /cache/keys": {Summary: "List cached keys", Scope: ScopeCache, Query: []queryParam{
+		{"domain", "Only keys of this domain"}, {"prefix", "Only keys of paths with this prefix"},
+		{"page", "Page number, from 1"}, {"per_page", "Keys per page"}}},
+	"GET /cache/entry": {Summary: "Inspect a cache entry", Scope: ScopeCache, Query: []queryParam{
+		{"key", "Cache key"}, {"max_body", "Bytes of the body to return, 0 for all"}, {"body", "false to omit the body"}}},
+	"PATCH /cache/entry": {Summary: "Change the expiration of a cache entry", Scope: ScopeCache, Body: cacheEntryUpdate{}},
+	"DELETE /cache/": {Summary: "Clear the cache, or the entries of a domain and path pattern", Scope: ScopeCache, Query: []queryParam{
+		{"domain", "Only entries of this domain"}, {"path", "Only entries whose path matches this pattern, e.g. /static/*"},
+		{"soft", "true to mark the entries stale instead of deleting them"}}},
+	"POST /cache/purge":  {Summary: "Purge cache entries by URL, prefix, key pattern or tag", Scope: ScopeCache, Body: purgeRequest{}},
+	"GET /cache/warm":    {Summary: "Get the status of cache warming", Scope: ScopeCache},
+	"POST /cache/warm":   {Summary: "Warm the cache", Scope: ScopeCache, Body: warmer.Job{}},
+	"DELETE /cache/:key": {Summary: "Delete a cache key", Scope: ScopeCache},
+
+	"GET /tls/domains":                {Summary: "List TLS domains", Scope: ScopeTLS},
+	"GET /tls/status":                 {Summary: "Get the TLS status", Scope: ScopeTLS},
+	"GET /tls/stats":                  {Summary: "Get TLS handshake statistics", Scope: ScopeTLS, Query: []queryParam{{"domain", "Only this domain"}}},
+	"DELETE /tls/stats":               {Summary: "Reset TLS handshake statistics", Scope: ScopeTLS},
+	"GET /tls/domains/:domain":        {Summary: "Get certificate information", Scope: ScopeTLS},
+	"GET /tls/domains/:domain/check":  {Summary: "Check the DNS, HTTP and certificate status of a domain", Scope: ScopeTLS},
+	"POST /tls/domains/:domain/renew": {Summary: "Renew a certificate", Scope: ScopeTLS},
+	"POST /tls/domains/:domain/revoke": {Summary: "Revoke a certificate", Scope: ScopeTLS, Query: []queryParam{
+		{"reason", "Revocation reason, e.g. keyCompromise"}, {"remove", "true to also remove the domain"}}},
+	"POST /tls/domains/:domain": {Summary: "Add a TLS domain", Scope: ScopeTLS, Query: []queryParam{
+		{"issuer", "acme or internal"}, {"challenge", "http-01 or dns-01"}}},
+	"DELETE /tls/domains/:domain": {Summary: "Remove a TLS domain", Scope: ScopeTLS, Query: []queryParam{
+		{"keep_certificate", "true to stop serving the domain but keep its certificate"}}},
+	"POST /tls/check-all": {Summary: "Check the DNS, HTTP and certificate status of every domain", Scope: ScopeTLS},
+	"POST /tls/renew-all": {Summary: "Run the renewal check for every domain and report the outcome per domain", Scope: ScopeTLS, Query: []queryParam{
+		{"force", "true to renew every certificate, due or not"}}},
+
+	"GET /system/status":  {Summary: "Get the system status", Scope: ScopeRead},
+	"GET /system/health":  {Summary: "Liveness check, the same as /healthz", Scope: ScopeRead},
+	"GET /system/runtime": {Summary: "Get goroutine, memory and garbage collector statistics", Scope: ScopeRead},
+	"GET /debug/pprof/*profile": {Summary: "Get a pprof profile, or the index of profiles for an empty name; requires server.admin.profiling", Scope: ScopeAdmin, Query: []queryParam{
+		{"seconds", "Duration of the profile and trace profiles, default 30"}, {"debug", "1 or 2 for text output"}}},
+	"POST /debug/pprof/*profile": {Summary: "Look up program counters for the symbol profile; requires server.admin.profiling", Scope: ScopeAdmin},
+	"GET /system/metrics":        {Summary: "Get proxy, cache and TLS metrics in Prometheus text format", Scope: ScopeRead},
+
+	"GET /proxy/upstreams":         {Summary: "Get the health and circuit state of every rule's target", Scope: ScopeRules},
+	"GET /proxy/upstreams/:domain": {Summary: "Get the health and circuit state of a rule's target", Scope: ScopeRules},
+	"POST /proxy/:domain/test": {Summary: "Send a test request through a proxy rule", Scope: ScopeRules, Query: []queryParam{
+		{"max_body", "Maximum response body bytes returned, default 4096, 0 for all"}}, Body: proxy.TestRequest{}},
+
+	"GET /traffic": {Summary: "Get live traffic per domain", Scope: ScopeRead, Query: []queryParam{
+		{"window", "Seconds to summarize, default 60, at most 900"}, {"domain", "Only this domain"}}},
+	"GET /traffic/series": {Summary: "Get live traffic as a time series", Scope: ScopeRead, Query: []queryParam{
+		{"domain", "Only this domain, all domains by default"},
+		{"window", "Seconds to cover, default 300, at most 900"},
+		{"step", "Seconds per point, default 5"}}},
+	"DELETE /traffic": {Summary: "Reset live traffic metrics", Scope: ScopeAdmin},
+
+	"GET /events": {Summary: "Stream runtime events (server-sent events)", Scope: ScopeRead, Query: []queryParam{
+		{"types", "Comma-separated event types to stream"}}},
+	"GET /events/recent": {Summary: "List recent runtime events", Scope: ScopeRead, Query: []queryParam{{"limit", "Maximum number of events, default 50"}}},
+	"GET /logs/tail": {Summary: "Stream log lines over a WebSocket", Scope: ScopeRead, Query: []queryParam{
+		{"level", "Minimum level: info, warning or error"}, {"domain", "Only access lines of this domain"},
+		{"lines", "Kept lines to send first, default 10"}}},
+
+	"GET /tokens":             {Summary: "List API tokens", Scope: ScopeAdmin},
+	"POST /tokens":            {Summary: "Create an API token", Scope: ScopeAdmin, Body: apiTokenRequest{}},
+	"DELETE /tokens/:id":      {Summary: "Revoke an API token", Scope: ScopeAdmin},
+	"POST /tokens/:id/rotate": {Summary: "Replace the secret of an API token", Scope: ScopeAdmin, Body: tokenRotation{}},
+
+	"POST /auth/login":        {Summary: "Log in to the Web UI", Public: true, Body: loginRequest{}},
+	"POST /auth/logout":       {Summary: "Log out of the Web UI", Public: true},
+	"GET /auth/sessions":      {Summary: "List Web UI sessions", Scope: ScopeAdmin},
+	"DELETE /auth/sessions":   {Summary: "Log out every Web UI session", Scope: ScopeAdmin},
+	"POST /auth/password":     {Summary: "Change the password of the current user, or of username for admins", Body: passwordChange{}},
+	"GET /auth/totp":          {Summary: "Get the two-factor status of the current user"},
+	"POST /auth/totp/enroll":  {Summary: "Start two-factor enrollment"},
+	"POST /auth/totp/confirm": {Summary: "Confirm two-factor enrollment", Body: totpCodeRequest{}},
+	"DELETE /auth/totp":       {Summary: "Disable two-factor authentication", Body: totpCodeRequest{}, Query: []queryParam{{"username", "User to reset, admins only"}}},
+	"GET /openapi.json":       {Summary: "Get this OpenAPI document", Public: true},
+	"GET /docs":               {Summary: "Browse this document with Swagger UI", Public: true},
+
+	"GET /auth/lockouts":    {Summary: "List locked out IPs", Scope: ScopeAdmin},
+	"DELETE /auth/lockouts": {Summary: "Lift lockouts", Scope: ScopeAdmin, Query: []queryParam{{"ip", "Only this IP"}}},
+}
+
+// OpenAPI returns an OpenAPI 3 document of the routes under basePath.
+func (a *AdminAPI) OpenAPI(routes gin.RoutesInfo, basePath string) gin.H {
+	schemas := gin.H{}
+	paths := gin.H{}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, route := range routes {
+		path, ok := strings.CutPrefix(route.Path, basePath)
+		if !ok || route.Method == http.MethodHead {
+			continue
+		}
+		doc, documented := routeDocs[route.Method+" "+path]
+		if !documented {
+			doc.Summary = route.Handler
+		}
+
+		operation := gin.H{
+			"summary":   doc.Summary,
+			"tags":      []string{strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]},
+			"responses": openAPIResponses(doc),
+		}
+		var parameters []gin.H
+		var openAPIPath []string
+		for _, segment := range strings.Split(path, "/") {
+			// Parameters and catch-all parameters
+			if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+				name := segment[1:]
+				parameters = append(parameters, gin.H{"name": name, "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+				segment = "{" + name + "}"
+			}
+			openAPIPath = append(openAPIPath, segment)
+		}
+		for _, param := range doc.Query {
+			parameters = append(parameters, gin.H{"name": param.Name, "in": "query", "description": param.Description, "schema": gin.H{"type": "string"}})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if doc.Body != nil {
+			operation["requestBody"] = gin.H{
+				"required": true,
+				"content":  gin.H{"application/json": gin.H{"schema": jsonSchema(reflect.TypeOf(doc.Body), schemas)}},
+			}
+		}
+		if doc.Public {
+			operation["security"] = []gin.H{}
+		} else if doc.Scope != "" {
+			operation["description"] = "Requires the " + doc.Scope + " scope" + readNote(doc.Scope, route.Method) + "."
+		}
+
+		key := basePath + strings.Join(openAPIPath, "/")
+		item, _ := paths[key].(gin.H)
+		if item == nil {
+			item = gin.H{}
+			paths[key] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "Saddy Admin API",
+			"version":     openAPIVersion,
+			"description": "Manage Saddy's proxy rules, cache and certificates.",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas,
+			"securitySchemes": gin.H{
+				"basicAuth":     gin.H{"type": "http", "scheme": "basic"},
+				"bearerAuth":    gin.H{"type": "http", "scheme": "bearer", "description": "API token created with POST /tokens"},
+				"sessionCookie": gin.H{"type": "apiKey", "in": "cookie", "name": SessionCookie, "description": "Web UI session; changes also need the " + CSRFHeader + " header"},
+			},
+		},
+		"security": []gin.H{{"basicAuth": []string{}}, {"bearerAuth": []string{}}, {"sessionCookie": []string{}}},
+	}
+}
+
+func readNote(scope, method string) string {
+	if scope == ScopeAdmin || scope == ScopeRead || (method != http.MethodGet && method != http.MethodHead) {
+		return ""
+	}
+	return " or " + ScopeRead
+}
+
+func openAPIResponses(doc routeDoc) gin.H {
+	errorSchema := gin.H{"type": "object", "properties": gin.H{"error": gin.H{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": gin.H{
+			"code":    gin.H{"type": "string", "description": "Machine-readable error code, e.g. not_found"},
+			"message": gin.H{"type": "string"},
+			"details": gin.H{"description": "More about the error, e.g. the problems of a rejected configuration"},
+		},
+	}}}
+	errorResponse := func(description string) gin.H {
+		return gin.H{"description": description, "content": gin.H{"application/json": gin.H{"schema": errorSchema}}}
+	}
+
+	responses := gin.H{
+		"200": gin.H{"description": "Success", "content": gin.H{"application/json": gin.H{"schema": gin.H{"type": "object"}}}},
+		"400": errorResponse("Invalid request"),
+		"500": errorResponse("Internal error"),
+		"503": errorResponse("Subsystem not running"),
+	}
+	if !doc.Public {
+		responses["401"] = errorResponse("Authentication required")
+		responses["403"] = errorResponse("Missing scope or CSRF token")
+		responses["429"] = errorResponse("Locked out after failed logins")
+	}
+	return responses
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the schema of values of t as encoding/json marshals
+// them. Named structs go to schemas and are referenced.
+func jsonSchema(t reflect.Type, schemas gin.H) gin.H {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return gin.H{"type": "number"}
+	case t.Kind() == reflect.String:
+		return gin.H{"type": "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return gin.H{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return gin.H{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return gin.H{}
+	}
+
+	if t.Name() == "" {
+		return structSchema(t, schemas)
+	}
+	if _, ok := schemas[t.Name()]; !ok {
+		schemas[t.Name()] = gin.H{} // Placeholder for recursive types
+		schemas[t.Name()] = structSchema(t, schemas)
+	}
+	return gin.H{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+func structSchema(t reflect.Type, schemas gin.H) gin.H {
+	properties := gin.H{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type, schemas)
+		if strings.Contains(field.Tag.Get("binding"), "required") && !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := gin.H{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minPasswordLength is the shortest password accepted by changePassword.
+const minPasswordLength = 8
+
+// passwordChange is the body of changePassword.
+type passwordChange struct {
+	Username        string `json:"username"`         // Another user, for admins; the current user by default
+	CurrentPassword string `json:"current_password"` // Required to change one's own password
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// changePassword sets a user's password, hashed like the existing one.
+// Users change their own with their current password; admins can reset
+// anyone's without it. The user's other sessions end.
+func (a *AdminAPI) changePassword(c *gin.Context) {
+	var request passwordChange
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+	if len(request.NewPassword) < minPasswordLength {
+		RespondError(c, http.StatusBadRequest, fmt.Sprintf("The new password must have at least %d characters", minPasswordLength))
+		return
+	}
+
+	current := a.currentUser(c)
+	var user *config.AdminUser
+	if request.Username == "" || (current != nil && request.Username == current.Username) {
+		if current == nil {
+			RespondError(c, http.StatusForbidden, "Changing the password requires a user login, or username for admins")
+			return
+		}
+		// A stolen session must not be enough to take the account over
+		if a.checkLockout(c) {
+			return
+		}
+		if !current.CheckPassword(request.CurrentPassword) {
+			a.loginFailed(c)
+			RespondError(c, http.StatusForbidden, "Current password is incorrect")
+			return
+		}
+		user = current
+	} else {
+		if !slices.Contains(c.GetStringSlice(authScopesKey), ScopeAdmin) {
+			RespondError(c, http.StatusForbidden, "Permission denied: requires the admin scope")
+			return
+		}
+		if user = a.findUser(request.Username); user == nil {
+			RespondError(c, http.StatusNotFound, "User not found: "+request.Username)
+			return
+		}
+	}
+
+	algorithm := config.PasswordBcrypt
+	if strings.HasPrefix(user.Password, "$argon2id$") {
+		algorithm = config.PasswordArgon2id
+	}
+	hash, err := config.HashPassword(request.NewPassword, algorithm)
+	if err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := a.updateCredentials(user.Username, func(password, _ *string) {
+		*password = hash
+	}); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ended := a.endUserSessions(user.Username, a.sessionFromCookie(c.Request))
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed for " + user.Username, "sessions_ended": ended})
+}
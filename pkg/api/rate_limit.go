@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimiter holds a token bucket per client IP. Buckets refill
+// continuously at the limit per minute and hold a minute's worth.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	limited bool // Refused the last request, to log once per episode
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rateBucket)}
+}
+
+// take uses a token of ip's bucket for limit requests per minute. If none
+// is left it returns how long until there is one, and whether ip just
+// became limited.
+func (l *rateLimiter) take(ip string, limit int, now time.Time) (time.Duration, bool) {
+	perSecond := float64(limit) / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Buckets idle for a minute are full again, the same as no bucket
+	if now.Sub(l.lastSweep) > time.Minute {
+		for client, b := range l.buckets {
+			if now.Sub(b.updated) > time.Minute {
+				delete(l.buckets, client)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &rateBucket{tokens: float64(limit), updated: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return 0, false
+	}
+	started := !b.limited
+	b.limited = true
+	return time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), started
+}
+
+// rateLimit refuses admin API requests beyond server.admin.rate_limit with
+// 429, so that a runaway script can't keep the admin interface, or the
+// configuration saves and purges behind it, busy. Clients are told apart by
+// the connection's address, like CheckAllowedIP, not by forwarding headers
+// they could change on every request. The limits are read per request, so
+// a reload changes them.
+func (a *AdminAPI) rateLimit(c *gin.Context) {
+	limits := a.config.Snapshot().Server.Admin.RateLimit
+	ip := c.RemoteIP()
+	now := time.Now()
+
+	check := func(limiter *rateLimiter, limit int, what string) bool {
+		if limit <= 0 {
+			return true
+		}
+		wait, started := limiter.take(ip, limit, now)
+		if wait == 0 {
+			return true
+		}
+		if started {
+			log.Printf("Warning: Rate limiting %s on the admin API, over %d %s per minute", ip, limit, what)
+		}
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", fmt.Sprint(seconds))
+		respondError(c, http.StatusTooManyRequests, "", fmt.Sprintf("Too many %s, try again in %d seconds", what, seconds), gin.H{"retry_after": seconds})
+		return false
+	}
+
+	if !check(a.requests, limits.Requests, "requests") {
+		return
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && !check(a.writes, limits.Writes, "changes") {
+		return
+	}
+	c.Next()
+}
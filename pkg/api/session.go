@@ -0,0 +1,216 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SessionCookie is the name of the Web UI session cookie.
+	SessionCookie = "saddy_session"
+
+	defaultSessionTTL = 24 * time.Hour
+)
+
+// session is a Web UI login. Sessions are kept in memory, so restarting
+// Saddy logs everyone out.
+type session struct {
+	ID        string
+	Username  string
+	Role      string
+	CSRFToken string
+	RemoteIP  string
+	UserAgent string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+}
+
+// sessionTTL returns how long a session lasts after login.
+func (a *AdminAPI) sessionTTL() time.Duration {
+	if ttl := a.config.Snapshot().WebUI.SessionTTL; ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return defaultSessionTTL
+}
+
+// signSession returns the cookie value for a session ID: the ID and its
+// HMAC, so that cookies can't be forged without the server's key.
+func (a *AdminAPI) signSession(id string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionFromCookie returns a copy of the live session of the request's
+// cookie, taken under sessionsMu.
+func (a *AdminAPI) sessionFromCookie(r *http.Request) *session {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+	id, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(cookie.Value), []byte(a.signSession(id))) {
+		return nil
+	}
+
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	s, ok := a.sessions[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(s.ExpiresAt) {
+		delete(a.sessions, id)
+		return nil
+	}
+
+	// Removed users are logged out, and role changes apply immediately
+	user := a.findUser(s.Username)
+	if user == nil {
+		delete(a.sessions, id)
+		return nil
+	}
+	s.Role = user.Role
+	s.LastSeen = now
+	current := *s
+	return &current
+}
+
+// ValidSession reports whether the request carries a live Web UI session.
+func (a *AdminAPI) ValidSession(r *http.Request) bool {
+	return a.sessionFromCookie(r) != nil
+}
+
+// startSession creates a session and sets its cookie. Unless remember is
+// set the cookie ends with the browser session.
+func (a *AdminAPI) startSession(c *gin.Context, user *config.AdminUser, remember bool) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return err
+	}
+	now := time.Now()
+	s := &session{
+		ID:        base64.RawURLEncoding.EncodeToString(raw),
+		CSRFToken: base64.RawURLEncoding.EncodeToString(csrf),
+		Username:  user.Username,
+		Role:      user.Role,
+		RemoteIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(a.sessionTTL()),
+	}
+
+	a.sessionsMu.Lock()
+	for id, old := range a.sessions {
+		if now.After(old.ExpiresAt) {
+			delete(a.sessions, id)
+		}
+	}
+	a.sessions[s.ID] = s
+	a.sessionsMu.Unlock()
+
+	maxAge := 0
+	if remember {
+		maxAge = int(a.sessionTTL() / time.Second)
+	}
+	a.setSessionCookie(c, a.signSession(s.ID), maxAge)
+	a.setCSRFCookie(c, s.CSRFToken, maxAge)
+	return nil
+}
+
+// setSessionCookie sets the session cookie, HttpOnly and SameSite=Strict,
+// and Secure when the admin interface is reached over HTTPS.
+func (a *AdminAPI) setSessionCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// InvalidateSessions ends every Web UI session, e.g. after the admin
+// credentials change.
+func (a *AdminAPI) InvalidateSessions() int {
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	n := len(a.sessions)
+	a.sessions = make(map[string]*session)
+	return n
+}
+
+// endUserSessions ends the sessions of username except keep, e.g. after
+// the user's password changed.
+func (a *AdminAPI) endUserSessions(username string, keep *session) int {
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	n := 0
+	for id, s := range a.sessions {
+		if s.Username == username && (keep == nil || s.ID != keep.ID) {
+			delete(a.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Logout ends the request's session and clears its cookie.
+func (a *AdminAPI) Logout(c *gin.Context) {
+	if s := a.sessionFromCookie(c.Request); s != nil {
+		a.sessionsMu.Lock()
+		delete(a.sessions, s.ID)
+		a.sessionsMu.Unlock()
+	}
+	a.setSessionCookie(c, "", -1)
+	a.setCSRFCookie(c, "", -1)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (a *AdminAPI) listSessions(c *gin.Context) {
+	current := a.sessionFromCookie(c.Request)
+	now := time.Now()
+
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	sessions := make([]gin.H, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		if now.After(s.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, gin.H{
+			"username":   s.Username,
+			"role":       s.Role,
+			"remote_ip":  s.RemoteIP,
+			"user_agent": s.UserAgent,
+			"created_at": s.CreatedAt,
+			"last_seen":  s.LastSeen,
+			"expires_at": s.ExpiresAt,
+			"current":    current != nil && s.ID == current.ID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "count": len(sessions)})
+}
+
+func (a *AdminAPI) invalidateSessions(c *gin.Context) {
+	n := a.InvalidateSessions()
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions invalidated successfully", "count": n})
+}
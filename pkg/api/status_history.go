@@ -0,0 +1,85 @@
+package api
+
+import (
+	"runtime"
+	"time"
+
+	"saddy/pkg/metrics"
+)
+
+const (
+	loadSampleInterval = time.Minute
+	loadHistorySize    = 60 // The last hour
+)
+
+// loadSample is the load of the process during one sampling interval, for
+// the trends of the system status.
+type loadSample struct {
+	Time              time.Time `json:"time"` // End of the interval
+	Requests          int64     `json:"requests"`
+	RequestsPerSecond float64   `json:"requests_per_second"`
+	BytesPerSecond    float64   `json:"bytes_per_second"`
+	ErrorRate         float64   `json:"error_rate"` // Share of 5xx responses
+	LatencyP95        float64   `json:"latency_p95_ms"`
+	Goroutines        int       `json:"goroutines"`
+	HeapAlloc         uint64    `json:"heap_alloc"`
+}
+
+// RecordLoad starts a background process that samples the load every
+// loadSampleInterval and keeps the last loadHistorySize samples for the
+// system status. The history is kept in memory, so it starts over when
+// Saddy restarts.
+func (a *AdminAPI) RecordLoad() {
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.recordLoadSample(a.sampleLoad(now))
+	}
+}
+
+func (a *AdminAPI) sampleLoad(now time.Time) loadSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sample := loadSample{
+		Time:       now.UTC().Truncate(time.Second),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+	}
+	if a.traffic != nil {
+		_, total := a.traffic.Summary(loadSampleInterval)
+		sample.Requests = total.Requests
+		sample.RequestsPerSecond = total.RequestsPerSecond
+		sample.BytesPerSecond = total.BytesPerSecond
+		sample.ErrorRate = total.ErrorRate
+		sample.LatencyP95 = total.Latency.P95
+	}
+	return sample
+}
+
+func (a *AdminAPI) recordLoadSample(sample loadSample) {
+	a.loadMu.Lock()
+	defer a.loadMu.Unlock()
+	if len(a.load) == loadHistorySize {
+		copy(a.load, a.load[1:])
+		a.load = a.load[:loadHistorySize-1]
+	}
+	a.load = append(a.load, sample)
+}
+
+// loadHistory returns a copy of the load samples, oldest first.
+func (a *AdminAPI) loadHistory() []loadSample {
+	a.loadMu.Lock()
+	defer a.loadMu.Unlock()
+	return append([]loadSample{}, a.load...)
+}
+
+// requestTotals sums the traffic of every domain since startup.
+func requestTotals(traffic *metrics.Recorder) map[string]int64 {
+	var requests, bytes, errors int64
+	for _, totals := range traffic.Totals() {
+		requests += totals.Requests
+		bytes += totals.Bytes
+		errors += totals.Status[5]
+	}
+	return map[string]int64{"requests": requests, "bytes": bytes, "errors": errors}
+}
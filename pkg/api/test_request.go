@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"saddy/pkg/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTestBodySize is the most of a response body a rule test keeps.
+const maxTestBodySize = 1 << 20
+
+// testProxyRule sends a synthetic request for a proxy rule through the
+// routing and caching pipeline and answers which rule matched, its
+// upstream, the cache key and outcome, the timing and the response. The
+// body is optional; max_body limits the response body returned like for
+// cache entries, up to maxTestBodySize.
+func (a *AdminAPI) testProxyRule(c *gin.Context) {
+	if a.proxy == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Proxy not available")
+		return
+	}
+
+	domain := c.Param("domain")
+	if a.config.GetProxyRule(domain) == nil && a.config.GetProxyRule(proxy.TestHost(domain)) == nil {
+		RespondError(c, http.StatusNotFound, "Proxy rule not found: "+domain)
+		return
+	}
+
+	maxBody, err := strconv.Atoi(c.DefaultQuery("max_body", strconv.Itoa(defaultInspectBodySize)))
+	if err != nil || maxBody < 0 {
+		RespondError(c, http.StatusBadRequest, "Invalid max_body: "+c.Query("max_body"))
+		return
+	}
+
+	var request proxy.TestRequest
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		respondBodyError(c, err)
+		return
+	}
+	if request.Host == "" {
+		request.Host = proxy.TestHost(domain)
+	}
+	request.MaxBody = maxTestBodySize
+	if maxBody > 0 {
+		request.MaxBody = min(maxBody, maxTestBodySize)
+	}
+
+	result, err := a.proxy.Test(request)
+	if err != nil {
+		RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	response := gin.H{
+		"host":        result.Host,
+		"rule":        result.Rule,
+		"upstream":    result.Upstream,
+		"cache_key":   result.CacheKey,
+		"cache":       result.Cache,
+		"status":      result.Status,
+		"headers":     result.Headers,
+		"duration_ms": float64(result.Duration.Microseconds()) / 1000,
+		"body_size":   result.BodySize,
+	}
+	addBody(response, result.Body, maxBody)
+	if result.BodySize > len(result.Body) {
+		response["body_truncated"] = true
+	}
+	c.JSON(http.StatusOK, response)
+}
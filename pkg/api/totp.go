@@ -0,0 +1,256 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // TOTP (RFC 6238) uses HMAC-SHA1 by default
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	totpPeriod  = 30 // Seconds per code
+	totpDigits  = 6
+	totpSkew    = 1 // Codes of adjacent periods accepted for clock drift
+	totpIssuer  = "Saddy"
+	authUserKey = "saddy.user"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code of secret for the period counter.
+func totpCode(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter) //nolint:errcheck
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validTOTP returns the period of code if it is valid for the base32
+// secret at now.
+func validTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkTOTP verifies a user's code and rejects codes that were already
+// used, so that an observed code can't be replayed.
+func (a *AdminAPI) checkTOTP(username, secret, code string) bool {
+	step, ok := validTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false
+	}
+
+	a.totpMu.Lock()
+	defer a.totpMu.Unlock()
+	if step <= a.totpUsed[username] {
+		return false
+	}
+	a.totpUsed[username] = step
+	return true
+}
+
+// setTOTPSecret stores the TOTP secret of a user, empty to disable TOTP,
+// and saves the configuration.
+func (a *AdminAPI) setTOTPSecret(username, secret string) error {
+	return a.updateCredentials(username, func(_, totpSecret *string) {
+		*totpSecret = secret
+	})
+}
+
+// updateCredentials changes the stored password and TOTP secret of a user
+// through update and saves the configuration. If saving fails, the change
+// is undone.
+func (a *AdminAPI) updateCredentials(username string, update func(password, totpSecret *string)) error {
+	a.tokensMu.Lock()
+	defer a.tokensMu.Unlock()
+
+	// Change a copy, as requests may be reading the users
+	previous := a.config.Snapshot().WebUI
+	webUI := previous
+	webUI.Users = slices.Clone(previous.Users)
+	var password, totpSecret *string
+	if webUI.Username != "" && webUI.Username == username {
+		password, totpSecret = &webUI.Password, &webUI.TOTPSecret
+	} else {
+		for i := range webUI.Users {
+			if webUI.Users[i].Username == username {
+				password, totpSecret = &webUI.Users[i].Password, &webUI.Users[i].TOTPSecret
+				break
+			}
+		}
+	}
+	if password == nil {
+		return fmt.Errorf("user not found: %s", username)
+	}
+
+	update(password, totpSecret)
+	a.config.Update(func(cfg *config.Config) { cfg.WebUI = webUI })
+	if err := a.config.Save(); err != nil {
+		a.config.Update(func(cfg *config.Config) { cfg.WebUI = previous })
+		return err
+	}
+	return nil
+}
+
+// currentUser returns the user of a session or Basic Auth request; API
+// tokens don't belong to a user.
+func (a *AdminAPI) currentUser(c *gin.Context) *config.AdminUser {
+	return a.findUser(c.GetString(authUserKey))
+}
+
+// totpCodeRequest is the body of confirmTOTP and disableTOTP.
+type totpCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func (a *AdminAPI) getTOTPStatus(c *gin.Context) {
+	user := a.currentUser(c)
+	if user == nil {
+		RespondError(c, http.StatusForbidden, "Two-factor authentication requires a user login")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": user.Username, "enabled": user.TOTPSecret != ""})
+}
+
+// enrollTOTP generates a secret for the current user. It only takes effect
+// once a code from the authenticator app is confirmed.
+func (a *AdminAPI) enrollTOTP(c *gin.Context) {
+	user := a.currentUser(c)
+	if user == nil {
+		RespondError(c, http.StatusForbidden, "Two-factor authentication requires a user login")
+		return
+	}
+	if user.TOTPSecret != "" {
+		RespondError(c, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	a.totpMu.Lock()
+	a.totpPending[user.Username] = secret
+	a.totpMu.Unlock()
+
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + user.Username,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":  secret,
+		"uri":     uri.String(),
+		"message": "Add the secret to an authenticator app and confirm with a code",
+	})
+}
+
+func (a *AdminAPI) confirmTOTP(c *gin.Context) {
+	var request totpCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+	user := a.currentUser(c)
+	if user == nil {
+		RespondError(c, http.StatusForbidden, "Two-factor authentication requires a user login")
+		return
+	}
+
+	a.totpMu.Lock()
+	secret, ok := a.totpPending[user.Username]
+	a.totpMu.Unlock()
+	if !ok {
+		RespondError(c, http.StatusConflict, "No two-factor enrollment in progress")
+		return
+	}
+	if !a.checkTOTP(user.Username, secret, request.Code) {
+		RespondError(c, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+
+	if err := a.setTOTPSecret(user.Username, secret); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.totpMu.Lock()
+	delete(a.totpPending, user.Username)
+	a.totpMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled successfully"})
+}
+
+// disableTOTP turns TOTP off for the current user, which requires a current
+// code, or for ?username= when called by an admin, e.g. after a lost phone.
+func (a *AdminAPI) disableTOTP(c *gin.Context) {
+	if username := c.Query("username"); username != "" {
+		if !slices.Contains(c.GetStringSlice(authScopesKey), ScopeAdmin) {
+			RespondError(c, http.StatusForbidden, "Permission denied: requires the admin scope")
+			return
+		}
+		if err := a.setTOTPSecret(username, ""); err != nil {
+			RespondError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled for " + username})
+		return
+	}
+
+	var request totpCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBodyError(c, err)
+		return
+	}
+	user := a.currentUser(c)
+	if user == nil {
+		RespondError(c, http.StatusForbidden, "Two-factor authentication requires a user login")
+		return
+	}
+	if user.TOTPSecret == "" {
+		RespondError(c, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+	if !a.checkTOTP(user.Username, user.TOTPSecret, request.Code) {
+		RespondError(c, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+
+	if err := a.setTOTPSecret(user.Username, ""); err != nil {
+		RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled successfully"})
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"saddy/pkg/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetTraffic enables the live traffic endpoints.
+func (a *AdminAPI) SetTraffic(traffic *metrics.Recorder) {
+	a.traffic = traffic
+}
+
+// secondsQuery parses the query parameter name as a number of seconds
+// between 1 and max seconds.
+func secondsQuery(c *gin.Context, name string, fallback, max time.Duration) (time.Duration, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, true
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > max {
+		RespondError(c, http.StatusBadRequest, "Invalid "+name+": must be between 1 and "+strconv.Itoa(int(max/time.Second))+" seconds")
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// getTraffic returns request rates, status codes, latency percentiles and
+// bandwidth per domain during the last ?window= seconds.
+func (a *AdminAPI) getTraffic(c *gin.Context) {
+	if a.traffic == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Traffic metrics not available")
+		return
+	}
+	window, ok := secondsQuery(c, "window", time.Minute, metrics.MaxWindow)
+	if !ok {
+		return
+	}
+
+	domains, total := a.traffic.Summary(window)
+	if domain := c.Query("domain"); domain != "" {
+		traffic, exists := domains[domain]
+		if !exists {
+			RespondError(c, http.StatusNotFound, "No traffic for domain: "+domain)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"window": int(window / time.Second), "domain": domain, "traffic": traffic})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"window": int(window / time.Second), "domains": domains, "total": total})
+}
+
+// getTrafficSeries returns the traffic of ?domain=, or of all domains, in
+// steps of ?step= seconds for graphs.
+func (a *AdminAPI) getTrafficSeries(c *gin.Context) {
+	if a.traffic == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Traffic metrics not available")
+		return
+	}
+	window, ok := secondsQuery(c, "window", 5*time.Minute, metrics.MaxWindow)
+	if !ok {
+		return
+	}
+	step, ok := secondsQuery(c, "step", 5*time.Second, window)
+	if !ok {
+		return
+	}
+
+	domain := c.Query("domain")
+	c.JSON(http.StatusOK, gin.H{
+		"domain": domain,
+		"window": int(window / time.Second),
+		"step":   int(step / time.Second),
+		"points": a.traffic.Series(domain, window, step),
+	})
+}
+
+func (a *AdminAPI) resetTraffic(c *gin.Context) {
+	if a.traffic == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Traffic metrics not available")
+		return
+	}
+	a.traffic.Reset()
+	c.JSON(http.StatusOK, gin.H{"message": "Traffic metrics reset successfully"})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"saddy/pkg/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetProxy enables the endpoints that report on the reverse proxy's
+// backends.
+func (a *AdminAPI) SetProxy(rp *proxy.ReverseProxy) {
+	a.proxy = rp
+}
+
+// getUpstreams returns the health and circuit state of every rule's target.
+func (a *AdminAPI) getUpstreams(c *gin.Context) {
+	if a.proxy == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Upstream status not available")
+		return
+	}
+
+	upstreams := a.proxy.Upstreams()
+	if upstreams == nil {
+		upstreams = []proxy.UpstreamStatus{}
+	}
+	healthy := 0
+	for _, upstream := range upstreams {
+		if upstream.Status == proxy.UpstreamHealthy {
+			healthy++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"upstreams": upstreams, "count": len(upstreams), "healthy": healthy})
+}
+
+func (a *AdminAPI) getUpstream(c *gin.Context) {
+	if a.proxy == nil {
+		RespondError(c, http.StatusServiceUnavailable, "Upstream status not available")
+		return
+	}
+
+	domain := c.Param("domain")
+	for _, upstream := range a.proxy.Upstreams() {
+		if upstream.Domain == domain {
+			c.JSON(http.StatusOK, upstream)
+			return
+		}
+	}
+	RespondError(c, http.StatusNotFound, "Proxy rule not found: "+domain)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxConfigSize bounds configuration documents submitted to the API.
+const maxConfigSize = 10 << 20
+
+// readConfigDocument reads a configuration document from the request body,
+// YAML if its content type says so and JSON otherwise.
+func readConfigDocument(c *gin.Context) ([]byte, string, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxConfigSize))
+	if err != nil {
+		return nil, "", err
+	}
+	format := "json"
+	if strings.Contains(c.ContentType(), "yaml") {
+		format = "yaml"
+	}
+	return data, format, nil
+}
+
+// validateConfig checks a submitted configuration without applying it. It
+// answers 200 if the configuration is valid and 422 with every problem found
+// otherwise.
+func (a *AdminAPI) validateConfig(c *gin.Context) {
+	data, format, err := readConfigDocument(c)
+	if err != nil {
+		respondBodyError(c, err)
+		return
+	}
+
+	_, errs := config.CheckConfig(data, format)
+	if len(errs) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"valid": false, "format": format, "errors": errs})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": true, "format": format, "errors": []config.ValidationError{}})
+}
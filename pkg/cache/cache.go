@@ -2,6 +2,9 @@ package cache
 
 import (
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -9,22 +12,55 @@ import (
 type Storage interface {
 	Set(key string, value []byte, ttl time.Duration)
 	SetWithHeaders(key string, value []byte, headers map[string]string, statusCode int, ttl time.Duration)
+	SetEntry(item *CacheItem)
 	Get(key string) []byte
 	GetItem(key string) *CacheItem
+	GetStale(key string) *CacheItem
+	Entries(pattern string) []*CacheItem
+	SetExpiry(key string, expiresAt time.Time) bool
 	Delete(key string)
+	Purge(pattern string, mode PurgeMode) int
+	PurgeTag(tag string, mode PurgeMode) int
+	SetDomainQuota(domain string, maxSize int64)
 	Clear()
 	Stats() map[string]interface{}
 	Stop()
 }
 
+// sortEntries orders entries by key so listings are stable between calls.
+func sortEntries(entries []*CacheItem) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+}
+
+// PurgeMode selects how purged entries are invalidated.
+type PurgeMode int
+
+const (
+	// PurgeHard deletes matching entries.
+	PurgeHard PurgeMode = iota
+	// PurgeSoft marks matching entries stale: the next request revalidates
+	// them with the backend, but they can still be served if it fails.
+	PurgeSoft
+)
+
+// SoftPurgeStaleTTL is how long soft-purged entries remain servable as stale.
+const SoftPurgeStaleTTL = 24 * time.Hour
+
 // FactoryConfig represents cache factory configuration.
 type FactoryConfig struct {
-	StorageType     string
-	CacheDir        string
-	MaxSize         string
-	DefaultTTL      int
-	CleanupInterval int
-	Persistent      bool // If true, cache never expires
+	StorageType        string
+	CacheDir           string
+	MaxSize            string
+	DefaultTTL         int
+	CleanupInterval    int
+	Persistent         bool    // If true, cache never expires
+	Compression        string  // On-disk compression for the file cache
+	IndexFlushInterval int     // Seconds between file cache index writes
+	DiskHighWatermark  float64 // Filesystem usage percentage that triggers eviction
+	DiskLowWatermark   float64 // Filesystem usage percentage eviction stops at
+	SnapshotFile       string  // Memory cache snapshot restored at start and written on Stop
 }
 
 // NewCacheStorage creates a new cache storage based on configuration.
@@ -32,11 +68,61 @@ func NewCacheStorage(config FactoryConfig) (Storage, error) {
 	switch config.StorageType {
 	case "file", "persistent":
 		// File-based persistent cache
-		return NewFileCache(config.CacheDir, config.MaxSize, config.DefaultTTL, config.Persistent)
+		return NewFileCache(config.CacheDir, config.MaxSize, config.DefaultTTL, config.Persistent, FileCacheOptions{
+			Compression:        config.Compression,
+			IndexFlushInterval: time.Duration(config.IndexFlushInterval) * time.Second,
+			DiskHighWatermark:  config.DiskHighWatermark,
+			DiskLowWatermark:   config.DiskLowWatermark,
+		})
 	case "memory", "":
 		// Memory-based cache (default)
-		return NewCache(config.MaxSize, config.DefaultTTL, config.CleanupInterval), nil
+		cache := NewCache(config.MaxSize, config.DefaultTTL, config.CleanupInterval)
+		if config.SnapshotFile != "" {
+			if err := cache.EnableSnapshots(config.SnapshotFile); err != nil {
+				// A bad snapshot only costs a cold start
+				log.Printf("Starting with an empty cache: %v", err)
+			}
+		}
+		return cache, nil
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", config.StorageType)
 	}
 }
+
+// URLKeyPattern converts a URL pattern such as "example.com/static/*" into a
+// pattern over cache keys, which have the form "domain:METHOD:path?query".
+// A bare domain matches every entry of that domain.
+func URLKeyPattern(urlPattern string) string {
+	urlPattern = strings.TrimPrefix(urlPattern, "https://")
+	urlPattern = strings.TrimPrefix(urlPattern, "http://")
+
+	domain, path, hasPath := strings.Cut(urlPattern, "/")
+	if !hasPath {
+		return domain + ":*"
+	}
+	return domain + ":*:/" + path
+}
+
+// MatchPattern reports whether key matches pattern, where "*" matches any
+// sequence of characters and everything else matches literally.
+func MatchPattern(pattern, key string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == key
+	}
+
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, part)
+		if i < 0 {
+			return false
+		}
+		key = key[i+len(part):]
+	}
+	return strings.HasSuffix(key, last)
+}
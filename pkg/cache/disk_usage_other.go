@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package cache
+
+import "errors"
+
+// diskUsage is not implemented on this platform, disk watermarks are ignored
+func diskUsage(string) (total, available uint64, err error) {
+	return 0, 0, errors.New("disk usage not supported on this platform")
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package cache
+
+import "syscall"
+
+// diskUsage returns the total and available bytes of the filesystem holding path
+func diskUsage(path string) (total, available uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	// Field types differ between platforms, and Bavail may be negative on BSDs
+	blockSize := uint64(stat.Bsize) //nolint:unconvert
+	if int64(stat.Bavail) > 0 {     //nolint:unconvert
+		available = uint64(stat.Bavail) * blockSize //nolint:unconvert
+	}
+	return uint64(stat.Blocks) * blockSize, available, nil //nolint:unconvert
+}
@@ -1,12 +1,19 @@
 package cache
 
 import (
-	"encoding/json"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 // FileCacheItem represents a persistent cache item
@@ -16,10 +23,46 @@ type FileCacheItem struct {
 	StatusCode int               `json:"status_code"`
 	CreatedAt  time.Time         `json:"created_at"`
 	ExpiresAt  time.Time         `json:"expires_at"` // For compatibility, but will use zero value for never expire
+	StaleUntil time.Time         `json:"stale_until,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Hits       int64             `json:"hits"`
 	Size       int               `json:"size"`
-	DataFile   string            `json:"data_file"` // Path to the data file
+	DataFile   string            `json:"data_file"`             // Path to the data file, relative to the data directory
+	Encoding   string            `json:"encoding,omitempty"`    // Compression of the data file, empty if stored raw
+	StoredSize int               `json:"stored_size,omitempty"` // Size of the data file when compressed
+	Checksum   string            `json:"checksum,omitempty"`    // CRC-32C of the data file, empty for entries written before checksums
+}
+
+// FileCacheOptions holds optional file cache settings
+type FileCacheOptions struct {
+	// Compression compresses data files on disk: "gzip", or empty/"none" to store them raw
+	Compression string
+	// IndexFlushInterval is how often pending index changes are written to disk
+	IndexFlushInterval time.Duration
+	// DiskHighWatermark is the filesystem usage percentage that triggers
+	// eviction, regardless of what else writes to the partition. 0 disables it
+	DiskHighWatermark float64
+	// DiskLowWatermark is the usage percentage eviction brings the filesystem
+	// back down to, defaults to 10 points below the high watermark
+	DiskLowWatermark float64
 }
 
+// defaultIndexFlushInterval batches index writes when no interval is configured
+const defaultIndexFlushInterval = 5 * time.Second
+
+// hitsFlushInterval is how often hit counts are written to the index. They
+// change on every lookup, so they are batched longer than other changes
+const hitsFlushInterval = time.Minute
+
+// diskCheckInterval is how often filesystem usage is compared to the watermarks
+const diskCheckInterval = 10 * time.Second
+
+// minCompressSize is the smallest body worth compressing
+const minCompressSize = 1024
+
+// checksumTable computes the CRC-32C checksums stored with each data file
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 // FileCache implements persistent file-based caching
 type FileCache struct {
 	cacheDir    string
@@ -27,17 +70,57 @@ type FileCache struct {
 	mutex       sync.RWMutex
 	maxSize     int64
 	currentSize int64
+	quotas      domainQuotas
 	ttl         time.Duration
 	persistent  bool // If true, cache never expires
+	compression string
+
+	// Metadata lives in an embedded bbolt database. It is written behind:
+	// mutations record the changed keys and a background loop commits them
+	// in one transaction, so bursts of writes cost a single commit
+	db            *bolt.DB
+	pending       map[string]struct{} // Hash keys changed since the last flush
+	hits          map[string]struct{} // Hash keys hit since their counts were last written
+	cleared       bool                // Drop every stored entry on the next flush
+	flushMutex    sync.Mutex          // Serializes index commits
+	flushInterval time.Duration
+	stopChan      chan bool
+	stopOnce      sync.Once
+
+	highWatermark float64
+	lowWatermark  float64
+
+	corrupted int64 // Entries dropped because their data file failed verification
 }
 
 // NewFileCache creates a new persistent file cache
-func NewFileCache(cacheDir string, maxSize string, defaultTTL int, persistent bool) (*FileCache, error) {
-	sizeBytes, err := parseSize(maxSize)
+func NewFileCache(cacheDir string, maxSize string, defaultTTL int, persistent bool, opts FileCacheOptions) (*FileCache, error) {
+	sizeBytes, err := ParseSize(maxSize)
 	if err != nil {
 		sizeBytes = 500 * 1024 * 1024 // Default 500MB
 	}
 
+	if opts.DiskHighWatermark < 0 || opts.DiskHighWatermark > 100 {
+		return nil, fmt.Errorf("invalid disk high watermark: %v", opts.DiskHighWatermark)
+	}
+	if opts.DiskHighWatermark > 0 {
+		if opts.DiskLowWatermark <= 0 {
+			opts.DiskLowWatermark = max(opts.DiskHighWatermark-10, 0)
+		}
+		if opts.DiskLowWatermark >= opts.DiskHighWatermark {
+			return nil, fmt.Errorf("disk low watermark %v must be below high watermark %v",
+				opts.DiskLowWatermark, opts.DiskHighWatermark)
+		}
+	}
+
+	switch opts.Compression {
+	case "", "none":
+		opts.Compression = ""
+	case "gzip":
+	default:
+		return nil, fmt.Errorf("unsupported cache compression: %s", opts.Compression)
+	}
+
 	// Create cache directory if it doesn't exist
 	if err := os.MkdirAll(cacheDir, 0750); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %v", err)
@@ -54,69 +137,82 @@ func NewFileCache(cacheDir string, maxSize string, defaultTTL int, persistent bo
 		items:       make(map[string]*FileCacheItem),
 		maxSize:     sizeBytes,
 		currentSize: 0,
+		quotas:      newDomainQuotas(),
 		ttl:         time.Duration(defaultTTL) * time.Second,
 		persistent:  persistent,
+		compression: opts.Compression,
+
+		pending:       make(map[string]struct{}),
+		hits:          make(map[string]struct{}),
+		flushInterval: opts.IndexFlushInterval,
+		stopChan:      make(chan bool),
+		highWatermark: opts.DiskHighWatermark,
+		lowWatermark:  opts.DiskLowWatermark,
+	}
+	if cache.flushInterval <= 0 {
+		cache.flushInterval = defaultIndexFlushInterval
+	}
+
+	if err := cache.openIndex(); err != nil {
+		return nil, fmt.Errorf("failed to open cache index: %v", err)
 	}
 
 	// Load existing cache from disk
 	if err := cache.loadFromDisk(); err != nil {
+		_ = cache.db.Close() //nolint:errcheck
 		return nil, fmt.Errorf("failed to load cache: %v", err)
 	}
 
+	go cache.startFlusher()
+	if cache.highWatermark > 0 {
+		go cache.startDiskMonitor()
+	}
+
 	return cache, nil
 }
 
-// loadFromDisk loads cache metadata from disk
-func (fc *FileCache) loadFromDisk() error {
-	indexFile := filepath.Join(fc.cacheDir, "index.json")
+// shardedDataFile returns the data file path for a hash key, spread over two
+// levels of prefix directories (data/ab/cd/abcd....bin) to keep directories small
+func shardedDataFile(hashKey string) string {
+	return filepath.Join(hashKey[0:2], hashKey[2:4], hashKey+".bin")
+}
 
-	// If index file doesn't exist, start with empty cache
-	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
-		return nil
-	}
+// dataPath returns the absolute path of a data file
+func (fc *FileCache) dataPath(dataFile string) string {
+	return filepath.Join(fc.cacheDir, "data", dataFile)
+}
 
-	data, err := os.ReadFile(indexFile)
-	if err != nil {
+// moveDataFile renames a data file, creating its shard directory
+func (fc *FileCache) moveDataFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(fc.dataPath(to)), 0750); err != nil {
 		return err
 	}
+	return os.Rename(fc.dataPath(from), fc.dataPath(to))
+}
 
-	var items map[string]*FileCacheItem
-	if err := json.Unmarshal(data, &items); err != nil {
-		return err
+// removeOrphans deletes data files the index doesn't know about, which are
+// left behind when the process stops before a pending index flush
+func (fc *FileCache) removeOrphans() {
+	known := make(map[string]bool, len(fc.items))
+	for _, item := range fc.items {
+		known[item.DataFile] = true
 	}
 
-	now := time.Now()
-	for key, item := range items {
-		// Check if data file exists
-		dataFile := filepath.Join(fc.cacheDir, "data", item.DataFile)
-		if _, err := os.Stat(dataFile); os.IsNotExist(err) {
-			continue // Skip items with missing data files
+	dataDir := filepath.Join(fc.cacheDir, "data")
+	removed := 0
+	_ = filepath.WalkDir(dataDir, func(path string, d os.DirEntry, err error) error { //nolint:errcheck
+		if err != nil || d.IsDir() {
+			return nil
 		}
-
-		// If not persistent mode, check expiration
-		if !fc.persistent && !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt) {
-			// Remove expired item
-			_ = os.Remove(dataFile) //nolint:errcheck
-			continue
+		if rel, err := filepath.Rel(dataDir, path); err == nil && !known[rel] {
+			_ = os.Remove(path) //nolint:errcheck
+			removed++
 		}
-
-		fc.items[key] = item
-		fc.currentSize += int64(item.Size)
-	}
-
-	return nil
-}
-
-// saveIndex saves cache metadata to disk
-func (fc *FileCache) saveIndex() error {
-	indexFile := filepath.Join(fc.cacheDir, "index.json")
-
-	data, err := json.MarshalIndent(fc.items, "", "  ")
-	if err != nil {
-		return err
+		return nil
+	})
+	if removed > 0 {
+		log.Printf("Removed %d orphaned cache data files", removed)
 	}
-
-	return os.WriteFile(indexFile, data, 0600)
 }
 
 // generateKey generates a hash key for the cache
@@ -126,61 +222,131 @@ func (fc *FileCache) generateKey(key string) string {
 
 // SetWithHeaders stores data with headers in persistent cache
 func (fc *FileCache) SetWithHeaders(key string, value []byte, headers map[string]string, statusCode int, ttl time.Duration) {
+	var expiresAt time.Time
+	if !fc.persistent {
+		if ttl == 0 {
+			ttl = fc.ttl
+		}
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	fc.SetEntry(&CacheItem{
+		Key:        key,
+		Value:      value,
+		Headers:    headers,
+		StatusCode: statusCode,
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// SetEntry stores a fully described item in persistent cache
+func (fc *FileCache) SetEntry(entry *CacheItem) {
 	fc.mutex.Lock()
 	defer fc.mutex.Unlock()
 
+	key := entry.Key
+	value := entry.Value
 	hashKey := fc.generateKey(key)
 
 	// Remove existing item if it exists
 	if item, exists := fc.items[hashKey]; exists {
-		fc.currentSize -= int64(item.Size)
-		// Remove old data file
-		oldDataFile := filepath.Join(fc.cacheDir, "data", item.DataFile)
-		_ = os.Remove(oldDataFile) //nolint:errcheck
-		delete(fc.items, hashKey)
+		fc.removeItem(hashKey, item)
+	}
+
+	// Compress the body unless the backend already encoded it
+	stored, encoding := value, ""
+	if fc.compression != "" && len(value) >= minCompressSize && entry.Headers["Content-Encoding"] == "" {
+		if compressed, err := compressData(value); err == nil && len(compressed) < len(value) {
+			stored, encoding = compressed, fc.compression
+		}
+	}
+
+	// Make room within the domain's quota first, so one domain can't push
+	// out everyone else's entries
+	size := int64(len(stored))
+	if fc.quotas.tooLarge(key, size) {
+		return
+	}
+	for fc.quotas.exceeds(key, size) {
+		if !fc.evictOldest(keyDomain(key)) {
+			break
+		}
 	}
 
 	// Check if we need to evict items
-	for fc.currentSize+int64(len(value)) > fc.maxSize && len(fc.items) > 0 {
-		fc.evictOldest()
+	for fc.currentSize+size > fc.maxSize && len(fc.items) > 0 {
+		fc.evictOldest("")
 	}
 
 	// Write data to file
-	dataFileName := fmt.Sprintf("%s.bin", hashKey)
-	dataFilePath := filepath.Join(fc.cacheDir, "data", dataFileName)
+	dataFileName := shardedDataFile(hashKey)
+	dataFilePath := fc.dataPath(dataFileName)
+	if err := os.MkdirAll(filepath.Dir(dataFilePath), 0750); err != nil {
+		return
+	}
 
-	if err := os.WriteFile(dataFilePath, value, 0600); err != nil {
+	// Write through a temporary file so a crash never leaves a partial body
+	// under the final name
+	tmpPath := dataFilePath + ".tmp"
+	if err := os.WriteFile(tmpPath, stored, 0600); err != nil {
 		// Failed to write, skip this cache item
+		_ = os.Remove(tmpPath) //nolint:errcheck
+		return
+	}
+	if err := os.Rename(tmpPath, dataFilePath); err != nil {
+		_ = os.Remove(tmpPath) //nolint:errcheck
 		return
 	}
 
 	// Create cache item
-	var expiresAt time.Time
-	if fc.persistent {
-		// Use zero value to indicate never expires
-		expiresAt = time.Time{}
-	} else {
-		if ttl == 0 {
-			ttl = fc.ttl
+	var expiresAt, staleUntil time.Time
+	if !fc.persistent {
+		// Persistent mode keeps the zero value to indicate never expires
+		expiresAt = entry.ExpiresAt
+		if expiresAt.IsZero() {
+			expiresAt = time.Now().Add(fc.ttl)
 		}
-		expiresAt = time.Now().Add(ttl)
+		staleUntil = entry.StaleUntil
 	}
 
 	item := &FileCacheItem{
 		Key:        key,
-		Headers:    headers,
-		StatusCode: statusCode,
+		Headers:    entry.Headers,
+		StatusCode: entry.StatusCode,
 		CreatedAt:  time.Now(),
 		ExpiresAt:  expiresAt,
+		StaleUntil: staleUntil,
+		Tags:       entry.Tags,
 		Size:       len(value),
 		DataFile:   dataFileName,
+		Encoding:   encoding,
+		Checksum:   checksum(stored),
+	}
+	if encoding != "" {
+		item.StoredSize = len(stored)
 	}
 
 	fc.items[hashKey] = item
-	fc.currentSize += int64(len(value))
+	fc.currentSize += size
+	fc.quotas.add(key, size)
+	fc.markDirty(hashKey)
+}
+
+// removeItem deletes an item and its data file, the caller must hold the write lock
+func (fc *FileCache) removeItem(hashKey string, item *FileCacheItem) {
+	_ = os.Remove(fc.dataPath(item.DataFile)) //nolint:errcheck
+
+	fc.currentSize -= int64(item.diskSize())
+	fc.quotas.remove(item.Key, int64(item.diskSize()))
+	delete(fc.items, hashKey)
+	fc.markDirty(hashKey)
+}
 
-	// Save index
-	_ = fc.saveIndex() //nolint:errcheck
+// SetDomainQuota caps how many bytes the entries of domain may use on disk, 0 removes the cap
+func (fc *FileCache) SetDomainQuota(domain string, maxSize int64) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.quotas.setLimit(domain, maxSize)
 }
 
 // Set stores data in persistent cache (legacy method)
@@ -190,41 +356,183 @@ func (fc *FileCache) Set(key string, value []byte, ttl time.Duration) {
 
 // GetItem retrieves a cache item with full metadata
 func (fc *FileCache) GetItem(key string) *CacheItem {
+	return fc.getItem(key, false)
+}
+
+// GetStale retrieves a cache item even if expired, as long as it is within its stale window
+func (fc *FileCache) GetStale(key string) *CacheItem {
+	return fc.getItem(key, true)
+}
+
+func (fc *FileCache) getItem(key string, allowStale bool) *CacheItem {
 	fc.mutex.RLock()
 	hashKey := fc.generateKey(key)
 	item, exists := fc.items[hashKey]
+	var snapshot FileCacheItem
+	if exists {
+		// Work on a copy so concurrent purges can't change it underneath us
+		snapshot = *item
+	}
 	fc.mutex.RUnlock()
 
 	if !exists {
 		return nil
 	}
 
-	// Check expiration (only if not persistent mode)
-	if !fc.persistent && !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		// Item expired
-		fc.Delete(key)
-		return nil
+	// Check expiration (persistent items only expire when soft purged)
+	now := time.Now()
+	expired := snapshot.expired(now)
+	if expired {
+		if !snapshot.usable(now) {
+			// Item expired and past its stale window
+			fc.Delete(key)
+			return nil
+		}
+		if !allowStale {
+			return nil
+		}
 	}
 
 	// Read data from file
-	dataFilePath := filepath.Join(fc.cacheDir, "data", item.DataFile)
+	dataFilePath := fc.dataPath(snapshot.DataFile)
 	data, err := os.ReadFile(dataFilePath)
 	if err != nil {
-		// File not found or error, remove from index
+		// File not found or unreadable, remove from index
 		fc.Delete(key)
 		return nil
 	}
+	if err := snapshot.verify(data); err != nil {
+		log.Printf("Dropping corrupt cache entry %s: %v", key, err)
+		fc.discardCorrupt(hashKey, &snapshot)
+		return nil
+	}
+	if snapshot.Encoding != "" {
+		if data, err = decompressData(data); err != nil {
+			log.Printf("Dropping corrupt cache entry %s: %v", key, err)
+			fc.discardCorrupt(hashKey, &snapshot)
+			return nil
+		}
+	}
 
+	// Only regular lookups count as hits, on the entry that was read
+	if !allowStale {
+		fc.mutex.Lock()
+		if fc.items[hashKey] == item {
+			item.Hits++
+			snapshot.Hits = item.Hits
+			fc.hits[hashKey] = struct{}{}
+		}
+		fc.mutex.Unlock()
+	}
+
+	entry := snapshot.toCacheItem()
+	entry.Value = data
+	return entry
+}
+
+// checksum returns the hex encoded CRC-32C of data
+func checksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, checksumTable))
+}
+
+// verify checks a data file's contents against the size and checksum recorded when it was written
+func (item *FileCacheItem) verify(data []byte) error {
+	if len(data) != item.diskSize() {
+		return fmt.Errorf("size mismatch: expected %d bytes, read %d", item.diskSize(), len(data))
+	}
+	if item.Checksum != "" {
+		if sum := checksum(data); sum != item.Checksum {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", item.Checksum, sum)
+		}
+	}
+	return nil
+}
+
+// discardCorrupt removes an entry that failed verification, unless it was replaced in the meantime
+func (fc *FileCache) discardCorrupt(hashKey string, snapshot *FileCacheItem) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if item, exists := fc.items[hashKey]; exists && item.DataFile == snapshot.DataFile && item.CreatedAt.Equal(snapshot.CreatedAt) {
+		fc.removeItem(hashKey, item)
+		fc.corrupted++
+	}
+}
+
+// toCacheItem converts the index metadata to a CacheItem without its value
+func (item *FileCacheItem) toCacheItem() *CacheItem {
 	return &CacheItem{
 		Key:        item.Key,
-		Value:      data,
 		Headers:    item.Headers,
 		StatusCode: item.StatusCode,
+		CreatedAt:  item.CreatedAt,
 		ExpiresAt:  item.ExpiresAt,
+		StaleUntil: item.StaleUntil,
+		Tags:       item.Tags,
+		Hits:       item.Hits,
 		Size:       item.Size,
 	}
 }
 
+// Entries returns the metadata of every usable item whose key matches pattern, sorted by key
+func (fc *FileCache) Entries(pattern string) []*CacheItem {
+	fc.mutex.RLock()
+	defer fc.mutex.RUnlock()
+
+	now := time.Now()
+	entries := make([]*CacheItem, 0)
+	for _, item := range fc.items {
+		if !item.usable(now) || !MatchPattern(pattern, item.Key) {
+			continue
+		}
+		entries = append(entries, item.toCacheItem())
+	}
+
+	sortEntries(entries)
+	return entries
+}
+
+// diskSize returns how many bytes the item's data file takes up
+func (item *FileCacheItem) diskSize() int {
+	if item.Encoding != "" {
+		return item.StoredSize
+	}
+	return item.Size
+}
+
+// compressData gzips a cache body
+func compressData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressData reverses compressData
+func decompressData(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = reader.Close() }() //nolint:errcheck
+	return io.ReadAll(reader)
+}
+
+// expired reports whether the item is past its freshness lifetime
+func (item *FileCacheItem) expired(now time.Time) bool {
+	return !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt)
+}
+
+// usable reports whether the item may still be served, fresh or stale
+func (item *FileCacheItem) usable(now time.Time) bool {
+	return !item.expired(now) || now.Before(item.StaleUntil)
+}
+
 // Get retrieves cached data (legacy method)
 func (fc *FileCache) Get(key string) []byte {
 	item := fc.GetItem(key)
@@ -234,6 +542,21 @@ func (fc *FileCache) Get(key string) []byte {
 	return nil
 }
 
+// SetExpiry changes when an item expires, a zero expiresAt pins it. It reports whether the item exists
+func (fc *FileCache) SetExpiry(key string, expiresAt time.Time) bool {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	hashKey := fc.generateKey(key)
+	item, exists := fc.items[hashKey]
+	if !exists {
+		return false
+	}
+	item.ExpiresAt = expiresAt
+	fc.markDirty(hashKey)
+	return true
+}
+
 // Delete removes an item from cache
 func (fc *FileCache) Delete(key string) {
 	fc.mutex.Lock()
@@ -242,16 +565,56 @@ func (fc *FileCache) Delete(key string) {
 	hashKey := fc.generateKey(key)
 
 	if item, exists := fc.items[hashKey]; exists {
-		// Remove data file
-		dataFilePath := filepath.Join(fc.cacheDir, "data", item.DataFile)
-		_ = os.Remove(dataFilePath) //nolint:errcheck
+		fc.removeItem(hashKey, item)
+	}
+}
+
+// Purge invalidates every item whose key matches pattern and returns how many were affected
+func (fc *FileCache) Purge(pattern string, mode PurgeMode) int {
+	return fc.purgeWhere(func(item *FileCacheItem) bool {
+		return MatchPattern(pattern, item.Key)
+	}, mode)
+}
+
+// PurgeTag invalidates every item carrying the surrogate key and returns how many were affected
+func (fc *FileCache) PurgeTag(tag string, mode PurgeMode) int {
+	return fc.purgeWhere(func(item *FileCacheItem) bool {
+		for _, t := range item.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}, mode)
+}
 
-		fc.currentSize -= int64(item.Size)
-		delete(fc.items, hashKey)
+// purgeWhere invalidates every item matching the predicate
+func (fc *FileCache) purgeWhere(match func(item *FileCacheItem) bool, mode PurgeMode) int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
 
-		// Save index
-		_ = fc.saveIndex() //nolint:errcheck
+	now := time.Now()
+	purged := 0
+	for hashKey, item := range fc.items {
+		if !match(item) {
+			continue
+		}
+		if mode == PurgeSoft {
+			// Expire now but keep the data for stale serving
+			if !item.expired(now) {
+				item.ExpiresAt = now
+			}
+			if staleUntil := now.Add(SoftPurgeStaleTTL); item.StaleUntil.Before(staleUntil) {
+				item.StaleUntil = staleUntil
+			}
+			fc.markDirty(hashKey)
+		} else {
+			fc.removeItem(hashKey, item)
+		}
+		purged++
 	}
+
+	return purged
 }
 
 // Clear removes all items from cache
@@ -259,43 +622,97 @@ func (fc *FileCache) Clear() {
 	fc.mutex.Lock()
 	defer fc.mutex.Unlock()
 
-	// Remove all data files
+	// Remove all data files including shard directories
 	dataDir := filepath.Join(fc.cacheDir, "data")
-	if files, err := os.ReadDir(dataDir); err == nil {
-		for _, file := range files {
-			_ = os.Remove(filepath.Join(dataDir, file.Name())) //nolint:errcheck
-		}
-	}
+	_ = os.RemoveAll(dataDir)      //nolint:errcheck
+	_ = os.MkdirAll(dataDir, 0750) //nolint:errcheck
 
 	fc.items = make(map[string]*FileCacheItem)
 	fc.currentSize = 0
+	fc.quotas.reset()
+	fc.pending = make(map[string]struct{})
+	fc.hits = make(map[string]struct{})
+	fc.cleared = true
+}
 
-	// Save index
-	_ = fc.saveIndex() //nolint:errcheck
+// startDiskMonitor periodically enforces the disk usage watermarks
+func (fc *FileCache) startDiskMonitor() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	fc.enforceDiskWatermark()
+	for {
+		select {
+		case <-ticker.C:
+			fc.enforceDiskWatermark()
+		case <-fc.stopChan:
+			return
+		}
+	}
 }
 
-// evictOldest removes the oldest cache item
-func (fc *FileCache) evictOldest() {
+// enforceDiskWatermark evicts the oldest items once the filesystem holding the
+// cache is above the high watermark, until it is back at the low watermark
+func (fc *FileCache) enforceDiskWatermark() {
+	total, available, err := diskUsage(fc.cacheDir)
+	if err != nil || total == 0 {
+		return
+	}
+
+	used := total - available
+	if float64(used)/float64(total)*100 < fc.highWatermark {
+		return
+	}
+	target := uint64(float64(total) * fc.lowWatermark / 100)
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	// Evict oldest first, like evictOldest, but sort once for the whole batch
+	keys := make([]string, 0, len(fc.items))
+	for key := range fc.items {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fc.items[keys[i]].CreatedAt.Before(fc.items[keys[j]].CreatedAt)
+	})
+
+	evicted := 0
+	for _, key := range keys {
+		if used <= target {
+			break
+		}
+		item := fc.items[key]
+		used -= min(used, uint64(item.diskSize())) //nolint:gosec
+		fc.removeItem(key, item)
+		evicted++
+	}
+	if evicted > 0 {
+		log.Printf("Disk usage of %s above %.0f%%, evicted %d cache items", fc.cacheDir, fc.highWatermark, evicted)
+	}
+}
+
+// evictOldest removes the oldest cache item, limited to domain unless it is
+// empty. It reports whether an item was removed
+func (fc *FileCache) evictOldest(domain string) bool {
 	var oldestKey string
 	var oldestTime time.Time
 
 	for key, item := range fc.items {
+		if domain != "" && keyDomain(item.Key) != domain {
+			continue
+		}
 		if oldestKey == "" || item.CreatedAt.Before(oldestTime) {
 			oldestKey = key
 			oldestTime = item.CreatedAt
 		}
 	}
 
-	if oldestKey != "" {
-		if item, exists := fc.items[oldestKey]; exists {
-			// Remove data file
-			dataFilePath := filepath.Join(fc.cacheDir, "data", item.DataFile)
-			_ = os.Remove(dataFilePath) //nolint:errcheck
-
-			fc.currentSize -= int64(item.Size)
-		}
-		delete(fc.items, oldestKey)
+	if oldestKey == "" {
+		return false
 	}
+	fc.removeItem(oldestKey, fc.items[oldestKey])
+	return true
 }
 
 // Stats returns cache statistics
@@ -303,7 +720,7 @@ func (fc *FileCache) Stats() map[string]interface{} {
 	fc.mutex.RLock()
 	defer fc.mutex.RUnlock()
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"items_count":   len(fc.items),
 		"current_size":  fc.currentSize,
 		"max_size":      fc.maxSize,
@@ -311,12 +728,25 @@ func (fc *FileCache) Stats() map[string]interface{} {
 		"storage_type":  "file",
 		"persistent":    fc.persistent,
 		"cache_dir":     fc.cacheDir,
+		"compression":   fc.compression,
+		"domain_sizes":  fc.quotas.snapshot(),
+		"corrupted":     fc.corrupted,
+	}
+	if total, available, err := diskUsage(fc.cacheDir); err == nil && total > 0 {
+		stats["disk_usage_percent"] = float64(total-available) / float64(total) * 100
 	}
+	return stats
 }
 
-// Stop performs cleanup (for file cache, just ensure index is saved)
+// Stop stops the background flusher, writes any pending index changes and closes the index.
+// Calls after the first do nothing.
 func (fc *FileCache) Stop() {
-	fc.mutex.Lock()
-	defer fc.mutex.Unlock()
-	_ = fc.saveIndex() //nolint:errcheck
+	fc.stopOnce.Do(func() {
+		close(fc.stopChan)
+		fc.scheduleHits()
+		if err := fc.flushIndex(); err != nil {
+			log.Printf("Failed to save cache index: %v", err)
+		}
+		_ = fc.db.Close() //nolint:errcheck
+	})
 }
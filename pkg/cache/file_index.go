@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// itemsBucket holds one JSON encoded FileCacheItem per hash key
+var itemsBucket = []byte("items")
+
+// openIndex opens the metadata database, creating it if needed
+func (fc *FileCache) openIndex() error {
+	db, err := bolt.Open(filepath.Join(fc.cacheDir, "index.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(itemsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close() //nolint:errcheck
+		return err
+	}
+
+	fc.db = db
+	return nil
+}
+
+// loadFromDisk loads cache metadata from the index database
+func (fc *FileCache) loadFromDisk() error {
+	if err := fc.migrateJSONIndex(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err := fc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(itemsBucket).ForEach(func(k, v []byte) error {
+			key := string(k)
+
+			var item FileCacheItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				// Drop undecodable records rather than refusing to start
+				fc.markDirty(key)
+				return nil
+			}
+
+			// Check if data file exists
+			dataFile := fc.dataPath(item.DataFile)
+			if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+				fc.markDirty(key)
+				return nil // Skip items with missing data files
+			}
+
+			// If not persistent mode, check expiration (keeping items still usable as stale)
+			if !fc.persistent && !item.usable(now) {
+				// Remove expired item
+				_ = os.Remove(dataFile) //nolint:errcheck
+				fc.markDirty(key)
+				return nil
+			}
+
+			// Move data files from the old flat layout into shard directories
+			if sharded := shardedDataFile(key); item.DataFile != sharded {
+				if err := fc.moveDataFile(item.DataFile, sharded); err == nil {
+					item.DataFile = sharded
+					fc.markDirty(key)
+				}
+			}
+
+			fc.items[key] = &item
+			fc.currentSize += int64(item.diskSize())
+			fc.quotas.add(item.Key, int64(item.diskSize()))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	fc.removeOrphans()
+	return nil
+}
+
+// migrateJSONIndex imports the index.json written by older versions and removes it
+func (fc *FileCache) migrateJSONIndex() error {
+	indexFile := filepath.Join(fc.cacheDir, "index.json")
+
+	data, err := os.ReadFile(indexFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items map[string]*FileCacheItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		// A damaged index only loses metadata, its data files are removed as orphans
+		log.Printf("Cache index %s is corrupt, discarding it: %v", indexFile, err)
+		items = nil
+	}
+
+	err = fc.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(itemsBucket)
+		for key, item := range items {
+			value, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", indexFile, err)
+	}
+
+	log.Printf("Migrated %d cache entries from %s", len(items), indexFile)
+	return os.Remove(indexFile)
+}
+
+// markDirty schedules the entry for the next index commit, the caller must hold the write lock
+func (fc *FileCache) markDirty(hashKey string) {
+	fc.pending[hashKey] = struct{}{}
+}
+
+// scheduleHits adds the entries whose hit counts changed to the next index commit
+func (fc *FileCache) scheduleHits() {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	for hashKey := range fc.hits {
+		fc.markDirty(hashKey)
+	}
+	fc.hits = make(map[string]struct{})
+}
+
+// startFlusher periodically commits pending index changes
+func (fc *FileCache) startFlusher() {
+	ticker := time.NewTicker(fc.flushInterval)
+	defer ticker.Stop()
+	hitsTicker := time.NewTicker(hitsFlushInterval)
+	defer hitsTicker.Stop()
+
+	for {
+		select {
+		case <-hitsTicker.C:
+			fc.scheduleHits()
+		case <-ticker.C:
+			if err := fc.flushIndex(); err != nil {
+				log.Printf("Failed to save cache index: %v", err)
+			}
+		case <-fc.stopChan:
+			return
+		}
+	}
+}
+
+// flushIndex commits every pending change in a single transaction
+func (fc *FileCache) flushIndex() error {
+	fc.flushMutex.Lock()
+	defer fc.flushMutex.Unlock()
+
+	// Snapshot the changes under the lock, then write without blocking readers
+	fc.mutex.Lock()
+	if len(fc.pending) == 0 && !fc.cleared {
+		fc.mutex.Unlock()
+		return nil
+	}
+	cleared := fc.cleared
+	keys := fc.pending
+	updates := make(map[string][]byte, len(keys))
+	for key := range keys {
+		item, exists := fc.items[key]
+		if !exists {
+			updates[key] = nil
+			continue
+		}
+		value, err := json.Marshal(item)
+		if err != nil {
+			fc.mutex.Unlock()
+			return err
+		}
+		updates[key] = value
+	}
+	fc.pending = make(map[string]struct{})
+	fc.cleared = false
+	fc.mutex.Unlock()
+
+	err := fc.db.Update(func(tx *bolt.Tx) error {
+		if cleared {
+			if err := tx.DeleteBucket(itemsBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(itemsBucket); err != nil {
+				return err
+			}
+		}
+
+		bucket := tx.Bucket(itemsBucket)
+		for key, value := range updates {
+			var err error
+			if value == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Retry on the next tick
+		fc.mutex.Lock()
+		fc.cleared = fc.cleared || cleared
+		for key := range keys {
+			fc.pending[key] = struct{}{}
+		}
+		fc.mutex.Unlock()
+		return err
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 )
@@ -21,24 +22,51 @@ type CacheItem struct {
 	Value      []byte
 	Headers    map[string]string
 	StatusCode int
+	CreatedAt  time.Time
 	ExpiresAt  time.Time
+	StaleUntil time.Time // Expired items are kept until this time for stale-if-error
+	Tags       []string  // Surrogate keys used for tag-based purging
+	Hits       int64     // Number of times the item was served from cache
 	Size       int
 }
 
+// HasTag reports whether the item carries the given surrogate key.
+func (item *CacheItem) HasTag(tag string) bool {
+	for _, t := range item.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired reports whether the item is past its freshness lifetime.
+func (item *CacheItem) IsExpired(now time.Time) bool {
+	return !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt)
+}
+
+// IsUsable reports whether the item may still be served, fresh or stale.
+func (item *CacheItem) IsUsable(now time.Time) bool {
+	return !item.IsExpired(now) || now.Before(item.StaleUntil)
+}
+
 // Cache implements an in-memory caching system with automatic cleanup.
 type Cache struct {
 	items           map[string]*CacheItem
 	mutex           sync.RWMutex
 	maxSize         int64
 	currentSize     int64
+	quotas          domainQuotas
 	ttl             time.Duration
 	cleanupInterval time.Duration
 	stopChan        chan bool
+	stopOnce        sync.Once
+	snapshotPath    string // Written on Stop when snapshots are enabled
 }
 
 // NewCache creates a new in-memory cache instance.
 func NewCache(maxSize string, defaultTTL int, cleanupInterval int) *Cache {
-	sizeBytes, err := parseSize(maxSize)
+	sizeBytes, err := ParseSize(maxSize)
 	if err != nil {
 		sizeBytes = 100 * 1024 * 1024 // Default 100MB
 	}
@@ -55,6 +83,7 @@ func NewCache(maxSize string, defaultTTL int, cleanupInterval int) *Cache {
 		items:           make(map[string]*CacheItem),
 		maxSize:         sizeBytes,
 		currentSize:     0,
+		quotas:          newDomainQuotas(),
 		ttl:             time.Duration(defaultTTL) * time.Second,
 		cleanupInterval: time.Duration(cleanupInterval) * time.Second,
 		stopChan:        make(chan bool),
@@ -66,7 +95,8 @@ func NewCache(maxSize string, defaultTTL int, cleanupInterval int) *Cache {
 	return cache
 }
 
-func parseSize(sizeStr string) (int64, error) {
+// ParseSize parses a human readable size such as "500MB" into bytes.
+func ParseSize(sizeStr string) (int64, error) {
 	if sizeStr == "" {
 		return 0, fmt.Errorf("empty size string")
 	}
@@ -113,40 +143,81 @@ func (c *Cache) Set(key string, value []byte, ttl time.Duration) {
 
 // SetWithHeaders stores data with HTTP headers and status code in the cache.
 func (c *Cache) SetWithHeaders(key string, value []byte, headers map[string]string, statusCode int, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	c.SetEntry(&CacheItem{
+		Key:        key,
+		Value:      value,
+		Headers:    headers,
+		StatusCode: statusCode,
+		ExpiresAt:  time.Now().Add(ttl),
+	})
+}
+
+// SetEntry stores a fully described item in the cache. A zero ExpiresAt uses the default TTL.
+func (c *Cache) SetEntry(entry *CacheItem) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	hashKey := c.generateKey(key)
+	hashKey := c.generateKey(entry.Key)
 
 	// Remove existing item if it exists
 	if item, exists := c.items[hashKey]; exists {
-		c.currentSize -= int64(item.Size)
-		delete(c.items, hashKey)
+		c.removeItem(hashKey, item)
 	}
 
-	// Check if we need to evict items
-	for c.currentSize+int64(len(value)) > c.maxSize && len(c.items) > 0 {
-		c.evictLRU()
+	// Make room within the domain's quota first, so one domain can't push
+	// out everyone else's entries
+	size := int64(len(entry.Value))
+	if c.quotas.tooLarge(entry.Key, size) {
+		return
+	}
+	for c.quotas.exceeds(entry.Key, size) {
+		if !c.evictLRU(keyDomain(entry.Key)) {
+			break
+		}
 	}
 
-	// Add new item
-	expiresAt := time.Now().Add(ttl)
-	if ttl == 0 {
-		expiresAt = time.Now().Add(c.ttl)
+	// Check if we need to evict items
+	for c.currentSize+size > c.maxSize && len(c.items) > 0 {
+		c.evictLRU("")
 	}
 
+	now := time.Now()
 	item := &CacheItem{
-		Key:        key,
-		Value:      make([]byte, len(value)),
-		Headers:    headers,
-		StatusCode: statusCode,
-		ExpiresAt:  expiresAt,
-		Size:       len(value),
+		Key:        entry.Key,
+		Value:      make([]byte, len(entry.Value)),
+		Headers:    entry.Headers,
+		StatusCode: entry.StatusCode,
+		CreatedAt:  now,
+		ExpiresAt:  entry.ExpiresAt,
+		StaleUntil: entry.StaleUntil,
+		Tags:       entry.Tags,
+		Size:       len(entry.Value),
+	}
+	copy(item.Value, entry.Value)
+	if item.ExpiresAt.IsZero() {
+		item.ExpiresAt = now.Add(c.ttl)
 	}
-	copy(item.Value, value)
 
 	c.items[hashKey] = item
-	c.currentSize += int64(len(value))
+	c.currentSize += size
+	c.quotas.add(item.Key, size)
+}
+
+// removeItem drops an item and its size accounting, the caller must hold the write lock.
+func (c *Cache) removeItem(hashKey string, item *CacheItem) {
+	delete(c.items, hashKey)
+	c.currentSize -= int64(item.Size)
+	c.quotas.remove(item.Key, int64(item.Size))
+}
+
+// SetDomainQuota caps how many bytes the entries of domain may use, 0 removes the cap.
+func (c *Cache) SetDomainQuota(domain string, maxSize int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.quotas.setLimit(domain, maxSize)
 }
 
 // Get retrieves cached data by key, returning nil if not found or expired.
@@ -157,7 +228,7 @@ func (c *Cache) Get(key string) []byte {
 	hashKey := c.generateKey(key)
 
 	if item, exists := c.items[hashKey]; exists {
-		if time.Now().Before(item.ExpiresAt) {
+		if !item.IsExpired(time.Now()) {
 			return item.Value
 		}
 	}
@@ -173,17 +244,70 @@ func (c *Cache) GetItem(key string) *CacheItem {
 	hashKey := c.generateKey(key)
 
 	if item, exists := c.items[hashKey]; exists {
-		if time.Now().Before(item.ExpiresAt) {
-			return item
+		now := time.Now()
+		if !item.IsExpired(now) {
+			item.Hits++
+			// Hand out a copy so later metadata updates don't race with the caller
+			clone := *item
+			return &clone
+		}
+		// Keep expired items around while they may still be served stale
+		if !item.IsUsable(now) {
+			c.removeItem(hashKey, item)
 		}
-		// Item expired, remove it
-		delete(c.items, hashKey)
-		c.currentSize -= int64(item.Size)
 	}
 
 	return nil
 }
 
+// GetStale retrieves an item even if it has expired, as long as it is within its stale window.
+func (c *Cache) GetStale(key string) *CacheItem {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if item, exists := c.items[c.generateKey(key)]; exists && item.IsUsable(time.Now()) {
+		clone := *item
+		return &clone
+	}
+
+	return nil
+}
+
+// Entries returns the metadata of every usable item whose key matches
+// pattern, sorted by key. Values are not included.
+func (c *Cache) Entries(pattern string) []*CacheItem {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := time.Now()
+	entries := make([]*CacheItem, 0)
+	for _, item := range c.items {
+		if !item.IsUsable(now) || !MatchPattern(pattern, item.Key) {
+			continue
+		}
+		clone := *item
+		clone.Value = nil
+		entries = append(entries, &clone)
+	}
+
+	sortEntries(entries)
+	return entries
+}
+
+// SetExpiry changes when an item expires. A zero expiresAt pins the item so
+// it never expires. It reports whether the item exists.
+func (c *Cache) SetExpiry(key string, expiresAt time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	item, exists := c.items[c.generateKey(key)]
+	if !exists {
+		return false
+	}
+	item.ExpiresAt = expiresAt
+	return true
+}
+
 // Delete removes an item from the cache by key.
 func (c *Cache) Delete(key string) {
 	c.mutex.Lock()
@@ -192,8 +316,52 @@ func (c *Cache) Delete(key string) {
 	hashKey := c.generateKey(key)
 
 	if item, exists := c.items[hashKey]; exists {
-		delete(c.items, hashKey)
-		c.currentSize -= int64(item.Size)
+		c.removeItem(hashKey, item)
+	}
+}
+
+// Purge invalidates every item whose key matches pattern and returns how many were affected.
+func (c *Cache) Purge(pattern string, mode PurgeMode) int {
+	return c.purgeWhere(func(item *CacheItem) bool {
+		return MatchPattern(pattern, item.Key)
+	}, mode)
+}
+
+// PurgeTag invalidates every item carrying the surrogate key and returns how many were affected.
+func (c *Cache) PurgeTag(tag string, mode PurgeMode) int {
+	return c.purgeWhere(func(item *CacheItem) bool {
+		return item.HasTag(tag)
+	}, mode)
+}
+
+func (c *Cache) purgeWhere(match func(item *CacheItem) bool, mode PurgeMode) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for hashKey, item := range c.items {
+		if !match(item) {
+			continue
+		}
+		if mode == PurgeSoft {
+			item.markStale(now)
+		} else {
+			c.removeItem(hashKey, item)
+		}
+		purged++
+	}
+
+	return purged
+}
+
+// markStale expires the item immediately while keeping it servable as stale.
+func (item *CacheItem) markStale(now time.Time) {
+	if !item.IsExpired(now) {
+		item.ExpiresAt = now
+	}
+	if staleUntil := now.Add(SoftPurgeStaleTTL); item.StaleUntil.Before(staleUntil) {
+		item.StaleUntil = staleUntil
 	}
 }
 
@@ -204,25 +372,35 @@ func (c *Cache) Clear() {
 
 	c.items = make(map[string]*CacheItem)
 	c.currentSize = 0
+	c.quotas.reset()
 }
 
-func (c *Cache) evictLRU() {
+// evictLRU removes the item closest to expiry, limited to domain unless it is
+// empty. It reports whether an item was removed.
+func (c *Cache) evictLRU(domain string) bool {
 	var oldestKey string
 	var oldestTime time.Time
 
 	for key, item := range c.items {
-		if oldestKey == "" || item.ExpiresAt.Before(oldestTime) {
+		if domain != "" && keyDomain(item.Key) != domain {
+			continue
+		}
+		expiresAt := item.ExpiresAt
+		if expiresAt.IsZero() {
+			// Pinned items are evicted last
+			expiresAt = time.Unix(1<<62, 0)
+		}
+		if oldestKey == "" || expiresAt.Before(oldestTime) {
 			oldestKey = key
-			oldestTime = item.ExpiresAt
+			oldestTime = expiresAt
 		}
 	}
 
-	if oldestKey != "" {
-		if item, exists := c.items[oldestKey]; exists {
-			c.currentSize -= int64(item.Size)
-		}
-		delete(c.items, oldestKey)
+	if oldestKey == "" {
+		return false
 	}
+	c.removeItem(oldestKey, c.items[oldestKey])
+	return true
 }
 
 func (c *Cache) startCleanup() {
@@ -245,9 +423,8 @@ func (c *Cache) cleanup() {
 
 	now := time.Now()
 	for key, item := range c.items {
-		if now.After(item.ExpiresAt) {
-			delete(c.items, key)
-			c.currentSize -= int64(item.Size)
+		if !item.IsUsable(now) {
+			c.removeItem(key, item)
 		}
 	}
 }
@@ -262,10 +439,23 @@ func (c *Cache) Stats() map[string]interface{} {
 		"current_size":  c.currentSize,
 		"max_size":      c.maxSize,
 		"usage_percent": float64(c.currentSize) / float64(c.maxSize) * 100,
+		"domain_sizes":  c.quotas.snapshot(),
 	}
 }
 
-// Stop stops the cache cleanup goroutine.
+// Stop stops the cache cleanup goroutine and writes a snapshot if enabled.
+// Calls after the first do nothing.
 func (c *Cache) Stop() {
-	close(c.stopChan)
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+
+		c.mutex.RLock()
+		path := c.snapshotPath
+		c.mutex.RUnlock()
+		if path != "" {
+			if err := c.saveSnapshot(path); err != nil {
+				log.Printf("Failed to save cache snapshot: %v", err)
+			}
+		}
+	})
 }
@@ -0,0 +1,69 @@
+package cache
+
+import "strings"
+
+// keyDomain returns the domain part of a cache key of the form "domain:METHOD:path"
+func keyDomain(key string) string {
+	domain, _, _ := strings.Cut(key, ":")
+	return domain
+}
+
+// domainQuotas tracks how much space each domain's entries use and the
+// optional limits on it. Callers must hold the owning cache's lock.
+type domainQuotas struct {
+	usage  map[string]int64
+	limits map[string]int64
+}
+
+func newDomainQuotas() domainQuotas {
+	return domainQuotas{
+		usage:  make(map[string]int64),
+		limits: make(map[string]int64),
+	}
+}
+
+// setLimit caps the space used by domain, a limit of 0 removes the cap
+func (q *domainQuotas) setLimit(domain string, limit int64) {
+	if limit <= 0 {
+		delete(q.limits, domain)
+		return
+	}
+	q.limits[domain] = limit
+}
+
+func (q *domainQuotas) add(key string, size int64) {
+	q.usage[keyDomain(key)] += size
+}
+
+func (q *domainQuotas) remove(key string, size int64) {
+	domain := keyDomain(key)
+	if q.usage[domain] -= size; q.usage[domain] <= 0 {
+		delete(q.usage, domain)
+	}
+}
+
+// tooLarge reports whether an entry of size can never fit in its domain's quota
+func (q *domainQuotas) tooLarge(key string, size int64) bool {
+	limit, exists := q.limits[keyDomain(key)]
+	return exists && size > limit
+}
+
+// exceeds reports whether adding size to key's domain would go over its quota
+func (q *domainQuotas) exceeds(key string, size int64) bool {
+	domain := keyDomain(key)
+	limit, exists := q.limits[domain]
+	return exists && q.usage[domain]+size > limit
+}
+
+// snapshot returns a copy of the per-domain usage
+func (q *domainQuotas) snapshot() map[string]int64 {
+	usage := make(map[string]int64, len(q.usage))
+	for domain, size := range q.usage {
+		usage[domain] = size
+	}
+	return usage
+}
+
+func (q *domainQuotas) reset() {
+	q.usage = make(map[string]int64)
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Reloadable is a Storage whose implementation can be replaced while it is
+// in use, so a configuration reload can change the cache settings without
+// handing a new storage to everything that holds the cache.
+type Reloadable struct {
+	mu      sync.RWMutex
+	storage Storage
+}
+
+// NewReloadable wraps storage.
+func NewReloadable(storage Storage) *Reloadable {
+	return &Reloadable{storage: storage}
+}
+
+// Rebuild stops the current storage and replaces it with the one build
+// returns. Stopping first lets the new storage pick up what the old one
+// flushed, such as the file cache index or the memory cache snapshot.
+// Calls wait until the new storage is ready. If build fails an empty memory
+// cache takes the place of the stopped storage, so that calls never reach
+// it, and the error is returned.
+func (r *Reloadable) Rebuild(build func() (Storage, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.storage.Stop()
+	storage, err := build()
+	if err != nil {
+		log.Printf("Warning: Falling back to an empty memory cache: %v", err)
+		r.storage = NewCache("", 0, 0)
+		return err
+	}
+	r.storage = storage
+	return nil
+}
+
+// Set stores value under key in the current storage.
+func (r *Reloadable) Set(key string, value []byte, ttl time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.Set(key, value, ttl)
+}
+
+// SetWithHeaders stores a response in the current storage.
+func (r *Reloadable) SetWithHeaders(key string, value []byte, headers map[string]string, statusCode int, ttl time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.SetWithHeaders(key, value, headers, statusCode, ttl)
+}
+
+// SetEntry stores item in the current storage.
+func (r *Reloadable) SetEntry(item *CacheItem) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.SetEntry(item)
+}
+
+// Get returns the value of key from the current storage.
+func (r *Reloadable) Get(key string) []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.Get(key)
+}
+
+// GetItem returns the item of key from the current storage.
+func (r *Reloadable) GetItem(key string) *CacheItem {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.GetItem(key)
+}
+
+// GetStale returns the item of key from the current storage, even if expired.
+func (r *Reloadable) GetStale(key string) *CacheItem {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.GetStale(key)
+}
+
+// Entries lists the items of the current storage matching pattern.
+func (r *Reloadable) Entries(pattern string) []*CacheItem {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.Entries(pattern)
+}
+
+// SetExpiry changes an item's expiration in the current storage.
+func (r *Reloadable) SetExpiry(key string, expiresAt time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.SetExpiry(key, expiresAt)
+}
+
+// Delete removes an item from the current storage.
+func (r *Reloadable) Delete(key string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.Delete(key)
+}
+
+// Purge invalidates matching items of the current storage.
+func (r *Reloadable) Purge(pattern string, mode PurgeMode) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.Purge(pattern, mode)
+}
+
+// PurgeTag invalidates tagged items of the current storage.
+func (r *Reloadable) PurgeTag(tag string, mode PurgeMode) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.PurgeTag(tag, mode)
+}
+
+// SetDomainQuota limits the size of a domain's items in the current storage.
+func (r *Reloadable) SetDomainQuota(domain string, maxSize int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.SetDomainQuota(domain, maxSize)
+}
+
+// Clear removes all items from the current storage.
+func (r *Reloadable) Clear() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.Clear()
+}
+
+// Stats returns the statistics of the current storage.
+func (r *Reloadable) Stats() map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.storage.Stats()
+}
+
+// Stop stops the current storage.
+func (r *Reloadable) Stop() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.storage.Stop()
+}
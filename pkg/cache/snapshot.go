@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EnableSnapshots restores the cache from the snapshot at path, if there is
+// one, and makes Stop write a new snapshot there. This lets a restarted
+// process start with a warm cache.
+func (c *Cache) EnableSnapshots(path string) error {
+	c.mutex.Lock()
+	c.snapshotPath = path
+	c.mutex.Unlock()
+
+	restored, err := c.loadSnapshot(path)
+	if err != nil {
+		return fmt.Errorf("failed to restore cache snapshot: %v", err)
+	}
+	if restored > 0 {
+		log.Printf("Restored %d cache items from %s", restored, path)
+	}
+	return nil
+}
+
+// loadSnapshot adds the usable items of a snapshot and returns how many were restored.
+func (c *Cache) loadSnapshot(path string) (int, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }() //nolint:errcheck
+
+	var items []*CacheItem
+	if err := gob.NewDecoder(file).Decode(&items); err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	restored := 0
+	for _, item := range items {
+		size := int64(len(item.Value))
+		if !item.IsUsable(now) || c.currentSize+size > c.maxSize {
+			continue
+		}
+
+		hashKey := c.generateKey(item.Key)
+		if existing, exists := c.items[hashKey]; exists {
+			c.removeItem(hashKey, existing)
+		}
+		item.Size = len(item.Value)
+		c.items[hashKey] = item
+		c.currentSize += size
+		c.quotas.add(item.Key, size)
+		restored++
+	}
+
+	return restored, nil
+}
+
+// saveSnapshot atomically writes every usable item to path.
+func (c *Cache) saveSnapshot(path string) error {
+	c.mutex.RLock()
+	now := time.Now()
+	items := make([]*CacheItem, 0, len(c.items))
+	for _, item := range c.items {
+		if item.IsUsable(now) {
+			items = append(items, item)
+		}
+	}
+
+	// Encode while holding the lock, items are mutated in place by purges
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	var tmp *os.File
+	if err == nil {
+		tmp, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	}
+	if err == nil {
+		err = gob.NewEncoder(tmp).Encode(items)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name()) //nolint:errcheck
+		}
+	}
+	c.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
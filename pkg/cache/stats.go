@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"sync"
+)
+
+// Cache outcomes reported through the X-Cache response header.
+const (
+	OutcomeHit    = "HIT"
+	OutcomeMiss   = "MISS"
+	OutcomeStale  = "STALE"
+	OutcomeBypass = "BYPASS"
+)
+
+// DomainStats holds cache effectiveness counters for a single domain.
+type DomainStats struct {
+	Requests    int64   `json:"requests"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	Stale       int64   `json:"stale"`
+	Bypasses    int64   `json:"bypasses"`
+	BytesServed int64   `json:"bytes_served"`
+	BytesCached int64   `json:"bytes_from_cache"`
+	HitRatio    float64 `json:"hit_ratio"`
+}
+
+// StatsRecorder accumulates per-domain cache statistics.
+type StatsRecorder struct {
+	mu      sync.Mutex
+	domains map[string]*DomainStats
+}
+
+// NewStatsRecorder creates an empty statistics recorder.
+func NewStatsRecorder() *StatsRecorder {
+	return &StatsRecorder{domains: make(map[string]*DomainStats)}
+}
+
+// Record accounts one response for domain. Outcome is one of the Outcome
+// constants, or empty for responses that were never eligible for caching.
+func (r *StatsRecorder) Record(domain, outcome string, bytes int) {
+	if bytes < 0 {
+		bytes = 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, exists := r.domains[domain]
+	if !exists {
+		stats = &DomainStats{}
+		r.domains[domain] = stats
+	}
+
+	stats.Requests++
+	stats.BytesServed += int64(bytes)
+	switch outcome {
+	case OutcomeHit:
+		stats.Hits++
+		stats.BytesCached += int64(bytes)
+	case OutcomeStale:
+		stats.Stale++
+		stats.BytesCached += int64(bytes)
+	case OutcomeMiss:
+		stats.Misses++
+	case OutcomeBypass:
+		stats.Bypasses++
+	}
+}
+
+// Snapshot returns a copy of the statistics of every domain.
+func (r *StatsRecorder) Snapshot() map[string]DomainStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := make(map[string]DomainStats, len(r.domains))
+	for domain, stats := range r.domains {
+		copied := *stats
+		if lookups := copied.Hits + copied.Stale + copied.Misses; lookups > 0 {
+			copied.HitRatio = float64(copied.Hits+copied.Stale) / float64(lookups)
+		}
+		snapshot[domain] = copied
+	}
+	return snapshot
+}
+
+// Reset clears all counters.
+func (r *StatsRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.domains = make(map[string]*DomainStats)
+}
@@ -2,62 +2,506 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // ServerConfig defines the main server configuration settings.
 type ServerConfig struct {
-	Host      string    `yaml:"host" json:"host"`
-	Port      int       `yaml:"port" json:"port"`
-	AdminPort int       `yaml:"admin_port" json:"admin_port"`
-	AutoHTTPS bool      `yaml:"auto_https" json:"auto_https"`
-	TLS       TLSConfig `yaml:"tls" json:"tls"`
+	Host      string      `yaml:"host" json:"host"`
+	Port      int         `yaml:"port" json:"port"`
+	AdminPort int         `yaml:"admin_port" json:"admin_port"`
+	AutoHTTPS bool        `yaml:"auto_https" json:"auto_https"`
+	TLS       TLSConfig   `yaml:"tls" json:"tls"`
+	Admin     AdminConfig `yaml:"admin" json:"admin"`
+}
+
+// Ways the admin interface terminates TLS.
+const (
+	AdminTLSACME       = "acme"        // Certificate for admin.domain from the ACME issuer, requires auto_https
+	AdminTLSSelfSigned = "self_signed" // Self-signed certificate for admin.domain, kept in the TLS cache_dir
+	AdminTLSFiles      = "files"       // admin.cert_file and admin.key_file
+)
+
+// AdminConfig defines where and how the admin interface listens.
+type AdminConfig struct {
+	Listen      string         `yaml:"listen" json:"listen"`             // "host:port" or "unix:/path/to/socket", defaults to host:admin_port
+	TLS         string         `yaml:"tls" json:"tls"`                   // "acme", "self_signed" or "files"; plain HTTP when empty
+	Domain      string         `yaml:"domain" json:"domain"`             // Certificate name for "acme" and "self_signed", defaults to localhost for "self_signed"
+	CertFile    string         `yaml:"cert_file" json:"cert_file"`       // PEM certificate chain for "files"
+	KeyFile     string         `yaml:"key_file" json:"key_file"`         // PEM private key for "files"
+	MetricsPath string         `yaml:"metrics_path" json:"metrics_path"` // Also serve the Prometheus metrics here without authentication, e.g. "/metrics"
+	Profiling   bool           `yaml:"profiling" json:"profiling"`       // Serve pprof profiles to admins under /api/v1/debug/pprof/
+	AllowedIPs  []string       `yaml:"allowed_ips" json:"allowed_ips"`   // Addresses and CIDR ranges that may connect to the admin interface, all when empty
+	RateLimit   AdminRateLimit `yaml:"rate_limit" json:"rate_limit"`
+}
+
+// AdminRateLimit bounds the admin API requests of each client IP. Clients
+// may use a minute's worth at once; beyond that they get 429.
+type AdminRateLimit struct {
+	Requests int `yaml:"requests" json:"requests"` // Requests per minute, 0 disables
+	Writes   int `yaml:"writes" json:"writes"`     // Requests per minute that change state (all but GET and HEAD), 0 disables
 }
 
 // TLSConfig defines TLS/SSL configuration for automatic HTTPS.
 type TLSConfig struct {
-	Email    string `yaml:"email" json:"email"`
-	CacheDir string `yaml:"cache_dir" json:"cache_dir"`
+	Email          string            `yaml:"email" json:"email"`
+	CacheDir       string            `yaml:"cache_dir" json:"cache_dir"`
+	Storage        CertStorageConfig `yaml:"storage" json:"storage"`                       // Where certificates are kept, cache_dir by default
+	Staging        bool              `yaml:"staging" json:"staging"`                       // Use the Let's Encrypt staging server when no directory is set
+	DirectoryURL   string            `yaml:"acme_directory_url" json:"acme_directory_url"` // ACME directory URL or CA name: letsencrypt, zerossl, buypass, google
+	CARoot         string            `yaml:"ca_root" json:"ca_root"`                       // PEM file trusted for an internal ACME server's certificate
+	EABKeyID       string            `yaml:"eab_key_id" json:"eab_key_id"`                 // External account binding, required by ZeroSSL and Google
+	EABHMACKey     string            `yaml:"eab_hmac_key" json:"eab_hmac_key"`             // Base64url HMAC key issued with the EAB key id
+	PreferredChain string            `yaml:"preferred_chain" json:"preferred_chain"`       // Issuer common name of the preferred alternate chain, e.g. "ISRG Root X1"
+	Issuer         string            `yaml:"issuer" json:"issuer"`                         // "acme" or "internal"; *.localhost and similar always use "internal"
+	Challenge      string            `yaml:"challenge" json:"challenge"`                   // Default ACME challenge: "http-01" or "dns-01"
+	DNS            DNSProviderConfig `yaml:"dns" json:"dns"`
+	Policy         TLSPolicy         `yaml:"policy" json:"policy"` // Default TLS policy, overridden per domain by ssl.policy
+	Notify         NotifyConfig      `yaml:"notify" json:"notify"`
+	OnDemand       OnDemandConfig    `yaml:"on_demand" json:"on_demand"`
+
+	RenewalDays     int `yaml:"renewal_days" json:"renewal_days"`         // Renew certificates this many days before expiry, defaults to 30
+	RenewalInterval int `yaml:"renewal_interval" json:"renewal_interval"` // Seconds between renewal checks, defaults to 86400
+	RenewalJitter   int `yaml:"renewal_jitter" json:"renewal_jitter"`     // Up to this many random seconds are added to each interval
+
+	SessionTicketRotation int `yaml:"session_ticket_rotation" json:"session_ticket_rotation"` // Seconds between session ticket key rotations, defaults to 43200
+
+	// ChallengeAddress is where the HTTP-01 challenge server listens,
+	// host:80 by default, or ChallengeOnMainListener to leave challenges to
+	// the main HTTP listener, e.g. when port 80 is forwarded to server.port
+	ChallengeAddress string `yaml:"challenge_address" json:"challenge_address"`
+}
+
+// ChallengeOnMainListener as challenge_address serves HTTP-01 challenges
+// from the main HTTP listener only.
+const ChallengeOnMainListener = "main"
+
+// CertStorageConfig selects where certificates, the ACME account and the
+// internal CA are stored. Nodes of a cluster must share one redis, sql or s3
+// storage to serve the same certificates. Only the fields of the selected type
+// are used.
+type CertStorageConfig struct {
+	Type            string `yaml:"type" json:"type"`                   // "file" (default), "redis", "sql" or "s3"
+	Prefix          string `yaml:"prefix" json:"prefix"`               // Key prefix for redis ("saddy:certs:" by default) and s3
+	Redis           string `yaml:"redis" json:"redis"`                 // Redis URL, e.g. redis://localhost:6379/0
+	Driver          string `yaml:"driver" json:"driver"`               // database/sql driver linked into the binary, e.g. "postgres" or "mysql"
+	DSN             string `yaml:"dsn" json:"dsn"`                     // Database connection string
+	Table           string `yaml:"table" json:"table"`                 // Created if missing, defaults to saddy_certificates
+	Bucket          string `yaml:"bucket" json:"bucket"`               // S3 bucket
+	Region          string `yaml:"region" json:"region"`               // S3 region, defaults to us-east-1
+	Endpoint        string `yaml:"endpoint" json:"endpoint"`           // S3-compatible endpoint, e.g. MinIO; AWS when empty
+	AccessKeyID     string `yaml:"access_key_id" json:"access_key_id"` // S3 credentials, default to the AWS_* environment variables
+	SecretAccessKey string `yaml:"secret_access_key" json:"secret_access_key"`
+
+	EncryptionPassphrase string `yaml:"encryption_passphrase" json:"encryption_passphrase"` // Encrypts stored private keys
+	EncryptionKeyFile    string `yaml:"encryption_key_file" json:"encryption_key_file"`     // Base64 32-byte key used instead of a passphrase, e.g. written by a KMS agent
+}
+
+// OnDemandConfig enables on-demand TLS: certificates for domains that aren't
+// configured are obtained during their first handshake, for names the ask
+// endpoint approves. Used for customer domains of SaaS applications.
+type OnDemandConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Ask     string `yaml:"ask" json:"ask"` // Required; GET <ask>?domain=<name> must answer 200 to allow a name
+}
+
+// NotifyConfig configures alerts about certificates that are about to expire
+// or failed to renew.
+type NotifyConfig struct {
+	ExpiryDays int        `yaml:"expiry_days" json:"expiry_days"` // Alert when a certificate has this many days left, defaults to 7
+	WebhookURL string     `yaml:"webhook_url" json:"webhook_url"` // Receives each event as a JSON POST
+	SMTP       SMTPConfig `yaml:"smtp" json:"smtp"`
+}
+
+// SMTPConfig configures the mail server used for email alerts.
+type SMTPConfig struct {
+	Host     string   `yaml:"host" json:"host"`
+	Port     int      `yaml:"port" json:"port"` // Defaults to 587 with STARTTLS, 465 uses implicit TLS
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+	From     string   `yaml:"from" json:"from"` // Defaults to Username
+	To       []string `yaml:"to" json:"to"`
+}
+
+// TLSPolicy restricts the TLS versions, cipher suites and ALPN protocols
+// offered to clients. Empty fields keep the defaults: TLS 1.2 and above with
+// forward secret AEAD ciphers, and h2 plus http/1.1.
+type TLSPolicy struct {
+	MinVersion   string   `yaml:"min_version,omitempty" json:"min_version,omitempty"`     // "1.0", "1.1", "1.2" or "1.3"
+	MaxVersion   string   `yaml:"max_version,omitempty" json:"max_version,omitempty"`     // Highest version offered, "1.3" when empty
+	CipherSuites []string `yaml:"cipher_suites,omitempty" json:"cipher_suites,omitempty"` // Go cipher suite names, TLS 1.2 and below only
+	ALPN         []string `yaml:"alpn,omitempty" json:"alpn,omitempty"`                   // e.g. ["http/1.1"] to disable HTTP/2
+	ClientAuth   string   `yaml:"client_auth,omitempty" json:"client_auth,omitempty"`     // "require" or "optional" to verify client certificates against ClientCA
+	ClientCA     string   `yaml:"client_ca,omitempty" json:"client_ca,omitempty"`         // PEM file with the CAs trusted for client certificates
+}
+
+// DNSProviderConfig configures the DNS provider that publishes DNS-01
+// challenge records. Only the fields of the selected provider are used.
+type DNSProviderConfig struct {
+	Provider           string `yaml:"provider" json:"provider"`             // "cloudflare", "route53", "digitalocean" or "webhook"
+	APIToken           string `yaml:"api_token" json:"api_token"`           // Cloudflare and DigitalOcean token, bearer token for the webhook
+	Zone               string `yaml:"zone" json:"zone"`                     // Zone holding the records, looked up from the domain when empty
+	HostedZoneID       string `yaml:"hosted_zone_id" json:"hosted_zone_id"` // Route53 hosted zone, looked up from the domain when empty
+	AccessKeyID        string `yaml:"access_key_id" json:"access_key_id"`   // Route53 credentials with SecretAccessKey, default to the AWS_* environment variables
+	SecretAccessKey    string `yaml:"secret_access_key" json:"secret_access_key"`
+	WebhookURL         string `yaml:"webhook_url" json:"webhook_url"`                 // Receives {"action", "fqdn", "value"} for present and cleanup
+	TTL                int    `yaml:"ttl" json:"ttl"`                                 // TTL of the challenge records, defaults to 120
+	PropagationTimeout int    `yaml:"propagation_timeout" json:"propagation_timeout"` // Seconds to wait for records to become visible, defaults to 120
 }
 
 // CacheRule defines caching behavior for a specific proxy rule.
 type CacheRule struct {
-	Enabled bool   `yaml:"enabled" json:"enabled"`
-	TTL     int    `yaml:"ttl" json:"ttl"`
-	MaxSize string `yaml:"max_size" json:"max_size"`
+	Enabled       bool   `yaml:"enabled" json:"enabled"`
+	TTL           int    `yaml:"ttl" json:"ttl"`                         // Seconds, unless the backend sends Surrogate-Control max-age or s-maxage
+	MaxSize       string `yaml:"max_size" json:"max_size"`               // Quota for this domain's entries, oldest are evicted first
+	MaxObjectSize string `yaml:"max_object_size" json:"max_object_size"` // Larger responses are streamed through uncached, e.g. "10MB"
+	StaleIfError  int    `yaml:"stale_if_error" json:"stale_if_error"`   // Seconds an expired entry may be served when the backend fails
+	NegativeTTL   int    `yaml:"negative_ttl" json:"negative_ttl"`       // Seconds to cache 404/410 responses, 0 disables negative caching
+	CacheErrors   bool   `yaml:"cache_errors" json:"cache_errors"`       // Also cache 5xx responses for NegativeTTL
+
+	// StatusTTL maps response status codes to TTLs in seconds, overriding the
+	// defaults above. A TTL of 0 disables caching for that status.
+	StatusTTL map[int]int `yaml:"status_ttl,omitempty" json:"status_ttl,omitempty"`
+
+	// PathTTL overrides TTL for requests matching a path pattern. The first
+	// matching entry wins; a TTL of 0 disables caching for those paths.
+	PathTTL []PathTTLRule `yaml:"path_ttl,omitempty" json:"path_ttl,omitempty"`
+
+	// Paths and ContentTypes restrict caching to matching requests and
+	// responses; empty means everything. A trailing "*" matches any suffix,
+	// e.g. "/static/*" or "image/*".
+	Paths        []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+	ExcludePaths []string `yaml:"exclude_paths,omitempty" json:"exclude_paths,omitempty"`
+	ContentTypes []string `yaml:"content_types,omitempty" json:"content_types,omitempty"`
+
+	Key          CacheKeyRule     `yaml:"key" json:"key"`
+	Bypass       CacheBypassRule  `yaml:"bypass" json:"bypass"`
+	RefreshAhead RefreshAheadRule `yaml:"refresh_ahead" json:"refresh_ahead"`
+	Admission    AdmissionRule    `yaml:"admission" json:"admission"`
+	Lock         CacheLockRule    `yaml:"lock" json:"lock"`
+}
+
+// CacheLockRule controls requests that arrive while another request is
+// already fetching the same entry from the backend. By default they wait for
+// that fetch to finish and share its response.
+type CacheLockRule struct {
+	Timeout  int `yaml:"timeout" json:"timeout"`     // Seconds to wait before giving up on the lock, 0 waits for the fetch
+	MaxStale int `yaml:"max_stale" json:"max_stale"` // Seconds an expired entry is kept to answer waiters while it is refreshed, 0 disables
+}
+
+// AdmissionRule only stores an object once it has been requested MinHits
+// times within Window, so one-off requests such as crawler traffic don't
+// push popular content out of the cache.
+type AdmissionRule struct {
+	MinHits int `yaml:"min_hits" json:"min_hits"` // Requests needed before a response is cached, 0 or 1 caches immediately
+	Window  int `yaml:"window" json:"window"`     // Seconds in which the requests must arrive, defaults to 60
+}
+
+// PathTTLRule sets the TTL for requests whose path matches Path, e.g. "/assets/*".
+type PathTTLRule struct {
+	Path string `yaml:"path" json:"path"`
+	TTL  int    `yaml:"ttl" json:"ttl"` // Seconds, 0 disables caching
+}
+
+// RefreshAheadRule refreshes popular entries in the background shortly before
+// they expire, so hot content never falls out of cache.
+type RefreshAheadRule struct {
+	MinHits int `yaml:"min_hits" json:"min_hits"` // Hits an entry needs before it is refreshed, 0 disables
+	Window  int `yaml:"window" json:"window"`     // Seconds before expiry to refresh, defaults to 10% of the TTL
+}
+
+// CacheBypassRule defines which requests skip the cache and go straight to the backend.
+//
+// Requests carrying one of the cookies are passed through without reading or
+// storing cache entries, so personalized pages are never shared. Requests
+// with one of the headers or Cache-Control/Pragma no-cache refresh the entry
+// from the backend instead.
+type CacheBypassRule struct {
+	Cookies      []string `yaml:"cookies,omitempty" json:"cookies,omitempty"`         // Cookie names, "prefix*" matches by prefix
+	Headers      []string `yaml:"headers,omitempty" json:"headers,omitempty"`         // Request headers that force a refresh
+	HonorNoCache bool     `yaml:"honor_no_cache" json:"honor_no_cache"`               // Refresh on Cache-Control: no-cache or Pragma: no-cache
+	AllowedIPs   []string `yaml:"allowed_ips,omitempty" json:"allowed_ips,omitempty"` // Restrict header-triggered refreshes to these IPs/CIDRs of the connection; X-Forwarded-For is not trusted
+}
+
+// CacheKeyRule customizes how cache keys are composed for a proxy rule.
+type CacheKeyRule struct {
+	IgnoreQuery   []string `yaml:"ignore_query,omitempty" json:"ignore_query,omitempty"` // Query parameters left out of the key, "prefix*" matches by prefix
+	SortQuery     bool     `yaml:"sort_query" json:"sort_query"`                         // Sort query parameters so their order doesn't matter
+	StripTracking bool     `yaml:"strip_tracking" json:"strip_tracking"`                 // Ignore common tracking parameters (utm_*, fbclid, gclid, ...)
+	Headers       []string `yaml:"headers,omitempty" json:"headers,omitempty"`           // Request headers included in the key
+	Cookies       []string `yaml:"cookies,omitempty" json:"cookies,omitempty"`           // Cookies included in the key
+	LowercasePath bool     `yaml:"lowercase_path" json:"lowercase_path"`
+	NormalizePath bool     `yaml:"normalize_path" json:"normalize_path"` // Collapse duplicate slashes and dot segments
 }
 
 // SSLRule defines SSL/TLS settings for a specific proxy rule.
 type SSLRule struct {
-	Enabled    bool `yaml:"enabled" json:"enabled"`
-	ForceHTTPS bool `yaml:"force_https" json:"force_https"`
+	Enabled    bool       `yaml:"enabled" json:"enabled"`
+	ForceHTTPS bool       `yaml:"force_https" json:"force_https"`
+	Issuer     string     `yaml:"issuer,omitempty" json:"issuer,omitempty"`       // Overrides the global certificate issuer for this domain
+	Challenge  string     `yaml:"challenge,omitempty" json:"challenge,omitempty"` // Overrides the global ACME challenge for this domain
+	IncludeWWW bool       `yaml:"include_www" json:"include_www"`                 // Also serve the www variant (or the apex of a www domain) from the same certificate
+	Policy     *TLSPolicy `yaml:"policy,omitempty" json:"policy,omitempty"`       // Overrides the global TLS policy for this domain
+	HSTS       HSTSRule   `yaml:"hsts" json:"hsts"`
+}
+
+// HSTSPreloadMinAge is the shortest max-age browser preload lists accept,
+// one year.
+const HSTSPreloadMinAge = 31536000
+
+// HSTSRule sets the Strict-Transport-Security header of HTTPS responses, which
+// makes browsers use only HTTPS for the domain until MaxAge runs out.
+// Preloading is hard to undo: browsers ship the domain as HTTPS-only, so it
+// requires a max-age of a year that includes subdomains.
+type HSTSRule struct {
+	MaxAge            int  `yaml:"max_age" json:"max_age"`                       // Seconds, 0 disables HSTS
+	IncludeSubDomains bool `yaml:"include_subdomains" json:"include_subdomains"` // Also applies to every subdomain
+	Preload           bool `yaml:"preload" json:"preload"`                       // Consent to inclusion in browser preload lists
+}
+
+// Validate checks that a preload request meets the preload list requirements.
+func (h HSTSRule) Validate() error {
+	if !h.Preload {
+		return nil
+	}
+	if h.MaxAge < HSTSPreloadMinAge {
+		return fmt.Errorf("HSTS preload requires max_age of at least %d seconds", HSTSPreloadMinAge)
+	}
+	if !h.IncludeSubDomains {
+		return fmt.Errorf("HSTS preload requires include_subdomains")
+	}
+	return nil
+}
+
+// Header returns the Strict-Transport-Security value, or "" if HSTS is
+// disabled. The preload directive is left out unless the rule is valid.
+func (h HSTSRule) Header() string {
+	if h.MaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.Itoa(h.MaxAge)
+	if h.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload && h.Validate() == nil {
+		value += "; preload"
+	}
+	return value
 }
 
 // ProxyRule defines a single reverse proxy routing rule.
 type ProxyRule struct {
-	Domain string    `yaml:"domain" json:"domain"`
-	Target string    `yaml:"target" json:"target"`
-	Cache  CacheRule `yaml:"cache" json:"cache"`
-	SSL    SSLRule   `yaml:"ssl" json:"ssl"`
+	Domain      string          `yaml:"domain" json:"domain"`
+	Target      string          `yaml:"target" json:"target"`
+	Passthrough bool            `yaml:"passthrough" json:"passthrough"` // Forward TLS connections by SNI to Target (host:port) without terminating them
+	Cache       CacheRule       `yaml:"cache" json:"cache"`
+	SSL         SSLRule         `yaml:"ssl" json:"ssl"`
+	UpstreamTLS UpstreamTLSRule `yaml:"upstream_tls,omitempty" json:"upstream_tls,omitempty"`
+	HealthCheck HealthCheckRule `yaml:"health_check,omitempty" json:"health_check,omitempty"`
+}
+
+// HealthCheckRule watches a rule's target. Failed requests and probes count
+// against it; after MaxFails consecutive failures the target is ejected and
+// requests are answered with 503, or a stale copy, until EjectTime passes or
+// a probe succeeds.
+type HealthCheckRule struct {
+	Path      string `yaml:"path,omitempty" json:"path,omitempty"`             // Probed with GET, e.g. "/healthz"; empty to only watch proxied requests
+	Interval  int    `yaml:"interval,omitempty" json:"interval,omitempty"`     // Seconds between probes, default 10
+	Timeout   int    `yaml:"timeout,omitempty" json:"timeout,omitempty"`       // Seconds per probe, default 5
+	MaxFails  int    `yaml:"max_fails,omitempty" json:"max_fails,omitempty"`   // Consecutive failures that eject the target, 0 never ejects
+	EjectTime int    `yaml:"eject_time,omitempty" json:"eject_time,omitempty"` // Seconds an ejected target is skipped, default 30
+}
+
+// UpstreamTLSRule pins the certificate an HTTPS target must present, so a
+// hijacked DNS entry of the backend can't receive proxied traffic. A matching
+// pin replaces the CA and hostname checks, which also admits self-signed
+// backends.
+type UpstreamTLSRule struct {
+	PinnedSPKI []string `yaml:"pinned_spki,omitempty" json:"pinned_spki,omitempty"` // Base64 SHA-256 hashes of accepted public keys (pin-sha256)
+	PinnedCert string   `yaml:"pinned_cert,omitempty" json:"pinned_cert,omitempty"` // PEM file of certificates accepted as they are
+}
+
+// Pinned reports whether any pin is configured.
+func (u UpstreamTLSRule) Pinned() bool {
+	return len(u.PinnedSPKI) > 0 || u.PinnedCert != ""
+}
+
+// SPKIHashes decodes PinnedSPKI. The "sha256//" prefix curl uses is accepted.
+func (u UpstreamTLSRule) SPKIHashes() ([][]byte, error) {
+	hashes := make([][]byte, 0, len(u.PinnedSPKI))
+	for _, pin := range u.PinnedSPKI {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: not a base64 SHA-256 hash", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Validate checks that the pins can be used.
+func (u UpstreamTLSRule) Validate() error {
+	if _, err := u.SPKIHashes(); err != nil {
+		return err
+	}
+	if u.PinnedCert != "" {
+		if _, err := os.Stat(u.PinnedCert); err != nil {
+			return fmt.Errorf("invalid pinned certificate: %v", err)
+		}
+	}
+	return nil
 }
 
 // CacheConfig defines global cache configuration settings.
 type CacheConfig struct {
-	DefaultTTL      int    `yaml:"default_ttl" json:"default_ttl"`
-	MaxSize         string `yaml:"max_size" json:"max_size"`
-	CleanupInterval int    `yaml:"cleanup_interval" json:"cleanup_interval"`
-	StorageType     string `yaml:"storage_type" json:"storage_type"`
-	CacheDir        string `yaml:"cache_dir" json:"cache_dir"`   // Directory for file-based cache
-	Persistent      bool   `yaml:"persistent" json:"persistent"` // If true, cache never expires
+	DefaultTTL         int     `yaml:"default_ttl" json:"default_ttl"`
+	MaxSize            string  `yaml:"max_size" json:"max_size"`
+	CleanupInterval    int     `yaml:"cleanup_interval" json:"cleanup_interval"`
+	StorageType        string  `yaml:"storage_type" json:"storage_type"`
+	CacheDir           string  `yaml:"cache_dir" json:"cache_dir"`                       // Directory for file-based cache
+	Persistent         bool    `yaml:"persistent" json:"persistent"`                     // If true, cache never expires
+	Compression        string  `yaml:"compression" json:"compression"`                   // On-disk compression for file cache: "gzip" or "none"
+	IndexFlushInterval int     `yaml:"index_flush_interval" json:"index_flush_interval"` // Seconds between file cache index writes, defaults to 5
+	DiskHighWatermark  float64 `yaml:"disk_high_watermark" json:"disk_high_watermark"`   // File cache evicts when the partition is this % full, 0 disables
+	DiskLowWatermark   float64 `yaml:"disk_low_watermark" json:"disk_low_watermark"`     // Eviction stops at this % full, defaults to high - 10
+	SnapshotFile       string  `yaml:"snapshot_file" json:"snapshot_file"`               // Memory cache is saved here on shutdown and restored on start
+
+	Purge        PurgeConfig        `yaml:"purge" json:"purge"`
+	Warm         WarmConfig         `yaml:"warm" json:"warm"`
+	Invalidation InvalidationConfig `yaml:"invalidation" json:"invalidation"`
+}
+
+// InvalidationConfig shares purge and clear operations between Saddy nodes
+// through a Redis pub/sub channel.
+type InvalidationConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Redis   string `yaml:"redis" json:"redis"`     // Redis URL, e.g. "redis://:password@10.0.0.5:6379/0"
+	Channel string `yaml:"channel" json:"channel"` // Defaults to "saddy:invalidation"
+}
+
+// WarmConfig defines URLs and sitemaps fetched through the proxy to pre-populate the cache.
+type WarmConfig struct {
+	Enabled     bool     `yaml:"enabled" json:"enabled"`
+	URLs        []string `yaml:"urls,omitempty" json:"urls,omitempty"`
+	Sitemaps    []string `yaml:"sitemaps,omitempty" json:"sitemaps,omitempty"`
+	Concurrency int      `yaml:"concurrency" json:"concurrency"` // Parallel requests, defaults to 4
+	Interval    int      `yaml:"interval" json:"interval"`       // Seconds between runs, 0 warms only at startup
+}
+
+// PurgeConfig controls CDN-style PURGE requests on the proxy listener.
+//
+// A PURGE request is accepted when the client IP is in AllowedIPs or it sends
+// Token in the X-Purge-Token header. With neither configured only loopback
+// clients may purge.
+type PurgeConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	AllowedIPs []string `yaml:"allowed_ips,omitempty" json:"allowed_ips,omitempty"`
+	Token      string   `yaml:"token,omitempty" json:"token,omitempty"`
 }
 
 // WebUIConfig defines configuration for the web admin interface.
 type WebUIConfig struct {
-	Enabled  bool   `yaml:"enabled" json:"enabled"`
-	Username string `yaml:"username" json:"username"`
-	Password string `yaml:"password" json:"password"`
+	Enabled          bool        `yaml:"enabled" json:"enabled"`
+	Username         string      `yaml:"username" json:"username"`
+	Password         string      `yaml:"password" json:"password"`
+	APITokens        []APIToken  `yaml:"api_tokens,omitempty" json:"api_tokens,omitempty"`   // Managed through the admin API
+	SessionTTL       int         `yaml:"session_ttl" json:"session_ttl"`                     // Lifetime of Web UI sessions in seconds, default 86400
+	TOTPSecret       string      `yaml:"totp_secret,omitempty" json:"totp_secret,omitempty"` // Base32 TOTP secret of Username, set by enrolling in the Web UI
+	LoginMaxAttempts int         `yaml:"login_max_attempts" json:"login_max_attempts"`       // Failed logins per IP before a lockout, default 5
+	LoginLockout     int         `yaml:"login_lockout" json:"login_lockout"`                 // Lockout duration in seconds, default 900
+	Users            []AdminUser `yaml:"users,omitempty" json:"users,omitempty"`             // Additional users; Username/Password is an admin
+}
+
+// Roles of admin users.
+const (
+	RoleViewer   = "viewer"   // Reads status, statistics, rules and certificates
+	RoleOperator = "operator" // Also manages proxy rules, the cache and certificates
+	RoleAdmin    = "admin"    // Everything, including the configuration, users and API tokens
+)
+
+// AdminUser is a Web UI and admin API user.
+type AdminUser struct {
+	Username   string `yaml:"username" json:"username"`
+	Password   string `yaml:"password" json:"password"`                           // bcrypt or argon2id hash, or plaintext
+	Role       string `yaml:"role" json:"role"`                                   // viewer, operator or admin
+	TOTPSecret string `yaml:"totp_secret,omitempty" json:"totp_secret,omitempty"` // Base32 secret for two-factor authentication
+}
+
+// Accounts returns every user who can log in: the Username/Password admin,
+// if set, followed by Users.
+func (w WebUIConfig) Accounts() []AdminUser {
+	accounts := make([]AdminUser, 0, len(w.Users)+1)
+	if w.Username != "" && w.Password != "" {
+		accounts = append(accounts, AdminUser{Username: w.Username, Password: w.Password, Role: RoleAdmin, TOTPSecret: w.TOTPSecret})
+	}
+	return append(accounts, w.Users...)
+}
+
+// Validate checks that users have a name, a password and a known role, and
+// that names are unique.
+func (w WebUIConfig) Validate() error {
+	seen := make(map[string]bool)
+	for _, user := range w.Accounts() {
+		if user.Username == "" || user.Password == "" {
+			return fmt.Errorf("web_ui users need a username and a password")
+		}
+		switch user.Role {
+		case RoleViewer, RoleOperator, RoleAdmin:
+		default:
+			return fmt.Errorf("user %s has an unknown role %q, expected viewer, operator or admin", user.Username, user.Role)
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("user %s is defined more than once", user.Username)
+		}
+		seen[user.Username] = true
+	}
+	return nil
+}
+
+// APIToken is a long-lived admin API credential for automation. Only the
+// SHA-256 hash of the token is kept.
+type APIToken struct {
+	ID        string    `yaml:"id" json:"id"`
+	Name      string    `yaml:"name" json:"name"`
+	Hash      string    `yaml:"hash" json:"hash"`
+	Scopes    []string  `yaml:"scopes" json:"scopes"`
+	CreatedAt time.Time `yaml:"created_at" json:"created_at"`
+	ExpiresAt time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty"` // Zero for tokens that don't expire
+}
+
+// HistoryConfig keeps previous versions of the configuration for rollback.
+type HistoryConfig struct {
+	Dir  string `yaml:"dir" json:"dir"`   // Directory of the versions, defaults to ./config-history
+	Keep int    `yaml:"keep" json:"keep"` // Versions kept, default 20
+}
+
+// WebhooksConfig sends runtime events, such as certificate renewals and
+// backends going down, to outside systems as they happen.
+type WebhooksConfig struct {
+	Endpoints      []WebhookEndpoint `yaml:"endpoints,omitempty" json:"endpoints,omitempty"`
+	CacheThreshold int               `yaml:"cache_threshold,omitempty" json:"cache_threshold,omitempty"` // Send cache_threshold when the cache is this percent full, 0 never
+}
+
+// WebhookEndpoint receives the events it subscribes to as POST requests.
+type WebhookEndpoint struct {
+	URL        string   `yaml:"url" json:"url"`
+	Events     []string `yaml:"events,omitempty" json:"events,omitempty"`           // Event types to send, all by default
+	Format     string   `yaml:"format,omitempty" json:"format,omitempty"`           // json (default), slack or pagerduty
+	Secret     string   `yaml:"secret,omitempty" json:"secret,omitempty"`           // Signs each body with HMAC-SHA256 in X-Saddy-Signature
+	RoutingKey string   `yaml:"routing_key,omitempty" json:"routing_key,omitempty"` // Integration key of the pagerduty format
 }
 
 // ProxyConfig contains all proxy routing rules.
@@ -67,22 +511,46 @@ type ProxyConfig struct {
 
 // Config represents the complete application configuration.
 type Config struct {
-	Server ServerConfig `yaml:"server" json:"server"`
-	Proxy  ProxyConfig  `yaml:"proxy" json:"proxy"`
-	Cache  CacheConfig  `yaml:"cache" json:"cache"`
-	WebUI  WebUIConfig  `yaml:"web_ui" json:"web_ui"`
+	Server   ServerConfig   `yaml:"server" json:"server"`
+	Proxy    ProxyConfig    `yaml:"proxy" json:"proxy"`
+	Cache    CacheConfig    `yaml:"cache" json:"cache"`
+	WebUI    WebUIConfig    `yaml:"web_ui" json:"web_ui"`
+	History  HistoryConfig  `yaml:"history" json:"history"`
+	Webhooks WebhooksConfig `yaml:"webhooks" json:"webhooks"`
+	Include  string         `yaml:"include,omitempty" json:"include,omitempty"` // Glob of files with more proxy rules, relative to this file, e.g. "conf.d/*.yaml"
+
+	path     string              // File the configuration was loaded from, where Save writes it
+	env      map[string]envValue // Values read from environment variables, by path
+	included map[string]string   // Files the included proxy rules came from, by domain
 }
 
-// LoadConfig loads configuration from a YAML file.
+// liveMu guards the configuration shared by the running servers against
+// Replace, Update and the rule changes. There is one per process, so
+// copies of a configuration needn't carry a lock.
+var liveMu sync.RWMutex
+
+// saveMu serializes saving, so that a save can't replace the files with an
+// older snapshot than the last one written.
+var saveMu sync.Mutex
+
+// LoadConfig loads configuration from a YAML file. References to
+// environment variables in its values, ${NAME} or ${NAME:-default}, are
+// replaced with their values, and saving the configuration writes them back.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	var config Config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	config := Config{path: path, env: make(map[string]envValue)}
+	if err := expandEnv(&document, "", config.env); err != nil {
+		return nil, err
+	}
+	if err := document.Decode(&config); err != nil {
 		return nil, err
 	}
 
@@ -97,46 +565,216 @@ func LoadConfig(path string) (*Config, error) {
 		config.Server.AdminPort = 8081
 	}
 
+	if err := config.loadIncludes(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
-// SaveConfig saves the current configuration to a YAML file.
+// Path returns the file the configuration was loaded from, or "" if it
+// wasn't loaded from a file.
+func (c *Config) Path() string {
+	return c.Snapshot().path
+}
+
+// Replace makes c a copy of next, keeping the file c is saved to. Unless
+// next was read from a file, the environment variable references and the
+// files of included proxy rules of c are kept as well. Requests being
+// served see either the old or the new configuration, through Snapshot
+// and GetProxyRule.
+func (c *Config) Replace(next *Config) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
+	path, env, included := c.path, c.env, c.included
+	*c = *next
+	c.path = path
+	if next.path == "" {
+		c.env, c.included = env, included
+	}
+}
+
+// Snapshot returns a copy of c that a later Replace, Update or rule change
+// leaves as it is. The copy shares lists with c, which are only replaced,
+// never changed in place, so it must be treated as read-only; changes go
+// through Update.
+func (c *Config) Snapshot() *Config {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	snapshot := *c
+	return &snapshot
+}
+
+// Update changes c through change, which must replace rather than modify
+// the lists of c, as snapshots share them.
+func (c *Config) Update(change func(*Config)) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	change(c)
+}
+
+// Save saves the configuration to the file it was loaded from.
+func (c *Config) Save() error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	snapshot := c.Snapshot()
+	if snapshot.path == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+	return snapshot.save(snapshot.path)
+}
+
+// SaveConfig saves the current configuration to a YAML file. The file is
+// replaced atomically, so a crash leaves either the old or the new
+// configuration, and the previous version is kept as path + ".bak".
+// Included proxy rules are saved to the files they came from instead.
 func (c *Config) SaveConfig(path string) error {
-	data, err := yaml.Marshal(c)
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	return c.Snapshot().save(path)
+}
+
+// save writes c to path and its included files. The caller holds saveMu.
+func (c *Config) save(path string) error {
+	if err := c.saveIncludes(); err != nil {
+		return err
+	}
+	data, err := c.marshal()
 	if err != nil {
 		return err
 	}
+	return replaceFile(path, data, true)
+}
+
+// replaceFile atomically replaces the file at path, or the target of a
+// symlink there, with data, optionally keeping the previous content as
+// path + ".bak".
+func replaceFile(path string, data []byte, backup bool) error {
+	// Replace the target of a symlinked configuration, not the link
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
 
-	return os.WriteFile(path, data, 0600)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if backup {
+		previous, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := os.WriteFile(path+".bak", previous, 0600); err != nil {
+				return fmt.Errorf("failed to back up %s: %v", path, err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
-// GetProxyRule retrieves a proxy rule for a specific domain.
+// GetProxyRule retrieves a proxy rule for a specific domain, or the wildcard
+// rule covering it, or the catch-all rule "*".
 func (c *Config) GetProxyRule(domain string) *ProxyRule {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+
 	for _, rule := range c.Proxy.Rules {
 		if rule.Domain == domain {
 			return &rule
 		}
 	}
+
+	// Fall back to a wildcard rule such as "*.example.com"
+	if i := strings.Index(domain, "."); i > 0 {
+		wildcard := "*" + domain[i:]
+		for _, rule := range c.Proxy.Rules {
+			if rule.Domain == wildcard {
+				return &rule
+			}
+		}
+	}
+
+	// The rule of the other www variant, if it includes this one
+	if variant := WWWVariant(domain); variant != "" {
+		for _, rule := range c.Proxy.Rules {
+			if rule.Domain == variant && rule.SSL.IncludeWWW {
+				return &rule
+			}
+		}
+	}
+
+	// The catch-all rule serves any other domain, e.g. customer domains
+	// with on-demand TLS
+	for _, rule := range c.Proxy.Rules {
+		if rule.Domain == "*" {
+			return &rule
+		}
+	}
 	return nil
 }
 
+// CertAliases returns the extra names bundled into the certificate of the
+// rule's domain.
+func (r *ProxyRule) CertAliases() []string {
+	if !r.SSL.IncludeWWW {
+		return nil
+	}
+	if variant := WWWVariant(r.Domain); variant != "" {
+		return []string{variant}
+	}
+	return nil
+}
+
+// WWWVariant returns the www subdomain of domain, or the parent of a www
+// domain: "www.example.com" for "example.com" and the other way around. It
+// returns "" for wildcards and names without a dot.
+func WWWVariant(domain string) string {
+	if strings.Contains(domain, "*") || !strings.Contains(domain, ".") || net.ParseIP(domain) != nil {
+		return ""
+	}
+	if parent, ok := strings.CutPrefix(domain, "www."); ok {
+		if !strings.Contains(parent, ".") {
+			return ""
+		}
+		return parent
+	}
+	return "www." + domain
+}
+
 // AddProxyRule adds or updates a proxy rule for a domain.
 func (c *Config) AddProxyRule(rule ProxyRule) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
 	// Remove existing rule for this domain if exists
-	for i, r := range c.Proxy.Rules {
-		if r.Domain == rule.Domain {
-			c.Proxy.Rules = append(c.Proxy.Rules[:i], c.Proxy.Rules[i+1:]...)
-			break
-		}
-	}
-	c.Proxy.Rules = append(c.Proxy.Rules, rule)
+	rules := slices.DeleteFunc(slices.Clone(c.Proxy.Rules), func(r ProxyRule) bool {
+		return r.Domain == rule.Domain
+	})
+	c.Proxy.Rules = append(rules, rule)
 }
 
 // RemoveProxyRule removes a proxy rule for a specific domain.
 func (c *Config) RemoveProxyRule(domain string) bool {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
 	for i, rule := range c.Proxy.Rules {
 		if rule.Domain == domain {
-			c.Proxy.Rules = append(c.Proxy.Rules[:i], c.Proxy.Rules[i+1:]...)
+			c.Proxy.Rules = slices.Delete(slices.Clone(c.Proxy.Rules), i, i+1)
 			return true
 		}
 	}
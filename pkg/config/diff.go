@@ -0,0 +1,338 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of changes reported by Diff.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// diffContext is the number of unchanged lines around each hunk of
+// UnifiedDiff.
+const diffContext = 3
+
+// maxDiffCells bounds the work of UnifiedDiff: past this many line pairs
+// the whole document is shown as replaced.
+const maxDiffCells = 4 << 20
+
+// Change is a setting that differs between two configurations. Path names
+// it like a ValidationError field, except that proxy rules are identified
+// by domain rather than position, e.g. "proxy.rules[example.com].target",
+// so moving a rule isn't reported as changing every rule after it.
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// Diff lists the settings that differ between current and next, sorted by
+// path except that proxy rules keep their order in next, followed by the
+// rules next removes.
+func Diff(current, next *Config) ([]Change, error) {
+	before, err := genericConfig(current)
+	if err != nil {
+		return nil, err
+	}
+	after, err := genericConfig(next)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	diffValues("", before, after, &changes)
+	return changes, nil
+}
+
+// genericConfig converts c to the maps and slices of its JSON document,
+// with proxy rules keyed by domain.
+func genericConfig(c *Config) (map[string]any, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	if proxy, ok := document["proxy"].(map[string]any); ok {
+		if rules, ok := proxy["rules"].([]any); ok {
+			list := keyedList{items: make(map[string]any, len(rules))}
+			for i, rule := range rules {
+				// Rules without a unique domain fall back to their position
+				key, _ := rule.(map[string]any)["domain"].(string)
+				if _, duplicate := list.items[key]; duplicate || key == "" {
+					key = fmt.Sprintf("#%d", i)
+				}
+				list.order = append(list.order, key)
+				list.items[key] = rule
+			}
+			proxy["rules"] = list
+		}
+	}
+	return document, nil
+}
+
+// keyedList is a list whose items are compared by key instead of position.
+type keyedList struct {
+	order []string
+	items map[string]any
+}
+
+func diffValues(path string, before, after any, changes *[]Change) {
+	switch b := before.(type) {
+	case map[string]any:
+		if a, ok := after.(map[string]any); ok {
+			for _, key := range mergedKeys(b, a) {
+				diffChild(joinPath(path, key), b, a, key, changes)
+			}
+			return
+		}
+	case keyedList:
+		if a, ok := after.(keyedList); ok {
+			for _, key := range mergedOrder(b.order, a.order) {
+				diffChild(path+"["+key+"]", b.items, a.items, key, changes)
+			}
+			return
+		}
+	case []any:
+		if a, ok := after.([]any); ok && len(a) == len(b) {
+			for i := range b {
+				diffValues(fmt.Sprintf("%s[%d]", path, i), b[i], a[i], changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, Change{Path: path, Kind: ChangeModified, Old: plain(before), New: plain(after)})
+	}
+}
+
+func diffChild(path string, before, after map[string]any, key string, changes *[]Change) {
+	b, inBefore := before[key]
+	a, inAfter := after[key]
+	switch {
+	case !inAfter:
+		*changes = append(*changes, Change{Path: path, Kind: ChangeRemoved, Old: plain(b)})
+	case !inBefore:
+		*changes = append(*changes, Change{Path: path, Kind: ChangeAdded, New: plain(a)})
+	default:
+		diffValues(path, b, a, changes)
+	}
+}
+
+// plain converts keyed lists back to lists for reporting.
+func plain(value any) any {
+	list, ok := value.(keyedList)
+	if !ok {
+		return value
+	}
+	items := make([]any, 0, len(list.order))
+	for _, key := range list.order {
+		items = append(items, list.items[key])
+	}
+	return items
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// mergedKeys returns the keys of both maps, sorted.
+func mergedKeys(before, after map[string]any) []string {
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, exists := before[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergedOrder returns the keys of after in order, with those only in
+// before after them.
+func mergedOrder(before, after []string) []string {
+	seen := make(map[string]bool, len(after))
+	keys := append([]string(nil), after...)
+	for _, key := range after {
+		seen[key] = true
+	}
+	for _, key := range before {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// UnifiedDiff returns the difference between the YAML documents of current
+// and next in unified diff format, or "" if they are the same.
+func UnifiedDiff(current, next *Config, currentName, nextName string) (string, error) {
+	before, err := yaml.Marshal(current)
+	if err != nil {
+		return "", err
+	}
+	after, err := yaml.Marshal(next)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(splitLines(string(before)), splitLines(string(after)), currentName, nextName), nil
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLine is one line of an edit script: ' ' kept, '-' removed or '+' added.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// editScript turns a into b with the fewest removed and added lines, using
+// their longest common subsequence.
+func editScript(a, b []string) []diffLine {
+	if len(a)*len(b) > maxDiffCells {
+		script := make([]diffLine, 0, len(a)+len(b))
+		for _, line := range a {
+			script = append(script, diffLine{'-', line})
+		}
+		for _, line := range b {
+			script = append(script, diffLine{'+', line})
+		}
+		return script
+	}
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	script := make([]diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			script = append(script, diffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, diffLine{'-', a[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return script
+}
+
+func unifiedDiff(a, b []string, aName, bName string) string {
+	script := editScript(a, b)
+
+	var out strings.Builder
+	for start := 0; start < len(script); {
+		// Find the next change and the hunk around it
+		first := start
+		for first < len(script) && script[first].op == ' ' {
+			first++
+		}
+		if first == len(script) {
+			break
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		hunkStart := max(first-diffContext, start)
+		end := first
+		for unchanged := 0; end < len(script) && unchanged <= 2*diffContext; end++ {
+			if script[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		// end is past the last change plus up to 2*diffContext+1 kept lines
+		last := end - 1
+		for last > first && script[last].op == ' ' {
+			last--
+		}
+		hunkEnd := min(last+1+diffContext, len(script))
+
+		// Line numbers of the hunk in a and b, counting from 1
+		aLine, bLine := 1, 1
+		for _, line := range script[:hunkStart] {
+			if line.op != '+' {
+				aLine++
+			}
+			if line.op != '-' {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, line := range script[hunkStart:hunkEnd] {
+			if line.op != '+' {
+				aCount++
+			}
+			if line.op != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+		for _, line := range script[hunkStart:hunkEnd] {
+			out.WriteByte(line.op)
+			out.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = hunkEnd
+	}
+	return out.String()
+}
+
+// hunkRange formats the start and length of a hunk; an empty range starts
+// at the line before it.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	default:
+		return fmt.Sprintf("%d,%d", start, count)
+	}
+}
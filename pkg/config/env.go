@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envReference matches ${NAME} and ${NAME:-default} in configuration values.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// envValue is a configuration value read from environment variables.
+type envValue struct {
+	Reference string // As written in the file, e.g. ${ADMIN_PASSWORD}
+	Value     string // As expanded
+}
+
+// expandEnv replaces the environment variable references in the values of a
+// YAML document, so that secrets can be kept out of the configuration file.
+// ${NAME:-default} uses default when NAME is unset or empty, ${NAME} requires
+// NAME to be set. The expanded values are recorded in env by their path,
+// e.g. "proxy.rules[0].target".
+func expandEnv(node *yaml.Node, path string, env map[string]envValue) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := expandEnv(child, path, env); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if err := expandEnv(child, fmt.Sprintf("%s[%d]", path, i), env); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		// Keys are names, not values
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnv(node.Content[i], joinPath(path, node.Content[i-1].Value), env); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		var missing string
+		value := envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			match := envReference.FindStringSubmatch(reference)
+			value, ok := os.LookupEnv(match[1])
+			switch {
+			case strings.Contains(reference, ":-") && value == "":
+				return match[2]
+			case !ok && missing == "":
+				missing = match[1]
+			}
+			return value
+		})
+		if missing != "" {
+			return fmt.Errorf("line %d: environment variable %s is not set", node.Line, missing)
+		}
+		if value == node.Value {
+			return nil
+		}
+		env[path] = envValue{Reference: node.Value, Value: value}
+		node.Value = value
+		// Let a plain value like ${PORT} be a number or a boolean
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	}
+	return nil
+}
+
+// marshal encodes c as YAML, without the included proxy rules and with the
+// values read from environment variables written as the references they
+// came from, as long as they weren't changed.
+func (c *Config) marshal() ([]byte, error) {
+	main := *c
+	main.Proxy.Rules = c.mainRules()
+	if len(c.env) == 0 {
+		return yaml.Marshal(&main)
+	}
+	var document yaml.Node
+	if err := document.Encode(&main); err != nil {
+		return nil, err
+	}
+	restoreEnv(&document, "", c.env)
+	return yaml.Marshal(&document)
+}
+
+// restoreEnv undoes expandEnv on an encoded configuration.
+func restoreEnv(node *yaml.Node, path string, env map[string]envValue) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			restoreEnv(child, path, env)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			restoreEnv(child, fmt.Sprintf("%s[%d]", path, i), env)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			restoreEnv(node.Content[i], joinPath(path, node.Content[i-1].Value), env)
+		}
+	case yaml.ScalarNode:
+		if expanded, ok := env[path]; ok && expanded.Value == node.Value {
+			node.Value = expanded.Reference
+			node.Tag = "!!str"
+			node.Style = 0
+		}
+	}
+}
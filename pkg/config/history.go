@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultHistoryDir  = "./config-history"
+	defaultHistoryKeep = 20
+	historyIndexFile   = "index.json"
+)
+
+// ErrVersionNotFound is returned for versions that were never recorded or
+// were pruned.
+var ErrVersionNotFound = errors.New("configuration version not found")
+
+// Version describes a recorded configuration.
+type Version struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Author  string    `json:"author"`  // User or API token that made the change
+	Message string    `json:"message"` // What changed
+}
+
+// History keeps the last versions of the configuration in a directory, one
+// YAML file per version and an index of their metadata. Versions are
+// numbered from 1 and never reused.
+type History struct {
+	mu   sync.Mutex
+	dir  string
+	keep int
+}
+
+// NewHistory returns the history configured in cfg.
+func NewHistory(cfg HistoryConfig) *History {
+	h := &History{dir: cfg.Dir, keep: cfg.Keep}
+	if h.dir == "" {
+		h.dir = defaultHistoryDir
+	}
+	if h.keep <= 0 {
+		h.keep = defaultHistoryKeep
+	}
+	return h
+}
+
+// Record stores c as a new version, unless it is the same as the latest
+// one, and prunes the oldest versions beyond the limit. It returns the
+// latest version.
+func (h *History) Record(c *Config, author, message string) (*Version, error) {
+	data, err := yaml.Marshal(c.Snapshot())
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.index()
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if stored, err := os.ReadFile(h.versionFile(latest.Version)); err == nil && bytes.Equal(stored, data) {
+			return &latest, nil
+		}
+	}
+
+	version := Version{Version: 1, Time: time.Now().UTC(), Author: author, Message: message}
+	if len(versions) > 0 {
+		version.Version = versions[len(versions)-1].Version + 1
+	}
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return nil, err
+	}
+	// Versions hold password hashes and secrets like the configuration file
+	if err := os.WriteFile(h.versionFile(version.Version), data, 0600); err != nil {
+		return nil, err
+	}
+	versions = append(versions, version)
+
+	for len(versions) > h.keep {
+		_ = os.Remove(h.versionFile(versions[0].Version)) //nolint:errcheck
+		versions = versions[1:]
+	}
+	if err := h.writeIndex(versions); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// List returns the recorded versions, newest first.
+func (h *History) List() ([]Version, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.index()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// Load returns a recorded version and its configuration.
+func (h *History) Load(version int) (*Version, *Config, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.index()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range versions {
+		if v.Version != version {
+			continue
+		}
+		data, err := os.ReadFile(h.versionFile(version))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrVersionNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var config Config
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, nil, fmt.Errorf("version %d: %v", version, err)
+		}
+		return &v, &config, nil
+	}
+	return nil, nil, ErrVersionNotFound
+}
+
+func (h *History) versionFile(version int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%d.yaml", version))
+}
+
+// index reads the metadata of the recorded versions, oldest first.
+func (h *History) index() ([]Version, error) {
+	data, err := os.ReadFile(filepath.Join(h.dir, historyIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("configuration history index: %v", err)
+	}
+	return versions, nil
+}
+
+// writeIndex replaces the index atomically, so a crash can't lose the
+// history.
+func (h *History) writeIndex(versions []Version) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(h.dir, historyIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(h.dir, historyIndexFile))
+}
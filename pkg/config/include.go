@@ -0,0 +1,168 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IncludePattern returns the glob of the included proxy rule files,
+// relative to the working directory, or "" if nothing is included.
+func (c *Config) IncludePattern() string {
+	if c.Include == "" || filepath.IsAbs(c.Include) || c.path == "" {
+		return c.Include
+	}
+	return filepath.Join(filepath.Dir(c.path), c.Include)
+}
+
+// loadIncludes appends the proxy rules of the files matching Include, in
+// the order of their names, so that each site can live in a file of its own
+// that provisioning tools drop in or remove.
+func (c *Config) loadIncludes() error {
+	pattern := c.IncludePattern()
+	if pattern == "" {
+		return nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("include %s: %v", c.Include, err)
+	}
+	c.included = make(map[string]string)
+	for _, file := range files {
+		rules, _, _, err := readRuleFile(file)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			c.included[rule.Domain] = file
+		}
+		c.Proxy.Rules = append(c.Proxy.Rules, rules...)
+	}
+	return nil
+}
+
+// readRuleFile reads an included file, holding one proxy rule or a list of
+// them. It also reports whether the file holds a single rule and the values
+// read from environment variables.
+func readRuleFile(name string) ([]ProxyRule, bool, map[string]envValue, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, false, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	env := make(map[string]envValue)
+	if err := expandEnv(&document, "", env); err != nil {
+		return nil, false, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(document.Content) == 0 {
+		return nil, false, env, nil
+	}
+
+	switch root := document.Content[0]; root.Kind {
+	case yaml.MappingNode:
+		var rule ProxyRule
+		if err := root.Decode(&rule); err != nil {
+			return nil, false, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return []ProxyRule{rule}, true, env, nil
+	case yaml.SequenceNode:
+		var rules []ProxyRule
+		if err := root.Decode(&rules); err != nil {
+			return nil, false, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return rules, false, env, nil
+	default:
+		return nil, false, nil, fmt.Errorf("%s: expected a proxy rule or a list of them", name)
+	}
+}
+
+// mainRules returns the proxy rules that weren't included from other files.
+func (c *Config) mainRules() []ProxyRule {
+	if len(c.included) == 0 {
+		return c.Proxy.Rules
+	}
+	var rules []ProxyRule
+	for _, rule := range c.Proxy.Rules {
+		if _, ok := c.included[rule.Domain]; !ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// saveIncludes writes the included proxy rules back to the files they came
+// from. Files whose rules didn't change are left as they are, files left
+// without rules are removed, and files removed since they were loaded are
+// not brought back.
+func (c *Config) saveIncludes() error {
+	files := make(map[string][]ProxyRule)
+	for _, file := range c.included {
+		files[file] = nil
+	}
+	for _, rule := range c.Proxy.Rules {
+		if file, ok := c.included[rule.Domain]; ok {
+			files[file] = append(files[file], rule)
+		}
+	}
+	names := make([]string, 0, len(files))
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+
+	for _, file := range names {
+		rules := files[file]
+		current, single, env, err := readRuleFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		before, err := yaml.Marshal(current)
+		if err != nil {
+			return err
+		}
+		after, err := yaml.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+
+		var document yaml.Node
+		if single && len(rules) == 1 {
+			err = document.Encode(rules[0])
+		} else {
+			err = document.Encode(rules)
+		}
+		if err != nil {
+			return err
+		}
+		restoreEnv(&document, "", env)
+		data, err := yaml.Marshal(&document)
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(file, data, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms supported by HashPassword.
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+)
+
+// PasswordHashCost is the bcrypt cost of hashes made by HashPassword.
+const PasswordHashCost = 12
+
+// HashPassword returns a hash of password for web_ui.password, using
+// algorithm PasswordBcrypt (the default) or PasswordArgon2id.
+func HashPassword(password, algorithm string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+
+	switch algorithm {
+	case "", PasswordBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return string(hash), nil
+	case PasswordArgon2id:
+		hash, err := hashArgon2id(password)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return hash, nil
+	default:
+		return "", fmt.Errorf("unsupported password hash algorithm: %s", algorithm)
+	}
+}
+
+// IsPasswordHash reports whether password is a bcrypt ("$2a$", "$2b$",
+// "$2y$") or argon2id ("$argon2id$") hash rather than a plaintext password.
+func IsPasswordHash(password string) bool {
+	return isBcryptHash(password) || strings.HasPrefix(password, "$argon2id$")
+}
+
+func isBcryptHash(password string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(password, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPassword reports whether password matches the configured one, which
+// is a bcrypt or argon2id hash or, for older configurations, plaintext.
+func (w WebUIConfig) CheckPassword(password string) bool {
+	return checkPassword(w.Password, password)
+}
+
+// CheckPassword reports whether password matches the user's.
+func (u AdminUser) CheckPassword(password string) bool {
+	return checkPassword(u.Password, password)
+}
+
+func checkPassword(stored, password string) bool {
+	switch {
+	case isBcryptHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return checkArgon2id(stored, password)
+	default:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+	}
+}
+
+// checkArgon2id verifies password against a hash in the PHC string format
+// used by the argon2 reference tools:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func checkArgon2id(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+// hashArgon2id returns an argon2id hash of password in the PHC string
+// format accepted by CheckPassword.
+func hashArgon2id(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	const memory, time, threads = 64 * 1024, 3, 4
+	hash := argon2.IDKey([]byte(password), salt, time, memory, threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
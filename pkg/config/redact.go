@@ -0,0 +1,75 @@
+package config
+
+import "slices"
+
+// RedactedSecret replaces credentials in the configurations answered by the
+// admin API. Sent back in an update, it keeps the running value.
+const RedactedSecret = "********"
+
+// Redacted returns a copy of c with its credentials, such as password
+// hashes, TOTP secrets and the keys of DNS providers and storages, replaced
+// by RedactedSecret.
+func (c *Config) Redacted() *Config {
+	redacted := *c.Snapshot()
+	redacted.WebUI.Users = slices.Clone(redacted.WebUI.Users)
+	redacted.WebUI.APITokens = slices.Clone(redacted.WebUI.APITokens)
+	redacted.Webhooks.Endpoints = slices.Clone(redacted.Webhooks.Endpoints)
+	for _, secret := range redacted.secrets() {
+		if *secret != "" {
+			*secret = RedactedSecret
+		}
+	}
+	return &redacted
+}
+
+// RestoreSecrets replaces the RedactedSecret values of c with those of
+// current, so that a redacted configuration can be sent back as it was
+// received. Secrets current doesn't have are cleared.
+func (c *Config) RestoreSecrets(current *Config) {
+	known := current.secrets()
+	for path, secret := range c.secrets() {
+		if *secret != RedactedSecret {
+			continue
+		}
+		*secret = ""
+		if value, ok := known[path]; ok {
+			*secret = *value
+		}
+	}
+}
+
+// secrets returns the credentials of c by their path. Users are keyed by
+// name and webhooks by URL, so that secrets follow them when the lists are
+// reordered.
+func (c *Config) secrets() map[string]*string {
+	tls := &c.Server.TLS
+	secrets := map[string]*string{
+		"server.tls.eab_hmac_key":                  &tls.EABHMACKey,
+		"server.tls.storage.redis":                 &tls.Storage.Redis,
+		"server.tls.storage.dsn":                   &tls.Storage.DSN,
+		"server.tls.storage.secret_access_key":     &tls.Storage.SecretAccessKey,
+		"server.tls.storage.encryption_passphrase": &tls.Storage.EncryptionPassphrase,
+		"server.tls.dns.api_token":                 &tls.DNS.APIToken,
+		"server.tls.dns.secret_access_key":         &tls.DNS.SecretAccessKey,
+		"server.tls.notify.smtp.password":          &tls.Notify.SMTP.Password,
+		"cache.purge.token":                        &c.Cache.Purge.Token,
+		"cache.invalidation.redis":                 &c.Cache.Invalidation.Redis,
+		"web_ui.password":                          &c.WebUI.Password,
+		"web_ui.totp_secret":                       &c.WebUI.TOTPSecret,
+	}
+	for i := range c.WebUI.Users {
+		user := &c.WebUI.Users[i]
+		secrets["web_ui.users["+user.Username+"].password"] = &user.Password
+		secrets["web_ui.users["+user.Username+"].totp_secret"] = &user.TOTPSecret
+	}
+	for i := range c.WebUI.APITokens {
+		token := &c.WebUI.APITokens[i]
+		secrets["web_ui.api_tokens["+token.ID+"].hash"] = &token.Hash
+	}
+	for i := range c.Webhooks.Endpoints {
+		endpoint := &c.Webhooks.Endpoints[i]
+		secrets["webhooks.endpoints["+endpoint.URL+"].secret"] = &endpoint.Secret
+		secrets["webhooks.endpoints["+endpoint.URL+"].routing_key"] = &endpoint.RoutingKey
+	}
+	return secrets
+}
@@ -0,0 +1,613 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/events"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem with one field of a configuration, which is
+// named by its path, e.g. "proxy.rules[2].target".
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists every problem found in a configuration.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...any) {
+	*e = append(*e, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// CheckConfig decodes a configuration document, format "yaml" or "json",
+// and returns it with every problem found: syntax and type errors, fields
+// that don't exist, and the problems Validate reports. The configuration is
+// nil if the document can't be decoded.
+func CheckConfig(data []byte, format string) (*Config, ValidationErrors) {
+	var config Config
+	var document any
+	var err error
+	switch format {
+	case "json":
+		if err = json.Unmarshal(data, &document); err == nil {
+			err = json.Unmarshal(data, &config)
+		}
+	case "yaml":
+		if err = yaml.Unmarshal(data, &document); err == nil {
+			err = yaml.Unmarshal(data, &config)
+		}
+	default:
+		return nil, ValidationErrors{{Message: "unsupported format " + strconv.Quote(format) + ", expected yaml or json"}}
+	}
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, ValidationErrors{{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}}
+		}
+		return nil, ValidationErrors{{Message: "invalid " + format + ": " + err.Error()}}
+	}
+
+	var errs ValidationErrors
+	unknownFields(document, reflect.TypeOf(config), "", &errs)
+	var invalid ValidationErrors
+	if errors.As(config.Validate(), &invalid) {
+		errs = append(errs, invalid...)
+	}
+	return &config, errs
+}
+
+// unknownFields reports the keys of a decoded document that have no field in
+// t. Keys are matched against the json tags, which equal the yaml ones.
+func unknownFields(value any, t reflect.Type, path string, errs *ValidationErrors) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		document, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		keys := make([]string, 0, len(document))
+		for key := range document {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := joinField(path, key)
+			if fieldType, ok := fields[key]; ok {
+				unknownFields(document[key], fieldType, field, errs)
+			} else {
+				errs.add(field, "unknown field")
+			}
+		}
+	case reflect.Slice:
+		list, ok := value.([]any)
+		if !ok {
+			return
+		}
+		for i, item := range list {
+			unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Validate checks a configuration before it is used: URLs, ports, host
+// names, known values of enumerations, duplicate proxy domains and
+// listeners that would conflict. It returns ValidationErrors, or nil.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	c.Server.validate(&errs)
+	for i := range c.Proxy.Rules {
+		c.Proxy.Rules[i].validate(fmt.Sprintf("proxy.rules[%d]", i), &errs)
+	}
+	c.Proxy.validateDomains(&errs)
+	c.Cache.validate(&errs)
+	if err := c.WebUI.Validate(); err != nil {
+		errs.add("web_ui", "%v", err)
+	}
+	nonNegative(&errs, map[string]int{"history.keep": c.History.Keep})
+	c.Webhooks.validate(&errs)
+	if _, err := filepath.Match(c.Include, ""); err != nil {
+		errs.add("include", "must be a valid glob pattern")
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (s *ServerConfig) validate(errs *ValidationErrors) {
+	if s.Host != "" && net.ParseIP(s.Host) == nil && !validHostname(s.Host) {
+		errs.add("server.host", "must be an IP address or host name")
+	}
+	if s.Port != 0 && !validPort(s.Port) {
+		errs.add("server.port", "must be between 1 and 65535")
+	}
+	if s.AdminPort != 0 && !validPort(s.AdminPort) {
+		errs.add("server.admin_port", "must be between 1 and 65535")
+	}
+
+	admin := s.Admin
+	if path, ok := strings.CutPrefix(admin.Listen, "unix:"); ok {
+		if path == "" {
+			errs.add("server.admin.listen", "needs a socket path after unix:")
+		}
+	} else if admin.Listen != "" {
+		if _, port, err := net.SplitHostPort(admin.Listen); err != nil || !validPortString(port) {
+			errs.add("server.admin.listen", "must be host:port or unix:/path/to/socket")
+		}
+	}
+	switch admin.TLS {
+	case "", AdminTLSSelfSigned:
+	case AdminTLSACME:
+		if !s.AutoHTTPS {
+			errs.add("server.admin.tls", "acme requires server.auto_https")
+		}
+		if admin.Domain == "" {
+			errs.add("server.admin.domain", "is required for acme")
+		}
+	case AdminTLSFiles:
+		if admin.CertFile == "" || admin.KeyFile == "" {
+			errs.add("server.admin.tls", "files requires cert_file and key_file")
+		}
+	default:
+		errs.add("server.admin.tls", "unknown value %q, expected acme, self_signed or files", admin.TLS)
+	}
+	validateIPs("server.admin.allowed_ips", admin.AllowedIPs, errs)
+	if admin.RateLimit.Requests < 0 {
+		errs.add("server.admin.rate_limit.requests", "must not be negative")
+	}
+	if admin.RateLimit.Writes < 0 {
+		errs.add("server.admin.rate_limit.writes", "must not be negative")
+	}
+	if path := admin.MetricsPath; path != "" {
+		if path[0] != '/' || path == "/" {
+			errs.add("server.admin.metrics_path", "must be a path below /, e.g. /metrics")
+		} else if reservedAdminPath(path) {
+			errs.add("server.admin.metrics_path", "%s is used by the admin interface", path)
+		}
+	}
+
+	s.TLS.validate(errs)
+	s.validateListeners(errs)
+}
+
+// reservedAdminPath reports whether path is served by the admin interface.
+func reservedAdminPath(path string) bool {
+	for _, prefix := range []string{"/api", "/static", "/login", "/logout", "/healthz", "/readyz"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateListeners reports listeners that would bind the same address.
+func (s *ServerConfig) validateListeners(errs *ValidationErrors) {
+	host := s.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port, adminPort := s.Port, s.AdminPort
+	if port == 0 {
+		port = 8080
+	}
+	if adminPort == 0 {
+		adminPort = 8081
+	}
+
+	type listener struct{ field, addr string }
+	main := listener{"server.port", net.JoinHostPort(host, strconv.Itoa(port))}
+	var listeners []listener
+	if s.AutoHTTPS {
+		// Mirrors how the HTTPS proxy starts its listeners
+		listeners = append(listeners, listener{"server.auto_https", net.JoinHostPort(host, "443")})
+		challenge := s.TLS.ChallengeAddress
+		if challenge == "" {
+			challenge = net.JoinHostPort(host, "80")
+		}
+		if challenge != ChallengeOnMainListener {
+			listeners = append(listeners, listener{"server.tls.challenge_address", challenge})
+		}
+		if main.addr != challenge && port != 443 {
+			listeners = append(listeners, main)
+		}
+	} else {
+		listeners = append(listeners, main)
+	}
+	admin := listener{"server.admin_port", net.JoinHostPort(host, strconv.Itoa(adminPort))}
+	if s.Admin.Listen != "" {
+		admin = listener{"server.admin.listen", s.Admin.Listen}
+	}
+	listeners = append(listeners, admin)
+
+	for i, a := range listeners {
+		for _, b := range listeners[i+1:] {
+			if listenersConflict(a.addr, b.addr) {
+				errs.add(b.field, "listens on %s, which conflicts with %s", b.addr, a.field)
+			}
+		}
+	}
+}
+
+// listenersConflict reports whether two listen addresses share a port on
+// the same or an unspecified host.
+func listenersConflict(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return hostA == hostB || unspecified(hostA) || unspecified(hostB)
+}
+
+func (t *TLSConfig) validate(errs *ValidationErrors) {
+	if t.DirectoryURL != "" && strings.Contains(t.DirectoryURL, "://") && !validURL(t.DirectoryURL) {
+		errs.add("server.tls.acme_directory_url", "must be an http(s) URL or a CA name")
+	}
+	switch t.Issuer {
+	case "", "acme", "internal":
+	default:
+		errs.add("server.tls.issuer", "unknown value %q, expected acme or internal", t.Issuer)
+	}
+	validateChallenge("server.tls.challenge", t.Challenge, errs)
+	if t.Challenge == "dns-01" && t.DNS.Provider == "" {
+		errs.add("server.tls.dns.provider", "is required for dns-01 challenges")
+	}
+	switch t.DNS.Provider {
+	case "", "cloudflare", "route53", "digitalocean":
+	case "webhook":
+		if !validURL(t.DNS.WebhookURL) {
+			errs.add("server.tls.dns.webhook_url", "must be an http(s) URL")
+		}
+	default:
+		errs.add("server.tls.dns.provider", "unknown value %q, expected cloudflare, route53, digitalocean or webhook", t.DNS.Provider)
+	}
+	switch t.Storage.Type {
+	case "", "file":
+	case "redis":
+		if t.Storage.Redis == "" {
+			errs.add("server.tls.storage.redis", "is required for redis storage")
+		}
+	case "sql":
+		if t.Storage.Driver == "" || t.Storage.DSN == "" {
+			errs.add("server.tls.storage", "sql storage requires driver and dsn")
+		}
+	case "s3":
+		if t.Storage.Bucket == "" {
+			errs.add("server.tls.storage.bucket", "is required for s3 storage")
+		}
+	default:
+		errs.add("server.tls.storage.type", "unknown value %q, expected file, redis, sql or s3", t.Storage.Type)
+	}
+	if t.OnDemand.Enabled && !validURL(t.OnDemand.Ask) {
+		errs.add("server.tls.on_demand.ask", "must be an http(s) URL when on-demand TLS is enabled")
+	}
+	if t.Notify.WebhookURL != "" && !validURL(t.Notify.WebhookURL) {
+		errs.add("server.tls.notify.webhook_url", "must be an http(s) URL")
+	}
+	if t.Notify.SMTP.Host != "" && len(t.Notify.SMTP.To) == 0 {
+		errs.add("server.tls.notify.smtp.to", "needs at least one recipient")
+	}
+	nonNegative(errs, map[string]int{
+		"server.tls.renewal_days":            t.RenewalDays,
+		"server.tls.renewal_interval":        t.RenewalInterval,
+		"server.tls.renewal_jitter":          t.RenewalJitter,
+		"server.tls.session_ticket_rotation": t.SessionTicketRotation,
+		"server.tls.notify.expiry_days":      t.Notify.ExpiryDays,
+	})
+	t.Policy.validate("server.tls.policy", errs)
+}
+
+func (w *WebhooksConfig) validate(errs *ValidationErrors) {
+	for i, endpoint := range w.Endpoints {
+		field := fmt.Sprintf("webhooks.endpoints[%d]", i)
+		if !validURL(endpoint.URL) {
+			errs.add(field+".url", "must be an http(s) URL")
+		}
+		for _, event := range endpoint.Events {
+			if !slices.Contains(events.Types, event) {
+				errs.add(field+".events", "unknown event type %q", event)
+			}
+		}
+		switch endpoint.Format {
+		case "", "json", "slack":
+		case "pagerduty":
+			if endpoint.RoutingKey == "" {
+				errs.add(field+".routing_key", "is required for the pagerduty format")
+			}
+		default:
+			errs.add(field+".format", "unknown value %q, expected json, slack or pagerduty", endpoint.Format)
+		}
+	}
+	if w.CacheThreshold < 0 || w.CacheThreshold > 100 {
+		errs.add("webhooks.cache_threshold", "must be between 0 and 100")
+	}
+}
+
+func validateChallenge(field, challenge string, errs *ValidationErrors) {
+	switch challenge {
+	case "", "http-01", "dns-01":
+	default:
+		errs.add(field, "unknown value %q, expected http-01 or dns-01", challenge)
+	}
+}
+
+func (p *TLSPolicy) validate(field string, errs *ValidationErrors) {
+	for _, version := range []struct{ name, value string }{{"min_version", p.MinVersion}, {"max_version", p.MaxVersion}} {
+		switch version.value {
+		case "", "1.0", "1.1", "1.2", "1.3":
+		default:
+			errs.add(field+"."+version.name, "unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version.value)
+		}
+	}
+	switch p.ClientAuth {
+	case "":
+	case "require", "optional":
+		if p.ClientCA == "" {
+			errs.add(field+".client_ca", "is required for client_auth")
+		}
+	default:
+		errs.add(field+".client_auth", "unknown value %q, expected require or optional", p.ClientAuth)
+	}
+}
+
+func (r *ProxyRule) validate(field string, errs *ValidationErrors) {
+	switch {
+	case r.Domain == "":
+		errs.add(field+".domain", "is required")
+	case strings.ContainsAny(r.Domain, ":/"):
+		errs.add(field+".domain", "must be a host name without scheme, port or path")
+	case r.Domain != "*" && !validHostname(strings.TrimPrefix(r.Domain, "*.")) && net.ParseIP(r.Domain) == nil:
+		errs.add(field+".domain", "must be a host name, *.domain or *")
+	}
+
+	switch {
+	case r.Target == "":
+		errs.add(field+".target", "is required")
+	case r.Passthrough:
+		host, port := r.Target, "443"
+		if strings.Contains(r.Target, "://") {
+			errs.add(field+".target", "must be host:port for passthrough rules, without a scheme")
+			break
+		}
+		if h, p, err := net.SplitHostPort(r.Target); err == nil {
+			host, port = h, p
+		}
+		if host == "" || !validPortString(port) {
+			errs.add(field+".target", "must be host:port")
+		}
+	case !validURL(r.Target):
+		errs.add(field+".target", "must be an http or https URL")
+	}
+
+	if r.Cache.Enabled {
+		cacheRule := r.Cache
+		validateSize(field+".cache.max_size", cacheRule.MaxSize, errs)
+		validateSize(field+".cache.max_object_size", cacheRule.MaxObjectSize, errs)
+		nonNegative(errs, map[string]int{
+			field + ".cache.ttl":            cacheRule.TTL,
+			field + ".cache.stale_if_error": cacheRule.StaleIfError,
+			field + ".cache.negative_ttl":   cacheRule.NegativeTTL,
+		})
+		for i, pathTTL := range cacheRule.PathTTL {
+			if pathTTL.TTL < 0 {
+				errs.add(fmt.Sprintf("%s.cache.path_ttl[%d].ttl", field, i), "must not be negative")
+			}
+		}
+		validateIPs(field+".cache.bypass.allowed_ips", cacheRule.Bypass.AllowedIPs, errs)
+	}
+
+	if r.SSL.Issuer != "" && r.SSL.Issuer != "acme" && r.SSL.Issuer != "internal" {
+		errs.add(field+".ssl.issuer", "unknown value %q, expected acme or internal", r.SSL.Issuer)
+	}
+	validateChallenge(field+".ssl.challenge", r.SSL.Challenge, errs)
+	if r.SSL.Policy != nil {
+		r.SSL.Policy.validate(field+".ssl.policy", errs)
+	}
+	if err := r.SSL.HSTS.Validate(); err != nil {
+		errs.add(field+".ssl.hsts", "%v", err)
+	}
+	if err := r.UpstreamTLS.Validate(); err != nil {
+		errs.add(field+".upstream_tls", "%v", err)
+	}
+
+	health := r.HealthCheck
+	if health.Path != "" && !strings.HasPrefix(health.Path, "/") {
+		errs.add(field+".health_check.path", "must start with /")
+	}
+	nonNegative(errs, map[string]int{
+		field + ".health_check.interval":   health.Interval,
+		field + ".health_check.timeout":    health.Timeout,
+		field + ".health_check.max_fails":  health.MaxFails,
+		field + ".health_check.eject_time": health.EjectTime,
+	})
+}
+
+// validateDomains reports domains served by more than one rule, including
+// the www variants of rules with include_www.
+func (p *ProxyConfig) validateDomains(errs *ValidationErrors) {
+	owners := make(map[string]int)
+	for i, rule := range p.Rules {
+		if rule.Domain == "" {
+			continue
+		}
+		if j, exists := owners[rule.Domain]; exists {
+			errs.add(fmt.Sprintf("proxy.rules[%d].domain", i), "duplicates proxy.rules[%d]", j)
+			continue
+		}
+		owners[rule.Domain] = i
+	}
+	for i, rule := range p.Rules {
+		if !rule.SSL.IncludeWWW {
+			continue
+		}
+		if j, exists := owners[WWWVariant(rule.Domain)]; exists && j != i {
+			errs.add(fmt.Sprintf("proxy.rules[%d].ssl.include_www", i), "includes %s, which proxy.rules[%d] serves", WWWVariant(rule.Domain), j)
+		}
+	}
+}
+
+func (c *CacheConfig) validate(errs *ValidationErrors) {
+	switch c.StorageType {
+	case "", "memory", "file", "persistent":
+	default:
+		errs.add("cache.storage_type", "unknown value %q, expected memory or file", c.StorageType)
+	}
+	switch c.Compression {
+	case "", "none", "gzip":
+	default:
+		errs.add("cache.compression", "unknown value %q, expected gzip or none", c.Compression)
+	}
+	validateSize("cache.max_size", c.MaxSize, errs)
+	nonNegative(errs, map[string]int{
+		"cache.default_ttl":          c.DefaultTTL,
+		"cache.cleanup_interval":     c.CleanupInterval,
+		"cache.index_flush_interval": c.IndexFlushInterval,
+		"cache.warm.concurrency":     c.Warm.Concurrency,
+		"cache.warm.interval":        c.Warm.Interval,
+	})
+	if c.DiskHighWatermark < 0 || c.DiskHighWatermark > 100 {
+		errs.add("cache.disk_high_watermark", "must be a percentage between 0 and 100")
+	}
+	if c.DiskLowWatermark < 0 || c.DiskLowWatermark > 100 {
+		errs.add("cache.disk_low_watermark", "must be a percentage between 0 and 100")
+	} else if c.DiskLowWatermark > 0 && c.DiskHighWatermark > 0 && c.DiskLowWatermark >= c.DiskHighWatermark {
+		errs.add("cache.disk_low_watermark", "must be below disk_high_watermark")
+	}
+	if c.Invalidation.Enabled && c.Invalidation.Redis == "" {
+		errs.add("cache.invalidation.redis", "is required when invalidation is enabled")
+	}
+	validateIPs("cache.purge.allowed_ips", c.Purge.AllowedIPs, errs)
+	for i, u := range c.Warm.URLs {
+		if !validURL(u) {
+			errs.add(fmt.Sprintf("cache.warm.urls[%d]", i), "must be an http or https URL")
+		}
+	}
+	for i, u := range c.Warm.Sitemaps {
+		if !validURL(u) {
+			errs.add(fmt.Sprintf("cache.warm.sitemaps[%d]", i), "must be an http or https URL")
+		}
+	}
+}
+
+var sizePattern = regexp.MustCompile(`^[0-9]+([KMG]B|[kmg]b|B|b)?$`)
+
+func validateSize(field, size string, errs *ValidationErrors) {
+	if size == "" {
+		return
+	}
+	// ParseSize ignores trailing garbage, such as a mistyped unit
+	if _, err := cache.ParseSize(size); err != nil || !sizePattern.MatchString(size) {
+		errs.add(field, "invalid size %q, expected e.g. 512KB, 100MB or 2GB", size)
+	}
+}
+
+func validateIPs(field string, entries []string, errs *ValidationErrors) {
+	for i, entry := range entries {
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			continue
+		}
+		errs.add(fmt.Sprintf("%s[%d]", field, i), "invalid IP address or CIDR range %q", entry)
+	}
+}
+
+// nonNegative reports the fields whose values are negative, in field order.
+func nonNegative(errs *ValidationErrors, values map[string]int) {
+	fields := make([]string, 0, len(values))
+	for field, value := range values {
+		if value < 0 {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		errs.add(field, "must not be negative")
+	}
+}
+
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+func validPortString(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && validPort(n)
+}
+
+// validURL reports whether s is an absolute http or https URL.
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	return u.Port() == "" || validPortString(u.Port())
+}
+
+// validHostname reports whether name is a DNS host name.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
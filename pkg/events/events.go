@@ -0,0 +1,125 @@
+// Package events distributes runtime events, such as certificate renewals
+// and backend failures, to subscribers like the admin API's event stream.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	CertIssued         = "certificate_issued"
+	CertRenewed        = "certificate_renewed"
+	CertRenewalFailed  = "certificate_renewal_failed"
+	CertIssuanceFailed = "certificate_issuance_failed"
+	CertExpiring       = "certificate_expiring"
+	CertRevoked        = "certificate_revoked"
+	BackendDown        = "backend_down"
+	BackendUp          = "backend_up"
+	ConfigUpdated      = "config_updated"
+	ConfigReloaded     = "config_reloaded"
+	CacheThreshold     = "cache_threshold"
+	Error              = "error"
+)
+
+// Types lists every event type.
+var Types = []string{
+	CertIssued, CertRenewed, CertRenewalFailed, CertIssuanceFailed, CertExpiring, CertRevoked,
+	BackendDown, BackendUp, ConfigUpdated, ConfigReloaded, CacheThreshold, Error,
+}
+
+const (
+	// historySize is how many past events are kept for subscribers that
+	// reconnect with the ID of the last event they saw.
+	historySize = 256
+	// subscriberBuffer is how many events a slow subscriber may fall behind
+	// before events are dropped for it.
+	subscriberBuffer = 64
+)
+
+// Event is something that happened at runtime.
+type Event struct {
+	ID      uint64         `json:"id"`
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Domain  string         `json:"domain,omitempty"`
+	Message string         `json:"message"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// Bus fans out published events to its subscribers. A nil *Bus discards
+// events, so publishers don't need to check for one.
+type Bus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+}
+
+// NewBus creates an event bus.
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish assigns event an ID and time and delivers it to every subscriber.
+// Subscribers that fall behind miss events instead of blocking publishers.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	event.ID = b.nextID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > historySize {
+		b.history = b.history[len(b.history)-historySize:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of new events, the kept events after lastID
+// (none for 0), and a function that ends the subscription.
+func (b *Bus) Subscribe(lastID uint64) (<-chan Event, []Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []Event
+	if lastID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+	return ch, missed, cancel
+}
+
+// Recent returns up to n of the latest events, oldest first.
+func (b *Bus) Recent(n int) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > len(b.history) {
+		n = len(b.history)
+	}
+	return append([]Event(nil), b.history[len(b.history)-n:]...)
+}
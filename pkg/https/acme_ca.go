@@ -0,0 +1,78 @@
+package https
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// letsEncryptStagingURL is the Let's Encrypt staging directory, used when
+// staging is enabled without an explicit directory.
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// knownDirectories maps shorthand CA names to their ACME directory URLs.
+var knownDirectories = map[string]string{
+	"letsencrypt":         acme.LetsEncryptURL,
+	"letsencrypt-staging": letsEncryptStagingURL,
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"buypass":             "https://api.buypass.com/acme/directory",
+	"buypass-staging":     "https://api.test4.buypass.no/acme/directory",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":      "https://dv.acme-v02.test-api.pki.goog/directory",
+}
+
+// directoryURL returns the ACME directory certificates are requested from:
+// the configured URL or CA name, else Let's Encrypt or its staging server.
+func (a *AutoTLS) directoryURL() string {
+	if directory := a.config.DirectoryURL; directory != "" {
+		if url, ok := knownDirectories[strings.ToLower(directory)]; ok {
+			return url
+		}
+		return directory
+	}
+	if a.config.Staging {
+		return letsEncryptStagingURL
+	}
+	return acme.LetsEncryptURL
+}
+
+// newExternalAccountBinding decodes the EAB credentials issued by a CA.
+func newExternalAccountBinding(keyID, hmacKey string) (*acme.ExternalAccountBinding, error) {
+	hmacKey = strings.TrimSpace(hmacKey)
+	if hmacKey == "" {
+		return nil, fmt.Errorf("EAB key id %s given without an HMAC key", keyID)
+	}
+
+	// CAs hand out unpadded base64url keys, accept padded and standard forms too
+	var key []byte
+	var err error
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if key, err = encoding.DecodeString(hmacKey); err == nil {
+			return &acme.ExternalAccountBinding{KID: keyID, Key: key}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid EAB HMAC key: %v", err)
+}
+
+// newACMEHTTPClient returns the HTTP client used to talk to the ACME server.
+// With caRootFile set, the server's certificate is verified against those
+// roots only, as needed for internal CAs such as step-ca.
+func newACMEHTTPClient(caRootFile string) (*http.Client, error) {
+	if caRootFile == "" {
+		return nil, nil
+	}
+
+	pool, err := loadCertPool(caRootFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:errcheck
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport, Timeout: 60 * time.Second}, nil
+}
@@ -0,0 +1,493 @@
+package https
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"saddy/pkg/events"
+)
+
+const (
+	// accountKeyName is the cache entry holding the ACME account key. It is
+	// shared with autocert so both challenge types use the same account, and
+	// kept across restarts so no new accounts are registered.
+	accountKeyName = "acme_account+key"
+	// dnsCertSuffix names the cache entries of certificates issued via DNS-01.
+	dnsCertSuffix = "+dns01"
+	// httpTokenSuffix names the cache entries autocert serves http-01
+	// challenge responses from.
+	httpTokenSuffix = "+http-01"
+	// dnsIssueTimeout bounds a complete issuance, DNS propagation included.
+	dnsIssueTimeout = 10 * time.Minute
+)
+
+// addDNSDomain registers a domain whose certificate is issued with DNS-01
+// challenges; wildcard domains such as "*.example.com" are supported. A cached certificate is used right away; issuance and renewal
+// run in the background since record propagation can take minutes.
+func (a *AutoTLS) addDNSDomain(domain string) error {
+	if a.config.DNSProvider == nil {
+		return fmt.Errorf("DNS-01 challenge for %s requires a DNS provider", domain)
+	}
+
+	a.mu.Lock()
+	a.dnsDomains[domain] = true
+	delete(a.allowedHosts, domain)
+	a.mu.Unlock()
+
+	var current *x509.Certificate
+	cert, err := a.loadCertificate(context.Background(), dnsCacheName(domain))
+	if err == nil {
+		a.mu.Lock()
+		a.certificates[domain] = cert
+		a.mu.Unlock()
+		if time.Until(cert.Leaf.NotAfter) > a.config.RenewBefore && coversNames(cert.Leaf, a.certNames(domain)) {
+			return nil
+		}
+		current = cert.Leaf
+	}
+	if until := a.backingOffUntil(domain); !until.IsZero() {
+		log.Printf("Not requesting a certificate for %s, backing off until %s", domain, until.Format(time.RFC3339))
+		return nil
+	}
+
+	go func() {
+		if err := a.issueCertificate(domain, ChallengeDNS01, current); err != nil {
+			a.scheduleRetry(domain, err)
+		}
+	}()
+	return nil
+}
+
+// issueCertificate obtains a fresh certificate for domain to replace current,
+// validated with the given challenge type, and starts serving it. current may
+// be nil.
+//
+// Only one node sharing the certificate storage issues at a time; when
+// another node stored a newer certificate that isn't due for renewal in the
+// meantime, that one is served instead of ordering a new one.
+func (a *AutoTLS) issueCertificate(domain, challengeType string, current *x509.Certificate) error {
+	lockCtx, cancelLock := context.WithTimeout(context.Background(), issuanceLockTTL)
+	defer cancelLock()
+	unlock, err := a.lockIssuance(lockCtx, domain)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsIssueTimeout)
+	defer cancel()
+
+	cert := a.sharedCertificate(ctx, certCacheName(domain, challengeType), current)
+	if cert != nil && !coversNames(cert.Leaf, a.certNames(domain)) {
+		cert = nil
+	}
+	if cert != nil {
+		log.Printf("Using certificate for %s issued by another node", domain)
+	} else {
+		if cert, err = a.obtainCertificate(ctx, domain, challengeType); err != nil {
+			return err
+		}
+		log.Printf("Successfully obtained certificate for domain via %s: %s", challengeType, domain)
+		if current == nil {
+			a.publish(events.CertIssued, domain, "Obtained a certificate for "+domain+" via "+challengeType)
+		}
+	}
+
+	a.mu.Lock()
+	a.certificates[domain] = cert
+	a.clearFallback(domain)
+	a.mu.Unlock()
+	return nil
+}
+
+// sharedCertificate returns the certificate stored under name if it is newer
+// than current and not yet due for renewal, i.e. another node has just
+// renewed it.
+func (a *AutoTLS) sharedCertificate(ctx context.Context, name string, current *x509.Certificate) *tls.Certificate {
+	stored, err := a.loadCertificate(ctx, name)
+	if err != nil {
+		return nil
+	}
+	if current != nil && !stored.Leaf.NotBefore.After(current.NotBefore) {
+		return nil
+	}
+	if time.Until(stored.Leaf.NotAfter) <= a.config.RenewBefore {
+		return nil
+	}
+	return stored
+}
+
+// obtainCertificate runs a complete ACME order for domain and its aliases,
+// answering their authorizations with challenges of the given type, and
+// caches the result.
+//
+// autocert obtains http-01 certificates on its own, but offers no way to
+// renew one before its fixed renewal time; ForceRenewal and ARI-driven
+// renewals use this instead.
+func (a *AutoTLS) obtainCertificate(ctx context.Context, domain, challengeType string) (*tls.Certificate, error) {
+	client, err := a.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := a.certNames(domain)
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL, challengeType); err != nil {
+			return nil, err
+		}
+	}
+	orderURL := order.URI
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return nil, fmt.Errorf("order not ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+
+	der, certURL, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// CAs that finalize asynchronously may not send the order URL back,
+		// which CreateOrderCert needs to wait for the certificate
+		if order, waitErr := client.WaitOrder(ctx, orderURL); waitErr == nil && order.Status == acme.StatusValid {
+			certURL = order.CertURL
+			der, err = client.FetchCert(ctx, certURL, true)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	der = a.preferredChain(ctx, client, der, certURL)
+
+	cert, err := newCertificate(der, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.saveCertificate(ctx, certCacheName(domain, challengeType), der, key); err != nil {
+		log.Printf("Warning: Failed to cache certificate for %s: %v", domain, err)
+	}
+	return cert, nil
+}
+
+// preferredChain returns the alternate chain the CA offers for the
+// certificate at certURL whose topmost certificate is issued by the
+// configured PreferredChain, or der when der matches or no alternate does.
+func (a *AutoTLS) preferredChain(ctx context.Context, client *acme.Client, der [][]byte, certURL string) [][]byte {
+	preferred := a.config.PreferredChain
+	if preferred == "" || chainIssuedBy(der, preferred) {
+		return der
+	}
+
+	alternates, err := client.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		log.Printf("Warning: Failed to list alternate certificate chains: %v", err)
+		return der
+	}
+	for _, url := range alternates {
+		chain, err := client.FetchCert(ctx, url, true)
+		if err != nil {
+			log.Printf("Warning: Failed to fetch alternate certificate chain: %v", err)
+			continue
+		}
+		if chainIssuedBy(chain, preferred) {
+			return chain
+		}
+	}
+	log.Printf("Warning: No certificate chain issued by %q offered, using the default chain", preferred)
+	return der
+}
+
+// chainIssuedBy reports whether the topmost certificate of chain was issued
+// by the CA with the given common name, or is that CA.
+func chainIssuedBy(chain [][]byte, issuer string) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	top, err := x509.ParseCertificate(chain[len(chain)-1])
+	return err == nil && (top.Issuer.CommonName == issuer || top.Subject.CommonName == issuer)
+}
+
+// authorize completes a single authorization with a challenge of the given type.
+func (a *AutoTLS) authorize(ctx context.Context, client *acme.Client, authzURL, challengeType string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no %s challenge offered for %s", challengeType, authz.Identifier.Value)
+	}
+
+	var cleanup func()
+	if challengeType == ChallengeDNS01 {
+		cleanup, err = a.presentDNS(ctx, client, authz.Identifier.Value, challenge)
+	} else {
+		cleanup, err = a.presentHTTP(ctx, client, challenge)
+	}
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization for %s failed: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// presentDNS publishes the TXT record of a DNS-01 challenge and waits for it
+// to propagate. The returned function removes it again.
+func (a *AutoTLS) presentDNS(ctx context.Context, client *acme.Client, identifier string, challenge *acme.Challenge) (func(), error) {
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(identifier, "*.")
+
+	if err := a.config.DNSProvider.Present(ctx, fqdn, value); err != nil {
+		return nil, fmt.Errorf("failed to publish challenge record %s: %v", fqdn, err)
+	}
+	cleanup := func() {
+		// Clean up even when ctx has expired
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := a.config.DNSProvider.CleanUp(cleanupCtx, fqdn, value); err != nil {
+			log.Printf("Warning: Failed to remove challenge record %s: %v", fqdn, err)
+		}
+	}
+
+	a.waitForTXT(ctx, fqdn, value)
+	return cleanup, nil
+}
+
+// presentHTTP makes autocert's challenge handler answer an http-01 challenge.
+// The handler falls back to the certificate cache for tokens it didn't create
+// itself, under the token name plus httpTokenSuffix.
+func (a *AutoTLS) presentHTTP(ctx context.Context, client *acme.Client, challenge *acme.Challenge) (func(), error) {
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(client.HTTP01ChallengePath(challenge.Token)) + httpTokenSuffix
+
+	if err := a.certManager.Cache.Put(ctx, name, []byte(response)); err != nil {
+		return nil, fmt.Errorf("failed to store challenge token: %v", err)
+	}
+	cleanup := func() {
+		_ = a.certManager.Cache.Delete(context.Background(), name) //nolint:errcheck
+	}
+	return cleanup, nil
+}
+
+// waitForTXT polls DNS until the challenge record is visible or the
+// propagation timeout passes. On timeout the CA is asked to validate anyway,
+// since its resolvers may see the record before ours do.
+func (a *AutoTLS) waitForTXT(ctx context.Context, fqdn, value string) {
+	timeout := a.config.DNSPropagationTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSPropagationTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		records, err := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		if err == nil {
+			for _, record := range records {
+				if record == value {
+					return
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Challenge record %s not visible after %s, continuing", fqdn, timeout)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dnsPropagationPollInterval):
+		}
+	}
+}
+
+// acmeClient returns a client for the configured ACME directory, registering
+// the account on first use.
+func (a *AutoTLS) acmeClient(ctx context.Context) (*acme.Client, error) {
+	a.acmeMu.Lock()
+	defer a.acmeMu.Unlock()
+
+	if a.acmeClientCache != nil {
+		return a.acmeClientCache, nil
+	}
+
+	key, err := a.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: a.directoryURL(), HTTPClient: a.acmeHTTPClient}
+
+	account := &acme.Account{ExternalAccountBinding: a.eab}
+	if a.config.Email != "" {
+		account.Contact = []string{"mailto:" + a.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	a.acmeClientCache = client
+	return client, nil
+}
+
+// accountKey loads the ACME account key from the certificate cache, creating
+// one if none exists yet.
+func (a *AutoTLS) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := a.certManager.Cache.Get(ctx, accountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid ACME account key")
+		}
+		return parsePrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, fmt.Errorf("failed to read ACME account key: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.certManager.Cache.Put(ctx, accountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %v", err)
+	}
+	return key, nil
+}
+
+// saveCertificate stores a certificate and its key as PEM in the cache, in
+// the format autocert uses.
+func (a *AutoTLS) saveCertificate(ctx context.Context, name string, der [][]byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, cert := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	return a.certManager.Cache.Put(ctx, name, data)
+}
+
+// loadCertificate reads a certificate stored by saveCertificate or autocert.
+func (a *AutoTLS) loadCertificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := a.certManager.Cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cached certificate %s: %v", name, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// certCacheName returns the cache entry name of a certificate obtained with
+// the given challenge type. http-01 certificates replace autocert's entry so
+// it loads them on restart.
+func certCacheName(domain, challengeType string) string {
+	if challengeType == ChallengeDNS01 {
+		return dnsCacheName(domain)
+	}
+	return domain
+}
+
+// dnsCacheName returns the cache entry name of a DNS-01 certificate. The
+// wildcard "*" is replaced since it isn't valid in file names everywhere.
+func dnsCacheName(domain string) string {
+	return strings.Replace(domain, "*", "_", 1) + dnsCertSuffix
+}
+
+// newCertificate assembles a tls.Certificate from an issued chain and its key.
+func newCertificate(der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, fmt.Errorf("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// parsePrivateKey decodes a DER private key in SEC 1, PKCS #8 or PKCS #1 form.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
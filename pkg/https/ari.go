@@ -0,0 +1,239 @@
+package https
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ariPollInterval is how often a renewal window is fetched again when the
+	// CA sends no Retry-After.
+	ariPollInterval    = 6 * time.Hour
+	ariMinPollInterval = time.Minute
+	ariMaxPollInterval = 24 * time.Hour
+	ariRequestTimeout  = 30 * time.Second
+)
+
+// RenewalWindow is the time range in which the CA suggests renewing a
+// certificate, from its ACME Renewal Information (ARI, RFC 9773) endpoint.
+// CAs move the window into the past to request early renewal, e.g. before
+// revoking certificates.
+type RenewalWindow struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	RenewAt        time.Time `json:"renew_at"` // Chosen at random inside the window
+	ExplanationURL string    `json:"explanation_url,omitempty"`
+}
+
+// ariState caches the renewal window of one certificate.
+type ariState struct {
+	window   *RenewalWindow // nil when the CA had none for the certificate
+	nextPoll time.Time
+}
+
+// renewalTime returns when the certificate of domain should be renewed: inside
+// the CA's suggested window when it publishes one, RenewBefore ahead of expiry
+// otherwise. recheck is when the window should be fetched again, zero if
+// there is none.
+func (a *AutoTLS) renewalTime(domain string, leaf *x509.Certificate) (renewAt, recheck time.Time) {
+	renewAt = leaf.NotAfter.Add(-a.config.RenewBefore)
+	if a.isInternalDomain(domain) {
+		// Not issued by the ACME CA
+		return renewAt, time.Time{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ariRequestTimeout)
+	defer cancel()
+	window, recheck, err := a.renewalWindow(ctx, leaf)
+	if err != nil {
+		log.Printf("Warning: Failed to fetch renewal information for %s: %v", domain, err)
+	}
+	if window != nil {
+		renewAt = window.RenewAt
+	}
+	return renewAt, recheck
+}
+
+// renewalWindow returns the CA's renewal window for leaf, fetching it when the
+// cached one is due for a refresh. It returns nil if the CA doesn't support
+// ARI or has no window for the certificate.
+func (a *AutoTLS) renewalWindow(ctx context.Context, leaf *x509.Certificate) (*RenewalWindow, time.Time, error) {
+	key := certKey(leaf)
+	now := time.Now()
+
+	a.ariMu.Lock()
+	state := a.ari[key]
+	a.ariMu.Unlock()
+	if state != nil && now.Before(state.nextPoll) {
+		return state.window, state.nextPoll, nil
+	}
+
+	baseURL, err := a.renewalInfoURL(ctx)
+	if err != nil || baseURL == "" {
+		return nil, time.Time{}, err
+	}
+	certID, err := ariCertID(leaf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	window, pollInterval, err := a.fetchRenewalInfo(ctx, strings.TrimSuffix(baseURL, "/")+"/"+certID)
+	if err != nil {
+		// Keep the last known window and try again later
+		next := &ariState{nextPoll: now.Add(ariPollInterval)}
+		if state != nil {
+			next.window = state.window
+		}
+		a.storeARIState(key, next)
+		return next.window, next.nextPoll, err
+	}
+
+	// Keep the chosen time while the window stays the same, so repeated
+	// polls don't keep moving it
+	if state != nil && state.window != nil && state.window.Start.Equal(window.Start) && state.window.End.Equal(window.End) {
+		window.RenewAt = state.window.RenewAt
+	} else {
+		window.RenewAt = window.Start
+		if span := window.End.Sub(window.Start); span > 0 {
+			window.RenewAt = window.Start.Add(rand.N(span))
+		}
+	}
+
+	next := &ariState{window: window, nextPoll: now.Add(pollInterval)}
+	a.storeARIState(key, next)
+	return window, next.nextPoll, nil
+}
+
+func (a *AutoTLS) storeARIState(key string, state *ariState) {
+	a.ariMu.Lock()
+	defer a.ariMu.Unlock()
+
+	a.ari[key] = state
+	// Drop the windows of certificates that have been replaced
+	now := time.Now()
+	for k, s := range a.ari {
+		if s.window != nil && now.After(s.window.End.Add(ariMaxPollInterval)) {
+			delete(a.ari, k)
+		}
+	}
+}
+
+// cachedRenewalWindow returns the last known renewal window of leaf without
+// contacting the CA.
+func (a *AutoTLS) cachedRenewalWindow(leaf *x509.Certificate) *RenewalWindow {
+	a.ariMu.Lock()
+	defer a.ariMu.Unlock()
+	if state := a.ari[certKey(leaf)]; state != nil {
+		return state.window
+	}
+	return nil
+}
+
+// renewalInfoURL returns the renewalInfo endpoint advertised in the ACME
+// directory, or "" if the CA doesn't support ARI.
+func (a *AutoTLS) renewalInfoURL(ctx context.Context) (string, error) {
+	a.ariMu.Lock()
+	if a.ariURL != "" {
+		defer a.ariMu.Unlock()
+		return a.ariURL, nil
+	}
+	a.ariMu.Unlock()
+
+	var directory struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if _, err := a.getJSON(ctx, a.directoryURL(), &directory); err != nil {
+		return "", fmt.Errorf("failed to fetch ACME directory: %v", err)
+	}
+
+	a.ariMu.Lock()
+	a.ariURL = directory.RenewalInfo
+	a.ariMu.Unlock()
+	return directory.RenewalInfo, nil
+}
+
+// fetchRenewalInfo requests one renewal window and returns it together with
+// the polling interval the CA asked for.
+func (a *AutoTLS) fetchRenewalInfo(ctx context.Context, url string) (*RenewalWindow, time.Duration, error) {
+	var info struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+		ExplanationURL string `json:"explanationURL"`
+	}
+	header, err := a.getJSON(ctx, url, &info)
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, 0, fmt.Errorf("invalid suggested window")
+	}
+
+	pollInterval := ariPollInterval
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		pollInterval = min(max(time.Duration(seconds)*time.Second, ariMinPollInterval), ariMaxPollInterval)
+	}
+
+	return &RenewalWindow{
+		Start:          info.SuggestedWindow.Start,
+		End:            info.SuggestedWindow.End,
+		ExplanationURL: info.ExplanationURL,
+	}, pollInterval, nil
+}
+
+// getJSON fetches url from the ACME server and decodes its JSON response.
+func (a *AutoTLS) getJSON(ctx context.Context, url string, out interface{}) (http.Header, error) {
+	client := a.acmeHTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: ariRequestTimeout}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, fmt.Errorf("failed to decode response from %s: %v", url, err)
+	}
+	return resp.Header, nil
+}
+
+// ariCertID builds the RFC 9773 identifier of a certificate: its authority
+// key identifier and serial number, base64url encoded.
+func ariCertID(leaf *x509.Certificate) (string, error) {
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("certificate has no authority key identifier")
+	}
+
+	// The serial is encoded as the bytes of its DER INTEGER, which carry a
+	// leading zero when the high bit is set
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
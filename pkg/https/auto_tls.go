@@ -3,18 +3,46 @@ package https
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+
+	"saddy/pkg/events"
+	"saddy/pkg/notify"
+)
+
+const (
+	// defaultExpiryWarningDays is when expiring certificates are reported to
+	// the notifier, unless configured otherwise.
+	defaultExpiryWarningDays = 7
+	defaultRenewBefore       = 30 * 24 * time.Hour
+	defaultRenewalInterval   = 24 * time.Hour
+	// minRenewalCheckDelay keeps checks apart when renewals are due
+	minRenewalCheckDelay = time.Minute
+	storageDeleteTimeout = 30 * time.Second
+	// acmeChallengePath prefixes the paths of HTTP-01 challenge requests
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	// autocertRSASuffix marks the RSA certificates autocert keeps for
+	// clients without ECDSA support
+	autocertRSASuffix = "+rsa"
 )
 
 // AutoTLS manages automatic TLS certificate provisioning and renewal.
@@ -24,6 +52,47 @@ type AutoTLS struct {
 	mu           sync.RWMutex
 	certificates map[string]*tls.Certificate
 	allowedHosts map[string]bool
+	dnsDomains   map[string]bool   // Domains validated with DNS-01 instead of autocert
+	autocertHeld map[string]bool   // Domains autocert has loaded or issued a certificate for
+	aliases      map[string]string // Extra names bundled into the certificate of a domain, e.g. its www variant
+
+	onDemandDenied map[string]time.Time // Names the ask endpoint refused, by time of refusal
+	onDemandClient *http.Client
+
+	// Domains signed by the internal root CA, "*.name" covers its subdomains
+	internalDomains map[string]bool
+	internalLeaves  []string                     // Subdomains issued a leaf on demand, oldest first
+	internalIssuing map[string]*internalIssuance // On-demand issuances in flight, by subdomain
+	caMu            sync.Mutex
+	caCert          *x509.Certificate
+	caKey           crypto.Signer
+
+	// Self-signed certificates served while a failed ACME issuance is retried
+	fallbacks map[string]*tls.Certificate
+	retries   map[string]*issuanceRetry
+	renewals  map[string]*RenewalStatus // Outcome of the last renewal by domain
+	revoked   map[string]bool           // Revoked certificates, by certKey, that autocert may still hold
+
+	policies map[string]*tls.Config // Per-domain TLS policies, "*.name" covers its subdomains
+
+	ocspMu  sync.Mutex
+	staples map[string]*ocspStaple // OCSP responses by certificate
+	crls    map[string]*crlEntry   // CRLs by distribution point
+
+	ariMu  sync.Mutex
+	ariURL string               // renewalInfo endpoint of the ACME directory
+	ari    map[string]*ariState // Renewal windows by certificate
+
+	handshakes *handshakeRecorder
+
+	ticketMu      sync.Mutex
+	ticketKeys    [][32]byte    // Session ticket keys, newest first
+	ticketConfigs []*tls.Config // Configurations handed out by GetTLSConfig
+
+	acmeMu          sync.Mutex
+	acmeClientCache *acme.Client
+	acmeHTTPClient  *http.Client // Trusts CARootFile when set, nil for the default client
+	eab             *acme.ExternalAccountBinding
 }
 
 // TLSConfig defines configuration for automatic TLS management.
@@ -31,6 +100,67 @@ type TLSConfig struct {
 	Email    string
 	CacheDir string
 	Staging  bool
+
+	// Storage holds certificates and ACME state, a file storage in CacheDir
+	// when nil. Nodes of a cluster share certificates through a common one
+	Storage CertStorage
+
+	// DirectoryURL is the ACME directory, or a known CA name such as
+	// "zerossl". Defaults to Let's Encrypt, or its staging server with Staging
+	DirectoryURL string
+	// CARootFile is a PEM bundle trusted for the ACME server's own
+	// certificate, for internal CAs
+	CARootFile string
+	// EABKeyID and EABHMACKey bind the ACME account to an existing CA
+	// account, as ZeroSSL and Google Trust Services require. The key is
+	// base64url encoded as handed out by the CA
+	EABKeyID   string
+	EABHMACKey string
+	// PreferredChain picks the CA's alternate chain whose topmost
+	// certificate is issued by this common name, e.g. "ISRG Root X1" for a
+	// shorter chain. The default chain is kept when none matches
+	PreferredChain string
+
+	// Issuer is the default certificate issuer: IssuerACME, or IssuerInternal
+	// to sign everything with the local root CA. Local development names
+	// such as *.localhost always use the internal issuer
+	Issuer string
+	// Challenge is the default ACME challenge type, ChallengeHTTP01 when empty
+	Challenge string
+	// DNSProvider publishes DNS-01 challenge records
+	DNSProvider DNSProvider
+	// DNSPropagationTimeout bounds the wait for challenge records to appear
+	DNSPropagationTimeout time.Duration
+
+	// OnDemandAsk enables on-demand TLS: handshakes for unregistered names
+	// obtain a certificate if this URL answers 200 to ?domain=<name>
+	OnDemandAsk string
+
+	// Policy is the TLS policy of all domains without one of their own
+	Policy TLSPolicy
+
+	// Notifier receives alerts about expiring certificates and failed
+	// renewals, once ExpiryWarningDays or fewer days are left
+	Notifier          *notify.Notifier
+	ExpiryWarningDays int
+
+	// Events receives certificate issuances, renewals and failures as they
+	// happen
+	Events *events.Bus
+
+	// RenewBefore is how long before expiry certificates are renewed, 30
+	// days by default
+	RenewBefore time.Duration
+	// RenewalInterval is the time between renewal checks, daily by default.
+	// A random delay of up to RenewalJitter is added to each so that many
+	// servers don't renew at the same moment
+	RenewalInterval time.Duration
+	RenewalJitter   time.Duration
+
+	// SessionTicketRotation is how often a new session ticket key is
+	// generated, every 12 hours by default. Keys are kept in Storage so
+	// nodes sharing it resume each other's TLS sessions
+	SessionTicketRotation time.Duration
 }
 
 // NewAutoTLS creates a new AutoTLS instance with the given configuration.
@@ -38,16 +168,59 @@ func NewAutoTLS(config *TLSConfig) *AutoTLS {
 	if config.CacheDir == "" {
 		config.CacheDir = "./certs"
 	}
+	if config.RenewBefore <= 0 {
+		config.RenewBefore = defaultRenewBefore
+	}
+	if config.RenewalInterval <= 0 {
+		config.RenewalInterval = defaultRenewalInterval
+	}
+	if config.SessionTicketRotation <= 0 {
+		config.SessionTicketRotation = defaultTicketKeyRotation
+	}
 
 	// Create cache directory
 	if err := os.MkdirAll(config.CacheDir, 0750); err != nil {
 		log.Printf("Failed to create cache directory: %v", err)
 	}
+	if config.Storage == nil {
+		config.Storage = fileStorage{autocert.DirCache(config.CacheDir)}
+	}
 
 	autoTLS := &AutoTLS{
 		config:       config,
 		certificates: make(map[string]*tls.Certificate),
 		allowedHosts: make(map[string]bool),
+		dnsDomains:   make(map[string]bool),
+		aliases:      make(map[string]string),
+
+		internalDomains: make(map[string]bool),
+		internalIssuing: make(map[string]*internalIssuance),
+		fallbacks:       make(map[string]*tls.Certificate),
+		retries:         make(map[string]*issuanceRetry),
+		renewals:        make(map[string]*RenewalStatus),
+		revoked:         make(map[string]bool),
+		policies:        make(map[string]*tls.Config),
+		staples:         make(map[string]*ocspStaple),
+		crls:            make(map[string]*crlEntry),
+		ari:             make(map[string]*ariState),
+		autocertHeld:    make(map[string]bool),
+		onDemandDenied:  make(map[string]time.Time),
+		onDemandClient:  &http.Client{Timeout: onDemandAskTimeout},
+		handshakes:      newHandshakeRecorder(),
+	}
+
+	httpClient, err := newACMEHTTPClient(config.CARootFile)
+	if err != nil {
+		log.Printf("Failed to load ACME CA root, using system roots: %v", err)
+	}
+	autoTLS.acmeHTTPClient = httpClient
+
+	if config.EABKeyID != "" {
+		eab, err := newExternalAccountBinding(config.EABKeyID, config.EABHMACKey)
+		if err != nil {
+			log.Printf("Failed to load external account binding: %v", err)
+		}
+		autoTLS.eab = eab
 	}
 
 	autoTLS.initCertManager()
@@ -56,11 +229,8 @@ func NewAutoTLS(config *TLSConfig) *AutoTLS {
 
 func (a *AutoTLS) initCertManager() {
 	hostPolicy := func(_ context.Context, host string) error {
-		a.mu.RLock()
-		defer a.mu.RUnlock()
-
 		// Check if host is in allowed list
-		if a.allowedHosts[host] {
+		if a.allowsHost(host) {
 			return nil
 		}
 
@@ -72,152 +242,625 @@ func (a *AutoTLS) initCertManager() {
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: hostPolicy,
 		Email:      a.config.Email,
-		Cache:      autocert.DirCache(a.config.CacheDir),
+		Cache:      a.config.Storage,
+
+		RenewBefore:            a.config.RenewBefore,
+		ExternalAccountBinding: a.eab,
 	}
 
-	// Use staging server for testing
-	if a.config.Staging {
-		certManager.Client = &acme.Client{
-			DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
-		}
+	// Use the configured CA, Let's Encrypt by default
+	certManager.Client = &acme.Client{
+		DirectoryURL: a.directoryURL(),
+		HTTPClient:   a.acmeHTTPClient,
 	}
 
 	a.certManager = certManager
+
+	// Load or create the persisted account key up front, so autocert and
+	// the orders run here can't each create one and register two accounts
+	key, err := a.accountKey(context.Background())
+	if err != nil {
+		log.Printf("Failed to load ACME account key: %v", err)
+		return
+	}
+	certManager.Client.Key = key
 }
 
-// GetCertificate retrieves or provisions a TLS certificate for the given client hello.
+// GetCertificate retrieves or provisions a TLS certificate for the given
+// client hello, with its OCSP response stapled.
 func (a *AutoTLS) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.getCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return a.stapled(cert), nil
+}
+
+func (a *AutoTLS) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	a.mu.RLock()
-	defer a.mu.RUnlock()
+	// Aliases are served the certificate they are bundled into
+	name := a.primaryDomain(hello.ServerName)
+	cert := a.cachedCertificate(name)
+	internal := cert == nil && a.internalCovers(name)
+	fallback := a.fallbacks[name]
+	acmeHost := a.allowedHosts[name]
+	// Certificates issued by our own orders rather than autocert
+	pending := a.dnsDomains[name] || (acmeHost && a.ordersOwnCertificate(name)) || (!acmeHost && a.dnsDomains[wildcardFor(name)])
+	a.mu.RUnlock()
 
 	// Check if we have cached certificate
-	if cert, exists := a.certificates[hello.ServerName]; exists {
+	if cert != nil {
 		return cert, nil
 	}
 
+	// Subdomains of internal wildcards get their own certificate on demand
+	if internal {
+		return a.issueInternalLeaf(name)
+	}
+
+	// Issuance failed or is still running, keep the handshake working with a
+	// self-signed certificate rather than asking the CA on every connection
+	if fallback != nil {
+		return fallback, nil
+	}
+	if pending {
+		return a.fallbackCertificate(name)
+	}
+
+	// Unregistered names may be allowed by the on-demand ask endpoint
+	if !acmeHost {
+		acmeHost = a.allowOnDemand(name)
+	}
+
+	// Names autocert would refuse don't need the issuance lock
+	if !acmeHost {
+		cert, err := a.certManager.GetCertificate(hello)
+		if err == nil && a.isRevoked(cert) {
+			// Still held by autocert after the domain was removed
+			return nil, fmt.Errorf("certificate for %s has been revoked", name)
+		}
+		return cert, err
+	}
+
+	// Approved on demand just now; autocert can't pick the chain
+	if a.config.PreferredChain != "" {
+		if err := a.issueCertificate(name, ChallengeHTTP01, nil); err != nil {
+			a.scheduleRetry(name, err)
+			return a.fallbackCertificate(name)
+		}
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return a.certificates[name], nil
+	}
+
 	// Get certificate from autocert
-	return a.certManager.GetCertificate(hello)
+	cert, err := a.autocertCertificate(hello)
+	if err != nil {
+		a.scheduleRetry(name, err)
+		return a.fallbackCertificate(name)
+	}
+	return cert, nil
+}
+
+// autocertCertificate returns autocert's certificate for hello. Until autocert
+// holds one for the name, the issuance lock is taken first, so that only one
+// node of a cluster orders it and the others load it from the shared storage.
+func (a *AutoTLS) autocertCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.lockedAutocertCertificate(hello)
+	if err != nil || !a.isRevoked(cert) {
+		return cert, err
+	}
+
+	// autocert keeps a certificate in memory until it is due for renewal, so
+	// a revoked one is replaced by an order of our own
+	if err := a.issueCertificate(hello.ServerName, ChallengeHTTP01, nil); err != nil {
+		return nil, err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.certificates[hello.ServerName], nil
+}
+
+func (a *AutoTLS) lockedAutocertCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+
+	a.mu.RLock()
+	held := a.autocertHeld[name]
+	a.mu.RUnlock()
+	if held {
+		return a.certManager.GetCertificate(hello)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autocertLockTimeout)
+	defer cancel()
+	unlock, err := a.lockIssuance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cert, err := a.certManager.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.autocertHeld[name] = true
+	a.mu.Unlock()
+	return cert, nil
+}
+
+// cachedCertificate returns the certificate held for name, falling back to
+// one for its parent wildcard. The caller must hold a.mu.
+func (a *AutoTLS) cachedCertificate(name string) *tls.Certificate {
+	if cert, exists := a.certificates[name]; exists {
+		return cert
+	}
+	if wildcard := wildcardFor(name); wildcard != "" {
+		return a.certificates[wildcard]
+	}
+	return nil
 }
 
 // GetTLSConfig returns a TLS configuration suitable for use with http.Server.
+// Domains with a TLS policy of their own get a separate configuration per
+// handshake.
 func (a *AutoTLS) GetTLSConfig() *tls.Config {
-	return &tls.Config{
-		GetCertificate: a.GetCertificate,
-		MinVersion:     tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-		},
+	config, err := a.buildTLSConfig(a.config.Policy)
+	if err != nil {
+		log.Printf("Invalid TLS policy, using defaults: %v", err)
+		config, _ = a.buildTLSConfig() //nolint:errcheck
 	}
+	config.GetConfigForClient = a.configForClient
+	a.useTicketKeys(config)
+	return config
+}
+
+// allowsHost reports whether autocert may order certificates for host.
+func (a *AutoTLS) allowsHost(host string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.allowedHosts[host] || a.aliases[host] != ""
 }
 
-// StartHTTPChallenge starts an HTTP server for Let's Encrypt HTTP-01 challenges.
+// HTTPChallengeHandler answers HTTP-01 challenges for the managed domains and
+// passes every other request to next, including challenges for other names,
+// which backends may be solving themselves. It lets a listener that carries
+// other traffic take the challenges, e.g. when port 80 is forwarded to it.
+func (a *AutoTLS) HTTPChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) && a.allowsHost(strings.ToLower(host)) {
+			a.certManager.HTTPHandler(nil).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StartHTTPChallenge starts an HTTP server for Let's Encrypt HTTP-01
+// challenges on listenAddr. Other requests are redirected to HTTPS.
 func (a *AutoTLS) StartHTTPChallenge(listenAddr string) error {
-	server := &http.Server{
+	log.Printf("Starting HTTP challenge server on %s", listenAddr)
+	return a.HTTPChallengeServer(listenAddr).ListenAndServe()
+}
+
+// HTTPChallengeServer returns the server StartHTTPChallenge runs, for
+// callers that manage its lifetime themselves.
+func (a *AutoTLS) HTTPChallengeServer(listenAddr string) *http.Server {
+	return &http.Server{
 		Addr:              listenAddr,
 		Handler:           a.certManager.HTTPHandler(nil),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
+}
 
-	log.Printf("Starting HTTP challenge server on %s", listenAddr)
-	return server.ListenAndServe()
+// DomainOptions selects how the certificate of a domain is obtained. Empty
+// fields use the configured defaults.
+type DomainOptions struct {
+	Issuer    string     // IssuerACME or IssuerInternal
+	Challenge string     // ACME challenge type, ChallengeHTTP01 or ChallengeDNS01
+	Policy    *TLSPolicy // Overrides the global TLS policy for this domain
+	Aliases   []string   // Extra names covered by the domain's certificate, e.g. its www variant
 }
 
 // AddDomain adds a domain to the list of allowed domains for certificate provisioning.
 func (a *AutoTLS) AddDomain(domain string) error {
+	return a.AddDomainWithOptions(domain, DomainOptions{})
+}
+
+// AddDomainWithOptions adds a domain whose certificate is obtained as opts
+// describe.
+func (a *AutoTLS) AddDomainWithOptions(domain string, opts DomainOptions) error {
+	// The names of the catch-all rule are only known at handshake time
+	if domain == "*" {
+		if a.config.OnDemandAsk == "" {
+			return fmt.Errorf("certificates for the catch-all domain require on-demand TLS")
+		}
+		return nil
+	}
+
+	if opts.Policy != nil {
+		if err := a.setPolicy(domain, *opts.Policy); err != nil {
+			return err
+		}
+	}
+
+	issuer := opts.Issuer
+	if issuer == "" {
+		issuer = a.config.Issuer
+		if isLocalDomain(domain) {
+			issuer = IssuerInternal
+		}
+	}
+	switch issuer {
+	case IssuerInternal:
+		// The internal CA signs each alias separately
+		for _, alias := range opts.Aliases {
+			if err := a.addInternalDomain(alias); err != nil {
+				return err
+			}
+		}
+		return a.addInternalDomain(domain)
+	case "", IssuerACME:
+	default:
+		return fmt.Errorf("unsupported certificate issuer: %q", issuer)
+	}
+
+	challenge := opts.Challenge
+	if challenge == "" {
+		challenge = a.config.Challenge
+		if strings.HasPrefix(domain, "*.") {
+			challenge = ChallengeDNS01
+		}
+	}
+	if strings.HasPrefix(domain, "*.") && challenge != ChallengeDNS01 {
+		return fmt.Errorf("wildcard certificate for %s requires the dns-01 challenge", domain)
+	}
+	switch challenge {
+	case ChallengeDNS01, "", ChallengeHTTP01:
+	default:
+		return fmt.Errorf("unsupported ACME challenge: %q", challenge)
+	}
+
+	a.setAliases(domain, opts.Aliases)
+	if challenge == ChallengeDNS01 {
+		return a.addDNSDomain(domain)
+	}
+
 	// Add domain to allowed hosts
 	a.mu.Lock()
 	a.allowedHosts[domain] = true
+	delete(a.dnsDomains, domain)
+	ordered := a.ordersOwnCertificate(domain)
+	coveredBy := wildcardFor(domain)
+	if !a.dnsDomains[coveredBy] {
+		coveredBy = ""
+	}
 	a.mu.Unlock()
 
+	if ordered {
+		return a.addOrderedDomain(domain)
+	}
+
+	// Subdomains of a wildcard are served its certificate; autocert only
+	// issues one on demand if the wildcard becomes unavailable
+	if coveredBy != "" {
+		log.Printf("Domain %s is covered by wildcard certificate %s", domain, coveredBy)
+		return nil
+	}
+
+	// Don't ask the CA again while an earlier failure is backed off; the
+	// scheduled retry picks the domain up
+	if until := a.backingOffUntil(domain); !until.IsZero() {
+		log.Printf("Not requesting a certificate for %s, backing off until %s", domain, until.Format(time.RFC3339))
+		return nil
+	}
+
 	// Pre-load certificate for domain
-	_, err := a.certManager.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	_, err := a.autocertCertificate(&tls.ClientHelloInfo{ServerName: domain})
 	if err != nil {
-		log.Printf("Warning: Failed to get certificate for %s (will retry on first request): %v", domain, err)
-		// Don't return error - certificate will be obtained on first request
+		// Don't return error - a self-signed certificate is served while
+		// issuance is retried in the background
+		a.scheduleRetry(domain, err)
 		return nil
 	}
 
+	a.mu.Lock()
+	a.clearFallback(domain)
+	a.mu.Unlock()
+
 	log.Printf("Successfully obtained certificate for domain: %s", domain)
 	return nil
 }
 
-// RemoveDomain removes a domain from the allowed list and deletes its certificate.
+// wildcardFor returns the wildcard name covering host, e.g. "*.example.com"
+// for "www.example.com", or "" if host has no parent domain.
+func wildcardFor(host string) string {
+	if i := strings.Index(host, "."); i > 0 && strings.Contains(host[i+1:], ".") {
+		return "*" + host[i:]
+	}
+	return ""
+}
+
+// RemoveDomain stops managing domain like DeactivateDomain and deletes its
+// stored certificates, so adding it again orders a new one.
 func (a *AutoTLS) RemoveDomain(domain string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.DeactivateDomain(domain)
 
-	delete(a.certificates, domain)
-	delete(a.allowedHosts, domain)
+	// autocert stores the ECDSA certificate under the domain itself, which is
+	// also where certificates of our own http-01 orders go
+	ctx, cancel := context.WithTimeout(context.Background(), storageDeleteTimeout)
+	defer cancel()
+	for _, name := range []string{domain, domain + autocertRSASuffix, dnsCacheName(domain)} {
+		if err := a.certManager.Cache.Delete(ctx, name); err != nil {
+			log.Printf("Warning: Failed to delete stored certificate %s: %v", name, err)
+		}
+	}
 
-	// Remove from cache
+	// Written by GenerateSelfSignedCert
 	certFile := filepath.Join(a.config.CacheDir, domain+".crt")
 	keyFile := filepath.Join(a.config.CacheDir, domain+".key")
-
 	_ = os.Remove(certFile) //nolint:errcheck
 	_ = os.Remove(keyFile)  //nolint:errcheck
 
 	log.Printf("Removed certificate for domain: %s", domain)
 }
 
+// DeactivateDomain stops serving and renewing certificates for domain but
+// keeps them in the storage, so adding the domain again reuses them.
+func (a *AutoTLS) DeactivateDomain(domain string) {
+	a.mu.Lock()
+	var leaves []*x509.Certificate
+	for name, cert := range a.certificates {
+		// Subdomain certificates of internal wildcards go with the wildcard
+		if name != domain && (wildcardFor(name) != domain || a.allowedHosts[name] || a.dnsDomains[name] || a.internalDomains[name]) {
+			continue
+		}
+		if cert.Leaf != nil {
+			leaves = append(leaves, cert.Leaf)
+		}
+		delete(a.certificates, name)
+	}
+	delete(a.allowedHosts, domain)
+	delete(a.dnsDomains, domain)
+	delete(a.internalDomains, domain)
+	delete(a.policies, domain)
+	delete(a.autocertHeld, domain)
+	delete(a.renewals, domain)
+	delete(a.aliases, domain)
+	for alias, primary := range a.aliases {
+		if primary == domain {
+			delete(a.aliases, alias)
+		}
+	}
+	a.clearFallback(domain)
+	a.mu.Unlock()
+
+	// Forget the OCSP and renewal window state of its certificates
+	a.ocspMu.Lock()
+	for _, leaf := range leaves {
+		delete(a.staples, certKey(leaf))
+	}
+	a.ocspMu.Unlock()
+	a.ariMu.Lock()
+	for _, leaf := range leaves {
+		delete(a.ari, certKey(leaf))
+	}
+	a.ariMu.Unlock()
+
+	log.Printf("Deactivated domain: %s", domain)
+}
+
 // ListDomains returns a list of all registered domains.
 func (a *AutoTLS) ListDomains() []string {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
-	domains := make([]string, 0, len(a.allowedHosts))
+	domains := make([]string, 0, len(a.allowedHosts)+len(a.dnsDomains)+len(a.internalDomains))
 	for domain := range a.allowedHosts {
 		domains = append(domains, domain)
 	}
+	for domain := range a.dnsDomains {
+		domains = append(domains, domain)
+	}
+	for domain := range a.internalDomains {
+		domains = append(domains, domain)
+	}
 
 	return domains
 }
 
+// CertificateExpiries returns when the certificate served for each managed
+// domain expires. Domains without a certificate yet are left out.
+func (a *AutoTLS) CertificateExpiries() map[string]time.Time {
+	expiries := make(map[string]time.Time)
+	for _, domain := range a.ListDomains() {
+		if cert, _, err := a.lookupCertificate(domain); err == nil {
+			expiries[domain] = cert.Leaf.NotAfter
+		}
+	}
+	return expiries
+}
+
 // GetCertInfo retrieves information about a certificate for a specific domain.
 func (a *AutoTLS) GetCertInfo(domain string) (*CertInfo, error) {
-	// Try to get certificate from autocert manager
-	hello := &tls.ClientHelloInfo{ServerName: domain}
-	cert, err := a.certManager.GetCertificate(hello)
+	cert, selfSigned, err := a.lookupCertificate(domain)
 	if err != nil {
-		return nil, fmt.Errorf("certificate not found for domain %s: %v", domain, err)
+		return nil, err
 	}
+	x509Cert := cert.Leaf
 
-	// Parse certificate
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	a.mu.RLock()
+	var retry *CertRetry
+	if r := a.retries[domain]; r != nil {
+		retry = &CertRetry{Failures: r.failures, LastError: r.lastError, RateLimited: r.rateLimited, BackingOffUntil: r.next}
+	}
+	lastRenewal := a.renewals[domain]
+	a.mu.RUnlock()
+
+	var revocation *RevocationStatus
+	if !selfSigned {
+		revocation = a.revocationStatus(cert)
 	}
 
 	return &CertInfo{
 		Domain:        domain,
+		SelfSigned:    selfSigned,
+		Revocation:    revocation,
+		OCSP:          a.ocspStatus(x509Cert),
+		RenewalWindow: a.cachedRenewalWindow(x509Cert),
+		Retry:         retry,
+		LastRenewal:   lastRenewal,
 		Issuer:        x509Cert.Issuer.CommonName,
 		NotBefore:     x509Cert.NotBefore,
 		NotAfter:      x509Cert.NotAfter,
 		IsExpired:     time.Now().After(x509Cert.NotAfter),
 		DaysRemaining: int(time.Until(x509Cert.NotAfter).Hours() / 24),
 		SerialNumber:  x509Cert.SerialNumber.String(),
+		SANs:          subjectAltNames(x509Cert),
+		KeyAlgorithm:  keyAlgorithm(x509Cert),
+		Chain:         certChain(cert),
 	}, nil
 }
 
+// subjectAltNames lists the DNS names and IP addresses leaf is valid for.
+func subjectAltNames(leaf *x509.Certificate) []string {
+	names := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// keyAlgorithm describes the public key of leaf, e.g. "ECDSA P-256".
+func keyAlgorithm(leaf *x509.Certificate) string {
+	switch key := leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return leaf.PublicKeyAlgorithm.String()
+	}
+}
+
+// certChain describes every certificate served for cert, leaf first.
+func certChain(cert *tls.Certificate) []ChainCertificate {
+	chain := make([]ChainCertificate, 0, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		fingerprint := sha256.Sum256(der)
+		chain = append(chain, ChainCertificate{
+			Subject:      parsed.Subject.String(),
+			Issuer:       parsed.Issuer.String(),
+			SerialNumber: parsed.SerialNumber.String(),
+			NotBefore:    parsed.NotBefore,
+			NotAfter:     parsed.NotAfter,
+			Fingerprint:  hex.EncodeToString(fingerprint[:]),
+		})
+	}
+	return chain
+}
+
+// lookupCertificate returns the certificate served for domain with its Leaf
+// set, and whether it is a self-signed fallback.
+func (a *AutoTLS) lookupCertificate(domain string) (*tls.Certificate, bool, error) {
+	a.mu.RLock()
+	domain = a.primaryDomain(domain)
+	cert := a.cachedCertificate(domain)
+	fallback := a.fallbacks[domain]
+	ordered := a.allowedHosts[domain] && a.ordersOwnCertificate(domain)
+	a.mu.RUnlock()
+
+	if cert == nil && fallback != nil {
+		cert = fallback
+	}
+	if cert == nil && ordered {
+		return nil, false, fmt.Errorf("certificate not found for domain %s", domain)
+	}
+	if cert == nil {
+		// Try to get certificate from autocert manager
+		hello := &tls.ClientHelloInfo{ServerName: domain}
+		var err error
+		cert, err = a.autocertCertificate(hello)
+		if err != nil {
+			return nil, false, fmt.Errorf("certificate not found for domain %s: %v", domain, err)
+		}
+	}
+
+	if cert.Leaf == nil {
+		// Parse certificate
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		withLeaf := *cert
+		withLeaf.Leaf = leaf
+		cert = &withLeaf
+	}
+	return cert, cert == fallback, nil
+}
+
 // CertInfo contains information about a TLS certificate.
 type CertInfo struct {
-	Domain        string    `json:"domain"`
-	Issuer        string    `json:"issuer"`
-	NotBefore     time.Time `json:"not_before"`
-	NotAfter      time.Time `json:"not_after"`
-	IsExpired     bool      `json:"is_expired"`
-	DaysRemaining int       `json:"days_remaining"`
-	SerialNumber  string    `json:"serial_number"`
+	Domain        string             `json:"domain"`
+	Issuer        string             `json:"issuer"`
+	NotBefore     time.Time          `json:"not_before"`
+	NotAfter      time.Time          `json:"not_after"`
+	IsExpired     bool               `json:"is_expired"`
+	DaysRemaining int                `json:"days_remaining"`
+	SerialNumber  string             `json:"serial_number"`
+	SANs          []string           `json:"sans"`
+	KeyAlgorithm  string             `json:"key_algorithm"`
+	Chain         []ChainCertificate `json:"chain"`                    // Leaf first
+	Revocation    *RevocationStatus  `json:"revocation,omitempty"`     // Unset for certificates naming neither an OCSP responder nor a CRL
+	SelfSigned    bool               `json:"self_signed,omitempty"`    // Served in place of a certificate ACME failed to issue
+	OCSP          string             `json:"ocsp,omitempty"`           // Stapled OCSP status: good, revoked or unknown
+	RenewalWindow *RenewalWindow     `json:"renewal_window,omitempty"` // Suggested by the CA through ARI
+	Retry         *CertRetry         `json:"retry,omitempty"`
+	LastRenewal   *RenewalStatus     `json:"last_renewal,omitempty"` // Unset until a renewal was attempted since startup
+}
+
+// ChainCertificate describes one certificate of a served chain.
+type ChainCertificate struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	Fingerprint  string    `json:"fingerprint"` // SHA-256 of the DER encoding
+}
+
+// RenewalStatus is the outcome of the last renewal attempt for a domain.
+type RenewalStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// CertRetry describes the backoff after failed issuances or renewals.
+type CertRetry struct {
+	Failures        int       `json:"failures"`
+	LastError       string    `json:"last_error"`
+	RateLimited     bool      `json:"rate_limited,omitempty"` // The CA rejected the last request for exceeding its rate limits
+	BackingOffUntil time.Time `json:"backing_off_until"`      // No requests go to the CA for the domain before this
 }
 
 // GenerateSelfSignedCert generates and saves a self-signed certificate for the domain.
 func (a *AutoTLS) GenerateSelfSignedCert(domain string) error {
 	// Fallback to self-signed certificate if ACME fails
-	cert, key := generateSelfSignedCertificate(domain)
+	_, cert, key, err := newLeafCertificate(domain, nil, nil, selfSignedValidity)
+	if err != nil {
+		return err
+	}
 
 	// Save to cache
 	certFile := filepath.Join(a.config.CacheDir, domain+".crt")
@@ -235,60 +878,180 @@ func (a *AutoTLS) GenerateSelfSignedCert(domain string) error {
 	return nil
 }
 
-func generateSelfSignedCertificate(_ string) ([]byte, []byte) {
-	// This is a placeholder - in a real implementation you would
-	// use crypto/tls or crypto/x509 to generate actual certificates
-	return []byte("self-signed-cert"), []byte("self-signed-key")
-}
-
 // ForceRenewal forces immediate renewal of a certificate for the given domain.
 func (a *AutoTLS) ForceRenewal(domain string) error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.mu.RLock()
+	domain = a.primaryDomain(domain)
+	a.mu.RUnlock()
+
+	if a.isInternalDomain(domain) {
+		_, err := a.issueInternalCertificate(domain)
+		a.recordRenewal(domain, err)
+		if err != nil {
+			return fmt.Errorf("failed to renew certificate for %s: %v", domain, err)
+		}
+		return nil
+	}
 
-	// Remove from cache to force renewal
-	delete(a.certificates, domain)
+	a.mu.RLock()
+	dns := a.dnsDomains[domain]
+	registered := dns || a.allowedHosts[domain]
+	a.mu.RUnlock()
+	if !registered {
+		return fmt.Errorf("domain %s is not registered", domain)
+	}
+	if until := a.backingOffUntil(domain); !until.IsZero() {
+		return fmt.Errorf("%w for %s until %s", ErrBackingOff, domain, until.Format(time.RFC3339))
+	}
 
-	// Force ACME renewal
-	if err := a.AddDomain(domain); err != nil {
-		return fmt.Errorf("failed to renew certificate for %s: %v", domain, err)
+	var current *x509.Certificate
+	if cert, selfSigned, err := a.lookupCertificate(domain); err == nil && !selfSigned {
+		current = cert.Leaf
 	}
 
-	log.Printf("Successfully renewed certificate for domain: %s", domain)
+	// autocert only renews at its own schedule, so run the order ourselves
+	challenge := ChallengeHTTP01
+	if dns {
+		challenge = ChallengeDNS01
+	}
+	err := a.issueCertificate(domain, challenge, current)
+	a.recordRenewal(domain, err)
+	if err != nil {
+		a.mu.Lock()
+		until := a.backOff(domain, err).next
+		a.mu.Unlock()
+		log.Printf("Warning: Failed to renew certificate for %s, backing off until %s", domain, until.Format(time.RFC3339))
+		return fmt.Errorf("failed to renew certificate for %s: %w", domain, err)
+	}
 	return nil
 }
 
-// CheckRenewals starts a background process that checks and renews expiring certificates daily.
+// recordRenewal remembers the outcome of a renewal attempt for CertInfo.
+func (a *AutoTLS) recordRenewal(domain string, err error) {
+	status := &RenewalStatus{Time: time.Now(), Success: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+		a.publish(events.CertRenewalFailed, domain, fmt.Sprintf("Renewing the certificate for %s failed: %v", domain, err))
+	} else {
+		a.publish(events.CertRenewed, domain, "Renewed the certificate for "+domain)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.renewals[domain] = status
+}
+
+// publish sends an event about domain to the event bus, if there is one.
+func (a *AutoTLS) publish(eventType, domain, message string) {
+	a.config.Events.Publish(events.Event{Type: eventType, Domain: domain, Message: message})
+}
+
+// CheckRenewals starts a background process that checks and renews expiring
+// certificates, right away and then every RenewalInterval, or earlier when a
+// renewal window suggested by the CA opens before that.
 func (a *AutoTLS) CheckRenewals() {
-	ticker := time.NewTicker(24 * time.Hour) // Check daily
-	defer ticker.Stop()
+	for {
+		next := a.checkAndRenewExpiringCerts()
 
-	for range ticker.C {
-		a.checkAndRenewExpiringCerts()
+		delay := a.config.RenewalInterval
+		if a.config.RenewalJitter > 0 {
+			delay += rand.N(a.config.RenewalJitter)
+		}
+		if !next.IsZero() && time.Until(next) < delay {
+			delay = max(time.Until(next), minRenewalCheckDelay)
+		}
+		time.Sleep(delay)
 	}
 }
 
-func (a *AutoTLS) checkAndRenewExpiringCerts() {
+// renewableDomains returns the domains whose certificates are renewed.
+func (a *AutoTLS) renewableDomains() []string {
 	a.mu.RLock()
-	domains := make([]string, 0, len(a.certificates))
+	defer a.mu.RUnlock()
+	domains := make([]string, 0, len(a.certificates)+len(a.allowedHosts))
 	for domain := range a.certificates {
 		domains = append(domains, domain)
 	}
-	a.mu.RUnlock()
+	// Certificates obtained by autocert are only held by autocert
+	for domain := range a.allowedHosts {
+		if _, exists := a.certificates[domain]; !exists {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// dueTime returns when the certificate leaf of domain is due for renewal,
+// and when to fetch the CA's renewal window again.
+func (a *AutoTLS) dueTime(domain string, leaf *x509.Certificate) (renewAt, recheck time.Time) {
+	renewAt, recheck = a.renewalTime(domain, leaf)
+	if names := a.certNames(domain); len(names) > 1 && !coversNames(leaf, names) {
+		// An alias was added since it was issued
+		renewAt = time.Now()
+	}
+	return renewAt, recheck
+}
+
+// checkAndRenewExpiringCerts renews the certificates that are due and returns
+// the time the next one becomes due, or zero if none does sooner than the
+// next regular check.
+func (a *AutoTLS) checkAndRenewExpiringCerts() time.Time {
+	domains := a.renewableDomains()
+
+	warningDays := a.config.ExpiryWarningDays
+	if warningDays <= 0 {
+		warningDays = defaultExpiryWarningDays
+	}
 
+	var next time.Time
 	for _, domain := range domains {
-		info, err := a.GetCertInfo(domain)
+		cert, selfSigned, err := a.lookupCertificate(domain)
 		if err != nil {
 			log.Printf("Error getting cert info for %s: %v", domain, err)
 			continue
 		}
+		if selfSigned {
+			// Failed issuance is already being retried
+			continue
+		}
 
-		// Renew if expires in less than 30 days
-		if info.DaysRemaining < 30 {
-			log.Printf("Certificate for %s expires in %d days, renewing...", domain, info.DaysRemaining)
+		renewAt, recheck := a.dueTime(domain, cert.Leaf)
+		if !recheck.IsZero() && (next.IsZero() || recheck.Before(next)) {
+			next = recheck
+		}
+		// A recently failed renewal is tried again once its backoff ends
+		if until := a.backingOffUntil(domain); until.After(renewAt) {
+			renewAt = until
+		}
+		if time.Now().Before(renewAt) {
+			if next.IsZero() || renewAt.Before(next) {
+				next = renewAt
+			}
+		} else {
+			log.Printf("Certificate for %s expires on %s, renewing...", domain, cert.Leaf.NotAfter.Format(time.RFC1123))
 			if err := a.ForceRenewal(domain); err != nil {
 				log.Printf("Failed to renew certificate for %s: %v", domain, err)
+				if until := a.backingOffUntil(domain); !until.IsZero() && (next.IsZero() || until.Before(next)) {
+					next = until
+				}
+				a.config.Notifier.Notify(notify.Event{
+					Type:    notify.EventCertRenewalFailed,
+					Domain:  domain,
+					Message: fmt.Sprintf("Renewing the certificate for %s failed: %v. It expires on %s.", domain, err, cert.Leaf.NotAfter.Format(time.RFC1123)),
+				})
+			} else if renewed, _, err := a.lookupCertificate(domain); err == nil {
+				cert = renewed
 			}
 		}
+
+		if daysRemaining := int(time.Until(cert.Leaf.NotAfter).Hours() / 24); daysRemaining <= warningDays {
+			a.publish(events.CertExpiring, domain, fmt.Sprintf("The certificate for %s expires in %d days", domain, daysRemaining))
+			a.config.Notifier.Notify(notify.Event{
+				Type:    notify.EventCertExpiring,
+				Domain:  domain,
+				Message: fmt.Sprintf("The certificate for %s expires in %d days, on %s.", domain, daysRemaining, cert.Leaf.NotAfter.Format(time.RFC1123)),
+			})
+		}
 	}
+	return next
 }
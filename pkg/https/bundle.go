@@ -0,0 +1,107 @@
+package https
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"slices"
+	"sort"
+	"time"
+)
+
+// setAliases replaces the extra names bundled into the certificate of
+// domain, e.g. its www variant.
+func (a *AutoTLS) setAliases(domain string, aliases []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for alias, primary := range a.aliases {
+		if primary == domain {
+			delete(a.aliases, alias)
+		}
+	}
+	for _, alias := range aliases {
+		if alias != "" && alias != domain {
+			a.aliases[alias] = domain
+		}
+	}
+}
+
+// primaryDomain returns the domain whose certificate bundles name, or name
+// itself if it is registered on its own or no alias. The caller must hold
+// a.mu.
+func (a *AutoTLS) primaryDomain(name string) string {
+	if domain, ok := a.aliases[name]; ok && !a.allowedHosts[name] && !a.dnsDomains[name] {
+		return domain
+	}
+	return name
+}
+
+// ordersOwnCertificate reports whether the http-01 certificate of domain is
+// ordered here rather than by autocert, which can neither bundle aliases nor
+// pick a preferred chain. The caller must hold a.mu.
+func (a *AutoTLS) ordersOwnCertificate(domain string) bool {
+	if a.config.PreferredChain != "" {
+		return true
+	}
+	for _, primary := range a.aliases {
+		if primary == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// certNames returns the names requested in the certificate of domain: the
+// domain itself followed by its aliases.
+func (a *AutoTLS) certNames(domain string) []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var aliases []string
+	for alias, primary := range a.aliases {
+		if primary == domain {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return append([]string{domain}, aliases...)
+}
+
+// coversNames reports whether leaf lists every one of names, so certificates
+// issued before an alias was added get replaced.
+func coversNames(leaf *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if !slices.Contains(leaf.DNSNames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// addOrderedDomain serves the stored certificate of an http-01 domain that
+// autocert can't handle, or orders one covering all its names like DNS-01
+// domains are.
+func (a *AutoTLS) addOrderedDomain(domain string) error {
+	var current *x509.Certificate
+	cert, err := a.loadCertificate(context.Background(), certCacheName(domain, ChallengeHTTP01))
+	if err == nil {
+		a.mu.Lock()
+		a.certificates[domain] = cert
+		a.mu.Unlock()
+		if time.Until(cert.Leaf.NotAfter) > a.config.RenewBefore && coversNames(cert.Leaf, a.certNames(domain)) {
+			return nil
+		}
+		current = cert.Leaf
+	}
+	if until := a.backingOffUntil(domain); !until.IsZero() {
+		log.Printf("Not requesting a certificate for %s, backing off until %s", domain, until.Format(time.RFC3339))
+		return nil
+	}
+
+	if err := a.issueCertificate(domain, ChallengeHTTP01, current); err != nil {
+		// A self-signed certificate is served while issuance is retried
+		a.scheduleRetry(domain, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertStorage holds certificates, the ACME account key, challenge tokens and
+// the internal root CA. Nodes of a cluster sharing one storage serve the same
+// certificates, and each can answer challenges for orders another started.
+//
+// It matches autocert.Cache: Get returns autocert.ErrCacheMiss for missing
+// entries.
+type CertStorage interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, data []byte) error
+	Delete(ctx context.Context, name string) error
+}
+
+var _ autocert.Cache = CertStorage(nil)
+
+// StorageConfig configures the certificate storage backend. Only the fields of
+// the selected type are used.
+type StorageConfig struct {
+	Type   string // "file" (default), "redis", "sql" or "s3"
+	Dir    string // Directory of file storage
+	Prefix string // Prepended to the key names of redis and s3 entries
+
+	RedisURL string // e.g. redis://localhost:6379/0
+
+	Driver string // database/sql driver, e.g. "postgres", "mysql" or "sqlite3"
+	DSN    string
+	Table  string // Created if missing, defaults to "saddy_certificates"
+
+	Bucket          string
+	Region          string // Defaults to us-east-1
+	Endpoint        string // S3-compatible endpoint such as MinIO, AWS when empty
+	AccessKeyID     string // Default to the AWS_* environment variables
+	SecretAccessKey string
+
+	// EncryptionPassphrase or EncryptionKeyFile, a base64 encoded 32-byte
+	// key such as a data key decrypted by a KMS, enable encryption of the
+	// stored private keys
+	EncryptionPassphrase string
+	EncryptionKeyFile    string
+}
+
+// NewCertStorage creates the certificate storage named in config.
+func NewCertStorage(config StorageConfig) (CertStorage, error) {
+	storage, err := newCertStorage(config)
+	if err != nil || (config.EncryptionPassphrase == "" && config.EncryptionKeyFile == "") {
+		return storage, err
+	}
+	return newEncryptedStorage(storage, config.EncryptionPassphrase, config.EncryptionKeyFile)
+}
+
+func newCertStorage(config StorageConfig) (CertStorage, error) {
+	switch strings.ToLower(config.Type) {
+	case "", "file":
+		if config.Dir == "" {
+			return nil, fmt.Errorf("file certificate storage requires a directory")
+		}
+		return fileStorage{autocert.DirCache(config.Dir)}, nil
+	case "redis":
+		return newRedisStorage(config)
+	case "sql":
+		return newSQLStorage(config)
+	case "s3":
+		return newS3Storage(config)
+	default:
+		return nil, fmt.Errorf("unsupported certificate storage: %q", config.Type)
+	}
+}
+
+// fileStorage is autocert's directory cache, with locks for nodes sharing the
+// directory over a network file system.
+type fileStorage struct {
+	autocert.DirCache
+}
+
+func (s fileStorage) createExclusive(_ context.Context, name string, data []byte, _ time.Duration) (bool, error) {
+	dir := string(s.DirCache)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) //nolint:gosec
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close() //nolint:errcheck
+		return false, err
+	}
+	return true, file.Close()
+}
+
+func (s fileStorage) deleteIfEqual(_ context.Context, name string, data []byte) error {
+	file := filepath.Join(string(s.DirCache), name)
+	current, err := os.ReadFile(file) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !bytes.Equal(current, data)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
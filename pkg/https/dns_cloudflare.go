@@ -0,0 +1,103 @@
+package https
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider manages challenge records through the Cloudflare API.
+type cloudflareProvider struct {
+	token  string
+	zone   string
+	ttl    int
+	client *http.Client
+
+	mu      sync.Mutex
+	records map[string]string // fqdn+value -> "zoneID/recordID"
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Result  []struct {
+		ID string `json:"id"`
+	} `json:"result"`
+}
+
+func newCloudflareProvider(config DNSConfig, client *http.Client) *cloudflareProvider {
+	return &cloudflareProvider{
+		token:   config.APIToken,
+		zone:    config.Zone,
+		ttl:     config.TTL,
+		client:  client,
+		records: make(map[string]string),
+	}
+}
+
+func (p *cloudflareProvider) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.token}
+}
+
+// zoneID finds the Cloudflare zone holding fqdn.
+func (p *cloudflareProvider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	candidates := zoneCandidates(fqdn)
+	if p.zone != "" {
+		candidates = []string{p.zone}
+	}
+
+	for _, name := range candidates {
+		var resp cloudflareResponse
+		if err := doJSON(ctx, p.client, http.MethodGet, cloudflareAPI+"/zones?name="+url.QueryEscape(name), p.headers(), nil, &resp); err != nil {
+			return "", err
+		}
+		if resp.Success && len(resp.Result) > 0 {
+			return resp.Result[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no cloudflare zone found for %s", fqdn)
+}
+
+func (p *cloudflareProvider) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	record := map[string]interface{}{"type": "TXT", "name": fqdn, "content": value, "ttl": p.ttl}
+	if err := doJSON(ctx, p.client, http.MethodPost, cloudflareAPI+"/zones/"+zoneID+"/dns_records", p.headers(), record, &resp); err != nil {
+		return fmt.Errorf("failed to create cloudflare record: %v", err)
+	}
+	if !resp.Success || resp.Result.ID == "" {
+		return fmt.Errorf("cloudflare did not create record %s", fqdn)
+	}
+
+	p.mu.Lock()
+	p.records[fqdn+"|"+value] = zoneID + "/dns_records/" + resp.Result.ID
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *cloudflareProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	path, exists := p.records[fqdn+"|"+value]
+	delete(p.records, fqdn+"|"+value)
+	p.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	if err := doJSON(ctx, p.client, http.MethodDelete, cloudflareAPI+"/zones/"+path, p.headers(), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete cloudflare record: %v", err)
+	}
+	return nil
+}
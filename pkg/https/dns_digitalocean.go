@@ -0,0 +1,87 @@
+package https
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const digitalOceanAPI = "https://api.digitalocean.com/v2"
+
+// digitalOceanProvider manages challenge records through the DigitalOcean API.
+type digitalOceanProvider struct {
+	token  string
+	zone   string
+	ttl    int
+	client *http.Client
+
+	mu      sync.Mutex
+	records map[string]string // fqdn+value -> "zone/records/recordID"
+}
+
+func newDigitalOceanProvider(config DNSConfig, client *http.Client) *digitalOceanProvider {
+	return &digitalOceanProvider{
+		token:   config.APIToken,
+		zone:    config.Zone,
+		ttl:     config.TTL,
+		client:  client,
+		records: make(map[string]string),
+	}
+}
+
+func (p *digitalOceanProvider) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.token}
+}
+
+// findZone returns the DigitalOcean domain holding fqdn.
+func (p *digitalOceanProvider) findZone(ctx context.Context, fqdn string) (string, error) {
+	if p.zone != "" {
+		return p.zone, nil
+	}
+	for _, name := range zoneCandidates(fqdn) {
+		if err := doJSON(ctx, p.client, http.MethodGet, digitalOceanAPI+"/domains/"+url.PathEscape(name), p.headers(), nil, nil); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no digitalocean domain found for %s", fqdn)
+}
+
+func (p *digitalOceanProvider) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := p.findZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		DomainRecord struct {
+			ID int64 `json:"id"`
+		} `json:"domain_record"`
+	}
+	record := map[string]interface{}{"type": "TXT", "name": relativeName(fqdn, zone), "data": value, "ttl": p.ttl}
+	if err := doJSON(ctx, p.client, http.MethodPost, digitalOceanAPI+"/domains/"+url.PathEscape(zone)+"/records", p.headers(), record, &resp); err != nil {
+		return fmt.Errorf("failed to create digitalocean record: %v", err)
+	}
+
+	p.mu.Lock()
+	p.records[fqdn+"|"+value] = url.PathEscape(zone) + "/records/" + strconv.FormatInt(resp.DomainRecord.ID, 10)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *digitalOceanProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	path, exists := p.records[fqdn+"|"+value]
+	delete(p.records, fqdn+"|"+value)
+	p.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	if err := doJSON(ctx, p.client, http.MethodDelete, digitalOceanAPI+"/domains/"+path, p.headers(), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete digitalocean record: %v", err)
+	}
+	return nil
+}
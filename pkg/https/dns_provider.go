@@ -0,0 +1,165 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DNSProvider publishes and removes the TXT records used by DNS-01 challenges.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn with the given value.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// DNSConfig configures a DNS provider for DNS-01 challenges.
+type DNSConfig struct {
+	Provider        string
+	APIToken        string
+	Zone            string
+	HostedZoneID    string
+	AccessKeyID     string
+	SecretAccessKey string
+	WebhookURL      string
+	TTL             int
+}
+
+const (
+	// ChallengeHTTP01 proves control of a domain over plain HTTP on port 80.
+	ChallengeHTTP01 = "http-01"
+	// ChallengeDNS01 proves control of a domain with a TXT record.
+	ChallengeDNS01 = "dns-01"
+
+	defaultDNSRecordTTL          = 120
+	defaultDNSPropagationTimeout = 2 * time.Minute
+	dnsPropagationPollInterval   = 5 * time.Second
+)
+
+// NewDNSProvider creates the DNS provider named in config.
+func NewDNSProvider(config DNSConfig) (DNSProvider, error) {
+	if config.TTL <= 0 {
+		config.TTL = defaultDNSRecordTTL
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	switch strings.ToLower(config.Provider) {
+	case "cloudflare":
+		if config.APIToken == "" {
+			return nil, fmt.Errorf("cloudflare DNS provider requires api_token")
+		}
+		return newCloudflareProvider(config, client), nil
+	case "route53":
+		return newRoute53Provider(config, client)
+	case "digitalocean":
+		if config.APIToken == "" {
+			return nil, fmt.Errorf("digitalocean DNS provider requires api_token")
+		}
+		return newDigitalOceanProvider(config, client), nil
+	case "webhook":
+		if config.WebhookURL == "" {
+			return nil, fmt.Errorf("webhook DNS provider requires webhook_url")
+		}
+		return &webhookProvider{url: config.WebhookURL, token: config.APIToken, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS provider: %q", config.Provider)
+	}
+}
+
+// zoneCandidates lists the parent domains of a challenge record that may be
+// the zone holding it, longest first, e.g. "_acme-challenge.www.example.com"
+// yields "www.example.com" and "example.com".
+func zoneCandidates(fqdn string) []string {
+	name := strings.TrimSuffix(strings.TrimPrefix(fqdn, "_acme-challenge."), ".")
+	labels := strings.Split(name, ".")
+
+	candidates := make([]string, 0, len(labels))
+	for i := 0; i < len(labels)-1; i++ {
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	return candidates
+}
+
+// relativeName returns fqdn relative to zone, or "@" for the zone apex.
+func relativeName(fqdn, zone string) string {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if fqdn == zone {
+		return "@"
+	}
+	return strings.TrimSuffix(fqdn, "."+zone)
+}
+
+// doJSON sends a request with an optional JSON body and decodes a JSON
+// response into out, failing on non-2xx statuses.
+func doJSON(ctx context.Context, client *http.Client, method, url string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: status %d: %s", method, url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode response from %s: %v", url, err)
+		}
+	}
+	return nil
+}
+
+// webhookProvider delegates record changes to an external HTTP endpoint,
+// for DNS servers without a built-in provider (e.g. RFC 2136 via a script).
+type webhookProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (p *webhookProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.send(ctx, "present", fqdn, value)
+}
+
+func (p *webhookProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.send(ctx, "cleanup", fqdn, value)
+}
+
+func (p *webhookProvider) send(ctx context.Context, action, fqdn, value string) error {
+	headers := map[string]string{}
+	if p.token != "" {
+		headers["Authorization"] = "Bearer " + p.token
+	}
+	body := map[string]string{"action": action, "fqdn": fqdn, "value": value}
+	return doJSON(ctx, p.client, http.MethodPost, p.url, headers, body, nil)
+}
@@ -0,0 +1,209 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	route53Host   = "route53.amazonaws.com"
+	route53Region = "us-east-1"
+	route53NS     = "https://route53.amazonaws.com/doc/2013-04-01/"
+)
+
+// route53Provider manages challenge records through the AWS Route53 API.
+//
+// A name can hold several challenge values at once (e.g. a wildcard and its
+// base domain), so the provider tracks them and rewrites the whole record
+// set on every change.
+type route53Provider struct {
+	awsCredentials
+	hostedZoneID string
+	ttl          int
+	client       *http.Client
+
+	mu     sync.Mutex
+	values map[string][]string // fqdn -> challenge values currently published
+}
+
+func newRoute53Provider(config DNSConfig, client *http.Client) (*route53Provider, error) {
+	p := &route53Provider{
+		awsCredentials: newAWSCredentials(config.AccessKeyID, config.SecretAccessKey),
+		hostedZoneID:   strings.TrimPrefix(config.HostedZoneID, "/hostedzone/"),
+		ttl:            config.TTL,
+		client:         client,
+		values:         make(map[string][]string),
+	}
+	if p.accessKeyID == "" || p.secretAccessKey == "" {
+		return nil, fmt.Errorf("route53 DNS provider requires access_key_id and secret_access_key")
+	}
+	return p, nil
+}
+
+type route53ResourceRecordSet struct {
+	Name    string   `xml:"Name"`
+	Type    string   `xml:"Type"`
+	TTL     int      `xml:"TTL"`
+	Records []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Change struct {
+	Action    string                   `xml:"Action"`
+	RecordSet route53ResourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+func (p *route53Provider) Present(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	values := append(append([]string(nil), p.values[fqdn]...), value)
+	if err := p.change(ctx, fqdn, "UPSERT", values); err != nil {
+		return err
+	}
+	p.values[fqdn] = values
+	return nil
+}
+
+func (p *route53Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.values[fqdn]
+	remaining := make([]string, 0, len(current))
+	for _, v := range current {
+		if v != value {
+			remaining = append(remaining, v)
+		}
+	}
+	if len(remaining) == len(current) {
+		return nil
+	}
+
+	var err error
+	if len(remaining) == 0 {
+		// Deletions must match the published record set exactly
+		err = p.change(ctx, fqdn, "DELETE", current)
+	} else {
+		err = p.change(ctx, fqdn, "UPSERT", remaining)
+	}
+	if err != nil {
+		return err
+	}
+	if len(remaining) == 0 {
+		delete(p.values, fqdn)
+	} else {
+		p.values[fqdn] = remaining
+	}
+	return nil
+}
+
+// change applies a single record set change to the hosted zone of fqdn.
+func (p *route53Provider) change(ctx context.Context, fqdn, action string, values []string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	records := make([]string, len(values))
+	for i, value := range values {
+		records[i] = `"` + value + `"`
+	}
+
+	request := route53ChangeRequest{
+		Xmlns: route53NS,
+		Changes: []route53Change{{
+			Action: action,
+			RecordSet: route53ResourceRecordSet{
+				Name:    strings.TrimSuffix(fqdn, ".") + ".",
+				Type:    "TXT",
+				TTL:     p.ttl,
+				Records: records,
+			},
+		}},
+	}
+
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	if _, err := p.do(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+zoneID+"/rrset/", nil, body); err != nil {
+		return fmt.Errorf("failed to %s route53 record %s: %v", strings.ToLower(action), fqdn, err)
+	}
+	return nil
+}
+
+// zoneID returns the configured hosted zone or looks up the one holding fqdn.
+func (p *route53Provider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	if p.hostedZoneID != "" {
+		return p.hostedZoneID, nil
+	}
+
+	for _, name := range zoneCandidates(fqdn) {
+		query := url.Values{"dnsname": {name}, "maxitems": {"1"}}
+		data, err := p.do(ctx, http.MethodGet, "/2013-04-01/hostedzonesbyname", query, nil)
+		if err != nil {
+			return "", err
+		}
+
+		var resp struct {
+			HostedZones []struct {
+				ID   string `xml:"Id"`
+				Name string `xml:"Name"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		if err := xml.Unmarshal(data, &resp); err != nil {
+			return "", fmt.Errorf("failed to decode route53 hosted zones: %v", err)
+		}
+		if len(resp.HostedZones) > 0 && resp.HostedZones[0].Name == name+"." {
+			return strings.TrimPrefix(resp.HostedZones[0].ID, "/hostedzone/"), nil
+		}
+	}
+	return "", fmt.Errorf("no route53 hosted zone found for %s", fqdn)
+}
+
+// do sends a request signed with AWS Signature Version 4.
+func (p *route53Provider) do(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, error) {
+	endpoint := "https://" + route53Host + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	p.sign(req, body, route53Region, "route53", time.Now().UTC())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
@@ -0,0 +1,208 @@
+package https
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"saddy/pkg/events"
+	"saddy/pkg/notify"
+)
+
+const (
+	// retryInitialDelay is the wait before the first retry of a failed
+	// issuance, doubled after every further failure up to retryMaxDelay.
+	// autocert keeps reporting a failure for a minute before it tries again.
+	retryInitialDelay = 2 * time.Minute
+	// retryMaxDelay keeps retries well below Let's Encrypt's limit of five
+	// failed validations per hostname and hour.
+	retryMaxDelay = time.Hour
+)
+
+// ErrBackingOff is returned for certificate requests made while an earlier
+// failure for the same domain is backed off.
+var ErrBackingOff = errors.New("backing off after failed certificate requests")
+
+// issuanceRetry tracks a domain whose ACME issuance or renewal failed. No
+// further requests go to the CA for it until next. Failed issuances are
+// retried in the background while a self-signed certificate is served.
+type issuanceRetry struct {
+	failures    int
+	lastError   string
+	rateLimited bool
+	next        time.Time
+	timer       *time.Timer // Scheduled retry of a failed issuance
+}
+
+// retryDelay returns the backoff after the given number of failures.
+func retryDelay(failures int) time.Duration {
+	delay := retryInitialDelay
+	for i := 1; i < failures && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// rateLimitDelay reports whether err is the CA rejecting a request because of
+// its rate limits, and how long it asked to wait, if it said.
+func rateLimitDelay(err error) (time.Duration, bool) {
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) {
+		return 0, false
+	}
+	return acme.RateLimit(acmeErr)
+}
+
+// backOff records a failed certificate request for domain and sets when the
+// CA may be asked again. Rate limited requests wait at least as long as the
+// CA asks, and no less than retryMaxDelay. The caller must hold a.mu.
+func (a *AutoTLS) backOff(domain string, cause error) *issuanceRetry {
+	retry := a.retries[domain]
+	if retry == nil {
+		retry = &issuanceRetry{}
+		a.retries[domain] = retry
+	}
+	retry.failures++
+	retry.lastError = cause.Error()
+
+	delay := retryDelay(retry.failures)
+	wait, limited := rateLimitDelay(cause)
+	if limited {
+		delay = max(delay, wait, retryMaxDelay)
+	}
+	retry.rateLimited = limited
+	retry.next = time.Now().Add(delay)
+	return retry
+}
+
+// backingOffUntil returns the time until which requests for domain are held
+// back after a failure, or zero if it may be requested now.
+func (a *AutoTLS) backingOffUntil(domain string) time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if retry := a.retries[domain]; retry != nil && time.Now().Before(retry.next) {
+		return retry.next
+	}
+	return time.Time{}
+}
+
+// fallbackCertificate returns the self-signed certificate served for name
+// until a real one is issued, creating it on first use.
+func (a *AutoTLS) fallbackCertificate(name string) (*tls.Certificate, error) {
+	a.mu.RLock()
+	cert := a.fallbacks[name]
+	a.mu.RUnlock()
+	if cert != nil {
+		return cert, nil
+	}
+
+	cert, _, _, err := newLeafCertificate(name, nil, nil, selfSignedValidity)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if existing := a.fallbacks[name]; existing != nil {
+		return existing, nil
+	}
+	a.fallbacks[name] = cert
+	log.Printf("Serving self-signed certificate for %s until a certificate is issued", name)
+	return cert, nil
+}
+
+// scheduleRetry records a failed issuance for domain and retries it in the
+// background with exponential backoff. Handshakes get a self-signed
+// certificate in the meantime instead of failing.
+func (a *AutoTLS) scheduleRetry(domain string, cause error) {
+	if _, err := a.fallbackCertificate(domain); err != nil {
+		log.Printf("Warning: Failed to create self-signed certificate for %s: %v", domain, err)
+	}
+
+	a.mu.Lock()
+	if !a.allowedHosts[domain] && !a.dnsDomains[domain] {
+		// Removed while the issuance was running
+		a.mu.Unlock()
+		return
+	}
+	retry := a.backOff(domain, cause)
+	if retry.timer != nil {
+		retry.timer.Stop()
+	}
+	delay := time.Until(retry.next).Round(time.Second)
+	retry.timer = time.AfterFunc(delay, func() { a.retryIssuance(domain) })
+	failures, rateLimited := retry.failures, retry.rateLimited
+	a.mu.Unlock()
+
+	a.publish(events.CertIssuanceFailed, domain, fmt.Sprintf("Obtaining a certificate for %s failed (attempt %d, retrying in %s): %v", domain, failures, delay, cause))
+	if rateLimited {
+		log.Printf("Warning: Rate limited obtaining certificate for %s (attempt %d, retrying in %s): %v", domain, failures, delay, cause)
+	} else {
+		log.Printf("Warning: Failed to obtain certificate for %s (attempt %d, retrying in %s): %v", domain, failures, delay, cause)
+	}
+	if failures == 1 {
+		a.config.Notifier.Notify(notify.Event{
+			Type:    notify.EventCertIssuanceFailed,
+			Domain:  domain,
+			Message: fmt.Sprintf("Obtaining a certificate for %s failed: %v. A self-signed certificate is served while issuance is retried.", domain, cause),
+		})
+	}
+}
+
+// retryIssuance runs a scheduled retry and drops the self-signed fallback once
+// a certificate has been issued.
+func (a *AutoTLS) retryIssuance(domain string) {
+	a.mu.RLock()
+	_, pending := a.retries[domain]
+	dns := a.dnsDomains[domain]
+	ordered := a.ordersOwnCertificate(domain)
+	a.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	if dns || ordered {
+		challenge := ChallengeHTTP01
+		if dns {
+			challenge = ChallengeDNS01
+		}
+		// issueCertificate drops the fallback itself on success
+		if err := a.issueCertificate(domain, challenge, nil); err != nil {
+			a.scheduleRetry(domain, err)
+		}
+		return
+	}
+
+	if _, err := a.autocertCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+		a.scheduleRetry(domain, err)
+		return
+	}
+
+	a.mu.Lock()
+	a.clearFallback(domain)
+	a.mu.Unlock()
+	log.Printf("Successfully obtained certificate for domain: %s", domain)
+}
+
+// clearFallback stops retrying domain and forgets the self-signed
+// certificates served for it and, for wildcards, its subdomains. The caller
+// must hold a.mu.
+func (a *AutoTLS) clearFallback(domain string) {
+	if retry := a.retries[domain]; retry != nil && retry.timer != nil {
+		retry.timer.Stop()
+	}
+	delete(a.retries, domain)
+	delete(a.fallbacks, domain)
+	for name := range a.fallbacks {
+		if wildcardFor(name) == domain {
+			delete(a.fallbacks, name)
+		}
+	}
+}
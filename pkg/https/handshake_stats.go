@@ -0,0 +1,157 @@
+package https
+
+import (
+	"crypto/tls"
+	"maps"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HandshakeCounters counts TLS handshakes and what the successful ones
+// negotiated.
+type HandshakeCounters struct {
+	Successes    int64            `json:"successes"`
+	Failures     int64            `json:"failures"`
+	Versions     map[string]int64 `json:"versions"`      // Successful handshakes by protocol version
+	CipherSuites map[string]int64 `json:"cipher_suites"` // Successful handshakes by cipher suite
+}
+
+// HandshakeStats are the TLS handshake counters of the HTTPS server, in total
+// and per domain. Wildcard certificates count under the wildcard name.
+type HandshakeStats struct {
+	HandshakeCounters
+	// UnknownSNI counts failed handshakes without a server name or for
+	// names that aren't managed, included in Failures
+	UnknownSNI int64                        `json:"unknown_sni"`
+	Domains    map[string]HandshakeCounters `json:"domains"`
+}
+
+// handshakeRecorder accumulates handshake statistics. Connections are counted
+// once, when their first request arrives or when they close without one.
+type handshakeRecorder struct {
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+	total   HandshakeCounters
+	unknown int64
+	domains map[string]*HandshakeCounters
+}
+
+func newHandshakeRecorder() *handshakeRecorder {
+	return &handshakeRecorder{
+		pending: make(map[net.Conn]struct{}),
+		total:   newHandshakeCounters(),
+		domains: make(map[string]*HandshakeCounters),
+	}
+}
+
+func newHandshakeCounters() HandshakeCounters {
+	return HandshakeCounters{Versions: make(map[string]int64), CipherSuites: make(map[string]int64)}
+}
+
+func (c *HandshakeCounters) record(state tls.ConnectionState) {
+	if !state.HandshakeComplete {
+		c.Failures++
+		return
+	}
+	c.Successes++
+	c.Versions[tls.VersionName(state.Version)]++
+	c.CipherSuites[tls.CipherSuiteName(state.CipherSuite)]++
+}
+
+func (c HandshakeCounters) clone() HandshakeCounters {
+	c.Versions = maps.Clone(c.Versions)
+	c.CipherSuites = maps.Clone(c.CipherSuites)
+	return c
+}
+
+// TrackHandshake is an http.Server ConnState hook that records the outcome of
+// each TLS handshake for HandshakeStats.
+func (a *AutoTLS) TrackHandshake(conn net.Conn, state http.ConnState) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+
+	r := a.handshakes
+	r.mu.Lock()
+	if state == http.StateNew {
+		r.pending[conn] = struct{}{}
+		r.mu.Unlock()
+		return
+	}
+	_, pending := r.pending[conn]
+	delete(r.pending, conn)
+	r.mu.Unlock()
+	if !pending || state == http.StateIdle {
+		return
+	}
+
+	// Active, closed or hijacked: the handshake is over either way
+	connState := tlsConn.ConnectionState()
+	domain := a.statsDomain(strings.ToLower(connState.ServerName))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total.record(connState)
+	if domain == "" {
+		if !connState.HandshakeComplete {
+			r.unknown++
+		}
+		return
+	}
+	counters := r.domains[domain]
+	if counters == nil {
+		c := newHandshakeCounters()
+		counters = &c
+		r.domains[domain] = counters
+	}
+	counters.record(connState)
+}
+
+// statsDomain returns the managed domain handshakes for name are counted
+// under, or "" if none is, so unknown names can't grow the statistics.
+func (a *AutoTLS) statsDomain(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	name = a.primaryDomain(name)
+	if a.allowedHosts[name] || a.dnsDomains[name] || a.internalDomains[name] || a.autocertHeld[name] || a.certificates[name] != nil {
+		return name
+	}
+	if wildcard := wildcardFor(name); wildcard != "" && (a.dnsDomains[wildcard] || a.internalDomains[wildcard] || a.certificates[wildcard] != nil) {
+		return wildcard
+	}
+	return ""
+}
+
+// HandshakeStats returns a copy of the TLS handshake statistics.
+func (a *AutoTLS) HandshakeStats() HandshakeStats {
+	r := a.handshakes
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := HandshakeStats{
+		HandshakeCounters: r.total.clone(),
+		UnknownSNI:        r.unknown,
+		Domains:           make(map[string]HandshakeCounters, len(r.domains)),
+	}
+	for domain, counters := range r.domains {
+		stats.Domains[domain] = counters.clone()
+	}
+	return stats
+}
+
+// ResetHandshakeStats clears the TLS handshake statistics.
+func (a *AutoTLS) ResetHandshakeStats() {
+	r := a.handshakes
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total = newHandshakeCounters()
+	r.unknown = 0
+	r.domains = make(map[string]*HandshakeCounters)
+}
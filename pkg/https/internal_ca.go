@@ -0,0 +1,339 @@
+package https
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// IssuerACME obtains certificates from the configured ACME CA.
+	IssuerACME = "acme"
+	// IssuerInternal signs certificates with a local root CA, for
+	// development domains no public CA will issue for.
+	IssuerInternal = "internal"
+
+	internalRootCertFile = "internal_root.crt"
+	internalRootKeyFile  = "internal_root.key"
+	internalRootValidity = 10 * 365 * 24 * time.Hour
+	// internalLeafValidity leaves room for the renewal check, which reissues
+	// certificates once they are within the renewal window
+	internalLeafValidity = 90 * 24 * time.Hour
+	selfSignedValidity   = 365 * 24 * time.Hour
+	// maxInternalLeaves bounds the leaves kept for subdomains of internal
+	// wildcards, which any client can ask for by name; the oldest are
+	// dropped and issued again when next asked for
+	maxInternalLeaves = 1000
+)
+
+// localSuffixes are names that never resolve publicly and get certificates
+// from the internal issuer by default.
+var localSuffixes = []string{".localhost", ".local", ".internal", ".home.arpa"}
+
+// isLocalDomain reports whether domain is a development name, such as
+// "localhost", "app.localhost" or an IP address, that ACME can't validate.
+func isLocalDomain(domain string) bool {
+	name := strings.TrimPrefix(domain, "*.")
+	if name == "localhost" || net.ParseIP(name) != nil {
+		return true
+	}
+	for _, suffix := range localSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addInternalDomain issues a certificate for domain from the internal root CA
+// and starts serving it. Subdomains of a wildcard domain are issued their own
+// certificate on first use.
+func (a *AutoTLS) addInternalDomain(domain string) error {
+	if strings.HasPrefix(domain, "*.") {
+		// Make sure the root exists so it can be trusted before the first request
+		if _, _, err := a.internalRoot(); err != nil {
+			return err
+		}
+	} else if _, err := a.issueInternalCertificate(domain); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.internalDomains[domain] = true
+	delete(a.allowedHosts, domain)
+	delete(a.dnsDomains, domain)
+	a.mu.Unlock()
+
+	log.Printf("Using internal issuer for domain: %s", domain)
+	return nil
+}
+
+// isInternalDomain reports whether domain gets certificates from the internal CA.
+func (a *AutoTLS) isInternalDomain(domain string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.internalCovers(domain)
+}
+
+// internalCovers reports whether domain or its parent wildcard is signed by
+// the internal CA. The caller must hold a.mu.
+func (a *AutoTLS) internalCovers(domain string) bool {
+	if a.internalDomains[domain] {
+		return true
+	}
+	i := strings.Index(domain, ".")
+	return i > 0 && a.internalDomains["*"+domain[i:]]
+}
+
+// issueInternalCertificate signs a fresh leaf for domain with the internal
+// root and starts serving it.
+func (a *AutoTLS) issueInternalCertificate(domain string) (*tls.Certificate, error) {
+	root, rootKey, err := a.internalRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, _, _, err := newLeafCertificate(domain, root, rootKey, internalLeafValidity)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.certificates[domain] = cert
+	a.mu.Unlock()
+	return cert, nil
+}
+
+// internalIssuance is an on-demand leaf being signed, which handshakes for
+// the same name wait for.
+type internalIssuance struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// issueInternalLeaf returns the leaf of a subdomain of an internal wildcard,
+// signing it unless another handshake already is.
+func (a *AutoTLS) issueInternalLeaf(domain string) (*tls.Certificate, error) {
+	a.mu.Lock()
+	if cert := a.certificates[domain]; cert != nil {
+		a.mu.Unlock()
+		return cert, nil
+	}
+	if issuance, ok := a.internalIssuing[domain]; ok {
+		a.mu.Unlock()
+		<-issuance.done
+		return issuance.cert, issuance.err
+	}
+	issuance := &internalIssuance{done: make(chan struct{})}
+	a.internalIssuing[domain] = issuance
+	a.mu.Unlock()
+
+	issuance.cert, issuance.err = a.issueInternalCertificate(domain)
+
+	a.mu.Lock()
+	delete(a.internalIssuing, domain)
+	if issuance.err == nil {
+		a.internalLeaves = append(a.internalLeaves, domain)
+		for len(a.internalLeaves) > maxInternalLeaves {
+			oldest := a.internalLeaves[0]
+			a.internalLeaves = a.internalLeaves[1:]
+			// Unless it has been added as a domain of its own since
+			if !a.internalDomains[oldest] {
+				delete(a.certificates, oldest)
+			}
+		}
+	}
+	a.mu.Unlock()
+	close(issuance.done)
+	return issuance.cert, issuance.err
+}
+
+// InternalRootPath returns the file holding the internal root CA certificate,
+// which clients must trust to accept internally issued certificates.
+func (a *AutoTLS) InternalRootPath() string {
+	return filepath.Join(a.config.CacheDir, internalRootCertFile)
+}
+
+// internalRoot loads the internal root CA from the certificate storage,
+// creating it on first use. All nodes sharing the storage sign with the same
+// root.
+func (a *AutoTLS) internalRoot() (*x509.Certificate, crypto.Signer, error) {
+	a.caMu.Lock()
+	defer a.caMu.Unlock()
+
+	if a.caCert != nil {
+		return a.caCert, a.caKey, nil
+	}
+
+	ctx := context.Background()
+	storage := a.certManager.Cache
+	certPEM, certErr := storage.Get(ctx, internalRootCertFile)
+	keyPEM, keyErr := storage.Get(ctx, internalRootKeyFile)
+	switch {
+	case certErr == nil && keyErr == nil:
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid internal root CA: %v", err)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid internal root CA: %v", err)
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported internal root CA key")
+		}
+		a.caCert, a.caKey = cert, signer
+	case errors.Is(certErr, autocert.ErrCacheMiss) && errors.Is(keyErr, autocert.ErrCacheMiss):
+		cert, key, err := createRootCA()
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := encodeKeyPEM(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if err := storage.Put(ctx, internalRootKeyFile, keyPEM); err != nil {
+			return nil, nil, fmt.Errorf("failed to save internal root CA key: %v", err)
+		}
+		if err := storage.Put(ctx, internalRootCertFile, certPEM); err != nil {
+			return nil, nil, fmt.Errorf("failed to save internal root CA: %v", err)
+		}
+		log.Printf("Created internal root CA, trust %s to accept its certificates", a.InternalRootPath())
+		a.caCert, a.caKey = cert, key
+	case certErr != nil && !errors.Is(certErr, autocert.ErrCacheMiss):
+		return nil, nil, fmt.Errorf("failed to load internal root CA: %v", certErr)
+	case keyErr != nil && !errors.Is(keyErr, autocert.ErrCacheMiss):
+		return nil, nil, fmt.Errorf("failed to load internal root CA key: %v", keyErr)
+	default:
+		return nil, nil, fmt.Errorf("incomplete internal root CA in certificate storage")
+	}
+
+	// With a shared storage the root isn't in the cache directory yet
+	if _, err := os.Stat(a.InternalRootPath()); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(a.InternalRootPath(), certPEM, 0644); err != nil { //nolint:gosec
+			log.Printf("Warning: Failed to write internal root CA to %s: %v", a.InternalRootPath(), err)
+		}
+	}
+	return a.caCert, a.caKey, nil
+}
+
+// createRootCA generates a root CA certificate and key.
+func createRootCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Saddy Internal Root CA", Organization: []string{"Saddy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(internalRootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create internal root CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// newLeafCertificate creates a server certificate for domain signed by parent,
+// or a self-signed one when parent is nil. It returns the certificate along
+// with its PEM encoded chain and key.
+func newLeafCertificate(domain string, parent *x509.Certificate, parentKey crypto.Signer, validity time.Duration) (*tls.Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{domain}
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create certificate for %s: %v", domain, err)
+	}
+
+	chain := [][]byte{der}
+	if parent != template {
+		chain = append(chain, parent.Raw)
+	}
+	cert, err := newCertificate(chain, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var certPEM []byte
+	for _, block := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block})...)
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cert, certPEM, keyPEM, nil
+}
+
+func encodeKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,93 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lockSuffix names the storage entries holding issuance locks.
+	lockSuffix = "+lock"
+	// issuanceLockTTL outlives a complete issuance, so a lock only expires
+	// when the node holding it died.
+	issuanceLockTTL     = dnsIssueTimeout + 5*time.Minute
+	lockPollInterval    = 2 * time.Second
+	autocertLockTimeout = 5 * time.Minute
+)
+
+// lockStore is implemented by the certificate storages that can hold locks.
+type lockStore interface {
+	CertStorage
+	// createExclusive stores data under name unless the entry exists, and
+	// reports whether it did. Backends that expire entries use ttl.
+	createExclusive(ctx context.Context, name string, data []byte, ttl time.Duration) (bool, error)
+	// deleteIfEqual removes name if it still holds data.
+	deleteIfEqual(ctx context.Context, name string, data []byte) error
+}
+
+// lockIssuance serializes certificate issuance for domain across the nodes
+// sharing the certificate storage, waiting while another node holds the lock.
+// It does nothing for storages without lock support.
+func (a *AutoTLS) lockIssuance(ctx context.Context, domain string) (func(), error) {
+	store, ok := a.certManager.Cache.(lockStore)
+	if !ok {
+		return func() {}, nil
+	}
+
+	name := strings.Replace(domain, "*", "_", 1) + lockSuffix
+	waitStarted := time.Now()
+	for {
+		// The random token tells our lock apart from a later one
+		token := make([]byte, 8)
+		if _, err := rand.Read(token); err != nil {
+			return nil, err
+		}
+		expires := time.Now().Add(issuanceLockTTL)
+		value := []byte(strconv.FormatInt(expires.UnixNano(), 10) + " " + hex.EncodeToString(token))
+
+		created, err := store.createExclusive(ctx, name, value, issuanceLockTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire issuance lock for %s: %v", domain, err)
+		}
+		if created {
+			if waited := time.Since(waitStarted); waited > lockPollInterval {
+				log.Printf("Acquired issuance lock for %s after %s", domain, waited.Round(time.Second))
+			}
+			return func() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := store.deleteIfEqual(releaseCtx, name, value); err != nil {
+					log.Printf("Warning: Failed to release issuance lock for %s: %v", domain, err)
+				}
+			}, nil
+		}
+
+		// Take over the locks of nodes that died while issuing
+		if current, err := store.Get(ctx, name); err == nil && lockExpired(current) {
+			log.Printf("Removing expired issuance lock for %s", domain)
+			_ = store.deleteIfEqual(ctx, name, current) //nolint:errcheck
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for issuance lock for %s: %v", domain, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockExpired reports whether a lock value has passed its expiry. Values that
+// can't be parsed count as expired.
+func lockExpired(value []byte) bool {
+	expiry, _, _ := bytes.Cut(value, []byte(" "))
+	nanos, err := strconv.ParseInt(string(expiry), 10, 64)
+	return err != nil || time.Now().After(time.Unix(0, nanos))
+}
@@ -0,0 +1,214 @@
+package https
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRefreshInterval is how often staples are checked for refresh.
+	ocspRefreshInterval = time.Hour
+	// ocspRetryInterval is the wait after a failed fetch.
+	ocspRetryInterval = 10 * time.Minute
+	// ocspDefaultLifetime is assumed for responses without a next update.
+	ocspDefaultLifetime = 24 * time.Hour
+)
+
+var ocspHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// ocspStaple holds the OCSP response stapled to handshakes for one
+// certificate.
+type ocspStaple struct {
+	leaf       *x509.Certificate
+	issuer     *x509.Certificate
+	response   []byte
+	status     string
+	revokedAt  time.Time
+	reason     int
+	checkedAt  time.Time
+	lastError  string
+	nextUpdate time.Time
+	refreshAt  time.Time
+	fetching   bool
+}
+
+// certKey identifies a certificate in the OCSP and ARI state.
+func certKey(leaf *x509.Certificate) string {
+	sum := sha256.Sum256(leaf.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// stapled returns cert with its current OCSP response attached. The first
+// handshake for a certificate starts fetching one in the background, so it
+// goes out without a staple.
+func (a *AutoTLS) stapled(cert *tls.Certificate) *tls.Certificate {
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return cert
+	}
+
+	now := time.Now()
+
+	a.ocspMu.Lock()
+	staple := a.stapleFor(cert)
+	if staple == nil {
+		a.ocspMu.Unlock()
+		return cert
+	}
+	response := staple.response
+	if !staple.nextUpdate.IsZero() && now.After(staple.nextUpdate) {
+		// Clients reject expired responses
+		response = nil
+	}
+	fetch := !staple.fetching && now.After(staple.refreshAt)
+	if fetch {
+		staple.fetching = true
+	}
+	a.ocspMu.Unlock()
+
+	if fetch {
+		go a.updateStaple(staple)
+	}
+	if response == nil {
+		return cert
+	}
+
+	stapledCert := *cert
+	stapledCert.OCSPStaple = response
+	return &stapledCert
+}
+
+// stapleFor returns the staple of cert, creating it on first use, or nil if
+// the issuer can't be parsed. The caller must hold a.ocspMu.
+func (a *AutoTLS) stapleFor(cert *tls.Certificate) *ocspStaple {
+	key := certKey(cert.Leaf)
+	if staple := a.staples[key]; staple != nil {
+		return staple
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil
+	}
+	staple := &ocspStaple{leaf: cert.Leaf, issuer: issuer}
+	a.staples[key] = staple
+	return staple
+}
+
+// RefreshOCSP starts a background process that refreshes OCSP responses
+// halfway through their validity, before clients would reject them.
+func (a *AutoTLS) RefreshOCSP() {
+	ticker := time.NewTicker(ocspRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.refreshStaples()
+	}
+}
+
+func (a *AutoTLS) refreshStaples() {
+	now := time.Now()
+
+	var due []*ocspStaple
+	a.ocspMu.Lock()
+	for key, staple := range a.staples {
+		if now.After(staple.leaf.NotAfter) {
+			// Replaced by a renewed certificate long ago
+			delete(a.staples, key)
+			continue
+		}
+		if !staple.fetching && now.After(staple.refreshAt) {
+			staple.fetching = true
+			due = append(due, staple)
+		}
+	}
+	a.ocspMu.Unlock()
+
+	for _, staple := range due {
+		a.updateStaple(staple)
+	}
+}
+
+// updateStaple fetches a fresh OCSP response for staple.
+func (a *AutoTLS) updateStaple(staple *ocspStaple) {
+	raw, response, err := fetchOCSP(staple.leaf, staple.issuer)
+
+	a.ocspMu.Lock()
+	defer a.ocspMu.Unlock()
+
+	staple.fetching = false
+	staple.checkedAt = time.Now()
+	if err != nil {
+		staple.lastError = err.Error()
+		staple.refreshAt = time.Now().Add(ocspRetryInterval)
+		log.Printf("Warning: Failed to fetch OCSP response for %s: %v", staple.leaf.Subject.CommonName, err)
+		return
+	}
+
+	staple.lastError = ""
+	staple.response = raw
+	staple.nextUpdate = response.NextUpdate
+	lifetime := ocspDefaultLifetime
+	if !response.NextUpdate.IsZero() {
+		lifetime = response.NextUpdate.Sub(response.ThisUpdate)
+	}
+	staple.refreshAt = response.ThisUpdate.Add(lifetime / 2)
+
+	switch response.Status {
+	case ocsp.Good:
+		staple.status = "good"
+	case ocsp.Revoked:
+		staple.status = "revoked"
+		staple.revokedAt = response.RevokedAt
+		staple.reason = response.RevocationReason
+		log.Printf("Warning: Certificate for %s has been revoked", staple.leaf.Subject.CommonName)
+	default:
+		staple.status = "unknown"
+	}
+}
+
+// ocspStatus returns the last OCSP status of leaf, or "" if none is known.
+func (a *AutoTLS) ocspStatus(leaf *x509.Certificate) string {
+	a.ocspMu.Lock()
+	defer a.ocspMu.Unlock()
+	if staple := a.staples[certKey(leaf)]; staple != nil {
+		return staple.status
+	}
+	return ""
+}
+
+// fetchOCSP asks the responder named in leaf for its revocation status.
+func fetchOCSP(leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocspHTTPClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	return raw, response, nil
+}
@@ -0,0 +1,100 @@
+package https
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	onDemandAskTimeout = 5 * time.Second
+	// onDemandDenyTTL keeps refused names from reaching the ask endpoint on
+	// every handshake.
+	onDemandDenyTTL = time.Minute
+	// onDemandMaxDenied bounds the memory spent on remembered refusals.
+	onDemandMaxDenied = 10000
+)
+
+// allowOnDemand reports whether a certificate may be issued for name at
+// handshake time. The ask endpoint is called with ?domain=name and allows it
+// by answering 200; allowed names are registered like configured domains.
+func (a *AutoTLS) allowOnDemand(name string) bool {
+	if a.config.OnDemandAsk == "" || !onDemandCandidate(name) {
+		return false
+	}
+
+	a.mu.RLock()
+	deniedAt, denied := a.onDemandDenied[name]
+	a.mu.RUnlock()
+	if denied && time.Since(deniedAt) < onDemandDenyTTL {
+		return false
+	}
+
+	allowed, err := a.askOnDemand(name)
+	if err != nil {
+		log.Printf("Warning: On-demand TLS ask for %s failed: %v", name, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !allowed {
+		if len(a.onDemandDenied) >= onDemandMaxDenied {
+			a.onDemandDenied = make(map[string]time.Time)
+		}
+		a.onDemandDenied[name] = time.Now()
+		return false
+	}
+	delete(a.onDemandDenied, name)
+	if !a.allowedHosts[name] {
+		a.allowedHosts[name] = true
+		log.Printf("On-demand certificate allowed for domain: %s", name)
+	}
+	return true
+}
+
+// askOnDemand calls the ask endpoint for name.
+func (a *AutoTLS) askOnDemand(name string) (bool, error) {
+	ask, err := url.Parse(a.config.OnDemandAsk)
+	if err != nil {
+		return false, err
+	}
+	query := ask.Query()
+	query.Set("domain", name)
+	ask.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), onDemandAskTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ask.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := a.onDemandClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close() //nolint:errcheck
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// onDemandCandidate filters out server names no public CA issues for, so
+// they never reach the ask endpoint.
+func onDemandCandidate(name string) bool {
+	if name == "" || len(name) > 253 || !strings.Contains(name, ".") || net.ParseIP(name) != nil || isLocalDomain(name) {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
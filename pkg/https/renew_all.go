@@ -0,0 +1,73 @@
+package https
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Actions reported by RenewAll.
+const (
+	RenewalRenewed = "renewed"
+	RenewalFailed  = "failed"
+	RenewalSkipped = "skipped"
+)
+
+// RenewalResult reports what RenewAll did for one domain.
+type RenewalResult struct {
+	Domain   string     `json:"domain"`
+	Action   string     `json:"action"`           // renewed, failed or skipped
+	Reason   string     `json:"reason,omitempty"` // Why it was skipped or failed
+	Error    string     `json:"error,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"` // Expiry of the certificate served afterwards
+	RenewAt  *time.Time `json:"renew_at,omitempty"`  // When a skipped certificate becomes due
+}
+
+// RenewAll runs the renewal check for every managed domain now instead of
+// at the next regular check, and reports the outcome per domain. Due
+// certificates are renewed, or all of them with force; domains without a
+// certificate yet are issued one.
+func (a *AutoTLS) RenewAll(force bool) []RenewalResult {
+	domains := a.renewableDomains()
+	sort.Strings(domains)
+
+	results := make([]RenewalResult, 0, len(domains))
+	for _, domain := range domains {
+		results = append(results, a.renewIfDue(domain, force))
+	}
+	return results
+}
+
+func (a *AutoTLS) renewIfDue(domain string, force bool) RenewalResult {
+	result := RenewalResult{Domain: domain}
+	if cert, selfSigned, err := a.lookupCertificate(domain); err == nil && !force {
+		if selfSigned {
+			result.Action, result.Reason = RenewalSkipped, "issuance failed and is being retried"
+			return result
+		}
+		renewAt, _ := a.dueTime(domain, cert.Leaf)
+		result.NotAfter = &cert.Leaf.NotAfter
+		if time.Now().Before(renewAt) {
+			result.Action, result.Reason, result.RenewAt = RenewalSkipped, "not due yet", &renewAt
+			return result
+		}
+		// A recently failed renewal is tried again once its backoff ends
+		if until := a.backingOffUntil(domain); !until.IsZero() {
+			result.Action, result.Reason, result.RenewAt = RenewalSkipped, "backing off after a failed attempt", &until
+			return result
+		}
+	}
+
+	if err := a.ForceRenewal(domain); err != nil {
+		result.Action, result.Error = RenewalFailed, err.Error()
+		if errors.Is(err, ErrBackingOff) {
+			result.Reason = "backing off after a failed attempt"
+		}
+	} else {
+		result.Action = RenewalRenewed
+	}
+	if cert, _, err := a.lookupCertificate(domain); err == nil {
+		result.NotAfter = &cert.Leaf.NotAfter
+	}
+	return result
+}
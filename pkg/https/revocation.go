@@ -0,0 +1,171 @@
+package https
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// crlMaxSize bounds a downloaded CRL; CAs shard large ones.
+const crlMaxSize = 16 << 20
+
+// RevocationStatus is whether the CA has revoked a certificate, according to
+// its OCSP responder or, lacking one, its CRL.
+type RevocationStatus struct {
+	Status    string     `json:"status"` // good, revoked or unknown
+	Source    string     `json:"source"` // ocsp or crl
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CheckedAt time.Time  `json:"checked_at"` // Zero while the first check is in progress
+	Error     string     `json:"error,omitempty"`
+}
+
+// crlReasonNames are the RFC 5280 reason codes.
+var crlReasonNames = map[int]string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+// crlEntry is a downloaded CRL, or the error of the last download.
+type crlEntry struct {
+	revoked   map[string]x509.RevocationListEntry // By serial number
+	checkedAt time.Time
+	refreshAt time.Time
+	err       error
+}
+
+// revocationStatus checks whether cert has been revoked. OCSP responses and
+// CRLs are cached, so only the first check of a certificate waits for the CA.
+// It returns nil for certificates that name neither.
+func (a *AutoTLS) revocationStatus(cert *tls.Certificate) *RevocationStatus {
+	if cert.Leaf == nil || len(cert.Certificate) < 2 {
+		return nil
+	}
+	if len(cert.Leaf.OCSPServer) > 0 {
+		return a.checkOCSP(cert)
+	}
+	if len(cert.Leaf.CRLDistributionPoints) > 0 {
+		return a.checkCRL(cert)
+	}
+	return nil
+}
+
+// checkOCSP returns the OCSP status of cert, fetching it if the certificate
+// hasn't been stapled yet.
+func (a *AutoTLS) checkOCSP(cert *tls.Certificate) *RevocationStatus {
+	a.ocspMu.Lock()
+	staple := a.stapleFor(cert)
+	if staple == nil {
+		a.ocspMu.Unlock()
+		return &RevocationStatus{Status: "unknown", Source: "ocsp", Error: "invalid issuer certificate"}
+	}
+	fetch := !staple.fetching && staple.checkedAt.IsZero()
+	if fetch {
+		staple.fetching = true
+	}
+	a.ocspMu.Unlock()
+
+	if fetch {
+		a.updateStaple(staple)
+	}
+
+	a.ocspMu.Lock()
+	defer a.ocspMu.Unlock()
+	status := &RevocationStatus{
+		Status:    staple.status,
+		Source:    "ocsp",
+		CheckedAt: staple.checkedAt,
+		Error:     staple.lastError,
+	}
+	if status.Status == "" {
+		status.Status = "unknown"
+	}
+	if staple.status == "revoked" {
+		status.RevokedAt = &staple.revokedAt
+		status.Reason = crlReasonNames[staple.reason]
+	}
+	return status
+}
+
+// checkCRL looks cert up in the CRL of its issuer.
+func (a *AutoTLS) checkCRL(cert *tls.Certificate) *RevocationStatus {
+	url := cert.Leaf.CRLDistributionPoints[0]
+
+	a.ocspMu.Lock()
+	entry := a.crls[url]
+	a.ocspMu.Unlock()
+
+	if entry == nil || time.Now().After(entry.refreshAt) {
+		entry = &crlEntry{checkedAt: time.Now()}
+		issuer, err := x509.ParseCertificate(cert.Certificate[1])
+		if err == nil {
+			entry.revoked, entry.err = fetchCRL(url, issuer)
+		} else {
+			entry.err = fmt.Errorf("invalid issuer certificate: %v", err)
+		}
+		entry.refreshAt = entry.checkedAt.Add(ocspRefreshInterval)
+		if entry.err != nil {
+			entry.refreshAt = entry.checkedAt.Add(ocspRetryInterval)
+		}
+
+		a.ocspMu.Lock()
+		a.crls[url] = entry
+		a.ocspMu.Unlock()
+	}
+
+	status := &RevocationStatus{Status: "good", Source: "crl", CheckedAt: entry.checkedAt}
+	if entry.err != nil {
+		status.Status = "unknown"
+		status.Error = entry.err.Error()
+		return status
+	}
+	if revoked, ok := entry.revoked[cert.Leaf.SerialNumber.String()]; ok {
+		status.Status = "revoked"
+		status.RevokedAt = &revoked.RevocationTime
+		status.Reason = crlReasonNames[revoked.ReasonCode]
+	}
+	return status
+}
+
+// fetchCRL downloads the CRL at url and returns its entries by serial number
+// once its signature checks out against issuer.
+func fetchCRL(url string, issuer *x509.Certificate) (map[string]x509.RevocationListEntry, error) {
+	resp, err := ocspHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, crlMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRL server returned status %d", resp.StatusCode)
+	}
+
+	list, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL: %v", err)
+	}
+	if err := list.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("invalid CRL signature: %v", err)
+	}
+
+	revoked := make(map[string]x509.RevocationListEntry, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = entry
+	}
+	return revoked, nil
+}
@@ -0,0 +1,124 @@
+package https
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"saddy/pkg/events"
+)
+
+// revokeTimeout bounds a revocation request, re-issuance excluded.
+const revokeTimeout = time.Minute
+
+// ErrInvalidRevocationReason is returned for revocation reasons other than
+// those in revocationReasons.
+var ErrInvalidRevocationReason = errors.New("invalid revocation reason")
+
+// revocationReasons are the RFC 5280 reasons a subscriber may give.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"":                     acme.CRLReasonUnspecified,
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+}
+
+// RevokeCertificate revokes the certificate served for domain with the CA and
+// stops serving it right away. With remove the domain is removed as well;
+// otherwise a replacement is ordered, and a self-signed certificate is served
+// until it arrives. reason is one of unspecified, keyCompromise,
+// affiliationChanged, superseded or cessationOfOperation.
+func (a *AutoTLS) RevokeCertificate(domain, reason string, remove bool) error {
+	code, ok := revocationReasons[reason]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidRevocationReason, reason)
+	}
+
+	a.mu.RLock()
+	domain = a.primaryDomain(domain)
+	dns := a.dnsDomains[domain]
+	registered := dns || a.allowedHosts[domain]
+	a.mu.RUnlock()
+	if !registered {
+		return fmt.Errorf("domain %s has no ACME certificate", domain)
+	}
+
+	cert, selfSigned, err := a.lookupCertificate(domain)
+	if err != nil {
+		return err
+	}
+	if selfSigned {
+		return fmt.Errorf("domain %s is served a self-signed certificate", domain)
+	}
+	if !coversNames(cert.Leaf, []string{domain}) {
+		return fmt.Errorf("domain %s is served the certificate of %v, revoke that domain instead", domain, cert.Leaf.DNSNames)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+	defer cancel()
+	if err := a.revoke(ctx, cert, code); err != nil {
+		return fmt.Errorf("failed to revoke certificate for %s: %w", domain, err)
+	}
+	log.Printf("Revoked certificate %s for %s (%s)", cert.Leaf.SerialNumber, domain, reason)
+	a.publish(events.CertRevoked, domain, fmt.Sprintf("Revoked certificate %s for %s (%s)", cert.Leaf.SerialNumber, domain, reason))
+
+	// Stop serving it, and keep it from being loaded again
+	challenge := ChallengeHTTP01
+	if dns {
+		challenge = ChallengeDNS01
+	}
+	a.mu.Lock()
+	a.revoked[certKey(cert.Leaf)] = true
+	delete(a.certificates, domain)
+	a.mu.Unlock()
+	if err := a.certManager.Cache.Delete(ctx, certCacheName(domain, challenge)); err != nil {
+		log.Printf("Warning: Failed to delete revoked certificate for %s: %v", domain, err)
+	}
+
+	if remove {
+		a.RemoveDomain(domain)
+		return nil
+	}
+	if err := a.issueCertificate(domain, challenge, nil); err != nil {
+		a.scheduleRetry(domain, err)
+		return fmt.Errorf("certificate for %s revoked, but ordering a replacement failed: %w", domain, err)
+	}
+	return nil
+}
+
+// revoke asks the CA to revoke cert. Key compromise has to be proven with the
+// certificate's own key; other reasons are signed by the account.
+func (a *AutoTLS) revoke(ctx context.Context, cert *tls.Certificate, reason acme.CRLReasonCode) error {
+	client, err := a.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var key crypto.Signer
+	if reason == acme.CRLReasonKeyCompromise {
+		signer, ok := cert.PrivateKey.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+		}
+		key = signer
+	}
+	return client.RevokeCert(ctx, key, cert.Certificate[0], reason)
+}
+
+// isRevoked reports whether cert was revoked by RevokeCertificate.
+func (a *AutoTLS) isRevoked(cert *tls.Certificate) bool {
+	if cert.Leaf == nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.revoked[certKey(cert.Leaf)]
+}
@@ -0,0 +1,45 @@
+package https
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selfSignedRenewBefore is when LoadOrCreateSelfSigned replaces a
+// certificate before it expires.
+const selfSignedRenewBefore = 30 * 24 * time.Hour
+
+// LoadOrCreateSelfSigned returns the self-signed certificate for name kept
+// as name.crt and name.key in dir, creating it when it is missing or about
+// to expire. Keeping it lets clients pin it across restarts.
+func LoadOrCreateSelfSigned(dir, name string) (*tls.Certificate, error) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > selfSignedRenewBefore {
+			cert.Leaf = leaf
+			return &cert, nil
+		}
+	}
+
+	cert, certPEM, keyPEM, err := newLeafCertificate(name, nil, nil, selfSignedValidity)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
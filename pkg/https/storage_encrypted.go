@@ -0,0 +1,185 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// encryptedBlockType is the PEM type of encrypted storage entries.
+	encryptedBlockType = "SADDY ENCRYPTED DATA"
+	encryptionSaltSize = 16
+	// scrypt parameters for passphrases, about 50ms per derivation
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var errWrongEncryptionKey = errors.New("wrong storage encryption passphrase or key")
+
+// encryptedStorage encrypts the entries holding private keys, and the session
+// ticket keys, with AES-GCM before they reach the inner storage. Certificates,
+// challenge tokens and locks stay readable. Entries written before encryption
+// was enabled are encrypted the first time they are read.
+type encryptedStorage struct {
+	CertStorage
+	passphrase []byte
+	key        []byte // Used as is instead of a passphrase, e.g. a data key from a KMS
+
+	mu   sync.Mutex
+	keys map[string][]byte // Keys derived from the passphrase, by salt
+}
+
+// encryptedLockStorage keeps the locks of an inner storage that supports
+// them; lock entries are never encrypted.
+type encryptedLockStorage struct {
+	*encryptedStorage
+	locks lockStore
+}
+
+func (s encryptedLockStorage) createExclusive(ctx context.Context, name string, data []byte, ttl time.Duration) (bool, error) {
+	return s.locks.createExclusive(ctx, name, data, ttl)
+}
+
+func (s encryptedLockStorage) deleteIfEqual(ctx context.Context, name string, data []byte) error {
+	return s.locks.deleteIfEqual(ctx, name, data)
+}
+
+// newEncryptedStorage wraps inner with encryption under passphrase, or under
+// the base64 encoded 32-byte key in keyFile.
+func newEncryptedStorage(inner CertStorage, passphrase, keyFile string) (CertStorage, error) {
+	s := &encryptedStorage{CertStorage: inner, keys: make(map[string][]byte)}
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile) //nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("failed to read storage encryption key: %v", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("storage encryption key in %s must be 32 bytes, base64 encoded", keyFile)
+		}
+		s.key = key
+	case passphrase != "":
+		s.passphrase = []byte(passphrase)
+	default:
+		return nil, fmt.Errorf("storage encryption requires a passphrase or key file")
+	}
+
+	if locks, ok := inner.(lockStore); ok {
+		return encryptedLockStorage{encryptedStorage: s, locks: locks}, nil
+	}
+	return s, nil
+}
+
+func (s *encryptedStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := s.CertStorage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedBlockType {
+		if secretEntry(name, data) {
+			// Stored before encryption was enabled
+			if err := s.Put(ctx, name, data); err != nil {
+				log.Printf("Warning: Failed to encrypt stored entry %s: %v", name, err)
+			}
+		}
+		return data, nil
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted entry %s: %v", name, err)
+	}
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted entry %s", name)
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	// The name is authenticated, so entries can't be swapped
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, errWrongEncryptionKey)
+	}
+	return plaintext, nil
+}
+
+func (s *encryptedStorage) Put(ctx context.Context, name string, data []byte) error {
+	if !secretEntry(name, data) {
+		return s.CertStorage.Put(ctx, name, data)
+	}
+
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:    encryptedBlockType,
+		Headers: map[string]string{"Salt": base64.StdEncoding.EncodeToString(salt)},
+		Bytes:   aead.Seal(nonce, nonce, data, []byte(name)),
+	}
+	return s.CertStorage.Put(ctx, name, pem.EncodeToMemory(block))
+}
+
+// cipher returns the AES-GCM cipher for an entry with salt.
+func (s *encryptedStorage) cipher(salt []byte) (cipher.AEAD, error) {
+	key := s.key
+	if key == nil {
+		var err error
+		if key, err = s.derivedKey(salt); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// derivedKey derives the key for salt from the passphrase, once per salt.
+func (s *encryptedStorage) derivedKey(salt []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	s.keys[string(salt)] = key
+	return key, nil
+}
+
+// secretEntry reports whether an entry holds secrets worth encrypting.
+func secretEntry(name string, data []byte) bool {
+	return name == ticketKeysName || bytes.Contains(data, []byte("PRIVATE KEY-----"))
+}
@@ -0,0 +1,74 @@
+package https
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultRedisStoragePrefix = "saddy:certs:"
+
+// redisDeleteIfEqual removes a key only while it holds the expected value.
+var redisDeleteIfEqual = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// redisStorage keeps certificates in Redis, one key per entry.
+type redisStorage struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisStorage(config StorageConfig) (*redisStorage, error) {
+	if config.RedisURL == "" {
+		return nil, fmt.Errorf("redis certificate storage requires a redis URL")
+	}
+	options, err := redis.ParseURL(config.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %v", err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close() //nolint:errcheck
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultRedisStoragePrefix
+	}
+	return &redisStorage{client: client, prefix: prefix}, nil
+}
+
+func (s *redisStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := s.client.Get(ctx, s.prefix+name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (s *redisStorage) Put(ctx context.Context, name string, data []byte) error {
+	return s.client.Set(ctx, s.prefix+name, data, 0).Err()
+}
+
+func (s *redisStorage) Delete(ctx context.Context, name string) error {
+	return s.client.Del(ctx, s.prefix+name).Err()
+}
+
+func (s *redisStorage) createExclusive(ctx context.Context, name string, data []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, s.prefix+name, data, ttl).Result()
+}
+
+func (s *redisStorage) deleteIfEqual(ctx context.Context, name string, data []byte) error {
+	return redisDeleteIfEqual.Run(ctx, s.client, []string{s.prefix + name}, data).Err()
+}
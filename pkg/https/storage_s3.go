@@ -0,0 +1,159 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultS3Region = "us-east-1"
+
+// s3Storage keeps certificates as objects in an S3 bucket, or any
+// S3-compatible store, addressed path-style.
+type s3Storage struct {
+	awsCredentials
+	endpoint string
+	bucket   string
+	region   string
+	prefix   string
+	client   *http.Client
+}
+
+func newS3Storage(config StorageConfig) (*s3Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 certificate storage requires a bucket")
+	}
+
+	s := &s3Storage{
+		awsCredentials: newAWSCredentials(config.AccessKeyID, config.SecretAccessKey),
+		endpoint:       strings.TrimSuffix(config.Endpoint, "/"),
+		bucket:         config.Bucket,
+		region:         config.Region,
+		prefix:         config.Prefix,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, fmt.Errorf("s3 certificate storage requires access_key_id and secret_access_key")
+	}
+	if s.region == "" {
+		s.region = defaultS3Region
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	return s, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 GET %s: status %d: %s", name, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.expect(ctx, http.MethodPut, name, data, nil, http.StatusOK)
+	return err
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.expect(ctx, http.MethodDelete, name, nil, nil, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// createExclusive uses a conditional write, which S3 rejects with 412 when
+// the object exists, or 409 when another conditional write is in progress.
+func (s *s3Storage) createExclusive(ctx context.Context, name string, data []byte, _ time.Duration) (bool, error) {
+	status, err := s.expect(ctx, http.MethodPut, name, data, map[string]string{"If-None-Match": "*"},
+		http.StatusOK, http.StatusPreconditionFailed, http.StatusConflict)
+	return status == http.StatusOK, err
+}
+
+// deleteIfEqual compares and deletes in two requests, so a lock taken over
+// in between may be deleted. Locks only change hands after expiring, making
+// that unlikely.
+func (s *s3Storage) deleteIfEqual(ctx context.Context, name string, data []byte) error {
+	current, err := s.Get(ctx, name)
+	if errors.Is(err, autocert.ErrCacheMiss) || (err == nil && !bytes.Equal(current, data)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, name)
+}
+
+// expect sends a request and fails unless it is answered with one of the
+// given statuses, which it returns.
+func (s *s3Storage) expect(ctx context.Context, method, name string, body []byte, headers map[string]string, statuses ...int) (int, error) {
+	resp, err := s.do(ctx, method, name, body, headers)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16)) //nolint:errcheck
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return status, nil
+		}
+	}
+	return resp.StatusCode, fmt.Errorf("s3 %s %s: status %d: %s", method, name, resp.StatusCode, strings.TrimSpace(string(data)))
+}
+
+// do sends a signed request for the object holding name.
+func (s *s3Storage) do(ctx context.Context, method, name string, body []byte, headers map[string]string) (*http.Response, error) {
+	target, err := url.Parse(s.endpoint + "/" + s.bucket + "/" + s3Escape(s.prefix+name))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	s.sign(req, body, s.region, "s3", time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// s3Escape encodes an object key as Signature Version 4 requires: everything
+// but unreserved characters and "/" is percent-encoded, e.g. the "*" of
+// wildcard names and the "+" of autocert's entries.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package https
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultSQLStorageTable = "saddy_certificates"
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// sqlStorage keeps certificates in a database table through database/sql.
+// The driver must be linked into the binary, e.g. by importing
+// github.com/lib/pq or github.com/go-sql-driver/mysql in main.
+type sqlStorage struct {
+	db *sql.DB
+
+	getQuery           string
+	deleteQuery        string
+	deleteIfEqualQuery string
+	insertQuery        string
+}
+
+func newSQLStorage(config StorageConfig) (*sqlStorage, error) {
+	if config.Driver == "" || config.DSN == "" {
+		return nil, fmt.Errorf("sql certificate storage requires a driver and a DSN")
+	}
+	table := config.Table
+	if table == "" {
+		table = defaultSQLStorageTable
+	}
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %q", table)
+	}
+
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	// Postgres numbers its placeholders and has no BLOB type
+	placeholders := [2]string{"?", "?"}
+	blob := "BLOB"
+	switch strings.ToLower(config.Driver) {
+	case "postgres", "pgx":
+		placeholders = [2]string{"$1", "$2"}
+		blob = "BYTEA"
+	case "mysql":
+		blob = "LONGBLOB"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, data %s NOT NULL)", table, blob)
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		_ = db.Close() //nolint:errcheck
+		return nil, fmt.Errorf("failed to create table %s: %v", table, err)
+	}
+
+	return &sqlStorage{
+		db:          db,
+		getQuery:    fmt.Sprintf("SELECT data FROM %s WHERE name = %s", table, placeholders[0]),
+		deleteQuery: fmt.Sprintf("DELETE FROM %s WHERE name = %s", table, placeholders[0]),
+		insertQuery: fmt.Sprintf("INSERT INTO %s (name, data) VALUES (%s, %s)", table, placeholders[0], placeholders[1]),
+
+		deleteIfEqualQuery: fmt.Sprintf("DELETE FROM %s WHERE name = %s AND data = %s", table, placeholders[0], placeholders[1]),
+	}, nil
+}
+
+func (s *sqlStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, s.getQuery, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put replaces the entry in a transaction, since upserts differ between
+// databases.
+func (s *sqlStorage) Put(ctx context.Context, name string, data []byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() //nolint:errcheck
+
+	if _, err := tx.ExecContext(ctx, s.deleteQuery, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.insertQuery, name, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStorage) Delete(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, s.deleteQuery, name)
+	return err
+}
+
+// createExclusive relies on the primary key to reject existing entries.
+func (s *sqlStorage) createExclusive(ctx context.Context, name string, data []byte, _ time.Duration) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, s.insertQuery, name, data); err != nil {
+		// Duplicate key errors differ between drivers, check for the entry
+		if _, getErr := s.Get(ctx, name); getErr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqlStorage) deleteIfEqual(ctx context.Context, name string, data []byte) error {
+	_, err := s.db.ExecContext(ctx, s.deleteIfEqualQuery, name, data)
+	return err
+}
@@ -0,0 +1,159 @@
+package https
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// ticketKeysName is the storage entry holding the session ticket keys,
+	// shared by all nodes using the same storage.
+	ticketKeysName           = "session_ticket_keys"
+	defaultTicketKeyRotation = 12 * time.Hour
+	// ticketKeyCount is how many keys are kept: the newest encrypts tickets,
+	// the older ones still decrypt tickets issued before recent rotations.
+	ticketKeyCount = 4
+	// ticketKeyPollInterval is how often keys rotated by other nodes are
+	// picked up.
+	ticketKeyPollInterval = time.Minute
+	ticketKeyTimeout      = 30 * time.Second
+)
+
+// ticketKeys is the stored form of the session ticket keys, newest first.
+type ticketKeys struct {
+	RotatedAt time.Time `json:"rotated_at"`
+	Keys      [][]byte  `json:"keys"`
+}
+
+// RotateSessionTicketKeys starts a background process that keeps the session
+// ticket keys of the TLS configurations in sync with the certificate storage,
+// rotating them every SessionTicketRotation. Nodes sharing the storage can
+// then resume each other's sessions.
+func (a *AutoTLS) RotateSessionTicketKeys() {
+	for {
+		if err := a.updateTicketKeys(); err != nil {
+			log.Printf("Warning: Failed to update session ticket keys: %v", err)
+		}
+		time.Sleep(ticketKeyPollInterval)
+	}
+}
+
+func (a *AutoTLS) updateTicketKeys() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ticketKeyTimeout)
+	defer cancel()
+
+	keys, err := a.loadTicketKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if keys == nil || time.Since(keys.RotatedAt) >= a.config.SessionTicketRotation {
+		if keys, err = a.rotateTicketKeys(ctx); err != nil {
+			return err
+		}
+	}
+	a.setTicketKeys(keys)
+	return nil
+}
+
+// rotateTicketKeys adds a fresh key in front of the stored ones. Only one
+// node rotates at a time; the others pick up its keys.
+func (a *AutoTLS) rotateTicketKeys(ctx context.Context) (*ticketKeys, error) {
+	unlock, err := a.lockIssuance(ctx, ticketKeysName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Another node may have rotated them while we waited for the lock
+	keys, err := a.loadTicketKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil && time.Since(keys.RotatedAt) < a.config.SessionTicketRotation {
+		return keys, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	rotated := &ticketKeys{RotatedAt: time.Now(), Keys: [][]byte{key}}
+	if keys != nil {
+		rotated.Keys = append(rotated.Keys, keys.Keys...)
+	}
+	if len(rotated.Keys) > ticketKeyCount {
+		rotated.Keys = rotated.Keys[:ticketKeyCount]
+	}
+
+	data, err := json.Marshal(rotated)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.certManager.Cache.Put(ctx, ticketKeysName, data); err != nil {
+		return nil, fmt.Errorf("failed to save session ticket keys: %v", err)
+	}
+	log.Printf("Rotated TLS session ticket keys")
+	return rotated, nil
+}
+
+// loadTicketKeys reads the stored keys, or returns nil if there are none yet.
+func (a *AutoTLS) loadTicketKeys(ctx context.Context) (*ticketKeys, error) {
+	data, err := a.certManager.Cache.Get(ctx, ticketKeysName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session ticket keys: %v", err)
+	}
+
+	var keys ticketKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		// Replaced by the next rotation
+		log.Printf("Warning: Invalid session ticket keys: %v", err)
+		return nil, nil
+	}
+	return &keys, nil
+}
+
+// setTicketKeys installs keys in the TLS configurations handed out by
+// GetTLSConfig. Per-domain policies use the keys of those configurations.
+func (a *AutoTLS) setTicketKeys(keys *ticketKeys) {
+	converted := make([][32]byte, 0, len(keys.Keys))
+	for _, key := range keys.Keys {
+		if len(key) == 32 {
+			converted = append(converted, [32]byte(key))
+		}
+	}
+	if len(converted) == 0 {
+		return
+	}
+
+	a.ticketMu.Lock()
+	defer a.ticketMu.Unlock()
+	if slices.Equal(converted, a.ticketKeys) {
+		return
+	}
+	a.ticketKeys = converted
+	for _, config := range a.ticketConfigs {
+		config.SetSessionTicketKeys(converted)
+	}
+}
+
+// useTicketKeys makes config use the shared session ticket keys.
+func (a *AutoTLS) useTicketKeys(config *tls.Config) {
+	a.ticketMu.Lock()
+	defer a.ticketMu.Unlock()
+	a.ticketConfigs = append(a.ticketConfigs, config)
+	if len(a.ticketKeys) > 0 {
+		config.SetSessionTicketKeys(a.ticketKeys)
+	}
+}
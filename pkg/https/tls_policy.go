@@ -0,0 +1,169 @@
+package https
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSPolicy restricts the protocol versions, cipher suites and ALPN protocols
+// offered to clients. Empty fields keep the defaults.
+type TLSPolicy struct {
+	MinVersion   string   // "1.0", "1.1", "1.2" or "1.3"
+	MaxVersion   string   // Highest version offered, "1.3" when empty
+	CipherSuites []string // Go cipher suite names; TLS 1.3 suites are not configurable
+	ALPN         []string // Protocols offered, e.g. "h2" and "http/1.1"
+	ClientAuth   string   // ClientAuthRequire or ClientAuthOptional to verify client certificates
+	ClientCA     string   // PEM file with the CAs client certificates must chain to
+}
+
+const (
+	// ClientAuthRequire rejects handshakes without a client certificate
+	// issued by the client CA.
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies client certificates when one is sent.
+	ClientAuthOptional = "optional"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are the TLS 1.2 suites offered unless a policy names
+// others, all forward secret AEAD ciphers.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// buildTLSConfig returns the server configuration for the default settings
+// with the given policies applied in order, later ones taking precedence.
+func (a *AutoTLS) buildTLSConfig(policies ...TLSPolicy) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: a.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites:   defaultCipherSuites,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	for _, policy := range policies {
+		if policy.MinVersion != "" {
+			version, ok := tlsVersions[policy.MinVersion]
+			if !ok {
+				return nil, fmt.Errorf("unsupported TLS version: %q", policy.MinVersion)
+			}
+			config.MinVersion = version
+		}
+		if policy.MaxVersion != "" {
+			version, ok := tlsVersions[policy.MaxVersion]
+			if !ok {
+				return nil, fmt.Errorf("unsupported TLS version: %q", policy.MaxVersion)
+			}
+			config.MaxVersion = version
+		}
+		if len(policy.CipherSuites) > 0 {
+			suites, err := parseCipherSuites(policy.CipherSuites)
+			if err != nil {
+				return nil, err
+			}
+			config.CipherSuites = suites
+		}
+		if len(policy.ALPN) > 0 {
+			config.NextProtos = policy.ALPN
+		}
+		switch policy.ClientAuth {
+		case "":
+		case ClientAuthRequire:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case ClientAuthOptional:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unsupported client auth mode: %q", policy.ClientAuth)
+		}
+		if policy.ClientCA != "" {
+			pool, err := loadCertPool(policy.ClientCA)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientCAs = pool
+		}
+	}
+
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return nil, fmt.Errorf("TLS max version is below min version")
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, fmt.Errorf("client auth requires client_ca")
+	}
+	return config, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// parseCipherSuites resolves cipher suite names such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Insecure suites are accepted for
+// legacy clients that support nothing else.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite: %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// setPolicy applies policy to handshakes for domain, on top of the global one.
+func (a *AutoTLS) setPolicy(domain string, policy TLSPolicy) error {
+	config, err := a.buildTLSConfig(a.config.Policy, policy)
+	if err != nil {
+		return fmt.Errorf("invalid TLS policy for %s: %v", domain, err)
+	}
+
+	a.mu.Lock()
+	a.policies[domain] = config
+	a.mu.Unlock()
+	return nil
+}
+
+// configForClient returns the configuration of the domain the client asked
+// for, or nil to use the global one.
+func (a *AutoTLS) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if config, exists := a.policies[hello.ServerName]; exists {
+		return config, nil
+	}
+	if wildcard := wildcardFor(hello.ServerName); wildcard != "" {
+		return a.policies[wildcard], nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,208 @@
+// Package invalidation propagates cache invalidations between Saddy nodes.
+//
+// Every node wraps its cache storage in a Storage that publishes deletes,
+// purges, clears and expiry changes to a Redis pub/sub channel and applies the
+// events published by its peers, so a purge on any node reaches all of them.
+package invalidation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the pub/sub channel used when none is configured.
+const DefaultChannel = "saddy:invalidation"
+
+const publishTimeout = 2 * time.Second
+
+// Event operations.
+const (
+	opDelete    = "delete"
+	opPurge     = "purge"
+	opPurgeTag  = "purge_tag"
+	opClear     = "clear"
+	opSetExpiry = "set_expiry"
+)
+
+// Event is an invalidation broadcast to peers.
+type Event struct {
+	Node      string          `json:"node"`
+	Op        string          `json:"op"`
+	Key       string          `json:"key,omitempty"`
+	Pattern   string          `json:"pattern,omitempty"`
+	Tag       string          `json:"tag,omitempty"`
+	Mode      cache.PurgeMode `json:"mode,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+// Storage is a cache.Storage that shares invalidations with other nodes.
+type Storage struct {
+	cache.Storage
+
+	client  *redis.Client
+	pubsub  *redis.PubSub
+	channel string
+	node    string
+	done    chan struct{}
+}
+
+// New connects to Redis and starts applying invalidations from peers to storage.
+func New(cfg config.InvalidationConfig, storage cache.Storage) (*Storage, error) {
+	options, err := redis.ParseURL(cfg.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %v", err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close() //nolint:errcheck
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+
+	channel := cfg.Channel
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	pubsub := client.Subscribe(context.Background(), channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close() //nolint:errcheck
+		_ = client.Close() //nolint:errcheck
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", channel, err)
+	}
+
+	s := &Storage{
+		Storage: storage,
+		client:  client,
+		pubsub:  pubsub,
+		channel: channel,
+		node:    newNodeID(),
+		done:    make(chan struct{}),
+	}
+	go s.listen()
+
+	log.Printf("Cache invalidation enabled on channel %s (node %s)", channel, s.node)
+	return s, nil
+}
+
+// newNodeID returns a random identifier used to ignore our own events.
+func newNodeID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) //nolint:errcheck
+	return hex.EncodeToString(id)
+}
+
+// listen applies events from peers until the subscription is closed.
+func (s *Storage) listen() {
+	defer close(s.done)
+
+	for msg := range s.pubsub.Channel() {
+		var event Event
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Printf("Ignoring malformed invalidation event: %v", err)
+			continue
+		}
+		if event.Node == s.node {
+			continue
+		}
+		s.apply(event)
+	}
+}
+
+// apply performs a peer's invalidation on the local storage only.
+func (s *Storage) apply(event Event) {
+	switch event.Op {
+	case opDelete:
+		s.Storage.Delete(event.Key)
+	case opPurge:
+		s.Storage.Purge(event.Pattern, event.Mode)
+	case opPurgeTag:
+		s.Storage.PurgeTag(event.Tag, event.Mode)
+	case opClear:
+		s.Storage.Clear()
+	case opSetExpiry:
+		s.Storage.SetExpiry(event.Key, event.ExpiresAt)
+	default:
+		log.Printf("Ignoring unknown invalidation event: %s", event.Op)
+	}
+}
+
+// publish broadcasts an event to peers. Failures are logged, the local
+// invalidation has already happened.
+func (s *Storage) publish(event Event) {
+	event.Node = s.node
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode invalidation event: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := s.client.Publish(ctx, s.channel, payload).Err(); err != nil {
+		log.Printf("Failed to publish invalidation event: %v", err)
+	}
+}
+
+// Delete removes an item on this node and its peers.
+func (s *Storage) Delete(key string) {
+	s.Storage.Delete(key)
+	s.publish(Event{Op: opDelete, Key: key})
+}
+
+// Purge invalidates matching items on this node and its peers and returns how
+// many were affected locally.
+func (s *Storage) Purge(pattern string, mode cache.PurgeMode) int {
+	purged := s.Storage.Purge(pattern, mode)
+	s.publish(Event{Op: opPurge, Pattern: pattern, Mode: mode})
+	return purged
+}
+
+// PurgeTag invalidates tagged items on this node and its peers and returns how
+// many were affected locally.
+func (s *Storage) PurgeTag(tag string, mode cache.PurgeMode) int {
+	purged := s.Storage.PurgeTag(tag, mode)
+	s.publish(Event{Op: opPurgeTag, Tag: tag, Mode: mode})
+	return purged
+}
+
+// Clear removes all items on this node and its peers.
+func (s *Storage) Clear() {
+	s.Storage.Clear()
+	s.publish(Event{Op: opClear})
+}
+
+// SetExpiry changes an item's expiration on this node and its peers.
+func (s *Storage) SetExpiry(key string, expiresAt time.Time) bool {
+	exists := s.Storage.SetExpiry(key, expiresAt)
+	s.publish(Event{Op: opSetExpiry, Key: key, ExpiresAt: expiresAt})
+	return exists
+}
+
+// Stats returns the wrapped storage statistics.
+func (s *Storage) Stats() map[string]interface{} {
+	stats := s.Storage.Stats()
+	stats["invalidation_channel"] = s.channel
+	stats["invalidation_node"] = s.node
+	return stats
+}
+
+// Stop unsubscribes, closes the Redis connection and stops the wrapped storage.
+func (s *Storage) Stop() {
+	_ = s.pubsub.Close() //nolint:errcheck
+	<-s.done
+	_ = s.client.Close() //nolint:errcheck
+	s.Storage.Stop()
+}
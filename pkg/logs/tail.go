@@ -0,0 +1,136 @@
+// Package logs keeps the latest access and error log lines of the process
+// and distributes new ones to subscribers, like the admin API's live log
+// tail.
+package logs
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levels, from least to most severe.
+const (
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// Levels lists every level, from least to most severe.
+var Levels = []string{LevelInfo, LevelWarning, LevelError}
+
+const (
+	// HistorySize is how many past lines are kept for subscribers to start
+	// with.
+	HistorySize = 1000
+	// subscriberBuffer is how many lines a slow subscriber may fall behind
+	// before lines are dropped for it.
+	subscriberBuffer = 256
+)
+
+// logTimestamp is the prefix the standard logger writes by default.
+const logTimestamp = "2006/01/02 15:04:05 "
+
+// Line is one log line.
+type Line struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Domain  string    `json:"domain,omitempty"` // Set on access lines
+	Message string    `json:"message"`
+}
+
+// Severity returns the rank of level in Levels, or -1 for unknown levels.
+func Severity(level string) int {
+	for i, l := range Levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Tail fans out published lines to its subscribers. A nil *Tail discards
+// lines, so writers don't need to check for one.
+type Tail struct {
+	mu          sync.Mutex
+	history     []Line
+	subscribers map[chan Line]struct{}
+}
+
+// NewTail creates an empty log tail.
+func NewTail() *Tail {
+	return &Tail{subscribers: make(map[chan Line]struct{})}
+}
+
+// Publish stamps line with the current time, unless it has one, and delivers
+// it to every subscriber. Subscribers that fall behind miss lines instead of
+// blocking the logging request.
+func (t *Tail) Publish(line Line) {
+	if t == nil {
+		return
+	}
+	if line.Time.IsZero() {
+		line.Time = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.history = append(t.history, line)
+	if len(t.history) > HistorySize {
+		t.history = t.history[len(t.history)-HistorySize:]
+	}
+	for ch := range t.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of new lines, up to n of the latest kept
+// lines, oldest first, and a function that ends the subscription.
+func (t *Tail) Subscribe(n int) (<-chan Line, []Line, func()) {
+	ch := make(chan Line, subscriberBuffer)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n = min(max(n, 0), len(t.history))
+	recent := append([]Line(nil), t.history[len(t.history)-n:]...)
+	t.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers, ch)
+	}
+	return ch, recent, cancel
+}
+
+// Write publishes the lines of the standard logger, so that it can write to
+// the tail as well as to stderr. Their level is guessed from the message.
+func (t *Tail) Write(p []byte) (int, error) {
+	for _, message := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		now := time.Now()
+		if len(message) >= len(logTimestamp) {
+			if logged, err := time.ParseInLocation(logTimestamp, message[:len(logTimestamp)], time.Local); err == nil {
+				now, message = logged, message[len(logTimestamp):]
+			}
+		}
+		t.Publish(Line{Time: now, Level: levelOf(message), Message: message})
+	}
+	return len(p), nil
+}
+
+// levelOf guesses the level of a message of the standard logger, which
+// Saddy prefixes with "Warning:" or starts with "Error" or "Failed" by
+// convention.
+func levelOf(message string) string {
+	switch {
+	case strings.HasPrefix(message, "Warning"):
+		return LevelWarning
+	case strings.HasPrefix(message, "Error"), strings.HasPrefix(message, "Failed"),
+		strings.HasPrefix(message, "Fatal"), strings.HasPrefix(message, "panic"):
+		return LevelError
+	}
+	return LevelInfo
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Metric types of the Prometheus text format.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Exposition builds a page in the Prometheus text exposition format.
+type Exposition struct {
+	b strings.Builder
+}
+
+// Family starts the samples of a metric.
+func (e *Exposition) Family(name, kind, help string) {
+	e.b.WriteString("# HELP " + name + " " + help + "\n")
+	e.b.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Sample adds a sample of the current family. labels are pairs of label
+// names and values.
+func (e *Exposition) Sample(name string, value float64, labels ...string) {
+	e.b.WriteString(name)
+	if len(labels) > 0 {
+		e.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.b.WriteByte(',')
+			}
+			e.b.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		e.b.WriteByte('}')
+	}
+	e.b.WriteByte(' ')
+	e.b.WriteString(formatValue(value))
+	e.b.WriteByte('\n')
+}
+
+// String returns the page.
+func (e *Exposition) String() string {
+	return e.b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	case value == math.Trunc(value) && math.Abs(value) < 1e15:
+		// Counters and sizes without an exponent
+		return strconv.FormatFloat(value, 'f', 0, 64)
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
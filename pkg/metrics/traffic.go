@@ -0,0 +1,288 @@
+// Package metrics records proxied traffic over sliding windows for the
+// dashboard: request rates, status codes, latency percentiles and bandwidth.
+// It also writes metrics in the Prometheus text format.
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxWindow is the longest window traffic is kept for, at one-second
+// resolution.
+const MaxWindow = 15 * time.Minute
+
+const slots = int(MaxWindow / time.Second)
+
+// latencyBounds are the upper bounds of the latency histogram buckets in
+// milliseconds. Slower requests fall into a last, unbounded bucket.
+var latencyBounds = [...]float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// second holds the traffic of one domain during one second.
+type second struct {
+	unix     int64
+	requests int64
+	bytes    int64
+	status   [6]int64 // By status/100; 0 for anything outside 1xx-5xx
+	latency  [len(latencyBounds) + 1]int64
+}
+
+func (s *second) add(other *second) {
+	s.requests += other.requests
+	s.bytes += other.bytes
+	for i := range s.status {
+		s.status[i] += other.status[i]
+	}
+	for i := range s.latency {
+		s.latency[i] += other.latency[i]
+	}
+}
+
+// Traffic summarizes the requests of a window.
+type Traffic struct {
+	Requests          int64            `json:"requests"`
+	RequestsPerSecond float64          `json:"requests_per_second"`
+	Bytes             int64            `json:"bytes"`
+	BytesPerSecond    float64          `json:"bytes_per_second"`
+	Status            map[string]int64 `json:"status"`     // By class, e.g. "2xx"
+	ErrorRate         float64          `json:"error_rate"` // Share of 5xx responses
+	Latency           Latency          `json:"latency_ms"`
+}
+
+// Latency holds latency percentiles in milliseconds, estimated from a
+// histogram.
+type Latency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// Point is the traffic of one step of a series.
+type Point struct {
+	Time time.Time `json:"time"`
+	Traffic
+}
+
+// Totals are the traffic of a domain since startup, for monitoring systems
+// that compute rates themselves.
+type Totals struct {
+	Requests       int64
+	Bytes          int64
+	Status         [6]int64                      // By status/100; 0 for anything outside 1xx-5xx
+	Latency        [len(latencyBounds) + 1]int64 // Requests per bucket of LatencyBounds, the last unbounded
+	LatencySeconds float64                       // Sum of all latencies
+}
+
+// LatencyBounds returns the upper bounds of the latency buckets in
+// milliseconds.
+func LatencyBounds() []float64 {
+	return latencyBounds[:]
+}
+
+// Recorder accumulates per-domain traffic of the last MaxWindow, and in
+// total since startup.
+type Recorder struct {
+	mu      sync.Mutex
+	domains map[string]*[slots]second
+	totals  map[string]*Totals
+}
+
+// NewRecorder creates an empty traffic recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{domains: make(map[string]*[slots]second), totals: make(map[string]*Totals)}
+}
+
+// Record accounts one response for domain.
+func (r *Recorder) Record(domain string, status, bytes int, latency time.Duration) {
+	if bytes < 0 {
+		bytes = 0
+	}
+	now := time.Now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ring, exists := r.domains[domain]
+	if !exists {
+		ring = new([slots]second)
+		r.domains[domain] = ring
+	}
+	s := &ring[now%int64(slots)]
+	if s.unix != now {
+		*s = second{unix: now}
+	}
+
+	class := status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+	bucket := sort.SearchFloat64s(latencyBounds[:], ms)
+
+	s.requests++
+	s.bytes += int64(bytes)
+	s.status[class]++
+	s.latency[bucket]++
+
+	totals, exists := r.totals[domain]
+	if !exists {
+		totals = &Totals{}
+		r.totals[domain] = totals
+	}
+	totals.Requests++
+	totals.Bytes += int64(bytes)
+	totals.Status[class]++
+	totals.Latency[bucket]++
+	totals.LatencySeconds += latency.Seconds()
+}
+
+// Totals returns a copy of the traffic of every domain since startup.
+func (r *Recorder) Totals() map[string]Totals {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	totals := make(map[string]Totals, len(r.totals))
+	for domain, t := range r.totals {
+		totals[domain] = *t
+	}
+	return totals
+}
+
+// Summary returns the traffic of every domain during the last window, and
+// the total of all domains.
+func (r *Recorder) Summary(window time.Duration) (map[string]Traffic, Traffic) {
+	window = clampWindow(window)
+	now := time.Now().Unix()
+	from := now - int64(window/time.Second)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	domains := make(map[string]Traffic, len(r.domains))
+	var total second
+	for domain, ring := range r.domains {
+		var sum second
+		for i := range ring {
+			if ring[i].unix > from && ring[i].unix <= now {
+				sum.add(&ring[i])
+			}
+		}
+		if sum.requests == 0 {
+			continue
+		}
+		domains[domain] = sum.traffic(window)
+		total.add(&sum)
+	}
+	return domains, total.traffic(window)
+}
+
+// Series returns the traffic of domain, or of all domains if it is empty,
+// during the last window in steps of step, oldest first.
+func (r *Recorder) Series(domain string, window, step time.Duration) []Point {
+	window = clampWindow(window)
+	if step < time.Second {
+		step = time.Second
+	}
+	now := time.Now().Unix()
+	stepSeconds := int64(step / time.Second)
+	steps := int64(window/time.Second) / stepSeconds
+	if steps == 0 {
+		steps = 1
+	}
+	from := now - steps*stepSeconds
+
+	sums := make([]second, steps)
+	r.mu.Lock()
+	for name, ring := range r.domains {
+		if domain != "" && name != domain {
+			continue
+		}
+		for i := range ring {
+			if ring[i].unix > from && ring[i].unix <= now {
+				sums[(ring[i].unix-from-1)/stepSeconds].add(&ring[i])
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	points := make([]Point, steps)
+	for i := range sums {
+		end := from + int64(i+1)*stepSeconds
+		points[i] = Point{Time: time.Unix(end, 0), Traffic: sums[i].traffic(step)}
+	}
+	return points
+}
+
+// Reset clears the traffic of the windows. Totals are kept, as monitoring
+// systems expect them to only grow.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.domains = make(map[string]*[slots]second)
+}
+
+func clampWindow(window time.Duration) time.Duration {
+	if window < time.Second {
+		return time.Second
+	}
+	if window > MaxWindow {
+		return MaxWindow
+	}
+	return window
+}
+
+// traffic summarizes s as the traffic of a window.
+func (s *second) traffic(window time.Duration) Traffic {
+	seconds := window.Seconds()
+	t := Traffic{
+		Requests:          s.requests,
+		RequestsPerSecond: float64(s.requests) / seconds,
+		Bytes:             s.bytes,
+		BytesPerSecond:    float64(s.bytes) / seconds,
+		Status:            make(map[string]int64),
+	}
+	classes := [...]string{"other", "1xx", "2xx", "3xx", "4xx", "5xx"}
+	for i, count := range s.status {
+		if count > 0 {
+			t.Status[classes[i]] = count
+		}
+	}
+	if s.requests > 0 {
+		t.ErrorRate = float64(s.status[5]) / float64(s.requests)
+	}
+	t.Latency = Latency{
+		P50: s.percentile(0.50),
+		P90: s.percentile(0.90),
+		P95: s.percentile(0.95),
+		P99: s.percentile(0.99),
+	}
+	return t
+}
+
+// percentile estimates the latency below which the fraction p of requests
+// fall, interpolating linearly within the histogram bucket.
+func (s *second) percentile(p float64) float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	rank := p * float64(s.requests)
+	var seen int64
+	for i, count := range s.latency {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		if i == len(latencyBounds) {
+			// Unbounded bucket, report its lower bound
+			return latencyBounds[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		return lower + (latencyBounds[i]-lower)*(rank-float64(seen))/float64(count)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
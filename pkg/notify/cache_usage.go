@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+)
+
+// cacheUsageInterval is how often MonitorCacheUsage checks the cache.
+const cacheUsageInterval = 30 * time.Second
+
+// MonitorCacheUsage publishes a cache_threshold event when the cache fills
+// past webhooks.cache_threshold percent of its size, until ctx is done. It
+// publishes again only after usage dropped below the threshold.
+func MonitorCacheUsage(ctx context.Context, storage cache.Storage, cfg *config.Config, bus *events.Bus) {
+	ticker := time.NewTicker(cacheUsageInterval)
+	defer ticker.Stop()
+
+	above := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			threshold := cfg.Snapshot().Webhooks.CacheThreshold
+			usage, ok := storage.Stats()["usage_percent"].(float64)
+			if threshold <= 0 || !ok {
+				above = false
+				continue
+			}
+			if usage < float64(threshold) {
+				above = false
+				continue
+			}
+			if !above {
+				above = true
+				bus.Publish(events.Event{
+					Type:    events.CacheThreshold,
+					Message: fmt.Sprintf("Cache is %.1f%% full, over the threshold of %d%%", usage, threshold),
+					Data:    map[string]any{"usage_percent": usage, "threshold": threshold},
+				})
+			}
+		}
+	}
+}
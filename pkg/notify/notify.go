@@ -0,0 +1,189 @@
+// Package notify delivers operational alerts, such as expiring certificates,
+// by webhook and email.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+)
+
+const sendTimeout = 30 * time.Second
+
+// Event types.
+const (
+	EventCertExpiring       = "certificate_expiring"
+	EventCertRenewalFailed  = "certificate_renewal_failed"
+	EventCertIssuanceFailed = "certificate_issuance_failed"
+)
+
+// Event is a single notification.
+type Event struct {
+	Type    string    `json:"type"`
+	Domain  string    `json:"domain"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier sends events to the configured webhook and email recipients.
+type Notifier struct {
+	webhookURL string
+	smtp       config.SMTPConfig
+	client     *http.Client
+}
+
+// New creates a notifier, or returns nil when no channel is configured.
+func New(cfg config.NotifyConfig) *Notifier {
+	if cfg.WebhookURL == "" && (cfg.SMTP.Host == "" || len(cfg.SMTP.To) == 0) {
+		return nil
+	}
+	if cfg.SMTP.Port == 0 {
+		cfg.SMTP.Port = 587
+	}
+	return &Notifier{
+		webhookURL: cfg.WebhookURL,
+		smtp:       cfg.SMTP,
+		client:     &http.Client{Timeout: sendTimeout},
+	}
+}
+
+// Notify sends event in the background; failures are logged. It is a no-op
+// on a nil notifier.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+
+	go func() {
+		if err := n.Send(event); err != nil {
+			log.Printf("Failed to send %s notification for %s: %v", event.Type, event.Domain, err)
+		}
+	}()
+}
+
+// Send delivers event to every configured channel.
+func (n *Notifier) Send(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	var errs []string
+	if n.webhookURL != "" {
+		if err := n.sendWebhook(event); err != nil {
+			errs = append(errs, "webhook: "+err.Error())
+		}
+	}
+	if n.smtp.Host != "" && len(n.smtp.To) > 0 {
+		if err := n.sendEmail(event); err != nil {
+			errs = append(errs, "email: "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sendWebhook POSTs the event as JSON.
+func (n *Notifier) sendWebhook(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16)) //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendEmail sends the event as a plain text mail. Port 465 uses implicit
+// TLS, other ports upgrade with STARTTLS when the server offers it.
+func (n *Notifier) sendEmail(event Event) error {
+	from := n.smtp.From
+	if from == "" {
+		from = n.smtp.Username
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.smtp.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [Saddy] %s: %s\r\n", strings.ReplaceAll(event.Type, "_", " "), event.Domain)
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(event.Message + "\r\n")
+
+	addr := net.JoinHostPort(n.smtp.Host, strconv.Itoa(n.smtp.Port))
+	var auth smtp.Auth
+	if n.smtp.Username != "" {
+		auth = smtp.PlainAuth("", n.smtp.Username, n.smtp.Password, n.smtp.Host)
+	}
+	if n.smtp.Port != 465 {
+		return smtp.SendMail(addr, auth, from, n.smtp.To, msg.Bytes())
+	}
+
+	dialer := &net.Dialer{Timeout: sendTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: n.smtp.Host, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, n.smtp.Host)
+	if err != nil {
+		_ = conn.Close() //nolint:errcheck
+		return err
+	}
+	defer func() { _ = client.Close() }() //nolint:errcheck
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range n.smtp.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
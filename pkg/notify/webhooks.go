@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+)
+
+// webhookAttempts is how often delivery of an event is tried, waiting
+// webhookRetryDelay, doubled each time, in between.
+const (
+	webhookAttempts   = 3
+	webhookRetryDelay = 2 * time.Second
+)
+
+// Webhooks sends the events published on a bus to the endpoints of the
+// webhooks configuration. The live configuration is read for each event, so
+// reloads take effect right away.
+type Webhooks struct {
+	config *config.Config
+	client *http.Client
+	source string // Host name reported to PagerDuty for events without a domain
+}
+
+// NewWebhooks returns webhooks configured in cfg.Webhooks.
+func NewWebhooks(cfg *config.Config) *Webhooks {
+	source, err := os.Hostname()
+	if err != nil {
+		source = "saddy"
+	}
+	return &Webhooks{config: cfg, client: &http.Client{Timeout: sendTimeout}, source: source}
+}
+
+// Run delivers the events published on bus until ctx is done.
+func (w *Webhooks) Run(ctx context.Context, bus *events.Bus) {
+	ch, _, cancel := bus.Subscribe(0)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-ch:
+			for _, endpoint := range w.config.Snapshot().Webhooks.Endpoints {
+				if len(endpoint.Events) == 0 || slices.Contains(endpoint.Events, event.Type) {
+					go w.deliver(ctx, endpoint, event)
+				}
+			}
+		}
+	}
+}
+
+// deliver sends event to endpoint, retrying failures; the last one is
+// logged.
+func (w *Webhooks) deliver(ctx context.Context, endpoint config.WebhookEndpoint, event events.Event) {
+	body, err := w.payload(endpoint, event)
+	if err != nil {
+		log.Printf("Failed to encode %s webhook for %s: %v", event.Type, endpoint.URL, err)
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, endpoint, event.Type, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	log.Printf("Failed to send %s webhook to %s: %v", event.Type, endpoint.URL, err)
+}
+
+// post sends one delivery. With a secret, the body is signed with
+// HMAC-SHA256 and sent as X-Saddy-Signature: sha256=<hex>.
+func (w *Webhooks) post(ctx context.Context, endpoint config.WebhookEndpoint, eventType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Saddy-Webhook")
+	req.Header.Set("X-Saddy-Event", eventType)
+	if endpoint.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Saddy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16)) //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload encodes event in the endpoint's format.
+func (w *Webhooks) payload(endpoint config.WebhookEndpoint, event events.Event) ([]byte, error) {
+	summary := "[Saddy] " + strings.ReplaceAll(event.Type, "_", " ")
+	if event.Domain != "" {
+		summary += " " + event.Domain
+	}
+	summary += ": " + event.Message
+
+	switch endpoint.Format {
+	case "slack":
+		return json.Marshal(map[string]string{"text": summary})
+	case "pagerduty":
+		return json.Marshal(w.pagerDutyEvent(endpoint, event, summary))
+	default:
+		return json.Marshal(event)
+	}
+}
+
+// pagerDutyEvent converts event to the PagerDuty Events API v2. Backends
+// coming back and issued certificates resolve the incident opened for
+// their domain.
+func (w *Webhooks) pagerDutyEvent(endpoint config.WebhookEndpoint, event events.Event, summary string) map[string]any {
+	action, severity := "trigger", "info"
+	switch event.Type {
+	case events.BackendUp, events.CertIssued, events.CertRenewed:
+		action = "resolve"
+	case events.BackendDown, events.CertRenewalFailed, events.CertIssuanceFailed, events.CertRevoked, events.Error:
+		severity = "error"
+	case events.CertExpiring, events.CacheThreshold:
+		severity = "warning"
+	}
+
+	source := event.Domain
+	if source == "" {
+		source = w.source
+	}
+	payload := map[string]any{
+		"summary":   summary,
+		"source":    source,
+		"severity":  severity,
+		"timestamp": event.Time.Format(time.RFC3339),
+		"component": incidentKind(event.Type),
+	}
+	if event.Data != nil {
+		payload["custom_details"] = event.Data
+	}
+	return map[string]any{
+		"routing_key":  endpoint.RoutingKey,
+		"event_action": action,
+		"dedup_key":    "saddy:" + incidentKind(event.Type) + ":" + source,
+		"payload":      payload,
+	}
+}
+
+// incidentKind groups the event types that open and resolve the same
+// incident.
+func incidentKind(eventType string) string {
+	switch {
+	case strings.HasPrefix(eventType, "backend_"):
+		return "backend"
+	case strings.HasPrefix(eventType, "certificate_"):
+		return "certificate"
+	default:
+		return eventType
+	}
+}
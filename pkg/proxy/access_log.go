@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"saddy/pkg/logs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetLogs publishes a line per proxied request to tail.
+func (rp *ReverseProxy) SetLogs(tail *logs.Tail) {
+	rp.logs = tail
+}
+
+// logAccess publishes the access line of a request for the rule of domain:
+// client, method, path, status, bytes and latency. 4xx responses are logged
+// as warnings and 5xx as errors.
+func (rp *ReverseProxy) logAccess(c *gin.Context, domain string, latency time.Duration) {
+	if rp.logs == nil {
+		return
+	}
+	status := c.Writer.Status()
+	level := logs.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = logs.LevelError
+	} else if status >= http.StatusBadRequest {
+		level = logs.LevelWarning
+	}
+	rp.logs.Publish(logs.Line{
+		Level:  level,
+		Domain: domain,
+		// Without the query, which may carry credentials
+		Message: fmt.Sprintf("%s %s %s %d %d %s", c.ClientIP(), c.Request.Method, c.Request.URL.Path,
+			status, max(c.Writer.Size(), 0), latency.Round(time.Microsecond)),
+	})
+}
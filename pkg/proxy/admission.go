@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"saddy/pkg/config"
+)
+
+const (
+	// defaultAdmissionWindow applies when an admission rule sets no window.
+	defaultAdmissionWindow = 60 * time.Second
+	// maxAdmissionKeys bounds how many uncached keys are tracked at once.
+	maxAdmissionKeys = 100000
+)
+
+// admissionTracker counts requests for objects that are not cached yet so
+// they are only stored once they prove popular.
+type admissionTracker struct {
+	mu   sync.Mutex
+	seen map[string]*admissionCount
+}
+
+type admissionCount struct {
+	hits      int
+	expiresAt time.Time
+}
+
+func newAdmissionTracker() *admissionTracker {
+	return &admissionTracker{seen: make(map[string]*admissionCount)}
+}
+
+// admit records a request for key and reports whether its response may be
+// cached under the rule.
+func (t *admissionTracker) admit(key string, rule config.AdmissionRule, now time.Time) bool {
+	if rule.MinHits <= 1 {
+		return true
+	}
+	window := time.Duration(rule.Window) * time.Second
+	if window <= 0 {
+		window = defaultAdmissionWindow
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count, exists := t.seen[key]
+	if !exists || now.After(count.expiresAt) {
+		if !exists && len(t.seen) >= maxAdmissionKeys {
+			t.prune(now)
+		}
+		count = &admissionCount{expiresAt: now.Add(window)}
+		t.seen[key] = count
+	}
+	count.hits++
+	return count.hits >= rule.MinHits
+}
+
+// prune drops expired counters, or all of them if that doesn't free enough
+// room. Caller must hold t.mu.
+func (t *admissionTracker) prune(now time.Time) {
+	for key, count := range t.seen {
+		if now.After(count.expiresAt) {
+			delete(t.seen, key)
+		}
+	}
+	if len(t.seen) >= maxAdmissionKeys {
+		t.seen = make(map[string]*admissionCount)
+	}
+}
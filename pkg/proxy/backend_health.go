@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	defaultEjectTime     = 30 * time.Second
+)
+
+// Upstream states reported by Upstreams.
+const (
+	UpstreamUnknown   = "unknown" // No request or probe yet
+	UpstreamHealthy   = "healthy"
+	UpstreamUnhealthy = "unhealthy" // The last request or probe failed
+	UpstreamEjected   = "ejected"   // Skipped until the ejection ends
+)
+
+// backendHealth tracks the targets of the proxy rules by rule domain.
+type backendHealth struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamState
+}
+
+// upstreamState is the health of one rule's target. Fields other than
+// inFlight are guarded by backendHealth.mu.
+type upstreamState struct {
+	target       string
+	inFlight     atomic.Int64
+	checked      bool
+	down         bool
+	failures     int // Consecutive
+	lastError    string
+	lastSuccess  time.Time
+	lastFailure  time.Time
+	ejectedUntil time.Time
+	probe        *ProbeResult
+	probing      bool
+	nextProbe    time.Time
+}
+
+// ProbeResult is the outcome of the latest health probe of a target.
+type ProbeResult struct {
+	Time       time.Time `json:"time"`
+	Healthy    bool      `json:"healthy"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Latency    float64   `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// UpstreamStatus describes the health and circuit state of a rule's target.
+type UpstreamStatus struct {
+	Domain              string       `json:"domain"`
+	Target              string       `json:"target"`
+	Status              string       `json:"status"`
+	Healthy             bool         `json:"healthy"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastError           string       `json:"last_error,omitempty"`
+	LastSuccess         *time.Time   `json:"last_success,omitempty"`
+	LastFailure         *time.Time   `json:"last_failure,omitempty"`
+	LastProbe           *ProbeResult `json:"last_probe,omitempty"`
+	Ejected             bool         `json:"ejected"`
+	EjectedUntil        *time.Time   `json:"ejected_until,omitempty"`
+	InFlight            int64        `json:"in_flight"`
+	HealthCheck         bool         `json:"health_check"` // Whether the target is probed
+}
+
+// state returns the health of the rule's target, starting over when the
+// rule got a new target.
+func (h *backendHealth) state(rule *config.ProxyRule) *upstreamState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.upstreams == nil {
+		h.upstreams = make(map[string]*upstreamState)
+	}
+	state, exists := h.upstreams[rule.Domain]
+	if !exists || state.target != rule.Target {
+		state = &upstreamState{target: rule.Target}
+		h.upstreams[rule.Domain] = state
+	}
+	return state
+}
+
+// healthTransport reports the outcome of requests to a backend.
+type healthTransport struct {
+	next http.RoundTripper
+	rp   *ReverseProxy
+	rule *config.ProxyRule
+}
+
+func (t *healthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	// Canceled client requests say nothing about the backend
+	if err != nil && req.Context().Err() != nil {
+		return resp, err
+	}
+	t.rp.recordBackend(t.rule, err)
+	return resp, err
+}
+
+// SetEvents publishes backends going down and coming back to bus.
+func (rp *ReverseProxy) SetEvents(bus *events.Bus) {
+	rp.events = bus
+}
+
+// recordBackend counts a request to, or probe of, the rule's target, ejects
+// the target after too many consecutive failures, and publishes an event
+// when it goes down or comes back.
+func (rp *ReverseProxy) recordBackend(rule *config.ProxyRule, err error) {
+	state := rp.health.state(rule)
+	now := time.Now()
+
+	rp.health.mu.Lock()
+	wasDown, known := state.down, state.checked
+	state.checked = true
+	state.down = err != nil
+	ejected := false
+	if err != nil {
+		state.failures++
+		state.lastError = err.Error()
+		state.lastFailure = now
+		if maxFails := rule.HealthCheck.MaxFails; maxFails > 0 && state.failures >= maxFails && !now.Before(state.ejectedUntil) {
+			ejectTime := defaultEjectTime
+			if rule.HealthCheck.EjectTime > 0 {
+				ejectTime = time.Duration(rule.HealthCheck.EjectTime) * time.Second
+			}
+			state.ejectedUntil = now.Add(ejectTime)
+			ejected = true
+		}
+	} else {
+		state.failures = 0
+		state.lastSuccess = now
+		state.ejectedUntil = time.Time{}
+	}
+	rp.health.mu.Unlock()
+
+	host := rule.Target
+	if target, parseErr := url.Parse(rule.Target); parseErr == nil && target.Host != "" {
+		host = target.Host
+	}
+	switch {
+	case err != nil && (!wasDown || !known || ejected):
+		message := fmt.Sprintf("Backend %s of %s is failing: %v", host, rule.Domain, err)
+		if ejected {
+			message = fmt.Sprintf("Backend %s of %s is ejected after %d consecutive failures: %v", host, rule.Domain, rule.HealthCheck.MaxFails, err)
+		}
+		rp.events.Publish(events.Event{
+			Type:    events.BackendDown,
+			Domain:  rule.Domain,
+			Message: message,
+			Data:    map[string]any{"backend": host, "ejected": ejected},
+		})
+	case err == nil && wasDown:
+		rp.events.Publish(events.Event{
+			Type:    events.BackendUp,
+			Domain:  rule.Domain,
+			Message: fmt.Sprintf("Backend %s of %s is responding again", host, rule.Domain),
+			Data:    map[string]any{"backend": host},
+		})
+	}
+}
+
+// ejected reports whether the rule's target is ejected, and until when.
+func (rp *ReverseProxy) ejected(rule *config.ProxyRule) (time.Time, bool) {
+	state := rp.health.state(rule)
+	rp.health.mu.Lock()
+	defer rp.health.mu.Unlock()
+	return state.ejectedUntil, time.Now().Before(state.ejectedUntil)
+}
+
+// Upstreams returns the health and circuit state of the target of every
+// proxy rule, sorted by domain. Passthrough rules aren't tracked.
+func (rp *ReverseProxy) Upstreams() []UpstreamStatus {
+	now := time.Now()
+	var upstreams []UpstreamStatus
+	for _, rule := range rp.config.Snapshot().Proxy.Rules {
+		if rule.Passthrough {
+			continue
+		}
+		state := rp.health.state(&rule)
+
+		rp.health.mu.Lock()
+		status := UpstreamStatus{
+			Domain:              rule.Domain,
+			Target:              rule.Target,
+			Status:              UpstreamUnknown,
+			Healthy:             !state.down,
+			ConsecutiveFailures: state.failures,
+			LastError:           state.lastError,
+			Ejected:             now.Before(state.ejectedUntil),
+			InFlight:            state.inFlight.Load(),
+			HealthCheck:         rule.HealthCheck.Path != "",
+		}
+		switch {
+		case status.Ejected:
+			status.Status = UpstreamEjected
+			until := state.ejectedUntil
+			status.EjectedUntil = &until
+		case state.down:
+			status.Status = UpstreamUnhealthy
+		case state.checked:
+			status.Status = UpstreamHealthy
+		}
+		if !state.lastSuccess.IsZero() {
+			success := state.lastSuccess
+			status.LastSuccess = &success
+		}
+		if !state.lastFailure.IsZero() {
+			failure := state.lastFailure
+			status.LastFailure = &failure
+		}
+		if state.probe != nil {
+			probe := *state.probe
+			status.LastProbe = &probe
+		}
+		rp.health.mu.Unlock()
+
+		upstreams = append(upstreams, status)
+	}
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Domain < upstreams[j].Domain })
+	return upstreams
+}
+
+// ProbeBackends probes the targets of rules with a health check path until
+// ctx is done.
+func (rp *ReverseProxy) ProbeBackends(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, rule := range rp.config.Snapshot().Proxy.Rules {
+				if rule.Passthrough || rule.HealthCheck.Path == "" {
+					continue
+				}
+				state := rp.health.state(&rule)
+
+				rp.health.mu.Lock()
+				due := !state.probing && !now.Before(state.nextProbe)
+				if due {
+					state.probing = true
+				}
+				rp.health.mu.Unlock()
+
+				if due {
+					go rp.probe(ctx, rule, state)
+				}
+			}
+		}
+	}
+}
+
+// probe sends a health check request to the rule's target. Redirects count
+// as healthy, as do other statuses below 500 except 429.
+func (rp *ReverseProxy) probe(ctx context.Context, rule config.ProxyRule, state *upstreamState) {
+	interval := defaultProbeInterval
+	if rule.HealthCheck.Interval > 0 {
+		interval = time.Duration(rule.HealthCheck.Interval) * time.Second
+	}
+	timeout := defaultProbeTimeout
+	if rule.HealthCheck.Timeout > 0 {
+		timeout = time.Duration(rule.HealthCheck.Timeout) * time.Second
+	}
+
+	start := time.Now()
+	result := &ProbeResult{Time: start}
+	err := func() error {
+		target, err := url.Parse(rule.Target)
+		if err != nil {
+			return err
+		}
+		probeURL := target.JoinPath(rule.HealthCheck.Path)
+		probeURL.RawQuery = ""
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "Saddy-HealthCheck")
+		req.Header.Set("X-Forwarded-Host", rule.Domain)
+
+		resp, err := rp.upstreamTransport(&rule).RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close() //nolint:errcheck
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	}()
+	result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	result.Healthy = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	// Shutting down isn't a failure of the backend
+	if ctx.Err() != nil {
+		return
+	}
+	rp.recordBackend(&rule, err)
+
+	rp.health.mu.Lock()
+	state.probe = result
+	state.probing = false
+	state.nextProbe = start.Add(interval)
+	rp.health.mu.Unlock()
+}
+
+// PruneUpstreams forgets the health of targets whose rule no longer exists,
+// so a rule added again later starts over.
+func (rp *ReverseProxy) PruneUpstreams() {
+	domains := make(map[string]bool)
+	for _, rule := range rp.config.Snapshot().Proxy.Rules {
+		domains[rule.Domain] = true
+	}
+
+	rp.health.mu.Lock()
+	defer rp.health.mu.Unlock()
+	for domain := range rp.health.upstreams {
+		if !domains[domain] {
+			delete(rp.health.upstreams, domain)
+		}
+	}
+}
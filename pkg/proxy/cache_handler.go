@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// surrogateKeyHeader lists the space separated tags a backend assigns to a
+// response, used for tag-based purging.
+const surrogateKeyHeader = "Surrogate-Key"
+
+// surrogateControlHeader carries caching directives aimed at the proxy only.
+const surrogateControlHeader = "Surrogate-Control"
+
+// isSurrogateHeader reports whether a response header is meant for the cache
+// and must not reach clients.
+func isSurrogateHeader(key string) bool {
+	return key == surrogateKeyHeader || key == surrogateControlHeader
+}
+
+// stripSurrogateHeaders removes cache-only headers from responses that are
+// proxied straight to the client.
+func stripSurrogateHeaders(resp *http.Response) error {
+	resp.Header.Del(surrogateKeyHeader)
+	resp.Header.Del(surrogateControlHeader)
+	return nil
+}
+
+// coalescedFetchTimeout bounds a fetch that other requests wait for, since it
+// goes on when the client that started it leaves.
+const coalescedFetchTimeout = 5 * time.Minute
+
+// fetchAndCache fetches a cache miss from the backend and stores the result.
+//
+// Concurrent misses for the same key are coalesced behind a cache lock so that
+// only one request reaches the backend; waiters are answered from the shared
+// response, or as the rule's lock settings allow. The fetch doesn't stop when
+// the client that started it disconnects, so the waiters still get it. When the backend is
+// unreachable or returns a 5xx status, a stale copy is served instead if one
+// is available. Responses are only stored once the rule's admission policy
+// lets the key in.
+func (rp *ReverseProxy) fetchAndCache(c *gin.Context, proxy *httputil.ReverseProxy, rule *config.ProxyRule, cacheKey string, stale *cache.CacheItem) {
+	if c.Writer.Header().Get("X-Cache") == "" {
+		c.Header("X-Cache", cache.OutcomeMiss)
+	}
+
+	lock := newCacheLock()
+	if held, busy := rp.locks.LoadOrStore(cacheKey, lock); busy {
+		rp.awaitLock(c, proxy, rule, cacheKey, stale, held.(*cacheLock)) //nolint:errcheck
+		return
+	}
+
+	var maxObjectSize int64
+	if rule.Cache.MaxObjectSize != "" {
+		if size, err := cache.ParseSize(rule.Cache.MaxObjectSize); err == nil {
+			maxObjectSize = size
+		}
+	}
+
+	// Objects that aren't requested often enough are fetched but not stored
+	admitted := rp.admission.admit(cacheKey, rule.Cache.Admission, time.Now())
+
+	buffer := newBufferedResponse()
+	if maxObjectSize > 0 {
+		// Oversized responses are streamed to this client instead of buffered
+		buffer.limit = maxObjectSize
+		buffer.passthrough = c.Writer
+	}
+	func() {
+		// Waiters must never be left hanging, even if the fetch panics
+		defer func() {
+			if r := recover(); r != nil {
+				buffer.err = errFetchAborted
+				rp.unlock(cacheKey, lock, buffer)
+				panic(r)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), coalescedFetchTimeout)
+		defer cancel()
+		proxy.ServeHTTP(buffer, c.Request.WithContext(ctx))
+	}()
+	// Keep the stale copy rather than replacing it with an error
+	if admitted && buffer.err == nil && !buffer.streaming && (stale == nil || buffer.statusCode < 500) {
+		rp.storeResponse(cacheKey, c.Request.URL.Path, rule, buffer)
+	}
+	rp.unlock(cacheKey, lock, buffer)
+
+	rp.writeFetched(c, proxy, cacheKey, stale, buffer)
+}
+
+// writeFetched answers a request with a response fetched for cacheKey, or
+// with the stale copy if the backend failed.
+func (rp *ReverseProxy) writeFetched(c *gin.Context, proxy *httputil.ReverseProxy, cacheKey string, stale *cache.CacheItem, buffer *bufferedResponse) {
+	if buffer.streaming {
+		// Already delivered to the client that fetched it; waiters fetch on their own
+		if buffer.passthrough != http.ResponseWriter(c.Writer) {
+			rp.passThrough(c, proxy)
+		}
+		return
+	}
+
+	if stale != nil && (buffer.err != nil || buffer.statusCode >= 500) {
+		c.Header("Warning", `111 - "Revalidation Failed"`)
+		rp.serveCachedItem(c, stale, cacheKey, cache.OutcomeStale)
+		return
+	}
+
+	if buffer.err != nil {
+		c.JSON(502, gin.H{"error": "Bad Gateway: " + buffer.err.Error()})
+		return
+	}
+
+	buffer.writeTo(c.Writer)
+}
+
+// passThrough proxies a request straight to the backend without caching.
+func (rp *ReverseProxy) passThrough(c *gin.Context, proxy *httputil.ReverseProxy) {
+	proxy.ModifyResponse = stripSurrogateHeaders
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// refreshAhead starts a background refresh of a popular entry that is about
+// to expire. At most one refresh per key runs at a time.
+func (rp *ReverseProxy) refreshAhead(c *gin.Context, rule *config.ProxyRule, item *cache.CacheItem, cacheKey string) {
+	refresh := rule.Cache.RefreshAhead
+	if refresh.MinHits <= 0 || item.ExpiresAt.IsZero() || item.Hits < int64(refresh.MinHits) {
+		return
+	}
+
+	window := time.Duration(refresh.Window) * time.Second
+	if window <= 0 {
+		window = item.ExpiresAt.Sub(item.CreatedAt) / 10
+	}
+	if time.Until(item.ExpiresAt) > window {
+		return
+	}
+
+	targetURL, err := url.Parse(rule.Target)
+	if err != nil {
+		return
+	}
+	if _, busy := rp.refreshing.LoadOrStore(cacheKey, struct{}{}); busy {
+		return
+	}
+
+	req := c.Request.Clone(context.Background())
+	proxy := rp.newUpstreamProxy(rule, targetURL, req.Host, c.ClientIP())
+
+	go func() {
+		defer rp.refreshing.Delete(cacheKey)
+
+		buffer := newBufferedResponse()
+		proxy.ServeHTTP(buffer, req)
+		if buffer.err != nil || buffer.statusCode >= 500 {
+			log.Printf("Background refresh of %s failed: status=%d err=%v", cacheKey, buffer.statusCode, buffer.err)
+			return
+		}
+		rp.storeResponse(cacheKey, req.URL.Path, rule, buffer)
+	}()
+}
+
+// serveCachedItem writes a cached item to the client with cache status, age
+// and hit count headers.
+func (rp *ReverseProxy) serveCachedItem(c *gin.Context, item *cache.CacheItem, cacheKey, status string) {
+	// Restore headers
+	for key, value := range item.Headers {
+		if key == hstsHeader && c.Writer.Header().Get(hstsHeader) != "" {
+			continue
+		}
+		c.Header(key, value)
+	}
+	c.Header("X-Cache", status)
+	c.Header("X-Cache-Key", cacheKey)
+
+	// Age covers the time spent in this cache plus any age reported upstream
+	age := int64(time.Since(item.CreatedAt).Seconds())
+	if age < 0 {
+		age = 0
+	}
+	c.Header("X-Cache-Age", strconv.FormatInt(age, 10))
+	if upstream, err := strconv.ParseInt(item.Headers["Age"], 10, 64); err == nil && upstream > 0 {
+		age += upstream
+	}
+	c.Header("Age", strconv.FormatInt(age, 10))
+	c.Header("X-Cache-Hits", strconv.FormatInt(item.Hits, 10))
+
+	// Get Content-Type from cached headers, or use default
+	contentType := item.Headers["Content-Type"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Data(item.StatusCode, contentType, item.Value)
+}
+
+// storeResponse caches an upstream response for the request path p if the
+// rule allows its status.
+func (rp *ReverseProxy) storeResponse(cacheKey, p string, rule *config.ProxyRule, response *bufferedResponse) {
+	statusCode := response.statusCode
+	headers := selectCacheHeaders(response.header)
+	body := response.body.Bytes()
+
+	ttl, ok := responseTTL(rule, p, statusCode, len(body))
+	// Shared-cache directives from the backend take precedence over the rule
+	if sharedTTL, found := sharedMaxAge(response.header); found && ok {
+		ttl, ok = sharedTTL, sharedTTL > 0
+	}
+	if !ok || !contentTypeCacheable(headers["Content-Type"], rule.Cache) {
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if ttl == 0 {
+		// Let the storage apply its default TTL
+		expiresAt = time.Time{}
+	}
+
+	// Expired copies are kept for backend failures and for requests waiting
+	// on the cache lock, whichever needs them longer
+	staleWindow := max(rule.Cache.StaleIfError, rule.Cache.Lock.MaxStale)
+	var staleUntil time.Time
+	if staleWindow > 0 && !expiresAt.IsZero() && statusCode == http.StatusOK {
+		staleUntil = expiresAt.Add(time.Duration(staleWindow) * time.Second)
+	}
+
+	// Apply the rule's quota on every store so configuration changes take effect
+	var quota int64
+	if rule.Cache.MaxSize != "" {
+		if size, err := cache.ParseSize(rule.Cache.MaxSize); err == nil {
+			quota = size
+		}
+	}
+	rp.cache.SetDomainQuota(rule.Domain, quota)
+
+	rp.cache.SetEntry(&cache.CacheItem{
+		Key:        cacheKey,
+		Value:      body,
+		Headers:    headers,
+		StatusCode: statusCode,
+		ExpiresAt:  expiresAt,
+		StaleUntil: staleUntil,
+		Tags:       strings.Fields(response.header.Get(surrogateKeyHeader)),
+	})
+}
+
+// responseTTL returns how long a response with the given status for path p may
+// be cached, and whether it may be cached at all.
+func responseTTL(rule *config.ProxyRule, p string, statusCode int, bodySize int) (time.Duration, bool) {
+	if ttl, ok := rule.Cache.StatusTTL[statusCode]; ok {
+		return time.Duration(ttl) * time.Second, ttl > 0
+	}
+
+	negativeTTL := time.Duration(rule.Cache.NegativeTTL) * time.Second
+
+	switch {
+	case statusCode == http.StatusOK:
+		ttl := rule.Cache.TTL
+		if override, ok := pathTTL(p, rule.Cache); ok {
+			ttl = override
+		}
+		// Empty successful bodies are usually a backend hiccup, don't pin them
+		return time.Duration(ttl) * time.Second, bodySize > 0
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return negativeTTL, negativeTTL > 0
+	case statusCode >= 500:
+		return negativeTTL, negativeTTL > 0 && rule.Cache.CacheErrors
+	default:
+		return 0, false
+	}
+}
+
+// selectCacheHeaders extracts the response headers worth replaying from cache.
+func selectCacheHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range header {
+		if len(values) > 0 {
+			// Save important headers like Content-Type, Content-Encoding, etc.
+			switch key {
+			case "Content-Type", "Content-Encoding", "Content-Language", "Cache-Control", "Content-Disposition", "ETag",
+				"Location", "Content-Range", "Last-Modified", "Age":
+				headers[key] = values[0]
+			}
+		}
+	}
+	return headers
+}
+
+// bufferedResponse records an upstream response without sending it to the client.
+// Once complete it is read-only and may be replayed to several clients.
+//
+// When a limit is set and the response grows beyond it, the response switches
+// to streaming: everything recorded so far and all further writes go to the
+// passthrough writer and nothing is kept in memory.
+type bufferedResponse struct {
+	header     http.Header
+	body       bytes.Buffer
+	statusCode int
+	err        error // Transport error reported by the proxy, if any
+
+	limit       int64
+	passthrough http.ResponseWriter
+	streaming   bool
+	wroteHeader bool
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), statusCode: 200}
+}
+
+// shared reports whether the response may be replayed to clients other than
+// the one it was fetched for. A Set-Cookie header belongs to that client,
+// e.g. its session.
+func (br *bufferedResponse) shared() bool {
+	return br.header.Get("Set-Cookie") == ""
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	if !br.wroteHeader {
+		br.WriteHeader(http.StatusOK)
+	}
+	if br.streaming {
+		return br.passthrough.Write(b)
+	}
+	if br.limit > 0 && int64(br.body.Len()+len(b)) > br.limit {
+		if err := br.startStreaming(); err != nil {
+			return 0, err
+		}
+		return br.passthrough.Write(b)
+	}
+	return br.body.Write(b)
+}
+
+func (br *bufferedResponse) WriteHeader(statusCode int) {
+	if br.wroteHeader {
+		return
+	}
+	br.wroteHeader = true
+	br.statusCode = statusCode
+
+	// Skip buffering entirely when the backend announces an oversized body
+	if br.limit > 0 {
+		if length, err := strconv.ParseInt(br.header.Get("Content-Length"), 10, 64); err == nil && length > br.limit {
+			_ = br.startStreaming() //nolint:errcheck
+		}
+	}
+}
+
+// Flush forwards flushes once the response is being streamed.
+func (br *bufferedResponse) Flush() {
+	if br.streaming {
+		if flusher, ok := br.passthrough.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// startStreaming sends the headers and any buffered body to the passthrough writer.
+func (br *bufferedResponse) startStreaming() error {
+	br.streaming = true
+	for key, values := range br.header {
+		if isSurrogateHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			br.passthrough.Header().Add(key, value)
+		}
+	}
+	br.passthrough.WriteHeader(br.statusCode)
+
+	buffered := br.body.Bytes()
+	br.body = bytes.Buffer{}
+	if len(buffered) > 0 {
+		if _, err := br.passthrough.Write(buffered); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTo relays the recorded response to a client.
+func (br *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range br.header {
+		// Surrogate headers are meant for the cache only
+		if isSurrogateHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(br.statusCode)
+	_, _ = w.Write(br.body.Bytes()) //nolint:errcheck
+}
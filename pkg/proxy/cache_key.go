@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"saddy/pkg/config"
+)
+
+// generateCacheKey builds the cache key for a request as
+// "domain:METHOD:path?query", followed by the requested range, the content
+// coding variant and any headers and cookies the rule includes in the key.
+// The request's Accept-Encoding must already be normalized.
+func generateCacheKey(req *http.Request, rule *config.ProxyRule) string {
+	keyRule := rule.Cache.Key
+	baseKey := urlCacheKey(req.Method, req.URL, rule)
+
+	// Partial content must never be served for a different range
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		baseKey = baseKey + "#range=" + rangeHeader
+	}
+
+	var key strings.Builder
+	key.WriteString(baseKey)
+
+	// Compressed and identity responses are separate variants
+	if encoding := req.Header.Get("Accept-Encoding"); encoding != "" {
+		fmt.Fprintf(&key, "|ae=%s", encoding)
+	}
+
+	for _, name := range keyRule.Headers {
+		fmt.Fprintf(&key, "|h:%s=%s", strings.ToLower(name), req.Header.Get(name))
+	}
+	for _, name := range keyRule.Cookies {
+		value := ""
+		if cookie, err := req.Cookie(name); err == nil {
+			value = cookie.Value
+		}
+		fmt.Fprintf(&key, "|c:%s=%s", name, value)
+	}
+
+	return key.String()
+}
+
+// urlCacheKey builds the variant-independent part of a cache key.
+func urlCacheKey(method string, u *url.URL, rule *config.ProxyRule) string {
+	keyRule := rule.Cache.Key
+
+	// Include query string to differentiate requests like /image?id=1 and /image?id=2
+	keyPath := normalizeKeyPath(u.Path, keyRule)
+	if query := normalizeQuery(u.RawQuery, keyRule); query != "" {
+		keyPath = keyPath + "?" + query
+	}
+
+	return fmt.Sprintf("%s:%s:%s", rule.Domain, method, keyPath)
+}
+
+// normalizeKeyPath applies the rule's path normalization options.
+func normalizeKeyPath(p string, keyRule config.CacheKeyRule) string {
+	if keyRule.NormalizePath && p != "" {
+		cleaned := path.Clean(p)
+		// path.Clean drops the trailing slash, which is significant for most origins
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		p = cleaned
+	}
+	if keyRule.LowercasePath {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// trackingParams are query parameters added by analytics and ad platforms
+// that never affect the response content.
+var trackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "_ga", "yclid", "igshid",
+}
+
+// normalizeQuery removes ignored parameters from a raw query string and
+// optionally sorts the remaining ones. Without sorting the original parameter
+// order is preserved.
+func normalizeQuery(rawQuery string, keyRule config.CacheKeyRule) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	ignore := keyRule.IgnoreQuery
+	if keyRule.StripTracking {
+		ignore = append(append([]string{}, ignore...), trackingParams...)
+	}
+	if len(ignore) == 0 && !keyRule.SortQuery {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		name := paramName(param)
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !matchesParam(ignore, name) {
+			kept = append(kept, param)
+		}
+	}
+
+	if keyRule.SortQuery {
+		// Stable so repeated parameters keep their relative order
+		sort.SliceStable(kept, func(i, j int) bool {
+			return paramName(kept[i]) < paramName(kept[j])
+		})
+	}
+	return strings.Join(kept, "&")
+}
+
+func paramName(param string) string {
+	if i := strings.Index(param, "="); i >= 0 {
+		return param[:i]
+	}
+	return param
+}
+
+// matchesParam reports whether name matches one of the patterns, where a
+// trailing "*" matches any suffix.
+func matchesParam(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
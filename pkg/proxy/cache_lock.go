@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"net/http/httputil"
+	"time"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errFetchAborted is reported to waiters when the request holding the lock
+// panicked before its response was complete.
+var errFetchAborted = errors.New("upstream fetch aborted")
+
+// cacheLock is held by the request fetching a missing or expired entry.
+// Concurrent requests for the same key wait for it to be released and share
+// the fetched response.
+type cacheLock struct {
+	done   chan struct{}
+	buffer *bufferedResponse
+}
+
+func newCacheLock() *cacheLock {
+	return &cacheLock{done: make(chan struct{})}
+}
+
+// unlock publishes the fetched response to waiters and frees the key for the
+// next miss.
+func (rp *ReverseProxy) unlock(cacheKey string, lock *cacheLock, buffer *bufferedResponse) {
+	lock.buffer = buffer
+	close(lock.done)
+	rp.locks.Delete(cacheKey)
+}
+
+// awaitLock answers a request whose key is already being fetched by another
+// request.
+//
+// With max_stale set, an expired copy is served right away instead of waiting.
+// Otherwise the request waits for the fetch to finish; if the rule's timeout
+// passes first it gets the stale copy, or goes to the backend on its own
+// without touching the cache.
+func (rp *ReverseProxy) awaitLock(c *gin.Context, proxy *httputil.ReverseProxy, rule *config.ProxyRule, cacheKey string, stale *cache.CacheItem, lock *cacheLock) {
+	settings := rule.Cache.Lock
+	if stale != nil && settings.MaxStale > 0 {
+		c.Header("Warning", `110 - "Response is Stale"`)
+		rp.serveCachedItem(c, stale, cacheKey, cache.OutcomeStale)
+		return
+	}
+
+	var timeout <-chan time.Time
+	if settings.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(settings.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-lock.done:
+		if lock.buffer.err == nil && !lock.buffer.shared() {
+			// The response set cookies for the client that fetched it
+			rp.passThrough(c, proxy)
+			return
+		}
+		rp.writeFetched(c, proxy, cacheKey, stale, lock.buffer)
+	case <-timeout:
+		if stale != nil {
+			c.Header("Warning", `110 - "Response is Stale"`)
+			rp.serveCachedItem(c, stale, cacheKey, cache.OutcomeStale)
+			return
+		}
+		rp.passThrough(c, proxy)
+	case <-c.Request.Context().Done():
+		// Client went away, nothing left to answer
+	}
+}
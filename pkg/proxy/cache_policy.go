@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"saddy/pkg/config"
+)
+
+// cacheBypass describes how a request interacts with the cache.
+type cacheBypass int
+
+const (
+	// bypassNone serves from cache when possible.
+	bypassNone cacheBypass = iota
+	// bypassRefresh skips the cache lookup but stores the fresh response.
+	bypassRefresh
+	// bypassPass skips the cache entirely.
+	bypassPass
+)
+
+// checkBypass evaluates the rule's bypass settings against a request from
+// clientIP, the address of the connection.
+func checkBypass(req *http.Request, clientIP string, bypass config.CacheBypassRule) cacheBypass {
+	for _, cookie := range req.Cookies() {
+		if matchesParam(bypass.Cookies, cookie.Name) {
+			return bypassPass
+		}
+	}
+
+	refresh := false
+	for _, name := range bypass.Headers {
+		if req.Header.Get(name) != "" {
+			refresh = true
+			break
+		}
+	}
+	if !refresh && bypass.HonorNoCache {
+		refresh = strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache") ||
+			strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")
+	}
+
+	if refresh && (len(bypass.AllowedIPs) == 0 || IPAllowed(clientIP, bypass.AllowedIPs)) {
+		return bypassRefresh
+	}
+	return bypassNone
+}
+
+// IPAllowed reports whether ip matches one of the addresses or CIDR ranges.
+func IPAllowed(ip string, allowed []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, entry := range allowed {
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(parsed) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && other.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathCacheable reports whether the rule allows caching requests for p.
+func pathCacheable(p string, rule config.CacheRule) bool {
+	if matchesPath(rule.ExcludePaths, p) {
+		return false
+	}
+	if ttl, ok := pathTTL(p, rule); ok && ttl == 0 {
+		return false
+	}
+	return len(rule.Paths) == 0 || matchesPath(rule.Paths, p)
+}
+
+// pathTTL returns the TTL in seconds of the first PathTTL entry matching p.
+func pathTTL(p string, rule config.CacheRule) (int, bool) {
+	for _, override := range rule.PathTTL {
+		if matchesPath([]string{override.Path}, p) {
+			return override.TTL, true
+		}
+	}
+	return 0, false
+}
+
+// contentTypeCacheable reports whether the rule allows caching a response with the given Content-Type.
+func contentTypeCacheable(contentType string, rule config.CacheRule) bool {
+	if len(rule.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return matchesParam(rule.ContentTypes, mediaType)
+}
+
+// matchesPath reports whether p matches one of the glob patterns. A trailing
+// "*" matches any suffix including further path segments.
+func matchesPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+			if strings.HasPrefix(p, prefix) {
+				return true
+			}
+		} else if matched, err := path.Match(pattern, p); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedMaxAge returns the lifetime a backend grants shared caches, taken from
+// Surrogate-Control max-age or, failing that, Cache-Control s-maxage. Plain
+// max-age addresses browsers and is left to the rule TTL. A zero duration with
+// found set means the backend forbids storing the response.
+func sharedMaxAge(header http.Header) (ttl time.Duration, found bool) {
+	if value := header.Get(surrogateControlHeader); value != "" {
+		if hasDirective(value, "no-store") {
+			return 0, true
+		}
+		if seconds, ok := directiveSeconds(value, "max-age"); ok {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if seconds, ok := directiveSeconds(header.Get("Cache-Control"), "s-maxage"); ok {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// hasDirective reports whether a comma separated directive list contains name.
+func hasDirective(value, name string) bool {
+	for _, directive := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// directiveSeconds returns the delta-seconds value of a directive such as
+// "max-age=60". Surrogate-Control extensions like "max-age=60+30" keep only
+// the leading lifetime.
+func directiveSeconds(value, name string) (int, bool) {
+	for _, directive := range strings.Split(value, ",") {
+		key, arg, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), name) {
+			continue
+		}
+		arg = strings.Trim(strings.TrimSpace(arg), `"`)
+		arg, _, _ = strings.Cut(arg, "+")
+		if seconds, err := strconv.Atoi(arg); err == nil && seconds >= 0 {
+			return seconds, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"saddy/pkg/config"
+)
+
+// Headers describing the verified client certificate to the upstream. They
+// are always removed from incoming requests so clients can't forge them.
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertIssuerHeader      = "X-Client-Cert-Issuer"
+	clientCertSANHeader         = "X-Client-Cert-SAN"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+var clientCertHeaders = []string{
+	clientCertSubjectHeader,
+	clientCertIssuerHeader,
+	clientCertSANHeader,
+	clientCertFingerprintHeader,
+}
+
+// clientCertRequired reports whether the rule's domain only accepts clients
+// with a verified certificate. The handshake enforces this for the domain's
+// own server name; checking requests too stops clients from reaching it with
+// the Host header over a connection made to another domain.
+func (rp *ReverseProxy) clientCertRequired(rule *config.ProxyRule) bool {
+	mode := rp.config.Snapshot().Server.TLS.Policy.ClientAuth
+	if rule.SSL.Policy != nil && rule.SSL.Policy.ClientAuth != "" {
+		mode = rule.SSL.Policy.ClientAuth
+	}
+	return mode == "require"
+}
+
+// hasVerifiedClientCert reports whether the connection presented a client
+// certificate that chains to a trusted client CA.
+func hasVerifiedClientCert(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// setClientCertHeaders replaces the client certificate headers of an upstream
+// request with the details of the verified certificate, if any.
+func setClientCertHeaders(req *http.Request) {
+	for _, header := range clientCertHeaders {
+		req.Header.Del(header)
+	}
+	if !hasVerifiedClientCert(req.TLS) {
+		return
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	req.Header.Set(clientCertSubjectHeader, cert.Subject.String())
+	req.Header.Set(clientCertIssuerHeader, cert.Issuer.String())
+	if len(names) > 0 {
+		req.Header.Set(clientCertSANHeader, strings.Join(names, ","))
+	}
+	req.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// variantEncodings are the content codings cached as separate variants, in
+// order of preference when a client accepts several equally.
+var variantEncodings = []string{"br", "gzip"}
+
+// negotiateEncoding returns the preferred variant coding accepted by an
+// Accept-Encoding header, or "" when the client only gets identity.
+func negotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = parsed
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+		} else if name != "" {
+			weights[name] = weight
+		}
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range variantEncodings {
+		weight, listed := weights[encoding]
+		if !listed {
+			weight = wildcard
+		}
+		if weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// normalizeAcceptEncoding replaces the request's Accept-Encoding with the
+// single negotiated coding, so the backend answers with exactly the variant
+// the response is cached under.
+func normalizeAcceptEncoding(req *http.Request) {
+	if encoding := negotiateEncoding(req.Header.Get("Accept-Encoding")); encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	} else {
+		req.Header.Del("Accept-Encoding")
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"saddy/pkg/config"
+)
+
+const (
+	// clientHelloTimeout bounds how long a new connection may take to send
+	// its ClientHello.
+	clientHelloTimeout     = 10 * time.Second
+	passthroughDialTimeout = 10 * time.Second
+)
+
+var errClientHelloRead = errors.New("client hello read")
+
+// passthroughListener routes TLS connections by their server name (SNI).
+// Connections for rules with passthrough enabled are forwarded as they are to
+// the rule's target, which terminates TLS itself; all others are returned by
+// Accept for the HTTPS server.
+type passthroughListener struct {
+	net.Listener
+	config *config.Config
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPassthroughListener wraps the HTTPS listener so that connections to
+// passthrough rules bypass TLS termination.
+func NewPassthroughListener(inner net.Listener, cfg *config.Config) net.Listener {
+	l := &passthroughListener{
+		Listener: inner,
+		config:   cfg,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		go l.route(conn)
+	}
+}
+
+// Accept returns the next connection that is not passed through.
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (l *passthroughListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// route reads the ClientHello of conn and either forwards the connection or
+// hands it to the HTTPS server, replaying the bytes already read.
+func (l *passthroughListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)) //nolint:errcheck
+	serverName, hello := peekServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	replayed := &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(hello), conn)}
+	if serverName != "" {
+		if rule := l.config.GetProxyRule(serverName); rule != nil && rule.Passthrough {
+			forwardTLS(replayed, conn, serverName, rule.Target)
+			return
+		}
+	}
+
+	select {
+	case l.conns <- replayed:
+	case <-l.done:
+		_ = conn.Close() //nolint:errcheck
+	}
+}
+
+// peekServerName reads the ClientHello from r and returns its server name
+// together with all bytes consumed, so they can be replayed.
+func peekServerName(r io.Reader) (string, []byte) {
+	var read bytes.Buffer
+	var serverName string
+	_ = tls.Server(helloConn{reader: io.TeeReader(r, &read)}, &tls.Config{ //nolint:errcheck
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(hello.ServerName)
+			// Stop before anything is written back to the client
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName, read.Bytes()
+}
+
+// forwardTLS copies a passed through connection to and from target until both
+// sides are done. raw is the client's underlying connection.
+func forwardTLS(client io.ReadWriteCloser, raw net.Conn, serverName, target string) {
+	defer func() { _ = client.Close() }() //nolint:errcheck
+
+	backend, err := net.DialTimeout("tcp", passthroughAddress(target), passthroughDialTimeout)
+	if err != nil {
+		log.Printf("Warning: TLS passthrough for %s to %s failed: %v", serverName, target, err)
+		return
+	}
+	defer func() { _ = backend.Close() }() //nolint:errcheck
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(backend, client) //nolint:errcheck
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, backend) //nolint:errcheck
+		closeWrite(raw)
+	}()
+	wg.Wait()
+}
+
+// passthroughAddress returns the host:port of a passthrough target, which
+// defaults to port 443.
+func passthroughAddress(target string) string {
+	target = strings.TrimPrefix(target, "tcp://")
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return net.JoinHostPort(target, "443")
+	}
+	return target
+}
+
+// closeWrite signals the end of one direction while the other may still
+// carry data.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite() //nolint:errcheck
+	}
+}
+
+// replayConn is a connection whose first bytes have already been read and
+// are served again from reader.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// helloConn feeds a ClientHello to crypto/tls without writing anything back.
+type helloConn struct {
+	reader io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)       { return c.reader.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                     { return nil }
+func (c helloConn) LocalAddr() net.Addr              { return nil }
+func (c helloConn) RemoteAddr() net.Addr             { return nil }
+func (c helloConn) SetDeadline(time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// methodPurge is the non-standard method used by CDN purge tooling.
+const methodPurge = "PURGE"
+
+// handlePurge invalidates the cache entries for the requested URL, including
+// all range and header/cookie variants. Sending "X-Soft-Purge: 1" marks them
+// stale instead of deleting them.
+func (rp *ReverseProxy) handlePurge(c *gin.Context, rule *config.ProxyRule) {
+	purgeConfig := rp.config.Snapshot().Cache.Purge
+	if !purgeConfig.Enabled {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "PURGE is not enabled"})
+		return
+	}
+	if !purgeAuthorized(c, purgeConfig) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "PURGE not allowed"})
+		return
+	}
+
+	mode := cache.PurgeHard
+	if c.GetHeader("X-Soft-Purge") == "1" {
+		mode = cache.PurgeSoft
+	}
+
+	baseKey := urlCacheKey(http.MethodGet, c.Request.URL, rule)
+	purged := 0
+	for _, pattern := range []string{baseKey, baseKey + "#*", baseKey + "|*"} {
+		purged += rp.cache.Purge(pattern, mode)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"key":    baseKey,
+		"purged": purged,
+	})
+}
+
+// purgeAuthorized checks the purge token or the address of the connection.
+// X-Forwarded-For is not trusted, since any client could claim an allowed
+// address with it.
+func purgeAuthorized(c *gin.Context, purgeConfig config.PurgeConfig) bool {
+	if purgeConfig.Token != "" {
+		token := c.GetHeader("X-Purge-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(purgeConfig.Token)) == 1 {
+			return true
+		}
+	}
+
+	clientIP := c.RemoteIP()
+	if len(purgeConfig.AllowedIPs) > 0 {
+		return IPAllowed(clientIP, purgeConfig.AllowedIPs)
+	}
+
+	// Without explicit restrictions only local tooling may purge
+	ip := net.ParseIP(clientIP)
+	return purgeConfig.Token == "" && ip != nil && ip.IsLoopback()
+}
@@ -3,33 +3,60 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"saddy/pkg/cache"
 	"saddy/pkg/config"
+	"saddy/pkg/events"
+	"saddy/pkg/logs"
+	"saddy/pkg/metrics"
 
 	"github.com/gin-gonic/gin"
 )
 
+// hstsHeader is set from the rule's HSTS settings. Browsers only honor the
+// first one, so it takes precedence over one sent by the backend.
+const hstsHeader = "Strict-Transport-Security"
+
 // ReverseProxy manages reverse proxy routing and caching.
 type ReverseProxy struct {
 	config *config.Config
 	cache  cache.Storage
 	server *http.Server
 	engine *gin.Engine
+
+	// locks holds a *cacheLock per key whose miss is being fetched
+	locks sync.Map
+	// refreshing tracks keys with a background refresh in progress
+	refreshing sync.Map
+	// admission counts requests for objects not yet admitted to the cache
+	admission *admissionTracker
+	stats     *cache.StatsRecorder
+	traffic   *metrics.Recorder
+	// transports holds the upstream transports of pinned rules by their pins
+	transports sync.Map
+	health     backendHealth
+	events     *events.Bus
+	logs       *logs.Tail
 }
 
 // NewReverseProxy creates a new reverse proxy instance with the given configuration.
 func NewReverseProxy(cfg *config.Config, cacheStorage cache.Storage) *ReverseProxy {
 	proxy := &ReverseProxy{
-		config: cfg,
-		cache:  cacheStorage,
-		engine: gin.New(),
+		config:    cfg,
+		cache:     cacheStorage,
+		engine:    gin.New(),
+		admission: newAdmissionTracker(),
+		stats:     cache.NewStatsRecorder(),
+		traffic:   metrics.NewRecorder(),
 	}
 
 	proxy.setupRoutes()
@@ -67,6 +94,7 @@ func (rp *ReverseProxy) corsMiddleware() gin.HandlerFunc {
 }
 
 func (rp *ReverseProxy) handleProxy(c *gin.Context) {
+	start := time.Now()
 	host := c.Request.Host
 	// Remove port if present
 	if strings.Contains(host, ":") {
@@ -79,27 +107,83 @@ func (rp *ReverseProxy) handleProxy(c *gin.Context) {
 		c.JSON(404, gin.H{"error": "No proxy rule found for domain: " + host})
 		return
 	}
+	if rule.Passthrough {
+		// Only reachable with TLS connections made to the domain itself
+		c.JSON(http.StatusMisdirectedRequest, gin.H{"error": "Domain is served by TLS passthrough: " + host})
+		return
+	}
+
+	defer func() {
+		latency := time.Since(start)
+		rp.traffic.Record(rule.Domain, c.Writer.Status(), c.Writer.Size(), latency)
+		rp.logAccess(c, rule.Domain, latency)
+	}()
+
+	// HSTS is only honored, and only sent, over HTTPS
+	if c.Request.TLS != nil && rule.SSL.Enabled {
+		if hsts := rule.SSL.HSTS.Header(); hsts != "" {
+			c.Header(hstsHeader, hsts)
+		}
+	}
+
+	if rp.clientCertRequired(rule) && !hasVerifiedClientCert(c.Request.TLS) {
+		c.JSON(403, gin.H{"error": "Client certificate required"})
+		return
+	}
+
+	if c.Request.Method == methodPurge {
+		rp.handlePurge(c, rule)
+		return
+	}
+
+	defer func() {
+		rp.stats.Record(rule.Domain, c.Writer.Header().Get("X-Cache"), c.Writer.Size())
+	}()
 
 	// Check cache if enabled
-	if rule.Cache.Enabled && c.Request.Method == "GET" {
-		cacheKey := rp.generateCacheKey(c.Request, rule.Domain)
+	cacheable := rule.Cache.Enabled && c.Request.Method == "GET" && pathCacheable(c.Request.URL.Path, rule.Cache)
+	bypass := bypassNone
+	if cacheable {
+		bypass = checkBypass(c.Request, c.RemoteIP(), rule.Cache.Bypass)
+		if bypass != bypassNone {
+			c.Header("X-Cache", cache.OutcomeBypass)
+		}
+		// Passed-through requests neither read nor store cache entries
+		cacheable = bypass != bypassPass
+	}
+
+	var cacheKey string
+	var stale *cache.CacheItem
+	if cacheable {
+		normalizeAcceptEncoding(c.Request)
+		cacheKey = generateCacheKey(c.Request, rule)
+	}
+	if cacheable && bypass == bypassNone {
 		if cachedItem := rp.cache.GetItem(cacheKey); cachedItem != nil {
-			// Restore headers
-			for key, value := range cachedItem.Headers {
-				c.Header(key, value)
-			}
-			c.Header("X-Cache", "HIT")
-			c.Header("X-Cache-Key", cacheKey)
-
-			// Get Content-Type from cached headers, or use default
-			contentType := cachedItem.Headers["Content-Type"]
-			if contentType == "" {
-				contentType = "application/octet-stream"
-			}
-			c.Data(cachedItem.StatusCode, contentType, cachedItem.Value)
+			rp.refreshAhead(c, rule, cachedItem, cacheKey)
+			rp.serveCachedItem(c, cachedItem, cacheKey, cache.OutcomeHit)
+			return
+		}
+
+		// Remember an expired copy so it can be served if the backend fails;
+		// only entries with stale-if-error or soft purged ones qualify
+		stale = rp.cache.GetStale(cacheKey)
+	}
+
+	// Spare an ejected backend, serving the stale copy if there is one
+	if until, ejected := rp.ejected(rule); ejected {
+		if stale != nil {
+			c.Header("Warning", `111 - "Revalidation Failed"`)
+			rp.serveCachedItem(c, stale, cacheKey, cache.OutcomeStale)
 			return
 		}
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(until)/time.Second)+1))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service Unavailable: backend ejected after repeated failures"})
+		return
 	}
+	upstream := rp.health.state(rule)
+	upstream.inFlight.Add(1)
+	defer upstream.inFlight.Add(-1)
 
 	// Parse target URL
 	targetURL, err := url.Parse(rule.Target)
@@ -109,118 +193,87 @@ func (rp *ReverseProxy) handleProxy(c *gin.Context) {
 	}
 
 	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
-		c.JSON(502, gin.H{"error": "Bad Gateway: " + err.Error()})
-	}
+	proxy := rp.newUpstreamProxy(rule, targetURL, c.Request.Host, c.ClientIP())
 
 	// Modify request
 	c.Request.URL.Scheme = targetURL.Scheme
 	c.Request.URL.Host = targetURL.Host
 	c.Request.Host = targetURL.Host
 
-	// Custom director to add headers
-	proxy.Director = func(req *http.Request) {
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		req.Host = targetURL.Host
-		req.Header.Set("X-Forwarded-Host", c.Request.Host)
-		req.Header.Set("X-Forwarded-For", c.ClientIP())
-		req.Header.Set("X-Forwarded-Proto", "https")
-		req.Header.Set("X-Real-IP", c.ClientIP())
-	}
-
 	// Cache response if enabled
-	if rule.Cache.Enabled && c.Request.Method == "GET" {
-		rp.cacheResponse(c, proxy, rule)
+	if cacheable {
+		rp.fetchAndCache(c, proxy, rule, cacheKey, stale)
 	} else {
-		proxy.ServeHTTP(c.Writer, c.Request)
+		rp.passThrough(c, proxy)
 	}
 }
 
-func (rp *ReverseProxy) cacheResponse(c *gin.Context, proxy *httputil.ReverseProxy, rule *config.ProxyRule) {
-	// Intercept response
-	writer := &responseWriter{
-		ResponseWriter:  c.Writer,
-		body:            make([]byte, 0),
-		statusCode:      200,
-		headers:         make(map[string]string),
-		headersCaptured: false,
-	}
-
-	proxy.ServeHTTP(writer, c.Request)
+// acmeChallengePath prefixes the paths of ACME HTTP-01 challenge requests.
+const acmeChallengePath = "/.well-known/acme-challenge/"
 
-	// Cache successful responses
-	if writer.statusCode == 200 && len(writer.body) > 0 {
-		// Capture headers if not already done
-		if !writer.headersCaptured {
-			writer.captureHeaders()
+// UseChallengeHandler makes the proxy's listeners answer ACME HTTP-01
+// challenges through wrap, such as AutoTLS.HTTPChallengeHandler. Challenge
+// requests wrap passes on are routed to the proxy rules as usual.
+func (rp *ReverseProxy) UseChallengeHandler(wrap func(next http.Handler) http.Handler) {
+	rp.engine.Use(func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, acmeChallengePath) {
+			c.Next()
+			return
 		}
 
-		cacheKey := rp.generateCacheKey(c.Request, rule.Domain)
-		rp.cache.SetWithHeaders(
-			cacheKey,
-			writer.body,
-			writer.headers,
-			writer.statusCode,
-			time.Duration(rule.Cache.TTL)*time.Second,
-		)
-	}
-}
-
-func (rp *ReverseProxy) generateCacheKey(req *http.Request, domain string) string {
-	// Include query string to differentiate requests like /image?id=1 and /image?id=2
-	path := req.URL.Path
-	if req.URL.RawQuery != "" {
-		path = path + "?" + req.URL.RawQuery
-	}
-	return fmt.Sprintf("%s:%s:%s", domain, req.Method, path)
-}
-
-type responseWriter struct {
-	http.ResponseWriter
-	body            []byte
-	headers         map[string]string
-	statusCode      int
-	headersCaptured bool
+		passed := false
+		wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			passed = true
+		})).ServeHTTP(c.Writer, c.Request)
+		if !passed {
+			c.Abort()
+			return
+		}
+		c.Next()
+	})
 }
 
-func (rw *responseWriter) captureHeaders() {
-	if rw.headersCaptured {
-		return
-	}
-	// Capture important headers
-	for key, values := range rw.ResponseWriter.Header() {
-		if len(values) > 0 {
-			// Save important headers like Content-Type, Content-Encoding, etc.
-			switch key {
-			case "Content-Type", "Content-Encoding", "Content-Language", "Cache-Control", "Content-Disposition", "ETag":
-				rw.headers[key] = values[0]
-			}
+// newUpstreamProxy creates a reverse proxy to the rule's targetURL that
+// forwards the original client host and address.
+func (rp *ReverseProxy) newUpstreamProxy(rule *config.ProxyRule, targetURL *url.URL, clientHost, clientIP string) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = &healthTransport{next: rp.upstreamTransport(rule), rp: rp, rule: rule}
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		// Buffered fetches report the error to their caller instead
+		if buffer, ok := w.(*bufferedResponse); ok {
+			buffer.err = err
+			return
 		}
+		writeJSONError(w, http.StatusBadGateway, "Bad Gateway: "+err.Error())
 	}
-	rw.headersCaptured = true
-}
 
-func (rw *responseWriter) Write(b []byte) (int, error) {
-	// Capture headers before first write
-	if !rw.headersCaptured {
-		rw.captureHeaders()
+	// Custom director to add headers
+	proxy.Director = func(req *http.Request) {
+		req.URL.Scheme = targetURL.Scheme
+		req.URL.Host = targetURL.Host
+		req.Host = targetURL.Host
+		req.Header.Set("X-Forwarded-Host", clientHost)
+		req.Header.Set("X-Forwarded-For", clientIP)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Real-IP", clientIP)
+		setClientCertHeaders(req)
 	}
-	rw.body = append(rw.body, b...)
-	return rw.ResponseWriter.Write(b)
+
+	return proxy
 }
 
-func (rw *responseWriter) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
-	rw.captureHeaders()
-	rw.ResponseWriter.WriteHeader(statusCode)
+// writeJSONError writes a {"error": message} response outside of a gin handler.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(gin.H{"error": message}) //nolint:errcheck
 }
 
 // Start starts the reverse proxy server.
 func (rp *ReverseProxy) Start() error {
+	server := rp.config.Snapshot().Server
 	rp.server = &http.Server{
-		Addr:              fmt.Sprintf("%s:%d", rp.config.Server.Host, rp.config.Server.Port),
+		Addr:              fmt.Sprintf("%s:%d", server.Host, server.Port),
 		Handler:           rp.engine,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
@@ -228,6 +281,16 @@ func (rp *ReverseProxy) Start() error {
 	return rp.server.ListenAndServe()
 }
 
+// CacheStats returns the per-domain cache statistics recorder.
+func (rp *ReverseProxy) CacheStats() *cache.StatsRecorder {
+	return rp.stats
+}
+
+// Traffic returns the per-domain traffic recorder.
+func (rp *ReverseProxy) Traffic() *metrics.Recorder {
+	return rp.traffic
+}
+
 // GetEngine returns the underlying Gin engine for advanced configuration.
 func (rp *ReverseProxy) GetEngine() *gin.Engine {
 	return rp.engine
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// TestRequest describes a synthetic request sent through the proxy to see
+// how it is routed and cached.
+type TestRequest struct {
+	Method  string            `json:"method"`  // Default GET
+	Host    string            `json:"host"`    // Host header, a name the tested rule covers by default
+	Path    string            `json:"path"`    // Path and query, default "/"
+	Headers map[string]string `json:"headers"` // Sent as request headers
+	Body    string            `json:"body"`    // Sent as request body
+	MaxBody int               `json:"-"`       // Response body bytes kept, 0 keeps the whole body
+}
+
+// testRemoteAddr is the client address of test requests, from a range
+// reserved for documentation. It is neither loopback nor that of the admin
+// client, so allowed_ips settings don't let a test purge or refresh.
+const testRemoteAddr = "192.0.2.1:1"
+
+// TestResult describes how the proxy handled a TestRequest.
+type TestResult struct {
+	Host     string // Host the request was sent for
+	Rule     string // Domain of the matched rule, "" if none matched
+	Upstream string // Target of the matched rule
+	CacheKey string // Set for cacheable requests
+	Cache    string // X-Cache outcome: HIT, MISS, STALE, BYPASS...
+	Status   int
+	Headers  http.Header
+	Duration time.Duration
+	Body     []byte // Up to TestRequest.MaxBody bytes of the body
+	BodySize int    // Size of the whole body
+}
+
+// TestHost returns the host name a test of the rule for domain is sent for
+// by default: the domain itself, or a name its wildcard covers.
+func TestHost(domain string) string {
+	return strings.Replace(domain, "*", "saddy-test", 1)
+}
+
+// Test sends req through the proxy's routing and caching like a client
+// request and records what happened. Like a client request it reaches the
+// backend, is counted in the statistics and may fill the cache. Only an
+// invalid method or path, or PURGE, which belongs to the cache endpoints,
+// is returned as an error.
+func (rp *ReverseProxy) Test(req TestRequest) (*TestResult, error) {
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if strings.EqualFold(req.Method, methodPurge) {
+		return nil, fmt.Errorf("%s requests can't be tested", methodPurge)
+	}
+	if req.Path == "" || req.Path[0] != '/' {
+		req.Path = "/" + req.Path
+	}
+
+	httpReq, err := http.NewRequest(req.Method, req.Path, strings.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Host = req.Host
+	httpReq.RemoteAddr = testRemoteAddr
+	for name, value := range req.Headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	result := &TestResult{Host: req.Host}
+	if rule := rp.config.GetProxyRule(req.Host); rule != nil {
+		result.Rule = rule.Domain
+		result.Upstream = rule.Target
+		if rule.Cache.Enabled && !rule.Passthrough && req.Method == http.MethodGet && pathCacheable(httpReq.URL.Path, rule.Cache) {
+			// The key as handleProxy builds it, from a copy of the request
+			keyReq := httpReq.Clone(httpReq.Context())
+			normalizeAcceptEncoding(keyReq)
+			result.CacheKey = generateCacheKey(keyReq, rule)
+		}
+	}
+
+	recorder := &testRecorder{ResponseRecorder: httptest.NewRecorder(), limit: req.MaxBody}
+	start := time.Now()
+	rp.engine.ServeHTTP(recorder, httpReq)
+	result.Duration = time.Since(start)
+
+	result.Status = recorder.Code
+	result.Headers = recorder.Header()
+	result.Cache = result.Headers.Get("X-Cache")
+	result.Body = recorder.Body.Bytes()
+	result.BodySize = recorder.size
+	return result, nil
+}
+
+// testRecorder records the response to a test request, keeping up to limit
+// bytes of the body. Gin passes CloseNotify on to the writer for
+// httputil.ReverseProxy, which ResponseRecorder doesn't implement.
+type testRecorder struct {
+	*httptest.ResponseRecorder
+	limit int // 0 keeps the whole body
+	size  int // Body bytes written
+}
+
+func (r *testRecorder) Write(p []byte) (int, error) {
+	r.size += len(p)
+	keep := len(p)
+	if r.limit > 0 {
+		keep = min(keep, max(r.limit-r.Body.Len(), 0))
+	}
+	// Written even when empty, to record the header
+	_, _ = r.ResponseRecorder.Write(p[:keep]) //nolint:errcheck
+	return len(p), nil
+}
+
+func (r *testRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+// CloseNotify never reports a closed connection, as there is none.
+func (*testRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
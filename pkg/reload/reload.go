@@ -0,0 +1,391 @@
+// Package reload applies a new configuration to the running proxy, cache,
+// certificate manager and listeners.
+package reload
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+	"saddy/pkg/events"
+	"saddy/pkg/https"
+	"saddy/pkg/invalidation"
+	"saddy/pkg/proxy"
+	"saddy/pkg/warmer"
+)
+
+// Result describes how a configuration was applied.
+type Result struct {
+	Changed         []string `json:"changed"`                    // Settings that differ, such as "proxy.rules"
+	Applied         []string `json:"applied"`                    // Subsystems that were reconfigured
+	DomainsAdded    []string `json:"domains_added,omitempty"`    // Registered with the certificate manager
+	DomainsRemoved  []string `json:"domains_removed,omitempty"`  // No longer served or renewed; certificates are kept
+	RestartRequired []string `json:"restart_required,omitempty"` // Changed settings that are only read at startup
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+// ListenerFunc rebinds the listeners of the reverse proxy from the
+// addresses of current to those of next. When it fails the listeners must
+// be left on the addresses of current.
+type ListenerFunc func(current, next *config.Config) error
+
+// Reloader applies configurations to the running subsystems. The
+// configuration it holds is shared with them and replaced in place.
+type Reloader struct {
+	mu        sync.Mutex
+	config    *config.Config
+	proxy     *proxy.ReverseProxy
+	tls       *https.AutoTLS // nil without auto_https
+	cache     *cache.Reloadable
+	warmer    *warmer.Warmer
+	listeners ListenerFunc
+	events    *events.Bus
+}
+
+// New creates a reloader for the subsystems sharing cfg. tls may be nil.
+func New(cfg *config.Config, rp *proxy.ReverseProxy, tls *https.AutoTLS, storage *cache.Reloadable, w *warmer.Warmer) *Reloader {
+	return &Reloader{
+		config: cfg,
+		proxy:  rp,
+		tls:    tls,
+		cache:  storage,
+		warmer: w,
+	}
+}
+
+// SetListeners lets the reloader move the reverse proxy listeners. Without
+// it, listener changes require a restart.
+func (r *Reloader) SetListeners(fn ListenerFunc) {
+	r.listeners = fn
+}
+
+// SetEvents publishes applied configurations to bus.
+func (r *Reloader) SetEvents(bus *events.Bus) {
+	r.events = bus
+}
+
+// NewCache creates the cache storage configured in cfg, shared with the
+// other nodes of a cluster when invalidation is enabled.
+func NewCache(cfg *config.Config) (cache.Storage, error) {
+	storage, err := cache.NewCacheStorage(cache.FactoryConfig{
+		StorageType:        cfg.Cache.StorageType,
+		CacheDir:           cfg.Cache.CacheDir,
+		MaxSize:            cfg.Cache.MaxSize,
+		DefaultTTL:         cfg.Cache.DefaultTTL,
+		CleanupInterval:    cfg.Cache.CleanupInterval,
+		Persistent:         cfg.Cache.Persistent,
+		Compression:        cfg.Cache.Compression,
+		IndexFlushInterval: cfg.Cache.IndexFlushInterval,
+		DiskHighWatermark:  cfg.Cache.DiskHighWatermark,
+		DiskLowWatermark:   cfg.Cache.DiskLowWatermark,
+		SnapshotFile:       cfg.Cache.SnapshotFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Share purges with the other nodes of a cluster
+	if cfg.Cache.Invalidation.Enabled {
+		shared, err := invalidation.New(cfg.Cache.Invalidation, storage)
+		if err != nil {
+			storage.Stop()
+			return nil, fmt.Errorf("cache invalidation: %v", err)
+		}
+		return shared, nil
+	}
+	return storage, nil
+}
+
+// Preview reports what applying next would change, without validating or
+// applying it.
+func (r *Reloader) Preview(next *config.Config) *Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := *r.config.Snapshot()
+	return r.plan(&current, next)
+}
+
+// plan works out how next is applied on top of current. Applied lists the
+// subsystems that will be reconfigured.
+func (r *Reloader) plan(current, next *config.Config) *Result {
+	changed := changedSettings(current, next)
+	result := &Result{Changed: changed, Applied: []string{}}
+	if result.Changed == nil {
+		result.Changed = []string{}
+	}
+
+	if cacheSettingsChanged(current, next) && r.cache != nil {
+		result.Applied = append(result.Applied, "cache")
+	}
+	if listenersChanged(current, next) {
+		if r.listeners != nil {
+			result.Applied = append(result.Applied, "listeners")
+		} else {
+			for _, setting := range []string{"server.host", "server.port", "server.tls"} {
+				if slices.Contains(changed, setting) {
+					result.RestartRequired = append(result.RestartRequired, setting)
+				}
+			}
+		}
+	}
+	for _, setting := range restartRequired(current, next, changed) {
+		if !slices.Contains(result.RestartRequired, setting) {
+			result.RestartRequired = append(result.RestartRequired, setting)
+		}
+	}
+
+	result.Applied = append(result.Applied, "proxy")
+	if r.tls != nil {
+		result.Applied = append(result.Applied, "tls")
+		before, after := certDomains(current), certDomains(next)
+		for domain := range before {
+			if _, kept := after[domain]; !kept && adminDomain(next) != domain {
+				result.DomainsRemoved = append(result.DomainsRemoved, domain)
+			}
+		}
+		for domain, opts := range after {
+			if previous, existed := before[domain]; !existed || !reflect.DeepEqual(previous, opts) {
+				result.DomainsAdded = append(result.DomainsAdded, domain)
+			}
+		}
+		sort.Strings(result.DomainsRemoved)
+		sort.Strings(result.DomainsAdded)
+	}
+	if slices.Contains(changed, "cache.warm") && r.warmer != nil {
+		result.Applied = append(result.Applied, "warmer")
+	}
+	return result
+}
+
+// Apply validates next and makes it the running configuration. Steps that
+// can fail, rebuilding the cache and moving listeners, run first; if one
+// fails the running configuration is left as it was and an error returned.
+// Validation failures are returned as config.ValidationErrors.
+func (r *Reloader) Apply(next *config.Config) (*Result, error) {
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := *r.config.Snapshot()
+	result := r.plan(&current, next)
+
+	cacheChanged := slices.Contains(result.Applied, "cache")
+	if cacheChanged {
+		if err := r.rebuildCache(next, &current); err != nil {
+			return nil, err
+		}
+	}
+
+	if slices.Contains(result.Applied, "listeners") {
+		if err := r.listeners(&current, next); err != nil {
+			if cacheChanged {
+				if rollbackErr := r.rebuildCache(&current, nil); rollbackErr != nil {
+					log.Printf("Warning: Failed to restore the cache settings: %v", rollbackErr)
+				}
+			}
+			return nil, fmt.Errorf("failed to move listeners: %v", err)
+		}
+	}
+
+	r.config.Replace(next)
+	r.proxy.PruneUpstreams()
+
+	if r.tls != nil {
+		r.applyDomains(next, result)
+	}
+
+	if slices.Contains(result.Applied, "warmer") {
+		r.warmer.SetConfig(next.Cache.Warm)
+	}
+
+	for _, setting := range result.RestartRequired {
+		log.Printf("Warning: %s changed, restart Saddy to apply it", setting)
+	}
+	message := "Configuration applied"
+	if len(result.Changed) > 0 {
+		message = "Configuration applied: " + strings.Join(result.Changed, ", ")
+	}
+	log.Print(message)
+	r.events.Publish(events.Event{
+		Type:    events.ConfigReloaded,
+		Message: message,
+		Data: map[string]any{
+			"changed":          result.Changed,
+			"restart_required": result.RestartRequired,
+		},
+	})
+	return result, nil
+}
+
+// rebuildCache replaces the cache storage with one configured by cfg. If
+// that fails and fallback is set, a storage configured by fallback takes its
+// place so the proxy keeps a working cache.
+func (r *Reloader) rebuildCache(cfg, fallback *config.Config) error {
+	var buildErr error
+	err := r.cache.Rebuild(func() (cache.Storage, error) {
+		storage, err := NewCache(cfg)
+		if err == nil || fallback == nil {
+			return storage, err
+		}
+		buildErr = err
+		return NewCache(fallback)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rebuild the cache: %v", err)
+	}
+	if buildErr != nil {
+		return fmt.Errorf("failed to rebuild the cache: %v", buildErr)
+	}
+	log.Printf("Cache rebuilt: type=%s", cfg.Cache.StorageType)
+	return nil
+}
+
+// applyDomains deactivates the certificate domains of the plan that were
+// removed and registers those added or changed. Domains that fail to
+// register are moved from DomainsAdded to Warnings.
+func (r *Reloader) applyDomains(next *config.Config, result *Result) {
+	for _, domain := range result.DomainsRemoved {
+		r.tls.DeactivateDomain(domain)
+	}
+
+	after := certDomains(next)
+	added := result.DomainsAdded[:0]
+	for _, domain := range result.DomainsAdded {
+		// Changed options start over
+		r.tls.DeactivateDomain(domain)
+		if err := r.tls.AddDomainWithOptions(domain, after[domain]); err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Failed to register domain %s: %v", domain, err))
+			continue
+		}
+		added = append(added, domain)
+	}
+	result.DomainsAdded = added
+}
+
+// certDomains returns the certificate options of the rules that terminate
+// TLS, by domain.
+func certDomains(cfg *config.Config) map[string]https.DomainOptions {
+	domains := make(map[string]https.DomainOptions)
+	for _, rule := range cfg.Proxy.Rules {
+		if !rule.SSL.Enabled || rule.Passthrough {
+			continue
+		}
+		domains[rule.Domain] = https.DomainOptions{
+			Issuer:    rule.SSL.Issuer,
+			Challenge: rule.SSL.Challenge,
+			Policy:    (*https.TLSPolicy)(rule.SSL.Policy),
+			Aliases:   rule.CertAliases(),
+		}
+	}
+	return domains
+}
+
+// adminDomain returns the domain the admin interface obtains an ACME
+// certificate for, which must stay registered without a rule.
+func adminDomain(cfg *config.Config) string {
+	if cfg.Server.Admin.TLS != config.AdminTLSACME {
+		return ""
+	}
+	return cfg.Server.Admin.Domain
+}
+
+// changedSettings lists the settings that differ between current and next
+// as "section.setting", in the order of the configuration file.
+func changedSettings(current, next *config.Config) []string {
+	var changed []string
+	currentValue, nextValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		if !currentValue.Type().Field(i).IsExported() {
+			continue
+		}
+		section := yamlName(currentValue.Type().Field(i))
+		currentSection, nextSection := currentValue.Field(i), nextValue.Field(i)
+		// Settings of their own, like include
+		if currentSection.Kind() != reflect.Struct {
+			if !reflect.DeepEqual(currentSection.Interface(), nextSection.Interface()) {
+				changed = append(changed, section)
+			}
+			continue
+		}
+		for j := 0; j < currentSection.NumField(); j++ {
+			if !reflect.DeepEqual(currentSection.Field(j).Interface(), nextSection.Field(j).Interface()) {
+				changed = append(changed, section+"."+yamlName(currentSection.Type().Field(j)))
+			}
+		}
+	}
+	return changed
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// cacheSettingsChanged reports whether the cache storage must be rebuilt.
+// Purge and warming settings are read as they are used.
+func cacheSettingsChanged(current, next *config.Config) bool {
+	before, after := current.Cache, next.Cache
+	before.Purge, after.Purge = config.PurgeConfig{}, config.PurgeConfig{}
+	before.Warm, after.Warm = config.WarmConfig{}, config.WarmConfig{}
+	return !reflect.DeepEqual(before, after)
+}
+
+// listenersChanged reports whether the reverse proxy listens on other
+// addresses in next.
+func listenersChanged(current, next *config.Config) bool {
+	if current.Server.Host != next.Server.Host || current.Server.Port != next.Server.Port {
+		return true
+	}
+	return current.Server.AutoHTTPS && current.Server.TLS.ChallengeAddress != next.Server.TLS.ChallengeAddress
+}
+
+// restartRequired lists the changed settings that are only read at startup.
+func restartRequired(current, next *config.Config, changed []string) []string {
+	var settings []string
+	for _, setting := range []string{"server.admin_port", "server.auto_https", "history.dir", "history.keep"} {
+		if slices.Contains(changed, setting) {
+			settings = append(settings, setting)
+		}
+	}
+
+	// Profiling, the allowlist and the rate limits of the admin interface are
+	// read per request
+	beforeAdmin, afterAdmin := current.Server.Admin, next.Server.Admin
+	beforeAdmin.Profiling, afterAdmin.Profiling = false, false
+	beforeAdmin.AllowedIPs, afterAdmin.AllowedIPs = nil, nil
+	beforeAdmin.RateLimit, afterAdmin.RateLimit = config.AdminRateLimit{}, config.AdminRateLimit{}
+	if !reflect.DeepEqual(beforeAdmin, afterAdmin) {
+		settings = append(settings, "server.admin")
+	}
+
+	// The admin interface listens on server.host unless admin.listen is set
+	if current.Server.Host != next.Server.Host && next.Server.Admin.Listen == "" && !slices.Contains(settings, "server.admin") {
+		settings = append(settings, "server.host")
+	}
+
+	// The certificate manager is configured once; the challenge address
+	// only moves a listener
+	before, after := current.Server.TLS, next.Server.TLS
+	before.ChallengeAddress, after.ChallengeAddress = "", ""
+	if next.Server.AutoHTTPS && !reflect.DeepEqual(before, after) {
+		settings = append(settings, "server.tls")
+	}
+
+	// Admin API routes are only set up when the Web UI is enabled at startup
+	if current.WebUI.Enabled != next.WebUI.Enabled {
+		settings = append(settings, "web_ui.enabled")
+	}
+	return settings
+}
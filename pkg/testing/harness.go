@@ -0,0 +1,198 @@
+// Package testing provides an end-to-end harness for exercising Saddy in-process.
+//
+// A Harness wires a real reverse proxy and cache to an embedded origin server so
+// tests can assert on routing, caching semantics and upstream traffic without
+// binding fixed ports. Certificate issuance can be exercised against a Pebble
+// ACME server started with StartPebble.
+package testing
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+	"saddy/pkg/proxy"
+)
+
+// TB is the subset of testing.TB used by the harness.
+type TB interface {
+	Helper()
+	Cleanup(func())
+	Fatalf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+	Skipf(format string, args ...interface{})
+}
+
+// DefaultDomain is the domain routed to the embedded origin when no rules are given.
+const DefaultDomain = "origin.test"
+
+// Options configures a Harness.
+type Options struct {
+	// Rules are the proxy rules to install. A rule with an empty Target is
+	// pointed at the embedded origin. Defaults to a single cached rule for
+	// DefaultDomain.
+	Rules []config.ProxyRule
+	// Cache configures the cache storage. A file cache gets a temporary
+	// directory when CacheDir is empty.
+	Cache config.CacheConfig
+}
+
+// Harness runs a reverse proxy in front of an embedded origin server.
+type Harness struct {
+	tb     TB
+	Config *config.Config
+	Cache  cache.Storage
+	Proxy  *proxy.ReverseProxy
+	Origin *Origin
+	server *httptest.Server
+	client *http.Client
+}
+
+// New starts a proxy and origin pair. Both are shut down through tb.Cleanup.
+func New(tb TB, opts Options) *Harness {
+	tb.Helper()
+
+	origin := NewOrigin()
+	tb.Cleanup(origin.Close)
+
+	rules := opts.Rules
+	if len(rules) == 0 {
+		rules = []config.ProxyRule{{
+			Domain: DefaultDomain,
+			Cache:  config.CacheRule{Enabled: true, TTL: 60},
+		}}
+	}
+	for i := range rules {
+		if rules[i].Target == "" {
+			rules[i].Target = origin.URL()
+		}
+	}
+
+	cacheCfg := opts.Cache
+	if (cacheCfg.StorageType == "file" || cacheCfg.StorageType == "persistent") && cacheCfg.CacheDir == "" {
+		dir, err := os.MkdirTemp("", "saddy-cache-")
+		if err != nil {
+			tb.Fatalf("failed to create cache directory: %v", err)
+		}
+		tb.Cleanup(func() { _ = os.RemoveAll(dir) }) //nolint:errcheck
+		cacheCfg.CacheDir = dir
+	}
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{Host: "127.0.0.1"},
+		Proxy:  config.ProxyConfig{Rules: rules},
+		Cache:  cacheCfg,
+	}
+
+	storage, err := cache.NewCacheStorage(cache.FactoryConfig{
+		StorageType:        cacheCfg.StorageType,
+		CacheDir:           cacheCfg.CacheDir,
+		MaxSize:            cacheCfg.MaxSize,
+		DefaultTTL:         cacheCfg.DefaultTTL,
+		CleanupInterval:    cacheCfg.CleanupInterval,
+		Persistent:         cacheCfg.Persistent,
+		Compression:        cacheCfg.Compression,
+		IndexFlushInterval: cacheCfg.IndexFlushInterval,
+		DiskHighWatermark:  cacheCfg.DiskHighWatermark,
+		DiskLowWatermark:   cacheCfg.DiskLowWatermark,
+		SnapshotFile:       cacheCfg.SnapshotFile,
+	})
+	if err != nil {
+		tb.Fatalf("failed to initialize cache: %v", err)
+	}
+	tb.Cleanup(storage.Stop)
+
+	rp := proxy.NewReverseProxy(cfg, storage)
+	server := httptest.NewServer(rp.GetEngine())
+	tb.Cleanup(server.Close)
+
+	return &Harness{
+		tb:     tb,
+		Config: cfg,
+		Cache:  storage,
+		Proxy:  rp,
+		Origin: origin,
+		server: server,
+		client: &http.Client{
+			// Redirects are part of the behavior under test, never follow them.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// URL returns the base URL of the proxy listener.
+func (h *Harness) URL() string {
+	return h.server.URL
+}
+
+// Do sends req to the proxy, routing it by domain through the Host header.
+func (h *Harness) Do(domain string, req *http.Request) (*Response, error) {
+	req.Host = domain
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Response: resp, Body: body}, nil
+}
+
+// Request builds and sends a request for path on domain with optional headers.
+// It fails the test on transport errors.
+func (h *Harness) Request(method, domain, path string, headers map[string]string) *Response {
+	h.tb.Helper()
+
+	req, err := http.NewRequest(method, h.server.URL+path, nil)
+	if err != nil {
+		h.tb.Fatalf("failed to build request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := h.Do(domain, req)
+	if err != nil {
+		h.tb.Fatalf("%s %s%s failed: %v", method, domain, path, err)
+	}
+	return resp
+}
+
+// Get is shorthand for a GET request without extra headers.
+func (h *Harness) Get(domain, path string) *Response {
+	h.tb.Helper()
+	return h.Request(http.MethodGet, domain, path, nil)
+}
+
+// Response is a fully read proxy response.
+type Response struct {
+	*http.Response
+	Body []byte
+}
+
+// CacheStatus returns the X-Cache header value, or "MISS" when absent.
+func (r *Response) CacheStatus() string {
+	if status := r.Header.Get("X-Cache"); status != "" {
+		return status
+	}
+	return "MISS"
+}
+
+// String summarizes the response for failure messages.
+func (r *Response) String() string {
+	body := string(r.Body)
+	if len(body) > 200 {
+		body = body[:200] + "..."
+	}
+	return fmt.Sprintf("%d %s %q", r.StatusCode, strings.TrimSpace(r.Header.Get("Content-Type")), body)
+}
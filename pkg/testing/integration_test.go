@@ -0,0 +1,90 @@
+//go:build integration
+
+package testing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"saddy/pkg/cache"
+	"saddy/pkg/config"
+	harness "saddy/pkg/testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestProxyRoundTrip(t *testing.T) {
+	h := harness.New(t, harness.Options{})
+	h.Origin.Respond("/hello", http.StatusOK, map[string]string{"X-Origin": "yes"}, "hello")
+
+	resp := h.Get(harness.DefaultDomain, "/hello")
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "hello" {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+	if resp.Header.Get("X-Origin") != "yes" {
+		t.Fatalf("origin header not passed through: %v", resp.Header)
+	}
+	if hits := h.Origin.Hits("/hello"); hits != 1 {
+		t.Fatalf("origin hits = %d, want 1", hits)
+	}
+}
+
+func TestUnknownDomain(t *testing.T) {
+	h := harness.New(t, harness.Options{})
+
+	resp := h.Get("unknown.test", "/")
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("unknown domain was proxied: %s", resp)
+	}
+	if hits := h.Origin.Hits("/"); hits != 0 {
+		t.Fatalf("origin hits = %d, want 0", hits)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	for _, storageType := range []string{"memory", "file"} {
+		t.Run(storageType, func(t *testing.T) {
+			h := harness.New(t, harness.Options{Cache: config.CacheConfig{StorageType: storageType}})
+			h.Origin.Respond("/page", http.StatusOK, nil, "cached")
+
+			first := h.Get(harness.DefaultDomain, "/page")
+			if first.CacheStatus() != cache.OutcomeMiss {
+				t.Fatalf("first request: X-Cache = %s, want %s", first.CacheStatus(), cache.OutcomeMiss)
+			}
+			second := h.Get(harness.DefaultDomain, "/page")
+			if second.CacheStatus() != cache.OutcomeHit || string(second.Body) != "cached" {
+				t.Fatalf("second request: X-Cache = %s, %s", second.CacheStatus(), second)
+			}
+			if hits := h.Origin.Hits("/page"); hits != 1 {
+				t.Fatalf("origin hits = %d, want 1", hits)
+			}
+		})
+	}
+}
+
+func TestOriginDown(t *testing.T) {
+	h := harness.New(t, harness.Options{})
+	h.Origin.SetDown(true)
+
+	resp := h.Get(harness.DefaultDomain, "/down")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestPebbleAccount(t *testing.T) {
+	pebble := harness.StartPebble(t)
+
+	client, err := pebble.Client()
+	if err != nil {
+		t.Fatalf("failed to create ACME client: %v", err)
+	}
+	account, err := client.Register(context.Background(), &acme.Account{}, acme.AcceptTOS)
+	if err != nil {
+		t.Fatalf("failed to register account: %v", err)
+	}
+	if account.URI == "" {
+		t.Fatalf("account has no URI")
+	}
+}
@@ -0,0 +1,111 @@
+package testing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Origin is an in-process upstream server with programmable routes and
+// per-path request counters.
+type Origin struct {
+	server   *httptest.Server
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+	hits     map[string]int
+	down     bool
+}
+
+// NewOrigin starts an origin that answers unknown paths with "200 origin".
+func NewOrigin() *Origin {
+	o := &Origin{
+		handlers: make(map[string]http.Handler),
+		hits:     make(map[string]int),
+	}
+	o.server = httptest.NewServer(http.HandlerFunc(o.serveHTTP))
+	return o
+}
+
+func (o *Origin) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.hits[r.URL.Path]++
+	handler, exists := o.handlers[r.URL.Path]
+	down := o.down
+	o.mu.Unlock()
+
+	if down {
+		// Drop the connection so the proxy sees a transport error.
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				_ = conn.Close() //nolint:errcheck
+				return
+			}
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !exists {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("origin")) //nolint:errcheck
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// URL returns the origin base URL, suitable as a proxy rule target.
+func (o *Origin) URL() string {
+	return o.server.URL
+}
+
+// Handle registers a handler for an exact request path.
+func (o *Origin) Handle(path string, handler http.Handler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers[path] = handler
+}
+
+// Respond registers a fixed response for an exact request path.
+func (o *Origin) Respond(path string, status int, headers map[string]string, body string) {
+	o.Handle(path, StaticResponse(status, headers, body))
+}
+
+// Hits returns how many requests reached the origin for path.
+func (o *Origin) Hits(path string) int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.hits[path]
+}
+
+// Reset clears all request counters.
+func (o *Origin) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hits = make(map[string]int)
+}
+
+// SetDown makes the origin drop every connection until called with false.
+func (o *Origin) SetDown(down bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.down = down
+}
+
+// Close shuts down the origin server.
+func (o *Origin) Close() {
+	o.server.Close()
+}
+
+// StaticResponse returns a handler that always writes the given response.
+func StaticResponse(status int, headers map[string]string, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body)) //nolint:errcheck
+	})
+}
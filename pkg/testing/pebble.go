@@ -0,0 +1,267 @@
+package testing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	pebbleImage        = "ghcr.io/letsencrypt/pebble:latest"
+	pebbleStartTimeout = 30 * time.Second
+)
+
+// Pebble is a running Pebble ACME test server.
+//
+// Pebble is located in this order: an already running server given by the
+// PEBBLE_DIRECTORY environment variable, a `pebble` binary on PATH, and
+// finally a Docker container. The test is skipped when none is available.
+// Challenge validation is disabled (PEBBLE_VA_ALWAYS_VALID) so issuance
+// succeeds for any hostname.
+type Pebble struct {
+	// DirectoryURL is the ACME directory endpoint.
+	DirectoryURL string
+	// ManagementURL is the management endpoint used to fetch issuing roots.
+	ManagementURL string
+}
+
+// StartPebble starts or locates a Pebble server and stops it through tb.Cleanup.
+func StartPebble(tb TB) *Pebble {
+	tb.Helper()
+
+	if dir := os.Getenv("PEBBLE_DIRECTORY"); dir != "" {
+		p := &Pebble{DirectoryURL: dir, ManagementURL: os.Getenv("PEBBLE_MANAGEMENT")}
+		p.waitReady(tb)
+		return p
+	}
+
+	if path, err := exec.LookPath("pebble"); err == nil {
+		return startPebbleBinary(tb, path)
+	}
+
+	if path, err := exec.LookPath("docker"); err == nil {
+		return startPebbleContainer(tb, path)
+	}
+
+	tb.Skipf("pebble not available: set PEBBLE_DIRECTORY, install pebble, or install docker")
+	return nil
+}
+
+func startPebbleBinary(tb TB, binary string) *Pebble {
+	tb.Helper()
+
+	dir, err := os.MkdirTemp("", "saddy-pebble-")
+	if err != nil {
+		tb.Fatalf("failed to create pebble directory: %v", err)
+	}
+	tb.Cleanup(func() { _ = os.RemoveAll(dir) }) //nolint:errcheck
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := writeLocalhostCert(certFile, keyFile); err != nil {
+		tb.Fatalf("failed to create pebble certificate: %v", err)
+	}
+
+	listenAddr := freeAddr(tb)
+	managementAddr := freeAddr(tb)
+	pebbleConfig := map[string]interface{}{
+		"pebble": map[string]interface{}{
+			"listenAddress":           listenAddr,
+			"managementListenAddress": managementAddr,
+			"certificate":             certFile,
+			"privateKey":              keyFile,
+			"httpPort":                5002,
+			"tlsPort":                 5001,
+		},
+	}
+	data, err := json.Marshal(pebbleConfig)
+	if err != nil {
+		tb.Fatalf("failed to encode pebble config: %v", err)
+	}
+	configFile := filepath.Join(dir, "pebble.json")
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		tb.Fatalf("failed to write pebble config: %v", err)
+	}
+
+	cmd := exec.Command(binary, "-config", configFile) //nolint:gosec
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_ALWAYS_VALID=1", "PEBBLE_VA_NOSLEEP=1")
+	if err := cmd.Start(); err != nil {
+		tb.Fatalf("failed to start pebble: %v", err)
+	}
+	tb.Cleanup(func() {
+		_ = cmd.Process.Kill() //nolint:errcheck
+		_ = cmd.Wait()         //nolint:errcheck
+	})
+
+	p := &Pebble{
+		DirectoryURL:  "https://" + listenAddr + "/dir",
+		ManagementURL: "https://" + managementAddr,
+	}
+	p.waitReady(tb)
+	return p
+}
+
+func startPebbleContainer(tb TB, docker string) *Pebble {
+	tb.Helper()
+
+	listenAddr := freeAddr(tb)
+	managementAddr := freeAddr(tb)
+	_, listenPort, _ := net.SplitHostPort(listenAddr)         //nolint:errcheck
+	_, managementPort, _ := net.SplitHostPort(managementAddr) //nolint:errcheck
+
+	out, err := exec.Command(docker, "run", "-d", "--rm", //nolint:gosec
+		"-e", "PEBBLE_VA_ALWAYS_VALID=1",
+		"-e", "PEBBLE_VA_NOSLEEP=1",
+		"-p", "127.0.0.1:"+listenPort+":14000",
+		"-p", "127.0.0.1:"+managementPort+":15000",
+		pebbleImage,
+	).Output()
+	if err != nil {
+		tb.Skipf("failed to start pebble container: %v", err)
+	}
+	containerID := strings.TrimSpace(string(out))
+	tb.Cleanup(func() {
+		_ = exec.Command(docker, "rm", "-f", containerID).Run() //nolint:errcheck,gosec
+	})
+
+	p := &Pebble{
+		DirectoryURL:  "https://" + listenAddr + "/dir",
+		ManagementURL: "https://" + managementAddr,
+	}
+	p.waitReady(tb)
+	return p
+}
+
+// HTTPClient returns a client that trusts Pebble's self-signed API certificate.
+func (p *Pebble) HTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		},
+	}
+}
+
+// Client returns an ACME client bound to the Pebble directory with a fresh account key.
+func (p *Pebble) Client() (*acme.Client, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: p.DirectoryURL,
+		HTTPClient:   p.HTTPClient(),
+	}, nil
+}
+
+// RootCAs returns a pool with Pebble's current issuing root, for verifying
+// certificates it issued.
+func (p *Pebble) RootCAs() (*x509.CertPool, error) {
+	if p.ManagementURL == "" {
+		return nil, fmt.Errorf("pebble management URL not configured")
+	}
+
+	resp, err := p.HTTPClient().Get(p.ManagementURL + "/roots/0")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no root certificate returned by pebble")
+	}
+	return pool, nil
+}
+
+func (p *Pebble) waitReady(tb TB) {
+	tb.Helper()
+
+	client, err := p.Client()
+	if err != nil {
+		tb.Fatalf("failed to create ACME client: %v", err)
+	}
+
+	deadline := time.Now().Add(pebbleStartTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := client.Discover(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("pebble at %s not ready: %v", p.DirectoryURL, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// freeAddr reserves an ephemeral loopback address.
+func freeAddr(tb TB) string {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to reserve port: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close() //nolint:errcheck
+	return addr
+}
+
+// writeLocalhostCert writes a short-lived self-signed certificate for Pebble's API listener.
+func writeLocalhostCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
@@ -0,0 +1,339 @@
+// Package warmer pre-populates the cache by replaying requests through the reverse proxy.
+package warmer
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"saddy/pkg/config"
+)
+
+const (
+	defaultConcurrency = 4
+	maxSitemapSize     = 10 * 1024 * 1024
+	maxErrorsReported  = 20
+)
+
+// Job describes a set of URLs to warm.
+type Job struct {
+	URLs        []string `json:"urls"`
+	Sitemaps    []string `json:"sitemaps"`
+	Concurrency int      `json:"concurrency"`
+}
+
+// Report summarizes a warming run.
+type Report struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Total      int       `json:"total"`
+	Warmed     int       `json:"warmed"`
+	Failed     int       `json:"failed"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// Warmer issues GET requests for configured URLs against the proxy handler
+// so responses are cached exactly as they would be for real clients.
+type Warmer struct {
+	handler  http.Handler
+	reloaded chan struct{} // Signals Run that the configuration changed
+
+	mu     sync.Mutex
+	config config.WarmConfig
+	report *Report
+}
+
+// New creates a warmer that sends requests to handler, typically the reverse proxy engine.
+func New(handler http.Handler, cfg config.WarmConfig) *Warmer {
+	return &Warmer{
+		handler:  handler,
+		reloaded: make(chan struct{}, 1),
+		config:   cfg,
+	}
+}
+
+// SetConfig replaces the warming configuration. A running Run starts over
+// with it, warming right away if it is enabled.
+func (w *Warmer) SetConfig(cfg config.WarmConfig) {
+	w.mu.Lock()
+	w.config = cfg
+	w.mu.Unlock()
+
+	select {
+	case w.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Warmer) settings() config.WarmConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.config
+}
+
+// Run warms the configured URLs and sitemaps at startup and then on every
+// interval until ctx is canceled.
+func (w *Warmer) Run(ctx context.Context) {
+	for w.schedule(ctx) {
+	}
+}
+
+// schedule warms with the current configuration now and then on every
+// interval. It returns true when the configuration changes and false when
+// ctx is canceled.
+func (w *Warmer) schedule(ctx context.Context) bool {
+	cfg := w.settings()
+	job := Job{URLs: cfg.URLs, Sitemaps: cfg.Sitemaps, Concurrency: cfg.Concurrency}
+
+	var tick <-chan time.Time
+	if cfg.Enabled {
+		w.runScheduled(ctx, job)
+		if cfg.Interval > 0 {
+			ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+	}
+
+	for {
+		select {
+		case <-tick:
+			w.runScheduled(ctx, job)
+		case <-w.reloaded:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (w *Warmer) runScheduled(ctx context.Context, job Job) {
+	report, err := w.Warm(ctx, job)
+	if err != nil {
+		log.Printf("Cache warming skipped: %v", err)
+		return
+	}
+	log.Printf("Cache warming finished: %d/%d warmed, %d failed", report.Warmed, report.Total, report.Failed)
+}
+
+// Start runs a warming job in the background. It fails if a job is already running.
+func (w *Warmer) Start(job Job) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	go w.run(context.Background(), job)
+	return nil
+}
+
+// Warm runs a warming job and waits for it to complete.
+func (w *Warmer) Warm(ctx context.Context, job Job) (*Report, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	return w.run(ctx, job), nil
+}
+
+// Status returns a copy of the current or last report, or nil if nothing ran yet.
+func (w *Warmer) Status() *Report {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.report == nil {
+		return nil
+	}
+	report := *w.report
+	report.Errors = append([]string(nil), w.report.Errors...)
+	return &report
+}
+
+func (w *Warmer) begin() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.report != nil && w.report.Running {
+		return fmt.Errorf("cache warming already in progress")
+	}
+	w.report = &Report{Running: true, StartedAt: time.Now()}
+	return nil
+}
+
+func (w *Warmer) run(ctx context.Context, job Job) *Report {
+	targets := append([]string(nil), job.URLs...)
+	for _, sitemap := range job.Sitemaps {
+		urls, err := w.fetchSitemap(ctx, sitemap, true)
+		if err != nil {
+			w.recordError(fmt.Sprintf("sitemap %s: %v", sitemap, err))
+			continue
+		}
+		targets = append(targets, urls...)
+	}
+
+	w.mu.Lock()
+	w.report.Total = len(targets)
+	w.mu.Unlock()
+
+	concurrency := job.Concurrency
+	if concurrency <= 0 {
+		concurrency = w.settings().Concurrency
+	}
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range work {
+				status, err := w.fetch(ctx, target, io.Discard)
+				switch {
+				case err != nil:
+					w.recordError(fmt.Sprintf("%s: %v", target, err))
+				case status >= 400:
+					w.recordError(fmt.Sprintf("%s: status %d", target, status))
+				default:
+					w.mu.Lock()
+					w.report.Warmed++
+					w.mu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, target := range targets {
+		select {
+		case work <- target:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report.Running = false
+	w.report.FinishedAt = time.Now()
+	report := *w.report
+	return &report
+}
+
+func (w *Warmer) recordError(message string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.report.Failed++
+	if len(w.report.Errors) < maxErrorsReported {
+		w.report.Errors = append(w.report.Errors, message)
+	}
+}
+
+// fetch sends a GET request for target through the proxy handler and copies the body to dst.
+func (w *Warmer) fetch(ctx context.Context, target string, dst io.Writer) (int, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return 0, err
+	}
+	if u.Host == "" {
+		return 0, fmt.Errorf("URL must include a host")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = u.Host
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", "Saddy-Cache-Warmer")
+
+	recorder := &discardWriter{header: make(http.Header), statusCode: http.StatusOK, body: dst}
+	w.handler.ServeHTTP(recorder, req)
+	return recorder.statusCode, nil
+}
+
+// sitemap covers both <urlset> and <sitemapindex> documents.
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// fetchSitemap returns the page URLs listed in a sitemap, following one level of sitemap index.
+func (w *Warmer) fetchSitemap(ctx context.Context, sitemapURL string, followIndex bool) ([]string, error) {
+	var body limitedBuffer
+	body.limit = maxSitemapSize
+	status, err := w.fetch(ctx, sitemapURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("status %d", status)
+	}
+
+	var doc sitemap
+	if err := xml.Unmarshal(body.data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %v", err)
+	}
+
+	urls := make([]string, 0, len(doc.URLs))
+	for _, loc := range doc.URLs {
+		urls = append(urls, loc.Loc)
+	}
+	if followIndex {
+		for _, loc := range doc.Sitemaps {
+			nested, err := w.fetchSitemap(ctx, loc.Loc, false)
+			if err != nil {
+				w.recordError(fmt.Sprintf("sitemap %s: %v", loc.Loc, err))
+				continue
+			}
+			urls = append(urls, nested...)
+		}
+	}
+	return urls, nil
+}
+
+// discardWriter is a minimal http.ResponseWriter capturing only the status code.
+type discardWriter struct {
+	header     http.Header
+	statusCode int
+	body       io.Writer
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return d.body.Write(b)
+}
+
+func (d *discardWriter) WriteHeader(statusCode int) {
+	d.statusCode = statusCode
+}
+
+// limitedBuffer collects up to limit bytes and fails beyond that.
+type limitedBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if len(b.data)+len(p) > b.limit {
+		return 0, fmt.Errorf("sitemap larger than %d bytes", b.limit)
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
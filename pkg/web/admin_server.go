@@ -2,7 +2,11 @@
 package web
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -37,7 +41,19 @@ func NewAdminServer(adminAPI *api.AdminAPI) *AdminServer {
 func (s *AdminServer) setupRoutes() {
 	// Middleware
 	s.engine.Use(gin.Logger())
-	s.engine.Use(gin.Recovery())
+	s.engine.Use(s.api.CheckAllowedIP)
+	s.engine.Use(gin.CustomRecovery(func(c *gin.Context, _ any) {
+		api.RespondError(c, http.StatusInternalServerError, "Internal server error")
+	}))
+
+	// Unknown paths and methods answer the API's error envelope
+	s.engine.HandleMethodNotAllowed = true
+	s.engine.NoRoute(func(c *gin.Context) {
+		api.RespondError(c, http.StatusNotFound, "Not found: "+c.Request.URL.Path)
+	})
+	s.engine.NoMethod(func(c *gin.Context) {
+		api.RespondError(c, http.StatusMethodNotAllowed, "Method not allowed: "+c.Request.Method+" "+c.Request.URL.Path)
+	})
 
 	// Serve static files - look in current directory first, then web/
 	s.engine.Static("/static", "./web/static")
@@ -45,33 +61,35 @@ func (s *AdminServer) setupRoutes() {
 
 	// Login page
 	s.engine.GET("/login", func(c *gin.Context) {
+		if s.api.ValidSession(c.Request) {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
 		c.HTML(http.StatusOK, "login.html", nil)
 	})
+	s.engine.POST("/login", s.api.Login)
+	s.engine.POST("/logout", s.api.Logout)
 
-	// Main page (with auth check)
-	s.engine.GET("/", func(c *gin.Context) {
-		// Check for basic auth in header first
-		auth := c.GetHeader("Authorization")
-
-		// If no auth header, check for cookie
-		if auth == "" {
-			cookie, err := c.Cookie("saddy_auth")
-			if err == nil && cookie != "" {
-				auth = "Basic " + cookie
-			}
-		}
+	// Probes for load balancers and Kubernetes
+	s.engine.GET("/healthz", s.api.Liveness)
+	s.engine.GET("/readyz", s.api.Readiness)
+
+	// Metrics for Prometheus scrapers that can't authenticate
+	if path := s.api.PublicMetricsPath(); path != "" {
+		s.engine.GET(path, s.api.Metrics)
+	}
 
-		if auth == "" {
-			// No auth header or cookie, check if accessing from browser (not API)
+	// Main page (with session check)
+	s.engine.GET("/", func(c *gin.Context) {
+		if !s.api.ValidSession(c.Request) {
+			// Redirect browsers to the login page
 			if c.GetHeader("Accept") == "" || strings.Contains(c.GetHeader("Accept"), "text/html") {
 				c.Redirect(http.StatusFound, "/login")
 				return
 			}
-		}
 
-		// For API calls without proper auth, return 401
-		if auth == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			// For API calls without a session, return 401
+			api.RespondError(c, http.StatusUnauthorized, "Authentication required")
 			return
 		}
 
@@ -81,14 +99,54 @@ func (s *AdminServer) setupRoutes() {
 	// API routes with versioning
 	v1 := s.engine.Group("/api/v1")
 	s.api.SetupRoutes(v1)
+
+	// OpenAPI document of the routes above, and Swagger UI to browse it
+	v1.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.api.OpenAPI(s.engine.Routes(), v1.BasePath()))
+	})
+	v1.GET("/docs", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "docs.html", gin.H{"SpecURL": v1.BasePath() + "/openapi.json"})
+	})
 }
 
-// Start starts the admin server on the specified address.
-func (s *AdminServer) Start(addr string) error {
+// Start starts the admin server on addr, a TCP address or "unix:" and the
+// path of a socket. With tlsConfig it serves HTTPS.
+func (s *AdminServer) Start(addr string, tlsConfig *tls.Config) error {
 	server := &http.Server{
-		Addr:              addr,
 		Handler:           s.engine,
+		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: defaultReadHeaderTimeout,
 	}
-	return server.ListenAndServe()
+
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// listen opens a TCP listener, or a unix socket only its owner and group
+// can connect to.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove the socket left behind by an earlier run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = listener.Close() //nolint:errcheck
+		return nil, fmt.Errorf("failed to restrict socket %s: %v", path, err)
+	}
+	return listener, nil
 }
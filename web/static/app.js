@@ -1,46 +1,33 @@
 // API Configuration
 const API_BASE = '/api/v1';
 
-// Authentication
-function getAuthHeaders() {
-    const auth = localStorage.getItem('saddy_auth') || sessionStorage.getItem('saddy_auth');
-    if (!auth) {
-        window.location.href = '/login';
-        return {};
-    }
-    return {
-        'Authorization': 'Basic ' + auth
-    };
-}
-
-// Check authentication
-function checkAuth() {
-    const auth = localStorage.getItem('saddy_auth') || sessionStorage.getItem('saddy_auth');
-    if (!auth) {
-        window.location.href = '/login';
-        return false;
-    }
-    return true;
+// CSRF token of the session, sent back with every change
+function getCSRFToken() {
+    const match = document.cookie.match(/(?:^|;\s*)saddy_csrf=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : '';
 }
 
 // Initialize the application
 document.addEventListener('DOMContentLoaded', function() {
-    // Check authentication first
-    if (!checkAuth()) {
-        return;
-    }
-
-    // Set up logout handler
-    document.getElementById('logout-btn').addEventListener('click', function() {
-        localStorage.removeItem('saddy_auth');
-        sessionStorage.removeItem('saddy_auth');
-        window.location.href = '/login';
+    // Set up logout handler; the session cookie is HttpOnly, so the server clears it
+    document.getElementById('logout-btn').addEventListener('click', async function() {
+        try {
+            await fetch('/logout', {
+                method: 'POST',
+                credentials: 'same-origin',
+                headers: { 'X-CSRF-Token': getCSRFToken() }
+            });
+        } finally {
+            window.location.href = '/login';
+        }
     });
 
     loadSystemStatus();
     loadProxyRules();
     loadCacheStats();
     loadTLSDomains();
+    loadTOTPStatus();
+    loadTraffic();
 
     // Set up form handlers
     document.getElementById('settings-form').addEventListener('submit', saveSettings);
@@ -51,8 +38,43 @@ document.addEventListener('DOMContentLoaded', function() {
     // Auto-refresh every 30 seconds
     setInterval(loadSystemStatus, 30000);
     setInterval(loadCacheStats, 30000);
+    // Live traffic every 5 seconds
+    setInterval(loadTraffic, 5000);
+
+    subscribeEvents();
 });
 
+// Runtime events pushed by the server
+function subscribeEvents() {
+    if (!window.EventSource) {
+        return;
+    }
+    // EventSource reconnects by itself and resumes after the last event
+    const source = new EventSource(`${API_BASE}/events`, { withCredentials: true });
+    const failures = ['certificate_renewal_failed', 'certificate_issuance_failed', 'backend_down', 'error'];
+
+    const types = [
+        'certificate_issued', 'certificate_renewed', 'certificate_renewal_failed', 'certificate_issuance_failed',
+        'certificate_expiring', 'certificate_revoked', 'backend_down', 'backend_up',
+        'config_updated', 'config_reloaded', 'error'
+    ];
+    types.forEach(type => source.addEventListener(type, handleEvent));
+
+    function handleEvent(e) {
+        const event = JSON.parse(e.data);
+        if (event.type.startsWith('certificate_')) {
+            loadTLSDomains();
+        } else if (event.type.startsWith('config_')) {
+            loadProxyRules();
+        }
+        if (failures.includes(event.type)) {
+            showAlert(event.message, 'error');
+        } else if (event.type === 'backend_up') {
+            showAlert(event.message);
+        }
+    }
+}
+
 // Tab Management
 function showTab(tabName) {
     // Hide all tabs
@@ -66,6 +88,13 @@ function showTab(tabName) {
     // Show selected tab
     document.getElementById(tabName).classList.add('active');
     event.target.classList.add('active');
+
+    // Logs are only streamed while their tab is open
+    if (tabName === 'logs') {
+        tailLogs();
+    } else {
+        stopLogs();
+    }
 }
 
 // Alert Management
@@ -109,16 +138,11 @@ window.onclick = function(event) {
 // API Functions
 async function apiRequest(endpoint, options = {}) {
     const url = `${API_BASE}${endpoint}`;
-    const authHeaders = getAuthHeaders();
-
-    if (!authHeaders.Authorization) {
-        return;
-    }
-
     const defaultOptions = {
+        credentials: 'same-origin',
         headers: {
             'Content-Type': 'application/json',
-            ...authHeaders,
+            'X-CSRF-Token': getCSRFToken(),
             ...options.headers
         }
     };
@@ -128,8 +152,6 @@ async function apiRequest(endpoint, options = {}) {
 
         // Check for authentication errors
         if (response.status === 401) {
-            localStorage.removeItem('saddy_auth');
-            sessionStorage.removeItem('saddy_auth');
             window.location.href = '/login';
             return;
         }
@@ -137,7 +159,7 @@ async function apiRequest(endpoint, options = {}) {
         const data = await response.json();
 
         if (!response.ok) {
-            throw new Error(data.error || `HTTP ${response.status}`);
+            throw new Error((data.error && data.error.message) || `HTTP ${response.status}`);
         }
 
         return data;
@@ -187,10 +209,22 @@ function updateSystemStatus(status) {
                 <p><strong>TLS:</strong> ${status.tls_enabled ? 'Enabled' : 'Disabled'}</p>
                 <p><strong>Web UI:</strong> ${status.web_ui_enabled ? 'Enabled' : 'Disabled'}</p>
             </div>
+            <div class="stat-card">
+                <h4>Process</h4>
+                <p><strong>Started:</strong> ${new Date(status.started_at).toLocaleString()}</p>
+                <p><strong>Uptime:</strong> ${formatUptime(status.uptime_seconds)}</p>
+                ${status.request_totals ? `
+                <p><strong>Requests:</strong> ${status.request_totals.requests} (${status.request_totals.errors} 5xx)</p>
+                <p><strong>Transferred:</strong> ${(status.request_totals.bytes / 1024 / 1024).toFixed(2)}MB</p>
+                ` : ''}
+            </div>
         </div>
+        <h4>Requests per second, last hour</h4>
+        <canvas id="load-graph" height="60" style="width: 100%;"></canvas>
     `;
 
     document.getElementById('system-status').innerHTML = statusHtml;
+    drawTrafficGraph('load-graph', status.load_history.samples);
 }
 
 // Proxy Rules
@@ -306,6 +340,140 @@ async function deleteProxyRule(domain) {
     }
 }
 
+// Live Traffic
+async function loadTraffic() {
+    try {
+        const [summary, series] = await Promise.all([
+            apiRequest('/traffic?window=60'),
+            apiRequest('/traffic/series?window=300&step=5')
+        ]);
+        displayTraffic(summary);
+        drawTrafficGraph('traffic-graph', series.points || []);
+    } catch (error) {
+        document.getElementById('traffic-stats').innerHTML =
+            '<p style="color: red;">Failed to load traffic</p>';
+    }
+}
+
+function formatUptime(seconds) {
+    const days = Math.floor(seconds / 86400);
+    const hours = Math.floor(seconds % 86400 / 3600);
+    const minutes = Math.floor(seconds % 3600 / 60);
+    return days > 0 ? `${days}d ${hours}h ${minutes}m` : `${hours}h ${minutes}m`;
+}
+
+function formatRate(bytesPerSecond) {
+    if (bytesPerSecond >= 1024 * 1024) {
+        return `${(bytesPerSecond / 1024 / 1024).toFixed(2)} MB/s`;
+    }
+    return `${(bytesPerSecond / 1024).toFixed(1)} KB/s`;
+}
+
+function displayTraffic(summary) {
+    const domains = Object.entries(summary.domains || {});
+    if (domains.length === 0) {
+        document.getElementById('traffic-stats').innerHTML = '<p>No requests in the last minute.</p>';
+        return;
+    }
+
+    const row = (name, t) => `
+        <tr>
+            <td>${name}</td>
+            <td>${t.requests_per_second.toFixed(2)}</td>
+            <td>${t.status['2xx'] || 0} / ${t.status['3xx'] || 0} / ${t.status['4xx'] || 0} / ${t.status['5xx'] || 0}</td>
+            <td>${t.latency_ms.p50.toFixed(0)} / ${t.latency_ms.p95.toFixed(0)} / ${t.latency_ms.p99.toFixed(0)} ms</td>
+            <td>${formatRate(t.bytes_per_second)}</td>
+        </tr>
+    `;
+
+    document.getElementById('traffic-stats').innerHTML = `
+        <table class="table">
+            <thead>
+                <tr>
+                    <th>Domain</th>
+                    <th>Requests/s</th>
+                    <th>2xx / 3xx / 4xx / 5xx</th>
+                    <th>Latency p50 / p95 / p99</th>
+                    <th>Bandwidth</th>
+                </tr>
+            </thead>
+            <tbody>
+                ${domains.map(([domain, t]) => row(domain, t)).join('')}
+                ${domains.length > 1 ? row('<strong>Total</strong>', summary.total) : ''}
+            </tbody>
+        </table>
+    `;
+}
+
+// Requests per second of each point, 5xx responses in red
+function drawTrafficGraph(canvasId, points) {
+    const canvas = document.getElementById(canvasId);
+    const width = canvas.clientWidth;
+    const height = canvas.clientHeight;
+    canvas.width = width * window.devicePixelRatio;
+    canvas.height = height * window.devicePixelRatio;
+    const ctx = canvas.getContext('2d');
+    ctx.scale(window.devicePixelRatio, window.devicePixelRatio);
+    ctx.clearRect(0, 0, width, height);
+    if (points.length === 0) {
+        return;
+    }
+
+    const max = Math.max(1, ...points.map(p => p.requests_per_second));
+    const barWidth = width / points.length;
+    points.forEach((p, i) => {
+        const total = p.requests_per_second / max * height;
+        const errors = total * p.error_rate;
+        ctx.fillStyle = 'hsl(221.2 83.2% 53.3%)';
+        ctx.fillRect(i * barWidth, height - total, Math.max(1, barWidth - 1), total - errors);
+        ctx.fillStyle = 'hsl(0 84.2% 60.2%)';
+        ctx.fillRect(i * barWidth, height - errors, Math.max(1, barWidth - 1), errors);
+    });
+}
+
+// Live logs over a WebSocket, authenticated by the session cookie
+const MAX_LOG_LINES = 1000;
+let logSocket = null;
+
+function tailLogs() {
+    stopLogs();
+    const params = new URLSearchParams({ level: document.getElementById('log-level').value, lines: 100 });
+    const domain = document.getElementById('log-domain').value.trim();
+    if (domain) {
+        params.set('domain', domain);
+    }
+    const scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const container = document.getElementById('log-lines');
+    container.textContent = '';
+
+    logSocket = new WebSocket(`${scheme}//${location.host}${API_BASE}/logs/tail?${params}`);
+    logSocket.onmessage = (e) => {
+        const line = JSON.parse(e.data);
+        const atBottom = container.scrollTop + container.clientHeight >= container.scrollHeight - 4;
+        const div = document.createElement('div');
+        div.className = `log-${line.level}`;
+        div.textContent = `${new Date(line.time).toLocaleTimeString()} ${line.domain ? `[${line.domain}] ` : ''}${line.message}`;
+        container.appendChild(div);
+        while (container.childElementCount > MAX_LOG_LINES) {
+            container.firstElementChild.remove();
+        }
+        if (atBottom) {
+            container.scrollTop = container.scrollHeight;
+        }
+    };
+    logSocket.onerror = () => {
+        showAlert('Live log stream disconnected', 'error');
+    };
+}
+
+function stopLogs() {
+    if (logSocket) {
+        logSocket.onerror = null;
+        logSocket.close();
+        logSocket = null;
+    }
+}
+
 // Cache Functions
 async function loadCacheStats() {
     try {
@@ -409,12 +577,23 @@ async function addTLSDomain(event) {
 async function getCertInfo(domain) {
     try {
         const info = await apiRequest(`/tls/domains/${encodeURIComponent(domain)}`);
+        const revoked = info.revocation && info.revocation.status === 'revoked';
+        let status = 'Valid';
+        if (revoked) {
+            status = `REVOKED${info.revocation.reason ? ` (${info.revocation.reason})` : ''}`;
+        } else if (info.is_expired) {
+            status = 'EXPIRED';
+        }
         alert(`Certificate Information for ${domain}:\n\n` +
               `Issuer: ${info.issuer}\n` +
+              `Names: ${(info.sans || []).join(', ')}\n` +
+              `Key: ${info.key_algorithm}\n` +
+              `Chain: ${(info.chain || []).map(c => c.subject || domain).join(' <- ')}\n` +
               `Valid From: ${new Date(info.not_before).toLocaleString()}\n` +
               `Valid Until: ${new Date(info.not_after).toLocaleString()}\n` +
               `Days Remaining: ${info.days_remaining}\n` +
-              `Status: ${info.is_expired ? 'EXPIRED' : 'Valid'}`);
+              `Revocation: ${info.revocation ? info.revocation.status : 'not checked'}\n` +
+              `Status: ${status}`);
     } catch (error) {
         // Error is already handled by apiRequest
     }
@@ -453,22 +632,94 @@ async function removeTLSDomain(domain) {
 async function saveSettings(event) {
     event.preventDefault();
 
-    const settings = {
-        server: {
-            host: document.getElementById('server-host').value,
-            port: parseInt(document.getElementById('server-port').value),
-            admin_port: parseInt(document.getElementById('admin-port').value),
-            auto_https: document.getElementById('auto-https').checked
-        }
-    };
-
     try {
-        await apiRequest('/config/', {
+        // The whole configuration is replaced, so start from the running one
+        const settings = await apiRequest('/config/');
+        settings.server.host = document.getElementById('server-host').value;
+        settings.server.port = parseInt(document.getElementById('server-port').value);
+        settings.server.admin_port = parseInt(document.getElementById('admin-port').value);
+        settings.server.auto_https = document.getElementById('auto-https').checked;
+
+        const data = await apiRequest('/config/', {
             method: 'PUT',
             body: JSON.stringify(settings)
         });
 
-        showAlert('Settings saved successfully');
+        const restart = (data.reload && data.reload.restart_required) || [];
+        if (restart.length > 0) {
+            showAlert(`Settings saved, restart Saddy to apply ${restart.join(', ')}`);
+        } else {
+            showAlert('Settings saved successfully');
+        }
+    } catch (error) {
+        // Error is already handled by apiRequest
+    }
+}
+
+// Two-Factor Authentication
+async function loadTOTPStatus() {
+    const container = document.getElementById('totp-status');
+    try {
+        const data = await apiRequest('/auth/totp');
+        if (data.enabled) {
+            container.innerHTML = `
+                <p>Two-factor authentication is <strong>enabled</strong> for ${data.username}.</p>
+                <div class="form-group">
+                    <label for="totp-disable-code">Current code</label>
+                    <input type="text" id="totp-disable-code" class="form-control" inputmode="numeric" maxlength="6">
+                </div>
+                <button class="btn btn-destructive" onclick="disableTOTP()">Disable</button>
+            `;
+        } else {
+            container.innerHTML = `
+                <p>Protect ${data.username} with a code from an authenticator app when logging in.</p>
+                <button class="btn" onclick="enrollTOTP()">Enable</button>
+            `;
+        }
+    } catch (error) {
+        container.innerHTML = '<p>Two-factor authentication is not available.</p>';
+    }
+}
+
+async function enrollTOTP() {
+    try {
+        const data = await apiRequest('/auth/totp/enroll', { method: 'POST' });
+        document.getElementById('totp-status').innerHTML = `
+            <p>Add this key to your authenticator app, or open the link on your phone:</p>
+            <p><code>${data.secret}</code></p>
+            <p><a href="${data.uri}">${data.uri}</a></p>
+            <div class="form-group">
+                <label for="totp-confirm-code">Code from the app</label>
+                <input type="text" id="totp-confirm-code" class="form-control" inputmode="numeric" maxlength="6">
+            </div>
+            <button class="btn" onclick="confirmTOTP()">Confirm</button>
+        `;
+    } catch (error) {
+        // Error is already handled by apiRequest
+    }
+}
+
+async function confirmTOTP() {
+    try {
+        await apiRequest('/auth/totp/confirm', {
+            method: 'POST',
+            body: JSON.stringify({ code: document.getElementById('totp-confirm-code').value })
+        });
+        showAlert('Two-factor authentication enabled');
+        loadTOTPStatus();
+    } catch (error) {
+        // Error is already handled by apiRequest
+    }
+}
+
+async function disableTOTP() {
+    try {
+        await apiRequest('/auth/totp', {
+            method: 'DELETE',
+            body: JSON.stringify({ code: document.getElementById('totp-disable-code').value })
+        });
+        showAlert('Two-factor authentication disabled');
+        loadTOTPStatus();
     } catch (error) {
         // Error is already handled by apiRequest
     }